@@ -3,6 +3,10 @@ The article module containing the article CRUD operation and relationship CRUD.
 
 model.go: definition of orm based data model
 
+loaders.go: batched loading of the data serializers need for a whole page
+
+markdown.go: rendering and sanitizing of Markdown bodies
+
 routers.go: router binding and core logic
 
 serializers.go: definition the schema of return data
@@ -0,0 +1,330 @@
+package articles
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+	"github.com/jinzhu/gorm"
+)
+
+// How far back the ranked feed looks for articles.
+var RankedFeedWindow = time.Duration(common.GetEnvInt("RANKED_FEED_WINDOW_HOURS", 14*24)) * time.Hour
+
+// How long it takes for an article to lose half of its recency.
+var RankedFeedHalfLife = time.Duration(common.GetEnvInt("RANKED_FEED_HALF_LIFE_HOURS", 24)) * time.Hour
+
+// How many of the most favorited articles of the window are candidates even from strangers.
+const rankedFeedPopularLimit = 50
+
+// What the affinity of the viewer to an article is made of.
+const (
+	affinityFollowedAuthor  = 1.0
+	affinityFollowedTag     = 0.5
+	affinityFavoritedAuthor = 0.25
+	// Followed tags and earlier favorites of the author count this many times at most.
+	affinityMaxRepeats = 2
+)
+
+// Reasons an article is in the ranked feed.
+const (
+	ReasonFollowedAuthor  = "followed author"
+	ReasonFollowedTag     = "followed tag"
+	ReasonPopular         = "popular"
+	ReasonFavoritedAuthor = "favorited author before"
+)
+
+// Why an article ranks where it does, served with every article of the ranked feed in debug mode.
+//
+// Score = Recency * (1 + Engagement) * (1 + Affinity), where Recency halves every RankedFeedHalfLife,
+// Engagement is ln(1 + favorites + 2 * comments) and Affinity adds up the reasons.
+type FeedRanking struct {
+	Score      float64  `json:"score"`
+	Recency    float64  `json:"recency"`
+	Engagement float64  `json:"engagement"`
+	Affinity   float64  `json:"affinity"`
+	Reasons    []string `json:"reasons"`
+	Tags       []string `json:"tags,omitempty"`
+}
+
+type rankedArticle struct {
+	id       uint
+	authorID uint
+	ranking  *FeedRanking
+}
+
+// The articles of followed authors, followed tags and the popular ones of the last RankedFeedWindow,
+// best first. Everything is counted as it was at the time in the cursor, or now for the first page,
+// so that the pages of one listing neither repeat nor skip articles when favorites come in meanwhile.
+// Pages only go forward, the returned time goes into the next cursor. Traced like FindManyArticle.
+// 	models, rankings, count, info, err := articleUserModel.GetRankedFeed(c.Request.Context(), page)
+func (self *ArticleUserModel) GetRankedFeed(ctx context.Context, page common.Pagination) ([]ArticleModel, map[uint]*FeedRanking, int, common.PageInfo, error) {
+	ctx, span := common.StartSpan(ctx, "articles.GetRankedFeed")
+	defer span.End()
+	db := common.GetDBContext(ctx)
+	at := time.Now()
+	if page.Cursor != nil && page.Cursor.At != 0 {
+		at = time.Unix(0, page.Cursor.At)
+	}
+	since := at.Add(-RankedFeedWindow)
+
+	ranked, err := self.rankFeedCandidates(db, at, since)
+	if err != nil {
+		common.RecordSpanError(span, err)
+		return nil, nil, 0, common.PageInfo{}, err
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].ranking.Score != ranked[j].ranking.Score {
+			return ranked[i].ranking.Score > ranked[j].ranking.Score
+		}
+		return ranked[i].id > ranked[j].id
+	})
+
+	count := len(ranked)
+	start := 0
+	if page.Cursor != nil {
+		cursor := page.Cursor
+		for start < len(ranked) && (ranked[start].ranking.Score > cursor.Score ||
+			ranked[start].ranking.Score == cursor.Score && ranked[start].id >= cursor.ID) {
+			start++
+		}
+	} else if page.Offset < len(ranked) {
+		start = page.Offset
+	} else {
+		start = len(ranked)
+	}
+	end := len(ranked)
+	if page.Limit > 0 && start+page.Limit < end {
+		end = start + page.Limit
+	}
+	ranked = ranked[start:end]
+
+	var info common.PageInfo
+	if end < count && len(ranked) > 0 {
+		last := ranked[len(ranked)-1]
+		info.NextCursor = page.EncodeCursor(common.Cursor{ID: last.id, Score: last.ranking.Score, At: at.UnixNano()})
+	}
+	rankings := map[uint]*FeedRanking{}
+	ids := make([]uint, len(ranked))
+	for i, article := range ranked {
+		ids[i] = article.id
+		rankings[article.id] = article.ranking
+	}
+	var models []ArticleModel
+	if len(ids) > 0 {
+		if err := db.Preload("Author.UserModel").Preload("Tags").Where("id IN (?)", ids).Find(&models).Error; err != nil {
+			common.RecordSpanError(span, err)
+			return nil, nil, 0, common.PageInfo{}, err
+		}
+	}
+	position := map[uint]int{}
+	for i, id := range ids {
+		position[id] = i
+	}
+	sort.Slice(models, func(i, j int) bool { return position[models[i].ID] < position[models[j].ID] })
+	return models, rankings, count, info, nil
+}
+
+// Find the candidates of the feed and score them as of at.
+func (self *ArticleUserModel) rankFeedCandidates(db *gorm.DB, at time.Time, since time.Time) ([]rankedArticle, error) {
+	var authors []uint
+	err := db.Model(&ArticleUserModel{}).Where("user_model_id in ?", db.Model(&users.FollowModel{}).
+		Select("following_id").Where("followed_by_id = ?", self.UserModelID).SubQuery()).Pluck("id", &authors).Error
+	if err != nil {
+		return nil, err
+	}
+	var tags []uint
+	if err := db.Model(&TagFollowModel{}).Where("followed_by_id = ?", self.ID).Pluck("tag_id", &tags).Error; err != nil {
+		return nil, err
+	}
+	var popular []uint
+	err = db.Model(&FavoriteModel{}).Where("created_at BETWEEN ? AND ?", since, at).
+		Group("favorite_id").Order("count(*) desc, favorite_id desc").Limit(rankedFeedPopularLimit).
+		Pluck("favorite_id", &popular).Error
+	if err != nil {
+		return nil, err
+	}
+
+	query := visibleTo(db.Model(&ArticleModel{}), "article_models", *self).
+		Select("article_models.id, article_models.author_id, article_models.created_at").
+		Where("article_models.created_at BETWEEN ? AND ? AND article_models.author_id <> ?", since, at, self.ID)
+	var conditions []string
+	var values []interface{}
+	if len(authors) > 0 {
+		conditions = append(conditions, "article_models.author_id IN (?)")
+		values = append(values, authors)
+	}
+	if len(tags) > 0 {
+		conditions = append(conditions, "article_models.id IN ?")
+		values = append(values, db.Table("article_tags").Select("article_model_id").Where("tag_model_id IN (?)", tags).SubQuery())
+	}
+	if len(popular) > 0 {
+		conditions = append(conditions, "article_models.id IN (?)")
+		values = append(values, popular)
+	}
+	if len(conditions) == 0 {
+		return []rankedArticle{}, nil
+	}
+	condition := conditions[0]
+	for _, more := range conditions[1:] {
+		condition += " OR " + more
+	}
+	rows, err := query.Where(condition, values...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	var ranked []rankedArticle
+	byID := map[uint]*FeedRanking{}
+	for rows.Next() {
+		var article rankedArticle
+		var createdAt time.Time
+		if err := rows.Scan(&article.id, &article.authorID, &createdAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		article.ranking = &FeedRanking{
+			Recency: math.Pow(0.5, float64(at.Sub(createdAt))/float64(RankedFeedHalfLife)),
+			Reasons: []string{},
+		}
+		byID[article.id] = article.ranking
+		ranked = append(ranked, article)
+	}
+	rows.Close()
+	if len(ranked) == 0 {
+		return []rankedArticle{}, nil
+	}
+	ids := make([]uint, len(ranked))
+	for i, article := range ranked {
+		ids[i] = article.id
+	}
+
+	favorites := map[uint]float64{}
+	query = db.Model(&FavoriteModel{}).Select("favorite_id, count(*)").
+		Where("favorite_id IN (?) AND created_at <= ?", ids, at).Group("favorite_id")
+	if err := scanCounts(query, favorites); err != nil {
+		return nil, err
+	}
+	comments := map[uint]float64{}
+	query = db.Model(&CommentModel{}).Select("article_id, count(*)").
+		Where("article_id IN (?) AND created_at <= ? AND hidden_at IS NULL", ids, at).Group("article_id")
+	if err := scanCounts(query, comments); err != nil {
+		return nil, err
+	}
+	favoritedAuthors := map[uint]float64{}
+	query = db.Model(&FavoriteModel{}).Select("article_models.author_id, count(*)").
+		Joins("JOIN article_models ON article_models.id = favorite_models.favorite_id").
+		Where("favorite_models.favorite_by_id = ? AND favorite_models.created_at <= ?", self.ID, at).
+		Group("article_models.author_id")
+	if err := scanCounts(query, favoritedAuthors); err != nil {
+		return nil, err
+	}
+	if len(tags) > 0 {
+		rows, err := db.Table("article_tags").Select("article_tags.article_model_id, tag_models.tag").
+			Joins("JOIN tag_models ON tag_models.id = article_tags.tag_model_id").
+			Where("article_tags.article_model_id IN (?) AND article_tags.tag_model_id IN (?)", ids, tags).
+			Order("tag_models.tag").Rows()
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id uint
+			var tag string
+			if err := rows.Scan(&id, &tag); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			byID[id].Tags = append(byID[id].Tags, tag)
+		}
+		rows.Close()
+	}
+
+	followed := map[uint]bool{}
+	for _, id := range authors {
+		followed[id] = true
+	}
+	isPopular := map[uint]bool{}
+	for _, id := range popular {
+		isPopular[id] = true
+	}
+	for _, article := range ranked {
+		ranking := article.ranking
+		if followed[article.authorID] {
+			ranking.Affinity += affinityFollowedAuthor
+			ranking.Reasons = append(ranking.Reasons, ReasonFollowedAuthor)
+		}
+		if len(ranking.Tags) > 0 {
+			ranking.Affinity += affinityFollowedTag * math.Min(float64(len(ranking.Tags)), affinityMaxRepeats)
+			ranking.Reasons = append(ranking.Reasons, ReasonFollowedTag)
+		}
+		if favorited := favoritedAuthors[article.authorID]; favorited > 0 {
+			ranking.Affinity += affinityFavoritedAuthor * math.Min(favorited, affinityMaxRepeats)
+			ranking.Reasons = append(ranking.Reasons, ReasonFavoritedAuthor)
+		}
+		if isPopular[article.id] {
+			ranking.Reasons = append(ranking.Reasons, ReasonPopular)
+		}
+		ranking.Engagement = math.Log1p(favorites[article.id] + 2*comments[article.id])
+		ranking.Score = ranking.Recency * (1 + ranking.Engagement) * (1 + ranking.Affinity)
+	}
+	return ranked, nil
+}
+
+// How many feed articles one round of GetFeedDigest looks at.
+const feedDigestBatch = 100
+
+// The articles of the feed of the reader, see GetArticleFeed, written since since, the most favorited
+// first and the newest of equally favorited ones. Comes with the favorite counts of the articles.
+// 	articleModels, favorites, err := articleUserModel.GetFeedDigest(lastWeek, 10)
+func (self *ArticleUserModel) GetFeedDigest(since time.Time, limit int) ([]ArticleModel, map[uint]uint, error) {
+	var models []ArticleModel
+	page := common.Pagination{Limit: feedDigestBatch}
+	for {
+		batch, _, _, err := self.GetArticleFeed(context.Background(), page)
+		if err != nil {
+			return nil, nil, err
+		}
+		older := false
+		for _, model := range batch {
+			if model.CreatedAt.Before(since) {
+				older = true
+				break
+			}
+			models = append(models, model)
+		}
+		// The feed is newest first, nothing after an older article is new enough.
+		if older || len(batch) < feedDigestBatch {
+			break
+		}
+		page.Cursor = &common.Cursor{ID: batch[len(batch)-1].ID}
+	}
+
+	favorites := map[uint]uint{}
+	if len(models) == 0 {
+		return models, favorites, nil
+	}
+	db := common.GetDB()
+	rows, err := db.Model(&FavoriteModel{}).Select("favorite_id, count(*)").
+		Where("favorite_id in (?)", articleIDs(models)).Group("favorite_id").Rows()
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var id, count uint
+		if err := rows.Scan(&id, &count); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		favorites[id] = count
+	}
+	rows.Close()
+	sort.SliceStable(models, func(i, j int) bool {
+		return favorites[models[i].ID] > favorites[models[j].ID]
+	})
+	if limit > 0 && len(models) > limit {
+		models = models[:limit]
+	}
+	return models, favorites, nil
+}
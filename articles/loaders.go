@@ -0,0 +1,186 @@
+package articles
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+	"github.com/jinzhu/gorm"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The serializers need a few facts about every article that are not part of ArticleModel itself.
+// Asking for them one article at a time costs several queries per row, so the loader fetches them
+// for a whole page at once and keeps them for the rest of the request.
+//
+// It lives in the gin context, one loader per request:
+// 	loader := articleLoaderFor(c)
+// 	loader.prime(c, articleModels)
+// 	count := loader.favoritesCount[articleModel.ID]
+type articleLoader struct {
+	viewer         ArticleUserModel
+	loaded         map[uint]bool
+	favoritesCount map[uint]uint
+	favorited      map[uint]bool
+	loadedComments map[uint]bool
+	reactions      map[string]*reactionSet
+	mentions       map[string]map[uint][]users.UserModel
+	// Set by the ranked feed in debug mode, the serializers explain the rank of these articles.
+	rankings map[uint]*FeedRanking
+}
+
+// The reaction counts and the viewer's own reactions of one target type.
+type reactionSet struct {
+	counts map[uint]map[string]uint
+	mine   map[uint][]string
+}
+
+func articleLoaderFor(c *gin.Context) *articleLoader {
+	if loader, ok := c.Get("article_loader"); ok {
+		return loader.(*articleLoader)
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	loader := &articleLoader{
+		viewer:         GetArticleUserModel(myUserModel),
+		loaded:         map[uint]bool{},
+		favoritesCount: map[uint]uint{},
+		favorited:      map[uint]bool{},
+		loadedComments: map[uint]bool{},
+		reactions: map[string]*reactionSet{
+			ReactionOnArticle: {counts: map[uint]map[string]uint{}, mine: map[uint][]string{}},
+			ReactionOnComment: {counts: map[uint]map[string]uint{}, mine: map[uint][]string{}},
+		},
+		mentions: map[string]map[uint][]users.UserModel{ReactionOnArticle: {}, ReactionOnComment: {}},
+	}
+	c.Set("article_loader", loader)
+	return loader
+}
+
+// Load the favorite counts, the reactions, the viewer's favorites and followings for the articles
+// that were not loaded yet. Authors and tags are expected to be preloaded with the articles.
+// Like the single article helpers it replaces, a failed query just leaves the zero values.
+// The queries are traced together in an articles.prime span of the request.
+func (l *articleLoader) prime(c *gin.Context, articles []ArticleModel) {
+	var ids []uint
+	var authorIDs []uint
+	for _, article := range articles {
+		if l.loaded[article.ID] {
+			continue
+		}
+		l.loaded[article.ID] = true
+		ids = append(ids, article.ID)
+		authorIDs = append(authorIDs, article.Author.UserModelID)
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	ctx, span := common.StartSpan(c.Request.Context(), "articles.prime", trace.WithAttributes(attribute.Int("articles", len(ids))))
+	defer span.End()
+	db := common.GetDBContext(ctx)
+	rows, err := db.Model(&FavoriteModel{}).Select("favorite_id, count(*)").
+		Where("favorite_id in (?)", ids).Group("favorite_id").Rows()
+	if err == nil {
+		for rows.Next() {
+			var id, count uint
+			if rows.Scan(&id, &count) == nil {
+				l.favoritesCount[id] = count
+			}
+		}
+		rows.Close()
+	}
+
+	if l.viewer.ID != 0 {
+		var favorites []FavoriteModel
+		db.Where("favorite_by_id = ? AND favorite_id in (?)", l.viewer.ID, ids).Find(&favorites)
+		for _, favorite := range favorites {
+			l.favorited[favorite.FavoriteID] = true
+		}
+	}
+
+	l.primeReactions(db, ReactionOnArticle, ids)
+	users.PrimeFollowings(c, append(authorIDs, l.primeMentions(db, ReactionOnArticle, ids)...))
+}
+
+// Comments need the following flags of their authors and their reactions, replies included.
+func (l *articleLoader) primeComments(c *gin.Context, comments []CommentModel) {
+	var ids []uint
+	var authorIDs []uint
+	var collect func(comments []CommentModel)
+	collect = func(comments []CommentModel) {
+		for _, comment := range comments {
+			if !l.loadedComments[comment.ID] {
+				l.loadedComments[comment.ID] = true
+				ids = append(ids, comment.ID)
+				authorIDs = append(authorIDs, comment.Author.UserModelID)
+			}
+			collect(comment.Replies)
+		}
+	}
+	collect(comments)
+	if len(ids) == 0 {
+		return
+	}
+	ctx, span := common.StartSpan(c.Request.Context(), "articles.primeComments", trace.WithAttributes(attribute.Int("comments", len(ids))))
+	defer span.End()
+	db := common.GetDBContext(ctx)
+	l.primeReactions(db, ReactionOnComment, ids)
+	users.PrimeFollowings(c, append(authorIDs, l.primeMentions(db, ReactionOnComment, ids)...))
+}
+
+func (l *articleLoader) primeReactions(db *gorm.DB, targetType string, ids []uint) {
+	set := l.reactions[targetType]
+	var counts []ReactionCountModel
+	db.Where("target_type = ? AND target_id in (?) AND count > 0", targetType, ids).Find(&counts)
+	for _, count := range counts {
+		if set.counts[count.TargetID] == nil {
+			set.counts[count.TargetID] = map[string]uint{}
+		}
+		set.counts[count.TargetID][count.Reaction] = count.Count
+	}
+	if l.viewer.ID != 0 {
+		var reactions []ReactionModel
+		db.Where("target_type = ? AND target_id in (?) AND reacted_by_id = ?", targetType, ids, l.viewer.ID).
+			Order("id asc").Find(&reactions)
+		for _, reaction := range reactions {
+			set.mine[reaction.TargetID] = append(set.mine[reaction.TargetID], reaction.Reaction)
+		}
+	}
+}
+
+// Load the users mentioned in the targets and return their ids, so that their following flags are
+// primed together with the ones of the authors.
+func (l *articleLoader) primeMentions(db *gorm.DB, targetType string, ids []uint) []uint {
+	var mentions []MentionModel
+	db.Preload("UserModel").Where("target_type = ? AND target_id in (?)", targetType, ids).Order("id asc").Find(&mentions)
+	userIDs := make([]uint, len(mentions))
+	for i, mention := range mentions {
+		l.mentions[targetType][mention.TargetID] = append(l.mentions[targetType][mention.TargetID], mention.UserModel)
+		userIDs[i] = mention.UserModelID
+	}
+	return userIDs
+}
+
+// The profiles of the users mentioned in a target, never nil so they render as [].
+func (l *articleLoader) mentionsOf(c *gin.Context, targetType string, id uint) []users.ProfileResponse {
+	profiles := []users.ProfileResponse{}
+	for _, userModel := range l.mentions[targetType][id] {
+		serializer := users.ProfileSerializer{C: c, UserModel: userModel}
+		profiles = append(profiles, serializer.Response())
+	}
+	return profiles
+}
+
+// The reaction counts of a target and the viewer's own reactions, never nil so they render as {} and [].
+func (l *articleLoader) reactionsOf(targetType string, id uint) (map[string]uint, []string) {
+	set := l.reactions[targetType]
+	counts := set.counts[id]
+	if counts == nil {
+		counts = map[string]uint{}
+	}
+	mine := set.mine[id]
+	if mine == nil {
+		mine = []string{}
+	}
+	return counts, mine
+}
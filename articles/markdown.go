@@ -0,0 +1,206 @@
+package articles
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gosimple/slug"
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/text"
+	"golang.org/x/net/html"
+)
+
+// Bodies are CommonMark. Raw HTML in them is dropped by the renderer and whatever it
+// outputs goes through sanitizeHTML, so bodyHtml is safe to insert in a page as it is.
+var markdown = goldmark.New()
+
+// Bump it when the rendering changes so that nothing rendered the old way is served from the cache.
+const markdownCacheVersion = "1"
+
+const markdownCacheTTL = 24 * time.Hour
+
+// The words read per minute behind readingTimeMinutes.
+const readingWordsPerMinute = 200
+
+// One heading of an article, ID is the anchor of the heading in bodyHtml.
+type TocEntry struct {
+	Level int    `json:"level"`
+	ID    string `json:"id"`
+	Text  string `json:"text"`
+}
+
+type renderedMarkdown struct {
+	HTML string     `json:"html"`
+	TOC  []TocEntry `json:"toc"`
+}
+
+// Render a body to sanitized HTML with its table of contents. The result is cached under the hash
+// of the body, so an edited body is rendered anew and the old rendering just expires.
+// 	rendered := renderMarkdown(articleModel.Body)
+func renderMarkdown(source string) renderedMarkdown {
+	key := markdownCacheKey(source)
+	cache := common.GetCache()
+	if cache != nil {
+		if value, ok, err := cache.Get(key); err == nil && ok {
+			var rendered renderedMarkdown
+			if json.Unmarshal(value, &rendered) == nil {
+				return rendered
+			}
+		}
+	}
+
+	rendered := renderMarkdownUncached([]byte(source))
+	if cache != nil {
+		if value, err := json.Marshal(rendered); err == nil {
+			cache.Set(key, value, markdownCacheTTL)
+		}
+	}
+	return rendered
+}
+
+// The sanitized HTML of a body, for the pages the app renders outside of the API such as emails and feeds.
+// 	html := articles.RenderMarkdownHTML(newsletterModel.Body)
+func RenderMarkdownHTML(source string) string {
+	return renderMarkdown(source).HTML
+}
+
+func markdownCacheKey(source string) string {
+	sum := sha1.Sum([]byte(source))
+	return "markdown:" + markdownCacheVersion + ":" + hex.EncodeToString(sum[:])
+}
+
+func renderMarkdownUncached(source []byte) renderedMarkdown {
+	rendered := renderedMarkdown{TOC: []TocEntry{}}
+	document := markdown.Parser().Parse(text.NewReader(source))
+	// Anchors are made from the text of the headings like slugs, numbered when a heading repeats.
+	used := map[string]int{}
+	ast.Walk(document, func(node ast.Node, entering bool) (ast.WalkStatus, error) {
+		if heading, ok := node.(*ast.Heading); ok && entering {
+			entry := TocEntry{Level: heading.Level, Text: string(heading.Text(source))}
+			entry.ID = slug.Make(entry.Text)
+			if entry.ID == "" {
+				entry.ID = "section"
+			}
+			if used[entry.ID]++; used[entry.ID] > 1 {
+				entry.ID = fmt.Sprintf("%v-%v", entry.ID, used[entry.ID]-1)
+			}
+			heading.SetAttributeString("id", []byte(entry.ID))
+			rendered.TOC = append(rendered.TOC, entry)
+			return ast.WalkSkipChildren, nil
+		}
+		return ast.WalkContinue, nil
+	})
+	var buffer bytes.Buffer
+	if err := markdown.Renderer().Render(&buffer, source, document); err != nil {
+		return rendered
+	}
+	rendered.HTML = sanitizeHTML(buffer.String())
+	return rendered
+}
+
+// Rounded up, and at least a minute for any body with words in it.
+func readingTimeMinutes(source string) int {
+	words := len(strings.Fields(source))
+	return (words + readingWordsPerMinute - 1) / readingWordsPerMinute
+}
+
+// The only tags kept by sanitizeHTML with the attributes they keep, everything CommonMark can produce.
+var allowedTags = map[string][]string{
+	"a": {"href", "title"}, "img": {"src", "alt", "title"},
+	"h1": {"id"}, "h2": {"id"}, "h3": {"id"}, "h4": {"id"}, "h5": {"id"}, "h6": {"id"},
+	"p": nil, "br": nil, "hr": nil, "blockquote": nil, "pre": nil, "code": {"class"},
+	"em": nil, "strong": nil, "ul": nil, "ol": {"start"}, "li": nil,
+}
+
+// Tags dropped with everything in them rather than just the tags themselves.
+var droppedTags = map[string]bool{"script": true, "style": true, "iframe": true, "object": true, "template": true}
+
+var codeClassPattern = regexp.MustCompile(`^language-[\w+#-]+$`)
+
+// Keep the allowed tags and attributes of the HTML and drop everything else, text is kept escaped.
+// Links may only go to http, https, mailto or relative URLs and are marked nofollow.
+func sanitizeHTML(source string) string {
+	var output strings.Builder
+	tokenizer := html.NewTokenizer(strings.NewReader(source))
+	skipping := ""
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			return output.String()
+		}
+		token := tokenizer.Token()
+		if skipping != "" {
+			if tokenType == html.EndTagToken && token.Data == skipping {
+				skipping = ""
+			}
+			continue
+		}
+		switch tokenType {
+		case html.TextToken:
+			output.WriteString(html.EscapeString(token.Data))
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if droppedTags[token.Data] && tokenType == html.StartTagToken {
+				skipping = token.Data
+				continue
+			}
+			allowed, ok := allowedTags[token.Data]
+			if !ok {
+				continue
+			}
+			output.WriteString("<" + token.Data)
+			for _, attribute := range token.Attr {
+				if attribute.Namespace != "" || !contains(allowed, attribute.Key) ||
+					!safeAttribute(token.Data, attribute.Key, attribute.Val) {
+					continue
+				}
+				output.WriteString(" " + attribute.Key + `="` + html.EscapeString(attribute.Val) + `"`)
+			}
+			if token.Data == "a" {
+				output.WriteString(` rel="nofollow"`)
+			}
+			output.WriteString(">")
+		case html.EndTagToken:
+			if _, ok := allowedTags[token.Data]; ok {
+				output.WriteString("</" + token.Data + ">")
+			}
+		}
+	}
+}
+
+func safeAttribute(tag, key, value string) bool {
+	switch key {
+	case "href", "src":
+		link, err := url.Parse(strings.TrimSpace(value))
+		if err != nil {
+			return false
+		}
+		switch strings.ToLower(link.Scheme) {
+		case "", "http", "https":
+			return true
+		case "mailto":
+			return tag == "a"
+		}
+		return false
+	case "class":
+		return codeClassPattern.MatchString(value)
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package articles
+
+import (
+	"regexp"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+	"github.com/jinzhu/gorm"
+)
+
+// A user mentioned with @username in an article or a comment. The rows of a text are rewritten
+// whenever it is saved, TargetType is ReactionOnArticle or ReactionOnComment.
+type MentionModel struct {
+	gorm.Model
+	TargetType  string `gorm:"unique_index:idx_mention;size:32"`
+	TargetID    uint   `gorm:"unique_index:idx_mention"`
+	UserModel   users.UserModel
+	UserModelID uint `gorm:"unique_index:idx_mention"`
+}
+
+// Usernames are alphanumeric, an @ right after a letter or a digit is part of an email address instead.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@.])@([A-Za-z0-9]+)`)
+
+// The most users one text may mention, the rest are left as plain text.
+const maxMentions = 20
+
+// The usernames mentioned in text in the order they first appear.
+func parseMentions(text string) []string {
+	var usernames []string
+	seen := map[string]bool{}
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		if !seen[match[1]] {
+			seen[match[1]] = true
+			usernames = append(usernames, match[1])
+		}
+	}
+	return usernames
+}
+
+// The users author mentions in text. Unknown usernames are ignored, so are users who block the author
+// or are blocked by the author: blocked users cannot mention you.
+// 	mentioned := resolveMentions(myUserModel, body)
+func resolveMentions(author users.UserModel, text string) []users.UserModel {
+	blocked := map[uint]bool{}
+	for _, id := range author.BlockedIDs() {
+		blocked[id] = true
+	}
+	usernames := parseMentions(text)
+	if len(usernames) == 0 {
+		return nil
+	}
+	db := common.GetDB()
+	var userModels []users.UserModel
+	if err := db.Where("username IN (?)", usernames).Find(&userModels).Error; err != nil {
+		common.GetLogger().Error().Err(err).Str("func", "articles.resolveMentions").Msg("db err")
+		return nil
+	}
+	byUsername := make(map[string]users.UserModel, len(userModels))
+	for _, userModel := range userModels {
+		byUsername[userModel.Username] = userModel
+	}
+	var mentioned []users.UserModel
+	for _, username := range usernames {
+		if len(mentioned) == maxMentions {
+			break
+		}
+		userModel, ok := byUsername[username]
+		if !ok || blocked[userModel.ID] {
+			continue
+		}
+		mentioned = append(mentioned, userModel)
+	}
+	return mentioned
+}
+
+// Replace the mentions of a text, returning the ids of the users it did not mention before.
+// 	added, err := setMentions(ReactionOnComment, commentModel.ID, mentioned)
+func setMentions(targetType string, targetID uint, mentioned []users.UserModel) ([]uint, error) {
+	db := common.GetDB()
+	var previous []uint
+	err := db.Model(&MentionModel{}).Where("target_type = ? AND target_id = ?", targetType, targetID).
+		Pluck("user_model_id", &previous).Error
+	if err != nil {
+		return nil, err
+	}
+	had := map[uint]bool{}
+	for _, id := range previous {
+		had[id] = true
+	}
+	tx := db.Begin()
+	err = tx.Unscoped().Where("target_type = ? AND target_id = ?", targetType, targetID).Delete(&MentionModel{}).Error
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	var added []uint
+	for _, userModel := range mentioned {
+		mention := MentionModel{TargetType: targetType, TargetID: targetID, UserModelID: userModel.ID}
+		if err := tx.Create(&mention).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if !had[userModel.ID] {
+			added = append(added, userModel.ID)
+		}
+	}
+	return added, tx.Commit().Error
+}
+
+// Save the mentions of a text and notify the users it mentions for the first time. Nothing is saved
+// while the text is hidden, the mentions are saved when a moderator releases it, see Release.
+func saveMentions(targetType string, targetID uint, mentioned []users.UserModel, authorID uint, hidden bool,
+	target *users.NotificationTarget) error {
+	if hidden {
+		return nil
+	}
+	added, err := setMentions(targetType, targetID, mentioned)
+	if err != nil {
+		return err
+	}
+	for _, id := range added {
+		if err := users.Notify(users.NotificationMention, id, authorID, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Drop the mentions of deleted texts.
+func removeMentions(targetType string, ids []uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	db := common.GetDB()
+	return db.Unscoped().Where("target_type = ? AND target_id IN (?)", targetType, ids).Delete(&MentionModel{}).Error
+}
@@ -1,23 +1,30 @@
 package articles
 
 import (
+	"context"
+	"errors"
 	_ "fmt"
+	"os"
+	"strings"
+	"time"
 	"github.com/jinzhu/gorm"
 	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/jobs"
 	"github.com/gothinkster/golang-gin-realworld-example-app/users"
-	"strconv"
 )
 
 type ArticleModel struct {
 	gorm.Model
 	Slug        string `gorm:"unique_index"`
 	Title       string
-	Description string `gorm:"size:2048"`
-	Body        string `gorm:"size:2048"`
+	Description string `gorm:"type:text"`
+	Body        string `gorm:"type:text"`
 	Author      ArticleUserModel
 	AuthorID    uint
 	Tags        []TagModel     `gorm:"many2many:article_tags;"`
 	Comments    []CommentModel `gorm:"ForeignKey:ArticleID"`
+	Version     uint           `gorm:"not null;default:1"`
+	HiddenAt    *time.Time     `gorm:"index"`
 }
 
 type ArticleUserModel struct {
@@ -36,21 +43,168 @@ type FavoriteModel struct {
 	FavoriteByID uint
 }
 
+// One reaction left by a reader on an article or a comment, a reader leaves each reaction once.
+// Reactions are deleted for real so that they can be added again.
+type ReactionModel struct {
+	gorm.Model
+	TargetType  string `gorm:"unique_index:idx_reaction_target_by"`
+	TargetID    uint   `gorm:"unique_index:idx_reaction_target_by"`
+	ReactedBy   ArticleUserModel
+	ReactedByID uint   `gorm:"unique_index:idx_reaction_target_by"`
+	Reaction    string `gorm:"unique_index:idx_reaction_target_by"`
+}
+
+// The number of each reaction on a target, kept up to date with every ReactionModel written
+// so that responses never have to count them.
+type ReactionCountModel struct {
+	gorm.Model
+	TargetType string `gorm:"unique_index:idx_reaction_count"`
+	TargetID   uint   `gorm:"unique_index:idx_reaction_count"`
+	Reaction   string `gorm:"unique_index:idx_reaction_count"`
+	Count      uint
+}
+
+const (
+	ReactionOnArticle = "article"
+	ReactionOnComment = "comment"
+)
+
+// The reactions readers may leave, set REACTIONS to a comma separated list to change them.
+var Reactions = reactionsFromEnv()
+
+var ErrUnknownReaction = errors.New("Unknown reaction")
+
+func reactionsFromEnv() []string {
+	reactions := []string{"clap", "like", "love", "laugh", "insightful", "sad"}
+	if value := os.Getenv("REACTIONS"); value != "" {
+		reactions = nil
+		for _, reaction := range strings.Split(value, ",") {
+			if reaction = strings.TrimSpace(reaction); reaction != "" {
+				reactions = append(reactions, reaction)
+			}
+		}
+	}
+	return reactions
+}
+
+func isReaction(reaction string) bool {
+	for _, allowed := range Reactions {
+		if reaction == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Add a reaction of user on a target, adding it twice changes nothing.
+// 	err := addReaction(ReactionOnArticle, articleModel.ID, GetArticleUserModel(myUserModel), "clap")
+func addReaction(targetType string, targetID uint, user ArticleUserModel, reaction string) error {
+	if !isReaction(reaction) {
+		return ErrUnknownReaction
+	}
+	db := common.GetDB()
+	tx := db.Begin()
+	condition := ReactionModel{TargetType: targetType, TargetID: targetID, ReactedByID: user.ID, Reaction: reaction}
+	var existing ReactionModel
+	tx.Where(condition).First(&existing)
+	if existing.ID != 0 {
+		return tx.Commit().Error
+	}
+	if err := tx.Create(&condition).Error; err != nil {
+		tx.Rollback()
+		// A concurrent request adding the same reaction wins the unique index, it is there either way.
+		var raced ReactionModel
+		if db.Where(ReactionModel{TargetType: targetType, TargetID: targetID, ReactedByID: user.ID, Reaction: reaction}).First(&raced).Error == nil {
+			return nil
+		}
+		return err
+	}
+	if err := changeReactionCount(tx, targetType, targetID, reaction, "count + 1"); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// Take back a reaction of user on a target, removing a missing reaction changes nothing.
+func removeReaction(targetType string, targetID uint, user ArticleUserModel, reaction string) error {
+	if !isReaction(reaction) {
+		return ErrUnknownReaction
+	}
+	db := common.GetDB()
+	tx := db.Begin()
+	deleted := tx.Unscoped().Where(ReactionModel{
+		TargetType:  targetType,
+		TargetID:    targetID,
+		ReactedByID: user.ID,
+		Reaction:    reaction,
+	}).Delete(ReactionModel{})
+	if deleted.Error != nil {
+		tx.Rollback()
+		return deleted.Error
+	}
+	if deleted.RowsAffected != 0 {
+		if err := changeReactionCount(tx, targetType, targetID, reaction, "count - 1"); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+func changeReactionCount(tx *gorm.DB, targetType string, targetID uint, reaction string, expr string) error {
+	condition := ReactionCountModel{TargetType: targetType, TargetID: targetID, Reaction: reaction}
+	var counter ReactionCountModel
+	if err := tx.Where(condition).FirstOrCreate(&counter).Error; err != nil {
+		return err
+	}
+	return tx.Model(&counter).UpdateColumn("count", gorm.Expr(expr)).Error
+}
+
 type TagModel struct {
 	gorm.Model
 	Tag           string         `gorm:"unique_index"`
 	ArticleModels []ArticleModel `gorm:"many2many:article_tags;"`
 }
 
+// Replies point to the comment they answer with ParentID and to the top level comment of their
+// thread with RootID, so a whole thread can be loaded in one query. Both are nil at the top level.
 type CommentModel struct {
 	gorm.Model
 	Article   ArticleModel
 	ArticleID uint
 	Author    ArticleUserModel
 	AuthorID  uint
-	Body      string `gorm:"size:2048"`
+	Body      string `gorm:"type:text"`
+	Version   uint   `gorm:"not null;default:1"`
+	ParentID  *uint  `gorm:"index"`
+	RootID    *uint  `gorm:"index"`
+	Depth     uint
+	EditedAt  *time.Time
+	HiddenAt  *time.Time     `gorm:"index"`
+	Replies   []CommentModel `gorm:"-"`
+}
+
+// Articles and comments used to be stored in varchar(2048) columns, widen them to hold long-form content.
+// Run it after AutoMigrate, which only ever adds columns.
+func WidenTextColumns(db *gorm.DB) error {
+	columns := map[string][]string{
+		"article_models": {"description", "body"},
+		"comment_models": {"body"},
+	}
+	for table, names := range columns {
+		for _, column := range names {
+			if err := common.WidenTextColumn(db, table, column); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
+// How deep replies may nest, top level comments are at depth 0.
+var MaxCommentDepth = uint(common.GetEnvInt("COMMENT_MAX_DEPTH", 5))
+
 func GetArticleUserModel(userModel users.UserModel) ArticleUserModel {
 	var articleUserModel ArticleUserModel
 	if userModel.ID == 0 {
@@ -64,33 +218,28 @@ func GetArticleUserModel(userModel users.UserModel) ArticleUserModel {
 	return articleUserModel
 }
 
-func (article ArticleModel) favoritesCount() uint {
-	db := common.GetDB()
-	var count uint
-	db.Model(&FavoriteModel{}).Where(FavoriteModel{
-		FavoriteID: article.ID,
-	}).Count(&count)
-	return count
-}
-
-func (article ArticleModel) isFavoriteBy(user ArticleUserModel) bool {
+// Favoriting again changes nothing, the first favorite records a FavoriteAdded event with it and is the
+// only one to return true.
+func (article ArticleModel) favoriteBy(user ArticleUserModel) (bool, error) {
 	db := common.GetDB()
-	var favorite FavoriteModel
-	db.Where(FavoriteModel{
-		FavoriteID:   article.ID,
-		FavoriteByID: user.ID,
-	}).First(&favorite)
-	return favorite.ID != 0
-}
-
-func (article ArticleModel) favoriteBy(user ArticleUserModel) error {
-	db := common.GetDB()
-	var favorite FavoriteModel
-	err := db.FirstOrCreate(&favorite, &FavoriteModel{
-		FavoriteID:   article.ID,
-		FavoriteByID: user.ID,
-	}).Error
-	return err
+	added := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var favorite FavoriteModel
+		tx.Where(FavoriteModel{
+			FavoriteID:   article.ID,
+			FavoriteByID: user.ID,
+		}).FirstOrInit(&favorite)
+		if favorite.ID != 0 {
+			return nil
+		}
+		if err := tx.Create(&favorite).Error; err != nil {
+			return err
+		}
+		added = true
+		return jobs.RecordEvent(tx, common.FavoriteAdded, []uint{article.Author.UserModelID, user.UserModelID},
+			FavoriteEvent{Article: article.Slug, Title: article.Title, User: user.UserModel.Username})
+	})
+	return added && err == nil, err
 }
 
 func (article ArticleModel) unFavoriteBy(user ArticleUserModel) error {
@@ -108,137 +257,394 @@ func SaveOne(data interface{}) error {
 	return err
 }
 
+// Save data and record the domain event event makes of it in the same transaction, so that the event exists
+// if and only if the change does. Nothing is recorded when event returns nil.
+// 	err := saveWithEvent(&articleModel, common.ArticleCreated, []uint{authorID}, func() interface{} {...})
+func saveWithEvent(data interface{}, kind string, userIDs []uint, event func() interface{}) error {
+	db := common.GetDB()
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(data).Error; err != nil {
+			return err
+		}
+		if payload := event(); payload != nil {
+			return jobs.RecordEvent(tx, kind, userIDs, payload)
+		}
+		return nil
+	})
+}
+
+// The article matching condition with its author and tags, gorm.ErrRecordNotFound when there is none.
 func FindOneArticle(condition interface{}) (ArticleModel, error) {
 	db := common.GetDB()
 	var model ArticleModel
-	tx := db.Begin()
-	tx.Where(condition).First(&model)
-	tx.Model(&model).Related(&model.Author, "Author")
-	tx.Model(&model.Author).Related(&model.Author.UserModel)
-	tx.Model(&model).Related(&model.Tags, "Tags")
-	err := tx.Commit().Error
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where(condition).First(&model).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&model).Related(&model.Author, "Author").Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&model.Author).Related(&model.Author.UserModel).Error; err != nil {
+			return err
+		}
+		return tx.Model(&model).Related(&model.Tags, "Tags").Error
+	})
 	return model, err
 }
 
-func (self *ArticleModel) getComments() error {
+// Load one page of the comments viewer may see, oldest first. Threaded pages hold top level comments
+// only, with their whole threads loaded in Replies, and are counted by thread. The queries are traced
+// and logged for ctx.
+func (self *ArticleModel) getComments(ctx context.Context, viewer ArticleUserModel, page common.Pagination, threaded bool) (int, common.PageInfo, error) {
+	db := common.GetDBContext(ctx)
+	var count int
+	var info common.PageInfo
+	err := db.Transaction(func(tx *gorm.DB) error {
+		query := visibleTo(tx.Model(&CommentModel{}).Where("article_id = ?", self.ID), "comment_models", viewer)
+		if threaded {
+			query = query.Where("parent_id IS NULL")
+		}
+		if err := query.Count(&count).Error; err != nil {
+			return err
+		}
+		if err := page.Scope(query.Preload("Author.UserModel"), "comment_models", false).Find(&self.Comments).Error; err != nil {
+			return err
+		}
+
+		var keep int
+		keep, info = page.Info(commentIDs(self.Comments), count)
+		self.Comments = self.Comments[:keep]
+		if page.Reverse() {
+			for i, j := 0, len(self.Comments)-1; i < j; i, j = i+1, j-1 {
+				self.Comments[i], self.Comments[j] = self.Comments[j], self.Comments[i]
+			}
+		}
+		if !threaded || len(self.Comments) == 0 {
+			return nil
+		}
+		var replies []CommentModel
+		err := visibleTo(tx.Preload("Author.UserModel"), "comment_models", viewer).
+			Where("root_id in (?)", commentIDs(self.Comments)).Order("id asc").Find(&replies).Error
+		if err != nil {
+			return err
+		}
+		threadComments(self.Comments, replies)
+		return nil
+	})
+	return count, info, err
+}
+
+var ErrInvalidParent = errors.New("Invalid parent comment")
+var ErrCommentTooDeep = errors.New("Replies are nested too deep")
+
+// Make the comment a reply to the comment parentID of the same article.
+// 	err := commentModel.setParent(articleModel.ID, 3)
+func (model *CommentModel) setParent(articleID uint, parentID uint) error {
 	db := common.GetDB()
-	tx := db.Begin()
-	tx.Model(self).Related(&self.Comments, "Comments")
-	for i, _ := range self.Comments {
-		tx.Model(&self.Comments[i]).Related(&self.Comments[i].Author, "Author")
-		tx.Model(&self.Comments[i].Author).Related(&self.Comments[i].Author.UserModel)
+	var parent CommentModel
+	db.Where("id = ? AND article_id = ?", parentID, articleID).First(&parent)
+	if parent.ID == 0 {
+		return ErrInvalidParent
 	}
-	err := tx.Commit().Error
-	return err
+	if parent.Depth+1 > MaxCommentDepth {
+		return ErrCommentTooDeep
+	}
+	model.ParentID = &parent.ID
+	model.RootID = &parent.ID
+	if parent.RootID != nil {
+		model.RootID = parent.RootID
+	}
+	model.Depth = parent.Depth + 1
+	return nil
 }
 
-func getAllTags() ([]TagModel, error) {
+func FindOneComment(condition interface{}) (CommentModel, error) {
 	db := common.GetDB()
-	var models []TagModel
-	err := db.Find(&models).Error
-	return models, err
+	var model CommentModel
+	err := db.Preload("Author.UserModel").Where(condition).First(&model).Error
+	return model, err
 }
 
-func FindManyArticle(tag, author, limit, offset, favorited string) ([]ArticleModel, int, error) {
-	db := common.GetDB()
-	var models []ArticleModel
-	var count int
+// Attach every reply to its parent, replies must be sorted the way they should be listed. A reply whose
+// parent is not listed, because it is hidden from the viewer, is attached to the top level comment of
+// its thread rather than dropped.
+func threadComments(roots []CommentModel, replies []CommentModel) {
+	listed := make(map[uint]bool, len(roots)+len(replies))
+	for _, comment := range roots {
+		listed[comment.ID] = true
+	}
+	for _, reply := range replies {
+		listed[reply.ID] = true
+	}
+	children := make(map[uint][]CommentModel)
+	for _, reply := range replies {
+		parentID := *reply.ParentID
+		if !listed[parentID] && reply.RootID != nil {
+			parentID = *reply.RootID
+		}
+		children[parentID] = append(children[parentID], reply)
+	}
+	var attach func(comment *CommentModel)
+	attach = func(comment *CommentModel) {
+		comment.Replies = children[comment.ID]
+		for i := range comment.Replies {
+			attach(&comment.Replies[i])
+		}
+	}
+	for i := range roots {
+		attach(&roots[i])
+	}
+}
 
-	offset_int, err := strconv.Atoi(offset)
-	if err != nil {
-		offset_int = 0
+func commentIDs(models []CommentModel) []uint {
+	ids := make([]uint, len(models))
+	for i, model := range models {
+		ids[i] = model.ID
 	}
+	return ids
+}
 
-	limit_int, err := strconv.Atoi(limit)
-	if err != nil {
-		limit_int = 20
+func articleIDs(models []ArticleModel) []uint {
+	ids := make([]uint, len(models))
+	for i, model := range models {
+		ids[i] = model.ID
 	}
+	return ids
+}
+
+// Load one page of an article query ordered from the newest to the oldest, with its total count.
+func findArticlePage(query *gorm.DB, page common.Pagination) ([]ArticleModel, int, common.PageInfo, error) {
+	var models []ArticleModel
+	var count int
+	if err := query.Count(&count).Error; err != nil {
+		return models, count, common.PageInfo{}, err
+	}
+	// Preload runs one query per association for the whole page instead of three per article.
+	query = query.Preload("Author.UserModel").Preload("Tags")
+	if err := page.Scope(query, "article_models", true).Find(&models).Error; err != nil {
+		return models, count, common.PageInfo{}, err
+	}
+	keep, info := page.Info(articleIDs(models), count)
+	models = models[:keep]
+	if page.Reverse() {
+		for i, j := 0, len(models)-1; i < j; i, j = i+1, j-1 {
+			models[i], models[j] = models[j], models[i]
+		}
+	}
+	return models, count, info, nil
+}
+
+// One page of the articles viewer may see, only those with tag, by author or favorited by favorited when
+// one is given. The queries are traced in a span of their own, a child of the span of ctx.
+// 	articleModels, count, info, err := FindManyArticle(c.Request.Context(), "golang", "", "", viewer, page)
+func FindManyArticle(ctx context.Context, tag, author, favorited string, viewer ArticleUserModel, page common.Pagination) ([]ArticleModel, int, common.PageInfo, error) {
+	ctx, span := common.StartSpan(ctx, "articles.FindManyArticle")
+	defer span.End()
+	db := common.GetDBContext(ctx)
 
 	tx := db.Begin()
+	query := visibleTo(tx.Model(&ArticleModel{}), "article_models", viewer)
 	if tag != "" {
-		var tagModel TagModel
-		tx.Where(TagModel{Tag: tag}).First(&tagModel)
-		if tagModel.ID != 0 {
-			tx.Model(&tagModel).Offset(offset_int).Limit(limit_int).Related(&models, "ArticleModels")
-			count = tx.Model(&tagModel).Association("ArticleModels").Count()
-		}
+		query = query.Where("article_models.id in ?", articlesTagged(tx, tag))
 	} else if author != "" {
-		var userModel users.UserModel
-		tx.Where(users.UserModel{Username: author}).First(&userModel)
-		articleUserModel := GetArticleUserModel(userModel)
-
-		if articleUserModel.ID != 0 {
-			count = tx.Model(&articleUserModel).Association("ArticleModels").Count()
-			tx.Model(&articleUserModel).Offset(offset_int).Limit(limit_int).Related(&models, "ArticleModels")
-		}
+		query = query.Where("article_models.author_id in ?", articleUsersNamed(tx, author))
 	} else if favorited != "" {
-		var userModel users.UserModel
-		tx.Where(users.UserModel{Username: favorited}).First(&userModel)
-		articleUserModel := GetArticleUserModel(userModel)
-		if articleUserModel.ID != 0 {
-			var favoriteModels []FavoriteModel
-			tx.Where(FavoriteModel{
-				FavoriteByID: articleUserModel.ID,
-			}).Offset(offset_int).Limit(limit_int).Find(&favoriteModels)
-
-			count = tx.Model(&articleUserModel).Association("FavoriteModels").Count()
-			for _, favorite := range favoriteModels {
-				var model ArticleModel
-				tx.Model(&favorite).Related(&model, "Favorite")
-				models = append(models, model)
-			}
-		}
-	} else {
-		db.Model(&models).Count(&count)
-		db.Offset(offset_int).Limit(limit_int).Find(&models)
+		query = query.Where("article_models.id in ?", tx.Model(&FavoriteModel{}).
+			Select("favorite_id").Where("favorite_by_id in ?", articleUsersNamed(tx, favorited)).SubQuery())
 	}
 
-	for i, _ := range models {
-		tx.Model(&models[i]).Related(&models[i].Author, "Author")
-		tx.Model(&models[i].Author).Related(&models[i].Author.UserModel)
-		tx.Model(&models[i]).Related(&models[i].Tags, "Tags")
+	models, count, info, err := findArticlePage(query, page)
+	if err != nil {
+		tx.Rollback()
+		common.RecordSpanError(span, err)
+		return models, count, info, err
 	}
 	err = tx.Commit().Error
-	return models, count, err
+	common.RecordSpanError(span, err)
+	return models, count, info, err
 }
 
-func (self *ArticleUserModel) GetArticleFeed(limit, offset string) ([]ArticleModel, int, error) {
-	db := common.GetDB()
-	var models []ArticleModel
-	var count int
+// A sub query selecting the ArticleUserModel ids of the user with this username.
+func articleUsersNamed(tx *gorm.DB, username string) interface{} {
+	return tx.Model(&ArticleUserModel{}).Select("id").Where("user_model_id in ?",
+		tx.Model(&users.UserModel{}).Select("id").Where("username = ?", username).SubQuery()).SubQuery()
+}
+
+// One page of the articles of the authors and tags the reader follows, traced like FindManyArticle.
+func (self *ArticleUserModel) GetArticleFeed(ctx context.Context, page common.Pagination) ([]ArticleModel, int, common.PageInfo, error) {
+	ctx, span := common.StartSpan(ctx, "articles.GetArticleFeed")
+	defer span.End()
+	db := common.GetDBContext(ctx)
+
+	tx := db.Begin()
+	followings := tx.Model(&users.FollowModel{}).Select("following_id").Where("followed_by_id = ?", self.UserModelID).SubQuery()
+	authors := tx.Model(&ArticleUserModel{}).Select("id").Where("user_model_id in ?", followings).SubQuery()
 
-	offset_int, err := strconv.Atoi(offset)
+	// Articles with a followed tag are in as well, unless the reader wrote them.
+	tags := tx.Model(&TagFollowModel{}).Select("tag_id").Where("followed_by_id = ?", self.ID).SubQuery()
+	tagged := tx.Table("article_tags").Select("article_model_id").Where("tag_model_id in ?", tags).SubQuery()
+
+	query := visibleTo(tx.Model(&ArticleModel{}), "article_models", *self).
+		Where("article_models.author_id in ? OR (article_models.id in ? AND article_models.author_id <> ?)", authors, tagged, self.ID)
+	models, count, info, err := findArticlePage(query, page)
 	if err != nil {
-		offset_int = 0
+		tx.Rollback()
+		common.RecordSpanError(span, err)
+		return models, count, info, err
+	}
+	err = tx.Commit().Error
+	common.RecordSpanError(span, err)
+	return models, count, info, err
+}
+
+// Hidden articles and comments are left out of listings for everyone but their author and moderators.
+func visibleTo(query *gorm.DB, table string, viewer ArticleUserModel) *gorm.DB {
+	if viewer.UserModel.Moderator {
+		return query
 	}
-	limit_int, err := strconv.Atoi(limit)
+	return query.Where(table+".hidden_at IS NULL OR "+table+".author_id = ?", viewer.ID)
+}
+
+// When an article last left the listings, deleted or hidden, the zero time if none ever did. Listings
+// change then even when none of the articles they still show did.
+// 	removedAt, err := articles.LastRemovedAt()
+func LastRemovedAt() (time.Time, error) {
+	db := common.GetDB()
+	var last time.Time
+	var deleted, hidden []ArticleModel
+	err := db.Unscoped().Select("id, deleted_at").Where("deleted_at IS NOT NULL").Order("deleted_at desc").Limit(1).Find(&deleted).Error
 	if err != nil {
-		limit_int = 20
+		return last, err
 	}
+	if len(deleted) > 0 {
+		last = *deleted[0].DeletedAt
+	}
+	err = db.Select("id, hidden_at").Where("hidden_at IS NOT NULL").Order("hidden_at desc").Limit(1).Find(&hidden).Error
+	if err != nil {
+		return last, err
+	}
+	if len(hidden) > 0 && hidden[0].HiddenAt.After(last) {
+		last = *hidden[0].HiddenAt
+	}
+	return last, nil
+}
 
-	tx := db.Begin()
-	followings := self.UserModel.GetFollowings()
-	var articleUserModels []uint
-	for _, following := range followings {
-		articleUserModel := GetArticleUserModel(following)
-		articleUserModels = append(articleUserModels, articleUserModel.ID)
+// What notifications about the article point to.
+func (model ArticleModel) notificationTarget() *users.NotificationTarget {
+	return &users.NotificationTarget{Type: "article", ID: model.ID, Slug: model.Slug, Title: model.Title}
+}
+
+// Notifications about a comment point to its article.
+func (model CommentModel) notificationTarget(article ArticleModel) *users.NotificationTarget {
+	return &users.NotificationTarget{Type: "comment", ID: model.ID, Slug: article.Slug, Title: article.Title}
+}
+
+// Whether viewer may see the article, see visibleTo.
+func (model ArticleModel) VisibleTo(viewer ArticleUserModel) bool {
+	return model.HiddenAt == nil || viewer.UserModel.Moderator || (viewer.ID != 0 && model.AuthorID == viewer.ID)
+}
+
+// Whether viewer may see the comment, see visibleTo.
+func (model CommentModel) VisibleTo(viewer ArticleUserModel) bool {
+	return model.HiddenAt == nil || viewer.UserModel.Moderator || (viewer.ID != 0 && model.AuthorID == viewer.ID)
+}
+
+// Hide the article from everyone but its author and moderators, or show it again.
+// 	err := articleModel.SetHidden(true)
+func (model *ArticleModel) SetHidden(hidden bool) error {
+	hiddenAt, err := setHidden(model, hidden)
+	if err == nil {
+		model.HiddenAt = hiddenAt
 	}
+	return err
+}
 
-	tx.Where("author_id in (?)", articleUserModels).Order("updated_at desc").Offset(offset_int).Limit(limit_int).Find(&models)
+// Hide the comment from everyone but its author and moderators, or show it again.
+func (model *CommentModel) SetHidden(hidden bool) error {
+	hiddenAt, err := setHidden(model, hidden)
+	if err == nil {
+		model.HiddenAt = hiddenAt
+	}
+	return err
+}
 
-	for i, _ := range models {
-		tx.Model(&models[i]).Related(&models[i].Author, "Author")
-		tx.Model(&models[i].Author).Related(&models[i].Author.UserModel)
-		tx.Model(&models[i]).Related(&models[i].Tags, "Tags")
+// Show the article held by the content filters again, with everything its creation left out while it
+// was held: the ArticleCreated event, the stream and the mentions. An article not hidden is left alone.
+// 	err := articleModel.Release()
+func (model *ArticleModel) Release() error {
+	if model.HiddenAt == nil {
+		return nil
 	}
-	err = tx.Commit().Error
-	return models, count, err
+	err := releaseWithEvent(model, common.ArticleCreated, []uint{model.Author.UserModelID}, articleEvent(*model))
+	if err != nil {
+		return err
+	}
+	model.HiddenAt = nil
+	publishArticle(*model)
+	mentioned := resolveMentions(model.Author.UserModel, model.Description+"\n"+model.Body)
+	return saveMentions(ReactionOnArticle, model.ID, mentioned, model.Author.UserModelID, false, model.notificationTarget())
+}
+
+// Show the comment held by the content filters again, with everything its creation left out while it
+// was held: the CommentCreated event, the notification of the author of the article, the stream and
+// the mentions. A comment not hidden is left alone.
+func (model *CommentModel) Release() error {
+	if model.HiddenAt == nil {
+		return nil
+	}
+	articleModel, err := FindOneArticle(&ArticleModel{Model: gorm.Model{ID: model.ArticleID}})
+	if err != nil {
+		return err
+	}
+	err = releaseWithEvent(model, common.CommentCreated, []uint{articleModel.Author.UserModelID, model.Author.UserModelID},
+		commentEvent(articleModel, *model))
+	if err != nil {
+		return err
+	}
+	model.HiddenAt = nil
+	err = users.Notify(users.NotificationComment, articleModel.Author.UserModelID, model.Author.UserModelID,
+		articleModel.notificationTarget())
+	if err != nil {
+		return err
+	}
+	publishComment(articleModel, *model)
+	mentioned := resolveMentions(model.Author.UserModel, model.Body)
+	return saveMentions(ReactionOnComment, model.ID, mentioned, model.Author.UserModelID, false,
+		model.notificationTarget(articleModel))
+}
+
+// Show model again and record the domain event of its creation in the same transaction. It counts as
+// updated, the listings it comes back to changed.
+func releaseWithEvent(model interface{}, kind string, userIDs []uint, payload interface{}) error {
+	db := common.GetDB()
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(model).UpdateColumns(map[string]interface{}{"hidden_at": gorm.Expr("NULL"), "updated_at": time.Now()}).Error
+		if err != nil {
+			return err
+		}
+		return jobs.RecordEvent(tx, kind, userIDs, payload)
+	})
+}
+
+func setHidden(model interface{}, hidden bool) (*time.Time, error) {
+	db := common.GetDB()
+	if !hidden {
+		return nil, db.Model(model).UpdateColumn("hidden_at", gorm.Expr("NULL")).Error
+	}
+	now := time.Now()
+	return &now, db.Model(model).UpdateColumn("hidden_at", &now).Error
 }
 
 func (model *ArticleModel) setTags(tags []string) error {
 	db := common.GetDB()
 	var tagList []TagModel
+	seen := map[string]bool{}
 	for _, tag := range tags {
+		tag = resolveTag(db, tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
 		var tagModel TagModel
 		err := db.FirstOrCreate(&tagModel, TagModel{Tag: tag}).Error
 		if err != nil {
@@ -256,14 +662,164 @@ func (model *ArticleModel) Update(data interface{}) error {
 	return err
 }
 
+var ErrStaleVersion = errors.New("has been modified since it was read")
+
+// Bump the version of a row and apply the update in one transaction. When expected is not zero
+// the row must still be at that version, otherwise nothing is written and ErrStaleVersion returned.
+// The new version is read back into version.
+// then runs in the transaction of the update when it is not nil.
+func updateVersioned(model interface{}, id uint, expected uint, data interface{}, version *uint, then func(tx *gorm.DB) error) error {
+	db := common.GetDB()
+	tx := db.Begin()
+	bump := tx.Model(model).Where("id = ?", id)
+	if expected != 0 {
+		bump = bump.Where("version = ?", expected)
+	}
+	bump = bump.UpdateColumn("version", gorm.Expr("version + 1"))
+	if bump.Error != nil {
+		tx.Rollback()
+		return bump.Error
+	}
+	if bump.RowsAffected == 0 {
+		tx.Rollback()
+		return ErrStaleVersion
+	}
+	if err := tx.Model(model).Update(data).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Model(model).Where("id = ?", id).Select("version").Row().Scan(version); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if then != nil {
+		if err := then(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// Update the article like Update does, but only if it is still at the expected version (zero to skip the check).
+// An ArticleUpdated event is recorded with the update unless the article ends up hidden.
+// 	err := articleModel.UpdateVersioned(articleModelValidator.articleModel, 3)
+func (model *ArticleModel) UpdateVersioned(data ArticleModel, expected uint) error {
+	data.Version = 0
+	return updateVersioned(model, model.ID, expected, data, &model.Version, func(tx *gorm.DB) error {
+		if model.HiddenAt != nil {
+			return nil
+		}
+		return jobs.RecordEvent(tx, common.ArticleUpdated, []uint{model.Author.UserModelID}, articleEvent(*model))
+	})
+}
+
+// Update the comment body only if it is still at the expected version (zero to skip the check).
+func (model *CommentModel) UpdateVersioned(data CommentModel, expected uint) error {
+	data.Version = 0
+	return updateVersioned(model, model.ID, expected, data, &model.Version, nil)
+}
+
+// Delete the articles matching condition, recording an ArticleDeleted event for every one of them readers could see.
 func DeleteArticleModel(condition interface{}) error {
 	db := common.GetDB()
-	err := db.Where(condition).Delete(ArticleModel{}).Error
-	return err
+	var models []ArticleModel
+	if err := db.Preload("Author.UserModel").Preload("Tags").Where(condition).Find(&models).Error; err != nil {
+		return err
+	}
+	ids := make([]uint, len(models))
+	for i, model := range models {
+		ids[i] = model.ID
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where(condition).Delete(ArticleModel{}).Error; err != nil {
+			return err
+		}
+		for _, model := range models {
+			if model.HiddenAt != nil {
+				continue
+			}
+			if err := jobs.RecordEvent(tx, common.ArticleDeleted, []uint{model.Author.UserModelID}, articleEvent(model)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := unindexArticleTerms(ids); err != nil {
+		return err
+	}
+	return removeMentions(ReactionOnArticle, ids)
 }
 
+// The replies of a deleted comment move up to its parent, those of a deleted top level comment start
+// threads of their own, so that no reply is lost with the comment it answered.
 func DeleteCommentModel(condition interface{}) error {
 	db := common.GetDB()
-	err := db.Where(condition).Delete(CommentModel{}).Error
-	return err
+	var ids []uint
+	if err := db.Model(&CommentModel{}).Where(condition).Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, id := range ids {
+			if err := reparentReplies(tx, id); err != nil {
+				return err
+			}
+		}
+		return tx.Where("id in (?)", ids).Delete(CommentModel{}).Error
+	})
+	if err != nil {
+		return err
+	}
+	return removeMentions(ReactionOnComment, ids)
+}
+
+// Move the replies of the comment id one level up, its direct replies answer its parent from now on.
+// The comment is read again in tx, an earlier call may have moved it.
+func reparentReplies(tx *gorm.DB, id uint) error {
+	var comment CommentModel
+	if err := tx.First(&comment, id).Error; err != nil {
+		return err
+	}
+	rootID := comment.ID
+	if comment.RootID != nil {
+		rootID = *comment.RootID
+	}
+	var thread []CommentModel
+	if err := tx.Where("root_id = ?", rootID).Order("id asc").Find(&thread).Error; err != nil {
+		return err
+	}
+	children := make(map[uint][]CommentModel)
+	for _, reply := range thread {
+		if reply.ParentID != nil {
+			children[*reply.ParentID] = append(children[*reply.ParentID], reply)
+		}
+	}
+	var move func(reply CommentModel, newRootID *uint) error
+	move = func(reply CommentModel, newRootID *uint) error {
+		columns := map[string]interface{}{"root_id": newRootID, "depth": reply.Depth - 1}
+		if *reply.ParentID == comment.ID {
+			columns["parent_id"] = comment.ParentID
+		}
+		if err := tx.Model(&CommentModel{}).Where("id = ?", reply.ID).UpdateColumns(columns).Error; err != nil {
+			return err
+		}
+		if newRootID == nil {
+			newRootID = &reply.ID
+		}
+		for _, child := range children[reply.ID] {
+			if err := move(child, newRootID); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, reply := range children[comment.ID] {
+		if err := move(reply, comment.RootID); err != nil {
+			return err
+		}
+	}
+	return nil
 }
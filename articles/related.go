@@ -0,0 +1,379 @@
+package articles
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/jinzhu/gorm"
+)
+
+// How often a term is used in the title and description of an article. Rows are rewritten whenever the
+// article is saved, so the index is kept up to date one article at a time instead of being rebuilt.
+type ArticleTermModel struct {
+	gorm.Model
+	ArticleID uint   `gorm:"unique_index:idx_article_term"`
+	Term      string `gorm:"unique_index:idx_article_term;size:64"`
+	Count     uint
+}
+
+// The number of articles using a term, the document frequency behind the inverse document frequency.
+type TermModel struct {
+	gorm.Model
+	Term      string `gorm:"unique_index;size:64"`
+	Documents uint
+}
+
+// How much each signal weighs in the related score, every signal is between 0 and 1.
+const (
+	relatedTagWeight      = 0.5
+	relatedFavoriteWeight = 0.2
+	relatedTextWeight     = 0.3
+)
+
+// The terms of an article with the highest tf-idf looked up to find articles with a similar text.
+const relatedQueryTerms = 20
+
+// The most articles scored for one article, the ones sharing the most terms are kept.
+const relatedCandidateLimit = 200
+
+// Terms are cut to as many letters.
+const maxTermLength = 64
+
+// Every indexed article, even one without a single term, has a row for this term, so that the number of
+// indexed articles is kept in its TermModel and IndexArticleTerms knows the article was indexed. No word
+// ever counts as it, words are at least three letters long.
+const indexedTerm = ""
+
+var stopWords = map[string]bool{}
+
+func init() {
+	for _, word := range strings.Fields(`about after all also and any are because been before but can could did
+		does each for from had has have her his how into its just more most not now off only other our out over
+		she should some such than that the their them then there these they this those through too under until
+		very was were what when where which while who why will with would you your`) {
+		stopWords[word] = true
+	}
+}
+
+// Lower cased words of the text counted, leaving out stop words and words shorter than three letters.
+func termCounts(text string) map[string]uint {
+	counts := map[string]uint{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		if len([]rune(word)) < 3 || stopWords[word] {
+			continue
+		}
+		if runes := []rune(word); len(runes) > maxTermLength {
+			word = string(runes[:maxTermLength])
+		}
+		counts[word]++
+	}
+	return counts
+}
+
+// Bring the terms of the article and the document frequencies in line with its title and description.
+// 	err := indexArticleTerms(articleModel)
+func indexArticleTerms(article ArticleModel) error {
+	db := common.GetDB()
+	tx := db.Begin()
+	counts := termCounts(article.Title + "\n" + article.Description)
+	counts[indexedTerm] = 1
+	if err := setArticleTerms(tx, article.ID, counts); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// Drop the articles from the index, call it with the ids of deleted articles.
+func unindexArticleTerms(ids []uint) error {
+	db := common.GetDB()
+	tx := db.Begin()
+	for _, id := range ids {
+		if err := setArticleTerms(tx, id, nil); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+func setArticleTerms(tx *gorm.DB, articleID uint, counts map[string]uint) error {
+	var previous []string
+	if err := tx.Model(&ArticleTermModel{}).Where("article_id = ?", articleID).Pluck("term", &previous).Error; err != nil {
+		return err
+	}
+	had := map[string]bool{}
+	var removed []string
+	for _, term := range previous {
+		had[term] = true
+		if counts[term] == 0 {
+			removed = append(removed, term)
+		}
+	}
+	if len(removed) > 0 {
+		err := tx.Model(&TermModel{}).Where("term IN (?)", removed).UpdateColumn("documents", gorm.Expr("documents - 1")).Error
+		if err != nil {
+			return err
+		}
+	}
+	for term := range counts {
+		if had[term] {
+			continue
+		}
+		var termModel TermModel
+		// A map rather than a struct, a struct condition would leave out the empty indexedTerm.
+		if err := tx.Where(map[string]interface{}{"term": term}).FirstOrCreate(&termModel).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&termModel).UpdateColumn("documents", gorm.Expr("documents + 1")).Error; err != nil {
+			return err
+		}
+	}
+	if err := tx.Unscoped().Where("article_id = ?", articleID).Delete(&ArticleTermModel{}).Error; err != nil {
+		return err
+	}
+	for term, count := range counts {
+		if err := tx.Create(&ArticleTermModel{ArticleID: articleID, Term: term, Count: count}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Index the articles written before the index existed. Run it once the tables are migrated.
+func IndexArticleTerms(db *gorm.DB) error {
+	var models []ArticleModel
+	err := db.Where("id NOT IN ?", db.Model(&ArticleTermModel{}).Select("article_id").Where("term = ?", indexedTerm).SubQuery()).
+		Find(&models).Error
+	if err != nil {
+		return err
+	}
+	for _, model := range models {
+		if err := indexArticleTerms(model); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rank the articles related to article for the viewer by tag overlap (Jaccard index), shared
+// favoriters (cosine of the favoriter sets) and text similarity (cosine of the tf-idf vectors of
+// title and description). Only articles sharing at least one tag, favoriter or top term are scored,
+// the viewer's own articles and favorites are left out.
+// 	models, err := findRelatedArticles(articleModel, viewer, 5)
+func findRelatedArticles(article ArticleModel, viewer ArticleUserModel, limit int) ([]ArticleModel, error) {
+	db := common.GetDB()
+	scores := map[uint]float64{}
+
+	tagIDs := make([]uint, len(article.Tags))
+	for i, tag := range article.Tags {
+		tagIDs[i] = tag.ID
+	}
+	sharedTags := map[uint]float64{}
+	if len(tagIDs) > 0 {
+		query := db.Table("article_tags").Select("article_model_id, count(*)").
+			Where("tag_model_id IN (?) AND article_model_id <> ?", tagIDs, article.ID).Group("article_model_id")
+		if err := scanCounts(query, sharedTags); err != nil {
+			return nil, err
+		}
+	}
+
+	sharedFavorites := map[uint]float64{}
+	query := db.Model(&FavoriteModel{}).Select("favorite_id, count(*)").
+		Where("favorite_by_id IN ? AND favorite_id <> ?",
+			db.Model(&FavoriteModel{}).Select("favorite_by_id").Where("favorite_id = ?", article.ID).SubQuery(), article.ID).
+		Group("favorite_id")
+	if err := scanCounts(query, sharedFavorites); err != nil {
+		return nil, err
+	}
+
+	var indexed TermModel
+	if err := db.Where("term = ?", indexedTerm).First(&indexed).Error; err != nil && !gorm.IsRecordNotFoundError(err) {
+		return nil, err
+	}
+	documents := int(indexed.Documents)
+	vectors, err := termVectors(db, []uint{article.ID}, documents)
+	if err != nil {
+		return nil, err
+	}
+	source := vectors[article.ID]
+	var sharedText []uint
+	if terms := topTerms(source, relatedQueryTerms); len(terms) > 0 {
+		err := db.Model(&ArticleTermModel{}).Where("term IN (?) AND article_id <> ?", terms, article.ID).
+			Group("article_id").Order("count(*) desc, article_id desc").Limit(relatedCandidateLimit).
+			Pluck("article_id", &sharedText).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var candidates []uint
+	for id := range sharedTags {
+		candidates = append(candidates, id)
+	}
+	for id := range sharedFavorites {
+		if _, ok := sharedTags[id]; !ok {
+			candidates = append(candidates, id)
+		}
+	}
+	for _, id := range sharedText {
+		if _, ok := sharedTags[id]; !ok {
+			if _, ok := sharedFavorites[id]; !ok {
+				candidates = append(candidates, id)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return []ArticleModel{}, nil
+	}
+	visible := visibleTo(db.Model(&ArticleModel{}), "article_models", viewer).Where("id IN (?)", candidates)
+	if viewer.ID != 0 {
+		visible = visible.Where("author_id <> ?", viewer.ID).Where("id NOT IN ?",
+			db.Model(&FavoriteModel{}).Select("favorite_id").Where("favorite_by_id = ?", viewer.ID).SubQuery())
+	}
+	if err := visible.Pluck("id", &candidates).Error; err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		return []ArticleModel{}, nil
+	}
+
+	ids := append([]uint{article.ID}, candidates...)
+	tagCounts := map[uint]float64{}
+	query = db.Table("article_tags").Select("article_model_id, count(*)").
+		Where("article_model_id IN (?)", ids).Group("article_model_id")
+	if err := scanCounts(query, tagCounts); err != nil {
+		return nil, err
+	}
+	favoriteCounts := map[uint]float64{}
+	query = db.Model(&FavoriteModel{}).Select("favorite_id, count(*)").Where("favorite_id IN (?)", ids).Group("favorite_id")
+	if err := scanCounts(query, favoriteCounts); err != nil {
+		return nil, err
+	}
+	vectors, err = termVectors(db, candidates, documents)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range candidates {
+		var score float64
+		if shared := sharedTags[id]; shared > 0 {
+			score += relatedTagWeight * shared / (tagCounts[article.ID] + tagCounts[id] - shared)
+		}
+		if shared := sharedFavorites[id]; shared > 0 {
+			score += relatedFavoriteWeight * shared / math.Sqrt(favoriteCounts[article.ID]*favoriteCounts[id])
+		}
+		score += relatedTextWeight * cosine(source, vectors[id])
+		if score > 0 {
+			scores[id] = score
+		}
+	}
+
+	ranked := make([]uint, 0, len(scores))
+	for id := range scores {
+		ranked = append(ranked, id)
+	}
+	// Newer articles first among equals, so that the order does not depend on the map.
+	sort.Slice(ranked, func(i, j int) bool {
+		if scores[ranked[i]] != scores[ranked[j]] {
+			return scores[ranked[i]] > scores[ranked[j]]
+		}
+		return ranked[i] > ranked[j]
+	})
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+	var models []ArticleModel
+	if err := db.Preload("Author.UserModel").Preload("Tags").Where("id IN (?)", ranked).Find(&models).Error; err != nil {
+		return nil, err
+	}
+	position := map[uint]int{}
+	for i, id := range ranked {
+		position[id] = i
+	}
+	sort.Slice(models, func(i, j int) bool { return position[models[i].ID] < position[models[j].ID] })
+	return models, nil
+}
+
+// Scan rows of an id and a count into counts.
+func scanCounts(query *gorm.DB, counts map[uint]float64) error {
+	rows, err := query.Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id uint
+		var count float64
+		if err := rows.Scan(&id, &count); err != nil {
+			return err
+		}
+		counts[id] = count
+	}
+	return nil
+}
+
+// The tf-idf vectors of the articles, out of the documents indexed articles.
+func termVectors(db *gorm.DB, ids []uint, documents int) (map[uint]map[string]float64, error) {
+	rows, err := db.Model(&ArticleTermModel{}).
+		Select("article_term_models.article_id, article_term_models.term, article_term_models.count, term_models.documents").
+		Joins("JOIN term_models ON term_models.term = article_term_models.term").
+		Where("article_term_models.article_id IN (?) AND article_term_models.term <> ?", ids, indexedTerm).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	vectors := map[uint]map[string]float64{}
+	for rows.Next() {
+		var id uint
+		var term string
+		var count, termDocuments float64
+		if err := rows.Scan(&id, &term, &count, &termDocuments); err != nil {
+			return nil, err
+		}
+		if vectors[id] == nil {
+			vectors[id] = map[string]float64{}
+		}
+		// Smoothed so that a term used by every article still weighs a little.
+		vectors[id][term] = count * (1 + math.Log(float64(documents+1)/(termDocuments+1)))
+	}
+	return vectors, nil
+}
+
+// The n terms with the highest weight, ties broken alphabetically.
+func topTerms(vector map[string]float64, n int) []string {
+	terms := make([]string, 0, len(vector))
+	for term := range vector {
+		terms = append(terms, term)
+	}
+	sort.Slice(terms, func(i, j int) bool {
+		if vector[terms[i]] != vector[terms[j]] {
+			return vector[terms[i]] > vector[terms[j]]
+		}
+		return terms[i] < terms[j]
+	})
+	if len(terms) > n {
+		terms = terms[:n]
+	}
+	return terms
+}
+
+func cosine(a, b map[string]float64) float64 {
+	var dot, normA, normB float64
+	for term, weight := range a {
+		dot += weight * b[term]
+		normA += weight * weight
+	}
+	for _, weight := range b {
+		normB += weight * weight
+	}
+	if dot == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(normA*normB)
+}
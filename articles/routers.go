@@ -2,11 +2,27 @@ package articles
 
 import (
 	"errors"
+	"github.com/jinzhu/gorm"
 	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/filters"
 	"github.com/gothinkster/golang-gin-realworld-example-app/users"
 	"github.com/gin-gonic/gin"
 	"net/http"
 	"strconv"
+	"time"
+)
+
+// How long a rendered list, article or tag response may be served from the cache.
+// Writes invalidate them long before that, the ttl only bounds what a lost invalidation can cost.
+const responseCacheTTL = 5 * time.Minute
+
+// Counted for GET /metrics, articles held for review included.
+var articlesCreatedCounter = common.NewCounter("articles_created_total", "Articles written.")
+
+// How many related articles are listed by default and at most.
+const (
+	defaultRelatedLimit = 5
+	maxRelatedLimit     = 20
 )
 
 func ArticlesRegister(router *gin.RouterGroup) {
@@ -15,33 +31,78 @@ func ArticlesRegister(router *gin.RouterGroup) {
 	router.DELETE("/:slug", ArticleDelete)
 	router.POST("/:slug/favorite", ArticleFavorite)
 	router.DELETE("/:slug/favorite", ArticleUnfavorite)
+	router.POST("/:slug/reactions/:reaction", ArticleReact)
+	router.DELETE("/:slug/reactions/:reaction", ArticleUnreact)
 	router.POST("/:slug/comments", ArticleCommentCreate)
+	router.PUT("/:slug/comments/:id", ArticleCommentUpdate)
 	router.DELETE("/:slug/comments/:id", ArticleCommentDelete)
+	router.POST("/:slug/comments/:id/reactions/:reaction", ArticleCommentReact)
+	router.DELETE("/:slug/comments/:id/reactions/:reaction", ArticleCommentUnreact)
 }
 
 func ArticlesAnonymousRegister(router *gin.RouterGroup) {
-	router.GET("/", ArticleList)
-	router.GET("/:slug", ArticleRetrieve)
+	router.GET("/", common.CacheResponse(responseCacheTTL, "articles"), ArticleList)
+	router.GET("/:slug", common.CacheResponse(responseCacheTTL, "articles"), ArticleRetrieve)
 	router.GET("/:slug/comments", ArticleCommentList)
+	router.GET("/:slug/related", common.CacheResponse(responseCacheTTL, "articles"), ArticleRelated)
 }
 
 func TagsAnonymousRegister(router *gin.RouterGroup) {
-	router.GET("/", TagList)
+	router.GET("/", common.CacheResponse(responseCacheTTL, "articles"), TagList)
+	router.GET("/:tag", common.CacheResponse(responseCacheTTL, "articles"), TagRetrieve)
+}
+
+func TagsRegister(router *gin.RouterGroup) {
+	router.POST("/:tag/follow", TagFollow)
+	router.DELETE("/:tag/follow", TagUnfollow)
+}
+
+// Tag management, the group has to be restricted to moderators with users.ModeratorMiddleware.
+func TagsAdminRegister(router *gin.RouterGroup) {
+	router.PUT("/tags/:tag", TagRename)
+	router.POST("/tags/:tag/merge", TagMerge)
+	router.POST("/tags/:tag/aliases", TagAliasCreate)
+	router.DELETE("/tags/:tag/aliases/:alias", TagAliasDelete)
+	router.DELETE("/orphan-tags", TagOrphansDelete)
 }
 
 func ArticleCreate(c *gin.Context) {
 	articleModelValidator := NewArticleModelValidator()
 	if err := articleModelValidator.Bind(c); err != nil {
-		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		c.JSON(http.StatusUnprocessableEntity, bindError(err))
 		return
 	}
 	//fmt.Println(articleModelValidator.articleModel.Author.UserModel)
 
-	if err := SaveOne(&articleModelValidator.articleModel); err != nil {
+	held := articleModelValidator.verdict.Outcome == filters.Hold
+	err := saveWithEvent(&articleModelValidator.articleModel, common.ArticleCreated,
+		[]uint{articleModelValidator.articleModel.Author.UserModelID}, func() interface{} {
+			if held {
+				return nil
+			}
+			return articleEvent(articleModelValidator.articleModel)
+		})
+	if err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
 	}
+	articlesCreatedCounter.Inc()
+	if held {
+		filters.NotifyHold("article", articleModelValidator.articleModel.ID, articleModelValidator.verdict)
+	} else {
+		publishArticle(articleModelValidator.articleModel)
+	}
+	err = saveMentions(ReactionOnArticle, articleModelValidator.articleModel.ID, articleModelValidator.mentioned,
+		articleModelValidator.articleModel.Author.UserModelID, held, articleModelValidator.articleModel.notificationTarget())
+	if err != nil {
+		common.RequestLogger(c).Error().Err(err).Str("func", "articles.saveMentions").Msg("db err")
+	}
+	if err := indexArticleTerms(articleModelValidator.articleModel); err != nil {
+		common.RequestLogger(c).Error().Err(err).Str("func", "articles.indexArticleTerms").Msg("db err")
+	}
+	common.InvalidateCache("articles")
 	serializer := ArticleSerializer{c, articleModelValidator.articleModel}
+	c.Header("ETag", common.VersionETag(articleModelValidator.articleModel.Version))
 	c.JSON(http.StatusCreated, gin.H{"article": serializer.Response()})
 }
 
@@ -50,33 +111,89 @@ func ArticleList(c *gin.Context) {
 	tag := c.Query("tag")
 	author := c.Query("author")
 	favorited := c.Query("favorited")
-	limit := c.Query("limit")
-	offset := c.Query("offset")
-	articleModels, modelCount, err := FindManyArticle(tag, author, limit, offset, favorited)
+	page, err := common.NewPagination(common.NewListing("articles", tag, author, favorited), c.Query("limit"), c.Query("offset"), c.Query("cursor"), common.DefaultPageLimit)
+	if err != nil {
+		c.JSON(common.CursorErrorStatus(err), common.NewError("cursor", err))
+		return
+	}
+	viewer := articleLoaderFor(c).viewer
+	articleModels, modelCount, pageInfo, err := FindManyArticle(c.Request.Context(), tag, author, favorited, viewer, page)
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid param")))
 		return
 	}
 	serializer := ArticlesSerializer{c, articleModels}
-	c.JSON(http.StatusOK, gin.H{"articles": serializer.Response(), "articlesCount": modelCount})
+	c.JSON(http.StatusOK, gin.H{
+		"articles":      serializer.Response(),
+		"articlesCount": modelCount,
+		"nextCursor":    pageInfo.NextCursor,
+		"prevCursor":    pageInfo.PrevCursor,
+	})
 }
 
+// The feed modes, mode=ranked orders the feed by FeedRanking instead of from the newest article,
+// and debug=true explains the ranking of every article.
+// 	GET /api/articles/feed?mode=ranked&debug=true
+const (
+	FeedChronological = "chronological"
+	FeedRanked        = "ranked"
+)
+
 func ArticleFeed(c *gin.Context) {
-	limit := c.Query("limit")
-	offset := c.Query("offset")
 	myUserModel := c.MustGet("my_user_model").(users.UserModel)
 	if myUserModel.ID == 0 {
 		c.AbortWithError(http.StatusUnauthorized, errors.New("{error : \"Require auth!\"}"))
 		return
 	}
-	articleUserModel := GetArticleUserModel(myUserModel)
-	articleModels, modelCount, err := articleUserModel.GetArticleFeed(limit, offset)
+	mode := c.Query("mode")
+	if mode == "" {
+		mode = FeedChronological
+	}
+	// Cursors are bound to their mode, the ranked feed refuses the cursors of the chronological one,
+	// backward ones included, and the other way around.
+	page, err := common.NewPagination(common.NewListing("feed", mode), c.Query("limit"), c.Query("offset"), c.Query("cursor"), common.DefaultPageLimit)
+	if err != nil {
+		c.JSON(common.CursorErrorStatus(err), common.NewError("cursor", err))
+		return
+	}
+	articleUserModel := articleLoaderFor(c).viewer
+	var articleModels []ArticleModel
+	var modelCount int
+	var pageInfo common.PageInfo
+	switch mode {
+	case FeedChronological:
+		articleModels, modelCount, pageInfo, err = articleUserModel.GetArticleFeed(c.Request.Context(), page)
+	case FeedRanked:
+		var rankings map[uint]*FeedRanking
+		articleModels, rankings, modelCount, pageInfo, err = articleUserModel.GetRankedFeed(c.Request.Context(), page)
+		if c.Query("debug") == "true" {
+			articleLoaderFor(c).rankings = rankings
+		}
+	default:
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("mode", errors.New("Invalid mode")))
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid param")))
 		return
 	}
 	serializer := ArticlesSerializer{c, articleModels}
-	c.JSON(http.StatusOK, gin.H{"articles": serializer.Response(), "articlesCount": modelCount})
+	c.JSON(http.StatusOK, gin.H{
+		"articles":      serializer.Response(),
+		"articlesCount": modelCount,
+		"nextCursor":    pageInfo.NextCursor,
+		"prevCursor":    pageInfo.PrevCursor,
+	})
+}
+
+// The article of the slug for a request. Database errors other than a missing article are logged with
+// the request, the handlers answer 404 either way.
+func findArticleBySlug(c *gin.Context, slug string) (ArticleModel, error) {
+	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
+	if err != nil && err != gorm.ErrRecordNotFound {
+		common.RequestLogger(c).Error().Err(err).Str("func", "articles.FindOneArticle").Str("slug", slug).Msg("db err")
+	}
+	return articleModel, err
 }
 
 func ArticleRetrieve(c *gin.Context) {
@@ -85,37 +202,99 @@ func ArticleRetrieve(c *gin.Context) {
 		ArticleFeed(c)
 		return
 	}
-	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
-	if err != nil {
+	articleModel, err := findArticleBySlug(c, slug)
+	if err != nil || !articleModel.VisibleTo(articleLoaderFor(c).viewer) {
 		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
 		return
 	}
 	serializer := ArticleSerializer{c, articleModel}
+	c.Header("ETag", common.VersionETag(articleModel.Version))
 	c.JSON(http.StatusOK, gin.H{"article": serializer.Response()})
 }
 
+// The most related articles first, five unless another limit up to twenty is asked for.
+// 	GET /api/articles/how-to-train-your-dragon/related?limit=10
+func ArticleRelated(c *gin.Context) {
+	viewer := articleLoaderFor(c).viewer
+	articleModel, err := findArticleBySlug(c, c.Param("slug"))
+	if err != nil || articleModel.ID == 0 || !articleModel.VisibleTo(viewer) {
+		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
+		return
+	}
+	limit := defaultRelatedLimit
+	if value := c.Query("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxRelatedLimit {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("limit", errors.New("Invalid limit")))
+			return
+		}
+	}
+	articleModels, err := findRelatedArticles(articleModel, viewer, limit)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid param")))
+		return
+	}
+	serializer := ArticlesSerializer{c, articleModels}
+	c.JSON(http.StatusOK, gin.H{"articles": serializer.Response(), "articlesCount": len(articleModels)})
+}
+
 func ArticleUpdate(c *gin.Context) {
 	slug := c.Param("slug")
-	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
+	articleModel, err := findArticleBySlug(c, slug)
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
 		return
 	}
 	articleModelValidator := NewArticleModelValidatorFillWith(articleModel)
 	if err := articleModelValidator.Bind(c); err != nil {
-		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		c.JSON(http.StatusUnprocessableEntity, bindError(err))
 		return
 	}
 
+	// Without If-Match the last writer wins like it always did.
+	var expected uint
+	if ifMatch := c.GetHeader("If-Match"); ifMatch != "" {
+		if !common.IfMatchVersion(ifMatch, articleModel.Version) {
+			versionConflict(c, "article", articleModel.Version)
+			return
+		}
+		expected = articleModel.Version
+	}
+
 	articleModelValidator.articleModel.ID = articleModel.ID
-	if err := articleModel.Update(articleModelValidator.articleModel); err != nil {
+	if err := articleModel.UpdateVersioned(articleModelValidator.articleModel, expected); err != nil {
+		if err == ErrStaleVersion {
+			current, _ := findArticleBySlug(c, slug)
+			versionConflict(c, "article", current.Version)
+			return
+		}
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
 	}
+	if articleModelValidator.verdict.Outcome == filters.Hold {
+		filters.NotifyHold("article", articleModel.ID, articleModelValidator.verdict)
+	}
+	err = saveMentions(ReactionOnArticle, articleModel.ID, articleModelValidator.mentioned, articleModel.Author.UserModelID,
+		articleModel.HiddenAt != nil, articleModel.notificationTarget())
+	if err != nil {
+		common.RequestLogger(c).Error().Err(err).Str("func", "articles.saveMentions").Msg("db err")
+	}
+	if err := indexArticleTerms(articleModelValidator.articleModel); err != nil {
+		common.RequestLogger(c).Error().Err(err).Str("func", "articles.indexArticleTerms").Msg("db err")
+	}
+	common.InvalidateCache("articles")
 	serializer := ArticleSerializer{c, articleModel}
+	c.Header("ETag", common.VersionETag(articleModel.Version))
 	c.JSON(http.StatusOK, gin.H{"article": serializer.Response()})
 }
 
+// Answer a write based on an outdated version with 412 and the version the client should reload.
+func versionConflict(c *gin.Context, key string, version uint) {
+	res := common.NewError(key, ErrStaleVersion)
+	res.Errors["version"] = version
+	c.Header("ETag", common.VersionETag(version))
+	c.JSON(http.StatusPreconditionFailed, res)
+}
+
 func ArticleDelete(c *gin.Context) {
 	slug := c.Param("slug")
 	err := DeleteArticleModel(&ArticleModel{Slug: slug})
@@ -123,57 +302,228 @@ func ArticleDelete(c *gin.Context) {
 		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
 		return
 	}
+	common.InvalidateCache("articles")
 	c.JSON(http.StatusOK, gin.H{"article": "Delete success"})
 }
 
 func ArticleFavorite(c *gin.Context) {
 	slug := c.Param("slug")
-	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
-	if err != nil {
+	articleModel, err := findArticleBySlug(c, slug)
+	if err != nil || !articleModel.VisibleTo(articleLoaderFor(c).viewer) {
 		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
 		return
 	}
 	myUserModel := c.MustGet("my_user_model").(users.UserModel)
-	err = articleModel.favoriteBy(GetArticleUserModel(myUserModel))
+	added, err := articleModel.favoriteBy(GetArticleUserModel(myUserModel))
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	if added {
+		err := users.Notify(users.NotificationFavorite, articleModel.Author.UserModelID, myUserModel.ID, articleModel.notificationTarget())
+		if err != nil {
+			common.RequestLogger(c).Error().Err(err).Str("func", "users.Notify").Msg("db err")
+		}
+	}
+	common.InvalidateCache("articles")
 	serializer := ArticleSerializer{c, articleModel}
 	c.JSON(http.StatusOK, gin.H{"article": serializer.Response()})
 }
 
 func ArticleUnfavorite(c *gin.Context) {
 	slug := c.Param("slug")
-	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
-	if err != nil {
+	articleModel, err := findArticleBySlug(c, slug)
+	if err != nil || !articleModel.VisibleTo(articleLoaderFor(c).viewer) {
 		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
 		return
 	}
 	myUserModel := c.MustGet("my_user_model").(users.UserModel)
 	err = articleModel.unFavoriteBy(GetArticleUserModel(myUserModel))
+	common.InvalidateCache("articles")
 	serializer := ArticleSerializer{c, articleModel}
 	c.JSON(http.StatusOK, gin.H{"article": serializer.Response()})
 }
 
-func ArticleCommentCreate(c *gin.Context) {
+func ArticleReact(c *gin.Context) {
+	articleReaction(c, addReaction)
+}
+
+func ArticleUnreact(c *gin.Context) {
+	articleReaction(c, removeReaction)
+}
+
+func articleReaction(c *gin.Context, change func(string, uint, ArticleUserModel, string) error) {
 	slug := c.Param("slug")
-	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
+	articleModel, err := findArticleBySlug(c, slug)
+	if err != nil || articleModel.ID == 0 || !articleModel.VisibleTo(articleLoaderFor(c).viewer) {
+		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	err = change(ReactionOnArticle, articleModel.ID, GetArticleUserModel(myUserModel), c.Param("reaction"))
 	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("reaction", err))
+		return
+	}
+	common.InvalidateCache("articles")
+	serializer := ArticleSerializer{c, articleModel}
+	c.JSON(http.StatusOK, gin.H{"article": serializer.Response()})
+}
+
+func ArticleCommentCreate(c *gin.Context) {
+	slug := c.Param("slug")
+	articleModel, err := findArticleBySlug(c, slug)
+	if err != nil || !articleModel.VisibleTo(articleLoaderFor(c).viewer) {
 		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid slug")))
 		return
 	}
 	commentModelValidator := NewCommentModelValidator()
 	if err := commentModelValidator.Bind(c); err != nil {
-		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		c.JSON(http.StatusUnprocessableEntity, bindError(err))
 		return
 	}
 	commentModelValidator.commentModel.Article = articleModel
+	if parentID := commentModelValidator.Comment.ParentID; parentID != 0 {
+		if err := commentModelValidator.commentModel.setParent(articleModel.ID, parentID); err != nil {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("parentId", err))
+			return
+		}
+	}
 
-	if err := SaveOne(&commentModelValidator.commentModel); err != nil {
+	held := commentModelValidator.verdict.Outcome == filters.Hold
+	err = saveWithEvent(&commentModelValidator.commentModel, common.CommentCreated,
+		[]uint{articleModel.Author.UserModelID, commentModelValidator.commentModel.Author.UserModelID}, func() interface{} {
+			if held {
+				return nil
+			}
+			return commentEvent(articleModel, commentModelValidator.commentModel)
+		})
+	if err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
 	}
+	if held {
+		filters.NotifyHold("comment", commentModelValidator.commentModel.ID, commentModelValidator.verdict)
+	} else {
+		err := users.Notify(users.NotificationComment, articleModel.Author.UserModelID,
+			commentModelValidator.commentModel.Author.UserModelID, articleModel.notificationTarget())
+		if err != nil {
+			common.RequestLogger(c).Error().Err(err).Str("func", "users.Notify").Msg("db err")
+		}
+		publishComment(articleModel, commentModelValidator.commentModel)
+	}
+	err = saveMentions(ReactionOnComment, commentModelValidator.commentModel.ID, commentModelValidator.mentioned,
+		commentModelValidator.commentModel.Author.UserModelID, held, commentModelValidator.commentModel.notificationTarget(articleModel))
+	if err != nil {
+		common.RequestLogger(c).Error().Err(err).Str("func", "articles.saveMentions").Msg("db err")
+	}
+	common.InvalidateCache("articles")
 	serializer := CommentSerializer{c, commentModelValidator.commentModel}
 	c.JSON(http.StatusCreated, gin.H{"comment": serializer.Response()})
 }
 
+func ArticleCommentUpdate(c *gin.Context) {
+	slug := c.Param("slug")
+	articleModel, err := findArticleBySlug(c, slug)
+	if err != nil || articleModel.ID == 0 {
+		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid slug")))
+		return
+	}
+	id64, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid id")))
+		return
+	}
+	commentModel, err := FindOneComment(&CommentModel{Model: gorm.Model{ID: uint(id64)}, ArticleID: articleModel.ID})
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid id")))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if commentModel.Author.UserModelID != myUserModel.ID {
+		c.JSON(http.StatusForbidden, common.NewError("comment", errors.New("Only the author can edit a comment")))
+		return
+	}
+
+	var expected uint
+	if ifMatch := c.GetHeader("If-Match"); ifMatch != "" {
+		if !common.IfMatchVersion(ifMatch, commentModel.Version) {
+			versionConflict(c, "comment", commentModel.Version)
+			return
+		}
+		expected = commentModel.Version
+	}
+
+	commentModelValidator := NewCommentModelValidatorFillWith(commentModel)
+	if err := commentModelValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, bindError(err))
+		return
+	}
+	editedAt := time.Now()
+	update := CommentModel{
+		Body:     commentModelValidator.commentModel.Body,
+		EditedAt: &editedAt,
+		HiddenAt: commentModelValidator.commentModel.HiddenAt,
+	}
+	if err := commentModel.UpdateVersioned(update, expected); err != nil {
+		if err == ErrStaleVersion {
+			current, _ := FindOneComment(&CommentModel{Model: gorm.Model{ID: commentModel.ID}})
+			versionConflict(c, "comment", current.Version)
+			return
+		}
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	if commentModelValidator.verdict.Outcome == filters.Hold {
+		filters.NotifyHold("comment", commentModel.ID, commentModelValidator.verdict)
+	}
+	err = saveMentions(ReactionOnComment, commentModel.ID, commentModelValidator.mentioned, myUserModel.ID,
+		commentModel.HiddenAt != nil, commentModel.notificationTarget(articleModel))
+	if err != nil {
+		common.RequestLogger(c).Error().Err(err).Str("func", "articles.saveMentions").Msg("db err")
+	}
+	common.InvalidateCache("articles")
+	serializer := CommentSerializer{c, commentModel}
+	c.Header("ETag", common.VersionETag(commentModel.Version))
+	c.JSON(http.StatusOK, gin.H{"comment": serializer.Response()})
+}
+
+func ArticleCommentReact(c *gin.Context) {
+	commentReaction(c, addReaction)
+}
+
+func ArticleCommentUnreact(c *gin.Context) {
+	commentReaction(c, removeReaction)
+}
+
+func commentReaction(c *gin.Context, change func(string, uint, ArticleUserModel, string) error) {
+	slug := c.Param("slug")
+	articleModel, err := findArticleBySlug(c, slug)
+	if err != nil || articleModel.ID == 0 || !articleModel.VisibleTo(articleLoaderFor(c).viewer) {
+		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid slug")))
+		return
+	}
+	id64, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid id")))
+		return
+	}
+	commentModel, err := FindOneComment(&CommentModel{Model: gorm.Model{ID: uint(id64)}, ArticleID: articleModel.ID})
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid id")))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	err = change(ReactionOnComment, commentModel.ID, GetArticleUserModel(myUserModel), c.Param("reaction"))
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("reaction", err))
+		return
+	}
+	common.InvalidateCache("articles")
+	serializer := CommentSerializer{c, commentModel}
+	c.JSON(http.StatusOK, gin.H{"comment": serializer.Response()})
+}
+
 func ArticleCommentDelete(c *gin.Context) {
 	id64, err := strconv.ParseUint(c.Param("id"), 10, 32)
 	id := uint(id64)
@@ -186,30 +536,162 @@ func ArticleCommentDelete(c *gin.Context) {
 		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid id")))
 		return
 	}
+	common.InvalidateCache("articles")
 	c.JSON(http.StatusOK, gin.H{"comment": "Delete success"})
 }
 
 func ArticleCommentList(c *gin.Context) {
 	slug := c.Param("slug")
-	articleModel, err := FindOneArticle(&ArticleModel{Slug: slug})
-	if err != nil {
+	articleModel, err := findArticleBySlug(c, slug)
+	viewer := articleLoaderFor(c).viewer
+	if err != nil || !articleModel.VisibleTo(viewer) {
 		c.JSON(http.StatusNotFound, common.NewError("comments", errors.New("Invalid slug")))
 		return
 	}
-	err = articleModel.getComments()
+	// Comments used to come back all at once, so they are only paginated when the client asks to.
+	page, err := common.NewPagination(common.NewListing("comments", slug, c.Query("mode")), c.Query("limit"), c.Query("offset"), c.Query("cursor"), 0)
 	if err != nil {
+		c.JSON(common.CursorErrorStatus(err), common.NewError("cursor", err))
+		return
+	}
+	threaded := c.Query("mode") == "threaded"
+	commentCount, pageInfo, err := articleModel.getComments(c.Request.Context(), viewer, page, threaded)
+	if err != nil {
+		common.RequestLogger(c).Error().Err(err).Str("func", "articles.getComments").Msg("db err")
 		c.JSON(http.StatusNotFound, common.NewError("comments", errors.New("Database error")))
 		return
 	}
 	serializer := CommentsSerializer{c, articleModel.Comments}
-	c.JSON(http.StatusOK, gin.H{"comments": serializer.Response()})
+	c.JSON(http.StatusOK, gin.H{
+		"comments":      serializer.Response(),
+		"commentsCount": commentCount,
+		"nextCursor":    pageInfo.NextCursor,
+		"prevCursor":    pageInfo.PrevCursor,
+	})
 }
+// Tags are the plain names like they always were, tagStats has the same tags with their counts.
+// 	GET /api/tags?sort=trending&limit=10
 func TagList(c *gin.Context) {
-	tagModels, err := getAllTags()
+	limit := 0
+	if value := c.Query("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("limit", errors.New("Invalid limit")))
+			return
+		}
+	}
+	stats, err := findTagStats(c.Query("sort"), limit)
+	if err == ErrInvalidSort {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("sort", err))
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid param")))
 		return
 	}
+	tagModels := make([]TagModel, len(stats))
+	for i, stat := range stats {
+		tagModels[i] = stat.TagModel
+	}
 	serializer := TagsSerializer{c, tagModels}
-	c.JSON(http.StatusOK, gin.H{"tags": serializer.Response()})
+	statsSerializer := TagStatsSerializer{c, stats}
+	c.JSON(http.StatusOK, gin.H{"tags": serializer.Response(), "tagStats": statsSerializer.Response()})
+}
+
+// Aliases answer with the tag they stand for.
+func TagRetrieve(c *gin.Context) {
+	tagModel, err := FindOneTag(resolveTag(common.GetDB(), c.Param("tag")))
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("tag", ErrTagNotFound))
+		return
+	}
+	serializer := TagDetailSerializer{c, tagModel}
+	c.JSON(http.StatusOK, gin.H{"tag": serializer.Response()})
+}
+
+func TagFollow(c *gin.Context) {
+	tagFollowing(c, TagModel.followedBy)
+}
+
+func TagUnfollow(c *gin.Context) {
+	tagFollowing(c, TagModel.unFollowedBy)
+}
+
+func tagFollowing(c *gin.Context, change func(TagModel, ArticleUserModel) error) {
+	tagModel, err := FindOneTag(resolveTag(common.GetDB(), c.Param("tag")))
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("tag", ErrTagNotFound))
+		return
+	}
+	if err := change(tagModel, articleLoaderFor(c).viewer); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	common.InvalidateCache("articles")
+	serializer := TagDetailSerializer{c, tagModel}
+	c.JSON(http.StatusOK, gin.H{"tag": serializer.Response()})
+}
+
+func TagRename(c *gin.Context) {
+	tagNameValidator := NewTagNameValidator()
+	if err := tagNameValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	tagModel, err := renameTag(c.Param("tag"), tagNameValidator.Tag.Name)
+	tagChanged(c, tagModel, err)
+}
+
+// The tag in the path goes away, its articles and aliases move to the tag in the body.
+func TagMerge(c *gin.Context) {
+	tagNameValidator := NewTagNameValidator()
+	if err := tagNameValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	tagModel, err := mergeTags(c.Param("tag"), tagNameValidator.Tag.Name)
+	tagChanged(c, tagModel, err)
+}
+
+func TagAliasCreate(c *gin.Context) {
+	tagAliasValidator := NewTagAliasValidator()
+	if err := tagAliasValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	tagModel, err := addTagAlias(c.Param("tag"), tagAliasValidator.Alias.Name)
+	tagChanged(c, tagModel, err)
+}
+
+func TagAliasDelete(c *gin.Context) {
+	tagModel, err := removeTagAlias(c.Param("tag"), c.Param("alias"))
+	tagChanged(c, tagModel, err)
+}
+
+func tagChanged(c *gin.Context, tagModel TagModel, err error) {
+	switch err {
+	case nil:
+	case ErrTagNotFound, ErrAliasNotFound:
+		c.JSON(http.StatusNotFound, common.NewError("tag", err))
+		return
+	case ErrInvalidTag, ErrTagExists:
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("tag", err))
+		return
+	default:
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	common.InvalidateCache("articles")
+	serializer := TagDetailSerializer{c, tagModel}
+	c.JSON(http.StatusOK, gin.H{"tag": serializer.Response()})
+}
+
+func TagOrphansDelete(c *gin.Context) {
+	removed, err := RemoveOrphanTags()
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	common.InvalidateCache("articles")
+	c.JSON(http.StatusOK, gin.H{"removedCount": removed})
 }
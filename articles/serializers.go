@@ -1,9 +1,13 @@
 package articles
 
 import (
+	"github.com/gin-gonic/gin"
 	"github.com/gosimple/slug"
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
 	"github.com/gothinkster/golang-gin-realworld-example-app/users"
-	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"math"
 )
 
 type TagSerializer struct {
@@ -29,13 +33,68 @@ func (s *TagsSerializer) Response() []string {
 	return response
 }
 
+// A tag with its stats in the tag list.
+type TagStatsSerializer struct {
+	C     *gin.Context
+	Stats []TagStat
+}
+
+type TagStatResponse struct {
+	Tag           string  `json:"tag"`
+	ArticlesCount int     `json:"articlesCount"`
+	TrendingScore float64 `json:"trendingScore"`
+}
+
+func (s *TagStatsSerializer) Response() []TagStatResponse {
+	response := []TagStatResponse{}
+	for _, stat := range s.Stats {
+		response = append(response, TagStatResponse{
+			Tag:           stat.Tag,
+			ArticlesCount: stat.ArticlesCount,
+			TrendingScore: roundScore(stat.TrendingScore),
+		})
+	}
+	return response
+}
+
+// Scores are only compared with each other, three decimals are plenty.
+func roundScore(score float64) float64 {
+	return math.Round(score*1000) / 1000
+}
+
+// The page of a tag, also returned by the tag management endpoints.
+type TagDetailSerializer struct {
+	C *gin.Context
+	TagModel
+}
+
+type TagDetailResponse struct {
+	Tag            string   `json:"tag"`
+	Aliases        []string `json:"aliases"`
+	ArticlesCount  int      `json:"articlesCount"`
+	TrendingScore  float64  `json:"trendingScore"`
+	FollowersCount int      `json:"followersCount"`
+	Following      bool     `json:"following"`
+}
+
+func (s *TagDetailSerializer) Response() TagDetailResponse {
+	return TagDetailResponse{
+		Tag:            s.TagModel.Tag,
+		Aliases:        s.TagModel.Aliases(),
+		ArticlesCount:  s.TagModel.ArticlesCount(),
+		TrendingScore:  roundScore(s.TagModel.TrendingScore()),
+		FollowersCount: s.TagModel.FollowersCount(),
+		Following:      s.TagModel.isFollowedBy(articleLoaderFor(s.C).viewer),
+	}
+}
+
 type ArticleUserSerializer struct {
 	C *gin.Context
 	ArticleUserModel
 }
 
 func (s *ArticleUserSerializer) Response() users.ProfileResponse {
-	response := users.ProfileSerializer{s.C, s.ArticleUserModel.UserModel}
+	response := users.ProfileSerializer{C: s.C, UserModel: s.ArticleUserModel.UserModel}
 	return response.Response()
 }
 
@@ -45,17 +104,26 @@ type ArticleSerializer struct {
 }
 
 type ArticleResponse struct {
-	ID             uint                  `json:"-"`
-	Title          string                `json:"title"`
-	Slug           string                `json:"slug"`
-	Description    string                `json:"description"`
-	Body           string                `json:"body"`
-	CreatedAt      string                `json:"createdAt"`
-	UpdatedAt      string                `json:"updatedAt"`
-	Author         users.ProfileResponse `json:"author"`
-	Tags           []string              `json:"tagList"`
-	Favorite       bool                  `json:"favorited"`
-	FavoritesCount uint                  `json:"favoritesCount"`
+	ID             uint                    `json:"-"`
+	Title          string                  `json:"title"`
+	Slug           string                  `json:"slug"`
+	Description    string                  `json:"description"`
+	Body           string                  `json:"body"`
+	BodyHTML       string                  `json:"bodyHtml"`
+	ReadingTime    int                     `json:"readingTimeMinutes"`
+	TOC            []TocEntry              `json:"toc"`
+	CreatedAt      string                  `json:"createdAt"`
+	UpdatedAt      string                  `json:"updatedAt"`
+	Author         users.ProfileResponse   `json:"author"`
+	Tags           []string                `json:"tagList"`
+	Favorite       bool                    `json:"favorited"`
+	FavoritesCount uint                    `json:"favoritesCount"`
+	Version        uint                    `json:"version"`
+	Reactions      map[string]uint         `json:"reactions"`
+	MyReactions    []string                `json:"myReactions"`
+	Hidden         bool                    `json:"hidden"`
+	Mentions       []users.ProfileResponse `json:"mentions"`
+	Ranking        *FeedRanking            `json:"ranking,omitempty"`
 }
 
 type ArticlesSerializer struct {
@@ -64,7 +132,8 @@ type ArticlesSerializer struct {
 }
 
 func (s *ArticleSerializer) Response() ArticleResponse {
-	myUserModel := s.C.MustGet("my_user_model").(users.UserModel)
+	loader := articleLoaderFor(s.C)
+	loader.prime(s.C, []ArticleModel{s.ArticleModel})
 	authorSerializer := ArticleUserSerializer{s.C, s.Author}
 	response := ArticleResponse{
 		ID:          s.ID,
@@ -76,9 +145,17 @@ func (s *ArticleSerializer) Response() ArticleResponse {
 		//UpdatedAt:      s.UpdatedAt.UTC().Format(time.RFC3339Nano),
 		UpdatedAt:      s.UpdatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
 		Author:         authorSerializer.Response(),
-		Favorite:       s.isFavoriteBy(GetArticleUserModel(myUserModel)),
-		FavoritesCount: s.favoritesCount(),
+		Favorite:       loader.favorited[s.ID],
+		FavoritesCount: loader.favoritesCount[s.ID],
+		Version:        s.Version,
+		Hidden:         s.HiddenAt != nil,
+		ReadingTime:    readingTimeMinutes(s.Body),
+		Ranking:        loader.rankings[s.ID],
 	}
+	rendered := renderMarkdown(s.Body)
+	response.BodyHTML, response.TOC = rendered.HTML, rendered.TOC
+	response.Reactions, response.MyReactions = loader.reactionsOf(ReactionOnArticle, s.ID)
+	response.Mentions = loader.mentionsOf(s.C, ReactionOnArticle, s.ID)
 	response.Tags = make([]string, 0)
 	for _, tag := range s.Tags {
 		serializer := TagSerializer{s.C, tag}
@@ -87,7 +164,12 @@ func (s *ArticleSerializer) Response() ArticleResponse {
 	return response
 }
 
+// Serializing a page goes in two traced phases: articles.prime loads what the page needs, articles.render
+// renders the markdown and builds the responses.
 func (s *ArticlesSerializer) Response() []ArticleResponse {
+	articleLoaderFor(s.C).prime(s.C, s.Articles)
+	_, span := common.StartSpan(s.C.Request.Context(), "articles.render", trace.WithAttributes(attribute.Int("articles", len(s.Articles))))
+	defer span.End()
 	response := []ArticleResponse{}
 	for _, article := range s.Articles {
 		serializer := ArticleSerializer{s.C, article}
@@ -107,26 +189,56 @@ type CommentsSerializer struct {
 }
 
 type CommentResponse struct {
-	ID        uint                  `json:"id"`
-	Body      string                `json:"body"`
-	CreatedAt string                `json:"createdAt"`
-	UpdatedAt string                `json:"updatedAt"`
-	Author    users.ProfileResponse `json:"author"`
+	ID          uint                    `json:"id"`
+	Body        string                  `json:"body"`
+	BodyHTML    string                  `json:"bodyHtml"`
+	CreatedAt   string                  `json:"createdAt"`
+	UpdatedAt   string                  `json:"updatedAt"`
+	Author      users.ProfileResponse   `json:"author"`
+	Version     uint                    `json:"version"`
+	ParentID    *uint                   `json:"parentId"`
+	Edited      bool                    `json:"edited"`
+	EditedAt    *string                 `json:"editedAt"`
+	Reactions   map[string]uint         `json:"reactions"`
+	MyReactions []string                `json:"myReactions"`
+	Hidden      bool                    `json:"hidden"`
+	Mentions    []users.ProfileResponse `json:"mentions"`
+	Replies     []CommentResponse       `json:"replies,omitempty"`
 }
 
 func (s *CommentSerializer) Response() CommentResponse {
+	loader := articleLoaderFor(s.C)
+	loader.primeComments(s.C, []CommentModel{s.CommentModel})
 	authorSerializer := ArticleUserSerializer{s.C, s.Author}
 	response := CommentResponse{
 		ID:        s.ID,
 		Body:      s.Body,
+		BodyHTML:  renderMarkdown(s.Body).HTML,
 		CreatedAt: s.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
 		UpdatedAt: s.UpdatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
 		Author:    authorSerializer.Response(),
+		Version:   s.Version,
+		ParentID:  s.ParentID,
+		Edited:    s.EditedAt != nil,
+		Hidden:    s.HiddenAt != nil,
+	}
+	response.Reactions, response.MyReactions = loader.reactionsOf(ReactionOnComment, s.ID)
+	response.Mentions = loader.mentionsOf(s.C, ReactionOnComment, s.ID)
+	if s.EditedAt != nil {
+		editedAt := s.EditedAt.UTC().Format("2006-01-02T15:04:05.999Z")
+		response.EditedAt = &editedAt
+	}
+	for _, reply := range s.Replies {
+		serializer := CommentSerializer{s.C, reply}
+		response.Replies = append(response.Replies, serializer.Response())
 	}
 	return response
 }
 
 func (s *CommentsSerializer) Response() []CommentResponse {
+	articleLoaderFor(s.C).primeComments(s.C, s.Comments)
+	_, span := common.StartSpan(s.C.Request.Context(), "articles.renderComments", trace.WithAttributes(attribute.Int("comments", len(s.Comments))))
+	defer span.End()
 	response := []CommentResponse{}
 	for _, comment := range s.Comments {
 		serializer := CommentSerializer{s.C, comment}
@@ -0,0 +1,226 @@
+package articles
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+	"golang.org/x/net/websocket"
+)
+
+// How often an idle stream sends something, so that proxies keep the connection open.
+var StreamHeartbeat = time.Duration(common.GetEnvInt("STREAM_HEARTBEAT_SECONDS", 25)) * time.Second
+
+// The types of the events pushed to the streams, notifications come from the users package.
+const (
+	EventArticle   = "article"
+	EventComment   = "comment"
+	EventHeartbeat = "heartbeat"
+)
+
+// An article as pushed to the streams and handed to the webhooks.
+type ArticleEvent struct {
+	Slug        string   `json:"slug"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tagList"`
+	Author      string   `json:"author"`
+	CreatedAt   string   `json:"createdAt"`
+}
+
+// A new comment as pushed to the streams and handed to the webhooks.
+type CommentEvent struct {
+	ID        uint   `json:"id"`
+	Article   string `json:"article"`
+	ParentID  *uint  `json:"parentId"`
+	Body      string `json:"body"`
+	BodyHTML  string `json:"bodyHtml"`
+	Author    string `json:"author"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// A favorite as handed to the webhooks.
+type FavoriteEvent struct {
+	Article string `json:"article"`
+	Title   string `json:"title"`
+	User    string `json:"user"`
+}
+
+func authorTopic(userModelID uint) string {
+	return fmt.Sprintf("author:%v", userModelID)
+}
+
+func articleTopic(articleID uint) string {
+	return fmt.Sprintf("article:%v", articleID)
+}
+
+func articleEvent(article ArticleModel) ArticleEvent {
+	event := ArticleEvent{
+		Slug:        article.Slug,
+		Title:       article.Title,
+		Description: article.Description,
+		Tags:        []string{},
+		Author:      article.Author.UserModel.Username,
+		CreatedAt:   article.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+	}
+	for _, tag := range article.Tags {
+		event.Tags = append(event.Tags, tag.Tag)
+	}
+	return event
+}
+
+// Tell the followers of the author about an article that is not held for review.
+func publishArticle(article ArticleModel) {
+	common.PublishEvent(authorTopic(article.Author.UserModelID), EventArticle, articleEvent(article))
+}
+
+func commentEvent(article ArticleModel, comment CommentModel) CommentEvent {
+	return CommentEvent{
+		ID:        comment.ID,
+		Article:   article.Slug,
+		ParentID:  comment.ParentID,
+		Body:      comment.Body,
+		BodyHTML:  renderMarkdown(comment.Body).HTML,
+		Author:    comment.Author.UserModel.Username,
+		CreatedAt: comment.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+	}
+}
+
+// Tell the readers watching the article about a comment that is not held for review.
+func publishComment(article ArticleModel, comment CommentModel) {
+	common.PublishEvent(articleTopic(article.ID), EventComment, commentEvent(article, comment))
+}
+
+func StreamRegister(router *gin.RouterGroup) {
+	router.GET("", Stream)
+}
+
+// Push the notifications of the user, the new articles of the authors the user follows and the new
+// comments of the articles given with article=slug (repeat it to watch more) as they happen.
+// Server-Sent Events by default, WebSocket messages of JSON encoded events for an upgrade request.
+// Either way a client reconnecting with the id of the last event it got, in the Last-Event-ID header
+// or the lastEventId query, first gets the events it missed if they are still remembered.
+// 	GET /api/stream?article=how-to-train-your-dragon&access_token=...
+func Stream(c *gin.Context) {
+	hub := common.GetHub()
+	if hub == nil {
+		c.JSON(http.StatusServiceUnavailable, common.NewError("stream", errors.New("Streaming is disabled")))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	topics := []string{users.UserTopic(myUserModel.ID)}
+	for _, following := range myUserModel.GetFollowings() {
+		topics = append(topics, authorTopic(following.ID))
+	}
+	viewer := articleLoaderFor(c).viewer
+	for _, slug := range c.QueryArray("article") {
+		articleModel, err := findArticleBySlug(c, slug)
+		if err != nil || articleModel.ID == 0 || !articleModel.VisibleTo(viewer) {
+			c.JSON(http.StatusNotFound, common.NewError("article", errors.New("Invalid slug")))
+			return
+		}
+		topics = append(topics, articleTopic(articleModel.ID))
+	}
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("lastEventId")
+	}
+	var lastID int64
+	if lastEventID != "" {
+		var err error
+		if lastID, err = strconv.ParseInt(lastEventID, 10, 64); err != nil {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("lastEventId", errors.New("Invalid event id")))
+			return
+		}
+	}
+
+	subscription, missed := hub.Subscribe(topics, lastID)
+	defer subscription.Close()
+	if strings.EqualFold(c.GetHeader("Upgrade"), "websocket") {
+		streamWebSocket(c, subscription, missed)
+	} else {
+		streamEvents(c, subscription, missed)
+	}
+}
+
+func streamEvents(c *gin.Context, subscription *common.Subscription, missed []common.Event) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	send := func(event common.Event) {
+		c.Render(-1, sse.Event{Id: strconv.FormatInt(event.ID, 10), Event: event.Type, Data: event.Data})
+		c.Writer.Flush()
+	}
+	for _, event := range missed {
+		send(event)
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(StreamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, ok := <-subscription.Events:
+			if !ok {
+				return
+			}
+			send(event)
+		case <-heartbeat.C:
+			io.WriteString(c.Writer, ": "+EventHeartbeat+"\n\n")
+			c.Writer.Flush()
+		case <-c.Request.Context().Done():
+			return
+		case <-subscription.Done():
+			return
+		}
+	}
+}
+
+func streamWebSocket(c *gin.Context, subscription *common.Subscription, missed []common.Event) {
+	// Clients authenticate with a token, not with cookies, so any origin may connect.
+	server := websocket.Server{Handler: func(conn *websocket.Conn) {
+		closed := make(chan struct{})
+		go func() {
+			// Nothing is expected from the client, reading only notices when it goes away.
+			io.Copy(ioutil.Discard, conn)
+			close(closed)
+		}()
+		for _, event := range missed {
+			if websocket.JSON.Send(conn, event) != nil {
+				return
+			}
+		}
+		heartbeat := time.NewTicker(StreamHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			var err error
+			select {
+			case event, ok := <-subscription.Events:
+				if !ok {
+					return
+				}
+				err = websocket.JSON.Send(conn, event)
+			case <-heartbeat.C:
+				err = websocket.JSON.Send(conn, common.Event{Type: EventHeartbeat})
+			case <-closed:
+				return
+			case <-subscription.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}}
+	server.ServeHTTP(c.Writer, c.Request)
+}
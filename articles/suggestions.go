@@ -0,0 +1,140 @@
+package articles
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+)
+
+// The types of the reasons the articles give to follow someone.
+const (
+	SuggestionFavoritedAuthor = "favorited_author"
+	SuggestionTagAuthor       = "tag_author"
+)
+
+// What a suggestion of each source weighs, favorites and articles of an author only count this many times.
+const (
+	suggestionFavoritedAuthorWeight = 0.75
+	suggestionTagAuthorWeight       = 0.5
+	suggestionMaxRepeats            = 3
+)
+
+// The tags named in the reason of a tag author suggestion.
+const suggestionReasonTags = 3
+
+// Authors of the articles the viewer favorited, plug it in with users.SetSuggestionSources.
+func FavoritedAuthorSuggestions(viewer users.UserModel, limit int) ([]users.Suggestion, error) {
+	db := common.GetDB()
+	reader := GetArticleUserModel(viewer)
+	query := db.Model(&FavoriteModel{}).Select("article_user_models.user_model_id, count(*)").
+		Joins("JOIN article_models ON article_models.id = favorite_models.favorite_id AND article_models.deleted_at IS NULL").
+		Joins("JOIN article_user_models ON article_user_models.id = article_models.author_id").
+		Where("favorite_models.favorite_by_id = ? AND article_models.hidden_at IS NULL", reader.ID).
+		Group("article_user_models.user_model_id").Order("count(*) desc, article_user_models.user_model_id").Limit(limit)
+	favorited := map[uint]float64{}
+	if err := scanCounts(query, favorited); err != nil {
+		return nil, err
+	}
+	var suggestions []users.Suggestion
+	for id, count := range favorited {
+		detail := "You favorited one of their articles"
+		if count > 1 {
+			detail = fmt.Sprintf("You favorited %v of their articles", count)
+		}
+		suggestions = append(suggestions, users.Suggestion{
+			UserID: id,
+			Score:  suggestionFavoritedAuthorWeight * math.Min(count, suggestionMaxRepeats),
+			Reason: users.SuggestionReason{Type: SuggestionFavoritedAuthor, Detail: detail},
+		})
+	}
+	return suggestions, nil
+}
+
+// Authors writing in the tags the viewer reads, that is the tags the viewer follows and the tags of the
+// articles the viewer favorited. Plug it in with users.SetSuggestionSources.
+func TagAuthorSuggestions(viewer users.UserModel, limit int) ([]users.Suggestion, error) {
+	db := common.GetDB()
+	reader := GetArticleUserModel(viewer)
+	var tags []uint
+	if err := db.Model(&TagFollowModel{}).Where("followed_by_id = ?", reader.ID).Pluck("tag_id", &tags).Error; err != nil {
+		return nil, err
+	}
+	var favoritedTags []uint
+	err := db.Table("article_tags").Where("article_model_id IN ?",
+		db.Model(&FavoriteModel{}).Select("favorite_id").Where("favorite_by_id = ?", reader.ID).SubQuery()).
+		Pluck("DISTINCT tag_model_id", &favoritedTags).Error
+	if err != nil {
+		return nil, err
+	}
+	tags = append(tags, favoritedTags...)
+	if len(tags) == 0 {
+		return nil, nil
+	}
+
+	rows, err := db.Table("article_tags").
+		Select("article_user_models.user_model_id, tag_models.tag, count(*)").
+		Joins("JOIN article_models ON article_models.id = article_tags.article_model_id AND article_models.deleted_at IS NULL").
+		Joins("JOIN article_user_models ON article_user_models.id = article_models.author_id").
+		Joins("JOIN tag_models ON tag_models.id = article_tags.tag_model_id").
+		Where("article_tags.tag_model_id IN (?) AND article_models.hidden_at IS NULL", tags).
+		Group("article_user_models.user_model_id, tag_models.tag").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	articles := map[uint]float64{}
+	tagCounts := map[uint]map[string]float64{}
+	for rows.Next() {
+		var id uint
+		var tag string
+		var count float64
+		if err := rows.Scan(&id, &tag, &count); err != nil {
+			return nil, err
+		}
+		articles[id] += count
+		if tagCounts[id] == nil {
+			tagCounts[id] = map[string]float64{}
+		}
+		tagCounts[id][tag] = count
+	}
+
+	authors := make([]uint, 0, len(articles))
+	for id := range articles {
+		authors = append(authors, id)
+	}
+	sort.Slice(authors, func(i, j int) bool {
+		if articles[authors[i]] != articles[authors[j]] {
+			return articles[authors[i]] > articles[authors[j]]
+		}
+		return authors[i] < authors[j]
+	})
+	if len(authors) > limit {
+		authors = authors[:limit]
+	}
+	var suggestions []users.Suggestion
+	for _, id := range authors {
+		names := make([]string, 0, len(tagCounts[id]))
+		for tag := range tagCounts[id] {
+			names = append(names, tag)
+		}
+		sort.Slice(names, func(i, j int) bool {
+			if tagCounts[id][names[i]] != tagCounts[id][names[j]] {
+				return tagCounts[id][names[i]] > tagCounts[id][names[j]]
+			}
+			return names[i] < names[j]
+		})
+		if len(names) > suggestionReasonTags {
+			names = names[:suggestionReasonTags]
+		}
+		suggestions = append(suggestions, users.Suggestion{
+			UserID: id,
+			Score:  suggestionTagAuthorWeight * math.Min(articles[id], suggestionMaxRepeats),
+			Reason: users.SuggestionReason{Type: SuggestionTagAuthor, Detail: "Writes about " + strings.Join(names, ", ")},
+		})
+	}
+	return suggestions, nil
+}
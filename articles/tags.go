@@ -0,0 +1,459 @@
+package articles
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Another name of a tag. Articles tagged or looked up with the alias get the tag instead, so "golang"
+// can stand for "go". Renaming and merging tags leave aliases behind for the names that went away.
+type TagAliasModel struct {
+	gorm.Model
+	Alias string `gorm:"unique_index"`
+	Tag   TagModel
+	TagID uint `gorm:"index"`
+}
+
+// A reader following a tag gets the articles with it in the feed.
+type TagFollowModel struct {
+	gorm.Model
+	Tag          TagModel
+	TagID        uint `gorm:"index"`
+	FollowedBy   ArticleUserModel
+	FollowedByID uint `gorm:"index"`
+}
+
+var ErrInvalidTag = errors.New("Invalid tag")
+var ErrTagNotFound = errors.New("Tag not found")
+var ErrTagExists = errors.New("Tag or alias already exists")
+var ErrAliasNotFound = errors.New("Alias not found")
+
+// The form tags are stored and compared in: unicode compatibility normalized, lower cased,
+// with the words joined by dashes. "  Go  Lang" and "go-lang" are the same tag.
+// 	NormalizeTag(" Machine Learning ") == "machine-learning"
+func NormalizeTag(tag string) string {
+	return strings.Join(strings.Fields(strings.ToLower(norm.NFKC.String(tag))), "-")
+}
+
+// The name of the tag a name stands for, the normalized name itself when it is no alias.
+func resolveTag(db *gorm.DB, name string) string {
+	name = NormalizeTag(name)
+	var tagModel TagModel
+	db.Where("id in ?", db.Model(&TagAliasModel{}).Select("tag_id").Where("alias = ?", name).SubQuery()).First(&tagModel)
+	if tagModel.ID != 0 {
+		return tagModel.Tag
+	}
+	return name
+}
+
+// A sub query selecting the ids of the articles with the tag or with the tag the name is an alias of.
+func articlesTagged(tx *gorm.DB, name string) interface{} {
+	name = NormalizeTag(name)
+	return tx.Table("article_tags").
+		Select("article_tags.article_model_id").
+		Joins("JOIN tag_models ON tag_models.id = article_tags.tag_model_id").
+		Where("tag_models.deleted_at IS NULL").
+		Where("tag_models.tag = ? OR tag_models.id in ?", name,
+			tx.Model(&TagAliasModel{}).Select("tag_id").Where("alias = ?", name).SubQuery()).SubQuery()
+}
+
+func FindOneTag(name string) (TagModel, error) {
+	db := common.GetDB()
+	var model TagModel
+	err := db.Where("tag = ?", NormalizeTag(name)).First(&model).Error
+	if gorm.IsRecordNotFoundError(err) {
+		err = ErrTagNotFound
+	}
+	return model, err
+}
+
+// The tag a name stands for, aliases included.
+// 	tagModel, err := articles.ResolveTag("golang")
+func ResolveTag(name string) (TagModel, error) {
+	return FindOneTag(resolveTag(common.GetDB(), name))
+}
+
+// The aliases of the tag, sorted.
+func (model TagModel) Aliases() []string {
+	db := common.GetDB()
+	aliases := []string{}
+	db.Model(&TagAliasModel{}).Where("tag_id = ?", model.ID).Order("alias").Pluck("alias", &aliases)
+	return aliases
+}
+
+// How many articles have the tag.
+func (model TagModel) ArticlesCount() int {
+	db := common.GetDB()
+	var count int
+	db.Table("article_tags").
+		Joins("JOIN article_models ON article_models.id = article_tags.article_model_id").
+		Where("article_tags.tag_model_id = ? AND article_models.deleted_at IS NULL", model.ID).Count(&count)
+	return count
+}
+
+func (model TagModel) followedBy(user ArticleUserModel) error {
+	db := common.GetDB()
+	var follow TagFollowModel
+	err := db.FirstOrCreate(&follow, &TagFollowModel{
+		TagID:        model.ID,
+		FollowedByID: user.ID,
+	}).Error
+	return err
+}
+
+func (model TagModel) unFollowedBy(user ArticleUserModel) error {
+	db := common.GetDB()
+	err := db.Where(TagFollowModel{
+		TagID:        model.ID,
+		FollowedByID: user.ID,
+	}).Delete(TagFollowModel{}).Error
+	return err
+}
+
+func (model TagModel) isFollowedBy(user ArticleUserModel) bool {
+	if user.ID == 0 {
+		return false
+	}
+	db := common.GetDB()
+	var count int
+	db.Model(&TagFollowModel{}).Where("tag_id = ? AND followed_by_id = ?", model.ID, user.ID).Count(&count)
+	return count > 0
+}
+
+func (model TagModel) FollowersCount() int {
+	db := common.GetDB()
+	var count int
+	db.Model(&TagFollowModel{}).Where("tag_id = ?", model.ID).Count(&count)
+	return count
+}
+
+// How long it takes for an article or a favorite to count half as much in the trending score.
+var TagTrendingHalfLife = time.Duration(common.GetEnvInt("TAG_TRENDING_HALF_LIFE_HOURS", 48)) * time.Hour
+
+// Activity older than this many half lives adds next to nothing to the score and is not loaded.
+const tagTrendingHalfLives = 10
+
+const (
+	TagSortPopular  = "popular"
+	TagSortTrending = "trending"
+)
+
+var ErrInvalidSort = errors.New("Invalid sort")
+
+// A tag with the number of visible articles it has and its trending score.
+type TagStat struct {
+	TagModel
+	ArticlesCount int
+	TrendingScore float64
+}
+
+// The tags with their stats, sorted by article count (popular), trending score (trending)
+// or in the order they were created (empty sort). A limit of zero lists them all.
+// 	stats, err := findTagStats(TagSortTrending, 10)
+func findTagStats(sortBy string, limit int) ([]TagStat, error) {
+	if sortBy != "" && sortBy != TagSortPopular && sortBy != TagSortTrending {
+		return nil, ErrInvalidSort
+	}
+	db := common.GetDB()
+	rows, err := db.Table("tag_models").
+		Select("tag_models.id, tag_models.tag, count(article_models.id)").
+		Joins("LEFT JOIN article_tags ON article_tags.tag_model_id = tag_models.id").
+		Joins("LEFT JOIN article_models ON article_models.id = article_tags.article_model_id " +
+			"AND article_models.deleted_at IS NULL AND article_models.hidden_at IS NULL").
+		Where("tag_models.deleted_at IS NULL").
+		Group("tag_models.id, tag_models.tag").
+		Order("tag_models.id").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var stats []TagStat
+	for rows.Next() {
+		var stat TagStat
+		if err := rows.Scan(&stat.ID, &stat.Tag, &stat.ArticlesCount); err != nil {
+			return nil, err
+		}
+		stats = append(stats, stat)
+	}
+	scores, err := tagTrendingScores(db, nil, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	for i := range stats {
+		stats[i].TrendingScore = scores[stats[i].ID]
+	}
+
+	switch sortBy {
+	case TagSortPopular:
+		sort.SliceStable(stats, func(i, j int) bool {
+			if stats[i].ArticlesCount != stats[j].ArticlesCount {
+				return stats[i].ArticlesCount > stats[j].ArticlesCount
+			}
+			return stats[i].Tag < stats[j].Tag
+		})
+	case TagSortTrending:
+		sort.SliceStable(stats, func(i, j int) bool {
+			if stats[i].TrendingScore != stats[j].TrendingScore {
+				return stats[i].TrendingScore > stats[j].TrendingScore
+			}
+			if stats[i].ArticlesCount != stats[j].ArticlesCount {
+				return stats[i].ArticlesCount > stats[j].ArticlesCount
+			}
+			return stats[i].Tag < stats[j].Tag
+		})
+	}
+	if limit > 0 && len(stats) > limit {
+		stats = stats[:limit]
+	}
+	return stats, nil
+}
+
+// Every recent article with a tag and every recent favorite of such an article adds to the score
+// of the tag, halved for each TagTrendingHalfLife it is old. Nil tagIDs scores every tag.
+func tagTrendingScores(db *gorm.DB, tagIDs []uint, now time.Time) (map[uint]float64, error) {
+	since := now.Add(-tagTrendingHalfLives * TagTrendingHalfLife)
+	scores := map[uint]float64{}
+	queries := []*gorm.DB{
+		db.Table("article_tags").Select("article_tags.tag_model_id, article_models.created_at").
+			Joins("JOIN article_models ON article_models.id = article_tags.article_model_id").
+			Where("article_models.created_at > ?", since),
+		db.Table("article_tags").Select("article_tags.tag_model_id, favorite_models.created_at").
+			Joins("JOIN article_models ON article_models.id = article_tags.article_model_id").
+			Joins("JOIN favorite_models ON favorite_models.favorite_id = article_models.id").
+			Where("favorite_models.created_at > ? AND favorite_models.deleted_at IS NULL", since),
+	}
+	for _, query := range queries {
+		query = query.Where("article_models.deleted_at IS NULL AND article_models.hidden_at IS NULL")
+		if tagIDs != nil {
+			query = query.Where("article_tags.tag_model_id IN (?)", tagIDs)
+		}
+		rows, err := query.Rows()
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var tagID uint
+			var at time.Time
+			if err := rows.Scan(&tagID, &at); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			scores[tagID] += math.Pow(0.5, float64(now.Sub(at))/float64(TagTrendingHalfLife))
+		}
+		rows.Close()
+	}
+	return scores, nil
+}
+
+// The trending score of a single tag, see tagTrendingScores.
+func (model TagModel) TrendingScore() float64 {
+	scores, _ := tagTrendingScores(common.GetDB(), []uint{model.ID}, time.Now())
+	return scores[model.ID]
+}
+
+// A name is free when no tag and no alias uses it, except for the alias of the tag given by exceptTagID.
+func tagNameFree(tx *gorm.DB, name string, exceptTagID uint) bool {
+	var count int
+	tx.Model(&TagModel{}).Where("tag = ?", name).Count(&count)
+	if count > 0 {
+		return false
+	}
+	tx.Model(&TagAliasModel{}).Where("alias = ? AND tag_id <> ?", name, exceptTagID).Count(&count)
+	return count == 0
+}
+
+// Give the tag a new name, the old one stays as an alias so that links to it keep working.
+// 	tagModel, err := renameTag("golang", "go")
+func renameTag(name string, newName string) (TagModel, error) {
+	tagModel, err := FindOneTag(name)
+	if err != nil {
+		return tagModel, err
+	}
+	newName = NormalizeTag(newName)
+	if newName == "" {
+		return tagModel, ErrInvalidTag
+	}
+	if newName == tagModel.Tag {
+		return tagModel, nil
+	}
+	tx := common.GetDB().Begin()
+	if !tagNameFree(tx, newName, tagModel.ID) {
+		tx.Rollback()
+		return tagModel, ErrTagExists
+	}
+	if err := tx.Unscoped().Where("alias = ?", newName).Delete(&TagAliasModel{}).Error; err != nil {
+		tx.Rollback()
+		return tagModel, err
+	}
+	oldName := tagModel.Tag
+	if err := tx.Model(&tagModel).UpdateColumn("tag", newName).Error; err != nil {
+		tx.Rollback()
+		return tagModel, err
+	}
+	if err := tx.Create(&TagAliasModel{Alias: oldName, TagID: tagModel.ID}).Error; err != nil {
+		tx.Rollback()
+		return tagModel, err
+	}
+	return tagModel, tx.Commit().Error
+}
+
+// Move every article and alias of the tag name to the tag into, then drop the tag name and keep it as an alias.
+// 	tagModel, err := mergeTags("golang", "go")
+func mergeTags(name string, into string) (TagModel, error) {
+	source, err := FindOneTag(name)
+	if err != nil {
+		return source, err
+	}
+	target, err := FindOneTag(into)
+	if err != nil {
+		return target, err
+	}
+	if source.ID == target.ID {
+		return target, ErrInvalidTag
+	}
+	tx := common.GetDB().Begin()
+	if err := mergeTagModels(tx, source, target); err != nil {
+		tx.Rollback()
+		return target, err
+	}
+	return target, tx.Commit().Error
+}
+
+func mergeTagModels(tx *gorm.DB, source TagModel, target TagModel) error {
+	// Articles with both tags keep the row they already have for the target.
+	err := tx.Exec(`INSERT INTO article_tags (article_model_id, tag_model_id)
+		SELECT article_model_id, ? FROM article_tags WHERE tag_model_id = ?
+		AND article_model_id NOT IN (SELECT article_model_id FROM article_tags WHERE tag_model_id = ?)`,
+		target.ID, source.ID, target.ID).Error
+	if err != nil {
+		return err
+	}
+	if err := tx.Exec("DELETE FROM article_tags WHERE tag_model_id = ?", source.ID).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&TagAliasModel{}).Where("tag_id = ?", source.ID).UpdateColumn("tag_id", target.ID).Error; err != nil {
+		return err
+	}
+	// Followers of both tags keep following the target once.
+	var followers []uint
+	if err := tx.Model(&TagFollowModel{}).Where("tag_id = ?", target.ID).Pluck("followed_by_id", &followers).Error; err != nil {
+		return err
+	}
+	if len(followers) > 0 {
+		err := tx.Unscoped().Where("tag_id = ? AND followed_by_id IN (?)", source.ID, followers).Delete(&TagFollowModel{}).Error
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Model(&TagFollowModel{}).Where("tag_id = ?", source.ID).UpdateColumn("tag_id", target.ID).Error; err != nil {
+		return err
+	}
+	if err := tx.Unscoped().Delete(&source).Error; err != nil {
+		return err
+	}
+	// Names from before normalization are never looked up, they need no alias.
+	if source.Tag == target.Tag || source.Tag != NormalizeTag(source.Tag) {
+		return nil
+	}
+	return tx.Create(&TagAliasModel{Alias: source.Tag, TagID: target.ID}).Error
+}
+
+// 	err := addTagAlias("go", "golang")
+func addTagAlias(name string, alias string) (TagModel, error) {
+	tagModel, err := FindOneTag(name)
+	if err != nil {
+		return tagModel, err
+	}
+	alias = NormalizeTag(alias)
+	if alias == "" {
+		return tagModel, ErrInvalidTag
+	}
+	db := common.GetDB()
+	if !tagNameFree(db, alias, 0) {
+		return tagModel, ErrTagExists
+	}
+	return tagModel, db.Create(&TagAliasModel{Alias: alias, TagID: tagModel.ID}).Error
+}
+
+func removeTagAlias(name string, alias string) (TagModel, error) {
+	tagModel, err := FindOneTag(name)
+	if err != nil {
+		return tagModel, err
+	}
+	db := common.GetDB()
+	query := db.Unscoped().Where("tag_id = ? AND alias = ?", tagModel.ID, NormalizeTag(alias)).Delete(&TagAliasModel{})
+	if query.Error != nil {
+		return tagModel, query.Error
+	}
+	if query.RowsAffected == 0 {
+		return tagModel, ErrAliasNotFound
+	}
+	return tagModel, nil
+}
+
+// Delete the tags no article has anymore and return how many went. Tags with aliases or followers
+// are kept, somebody cared enough about them to name or follow them.
+func RemoveOrphanTags() (int, error) {
+	db := common.GetDB()
+	var ids []uint
+	err := db.Model(&TagModel{}).
+		Where("id NOT IN ?", db.Table("article_tags").Select("article_tags.tag_model_id").
+			Joins("JOIN article_models ON article_models.id = article_tags.article_model_id").
+			Where("article_models.deleted_at IS NULL").SubQuery()).
+		Where("id NOT IN ?", db.Model(&TagAliasModel{}).Select("tag_id").SubQuery()).
+		Where("id NOT IN ?", db.Model(&TagFollowModel{}).Select("tag_id").SubQuery()).
+		Pluck("id", &ids).Error
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+	tx := db.Begin()
+	// The rows left behind by deleted articles go with the tag.
+	if err := tx.Exec("DELETE FROM article_tags WHERE tag_model_id IN (?)", ids).Error; err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err := tx.Unscoped().Where("id IN (?)", ids).Delete(&TagModel{}).Error; err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return len(ids), tx.Commit().Error
+}
+
+// Bring the tags stored before normalization in line: each tag is renamed to its normalized form,
+// or merged into the tag that already has it. Run it once the tables are migrated.
+func NormalizeTags(db *gorm.DB) error {
+	var models []TagModel
+	if err := db.Order("id").Find(&models).Error; err != nil {
+		return err
+	}
+	for _, model := range models {
+		name := resolveTag(db, model.Tag)
+		if name == model.Tag {
+			continue
+		}
+		tx := db.Begin()
+		var target TagModel
+		tx.Where("tag = ?", name).First(&target)
+		var err error
+		if target.ID == 0 {
+			err = tx.Model(&model).UpdateColumn("tag", name).Error
+		} else {
+			err = mergeTagModels(tx, model, target)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit().Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
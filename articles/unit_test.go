@@ -0,0 +1,968 @@
+package articles
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gosimple/slug"
+	"github.com/jinzhu/gorm"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/websocket"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/filters"
+	"github.com/gothinkster/golang-gin-realworld-example-app/jobs"
+	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+)
+
+var test_db *gorm.DB
+
+// Every statement sent to the database bumps this counter, reset it before the request you measure.
+var queryCount int
+
+func countQueries(scope *gorm.Scope) {
+	// Many to many preloads run the query callbacks once more for every scanned row without any SQL.
+	if _, skip := scope.InstanceGet("gorm:skip_query_callback"); skip {
+		return
+	}
+	queryCount++
+}
+
+func userModelMocker(n int) []users.UserModel {
+	var offset int
+	test_db.Model(&users.UserModel{}).Count(&offset)
+	var ret []users.UserModel
+	for i := offset + 1; i <= offset+n; i++ {
+		userModel := users.UserModel{
+			Username: fmt.Sprintf("user%v", i),
+			Email:    fmt.Sprintf("user%v@linkedin.com", i),
+			Bio:      fmt.Sprintf("bio%v", i),
+		}
+		test_db.Create(&userModel)
+		ret = append(ret, userModel)
+	}
+	return ret
+}
+
+func articleModelMocker(author users.UserModel, n int) []ArticleModel {
+	var offset int
+	test_db.Model(&ArticleModel{}).Count(&offset)
+	var ret []ArticleModel
+	for i := offset + 1; i <= offset+n; i++ {
+		articleModel := ArticleModel{
+			Slug:        fmt.Sprintf("title-%v", i),
+			Title:       fmt.Sprintf("title %v", i),
+			Description: fmt.Sprintf("description %v", i),
+			Body:        fmt.Sprintf("body %v", i),
+			Author:      GetArticleUserModel(author),
+		}
+		articleModel.setTags([]string{"tag", fmt.Sprintf("tag%v", i%3)})
+		test_db.Create(&articleModel)
+		ret = append(ret, articleModel)
+	}
+	return ret
+}
+
+//Reset test DB and create new one with mock data
+func resetDBWithMock() {
+	common.TestDBFree(test_db)
+	test_db = common.TestDBInit()
+	users.AutoMigrate()
+	jobs.AutoMigrate()
+	test_db.AutoMigrate(&ArticleModel{}, &TagModel{}, &TagAliasModel{}, &TagFollowModel{}, &FavoriteModel{},
+		&ArticleUserModel{}, &CommentModel{}, &ReactionModel{}, &ReactionCountModel{}, &ArticleTermModel{}, &TermModel{},
+		&MentionModel{})
+	filters.AutoMigrate()
+	test_db.Callback().Query().After("gorm:query").Register("test:count_queries", countQueries)
+	test_db.Callback().RowQuery().After("gorm:row_query").Register("test:count_queries", countQueries)
+	test_db.Callback().Create().After("gorm:create").Register("test:count_queries", countQueries)
+}
+
+func newRouter() *gin.Engine {
+	r := gin.New()
+	r.Use(users.AuthMiddleware(false))
+	ArticlesAnonymousRegister(r.Group("/articles"))
+	r.Use(users.AuthMiddleware(true))
+	ArticlesRegister(r.Group("/articles"))
+	return r
+}
+
+func requestQueries(r *gin.Engine, url string, userID uint) (int, *httptest.ResponseRecorder) {
+	req, _ := http.NewRequest("GET", url, bytes.NewBufferString(""))
+	if userID != 0 {
+		req.Header.Set("Authorization", fmt.Sprintf("Token %v", common.GenToken(userID)))
+	}
+	w := httptest.NewRecorder()
+	queryCount = 0
+	r.ServeHTTP(w, req)
+	return queryCount, w
+}
+
+func TestArticleListQueryCount(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	mockUsers := userModelMocker(4)
+	reader := mockUsers[0]
+	var articleModels []ArticleModel
+	for _, author := range mockUsers[1:] {
+		articleModels = append(articleModels, articleModelMocker(author, 10)...)
+	}
+	readerArticleUser := GetArticleUserModel(reader)
+	for i, articleModel := range articleModels {
+		if i%2 == 0 {
+			articleModel.favoriteBy(readerArticleUser)
+		}
+	}
+	test_db.Create(&users.FollowModel{FollowingID: mockUsers[1].ID, FollowedByID: reader.ID})
+	test_db.Create(&users.FollowModel{FollowingID: mockUsers[2].ID, FollowedByID: reader.ID})
+
+	r := newRouter()
+	small, w := requestQueries(r, "/articles/?limit=2", reader.ID)
+	asserts.Equal(http.StatusOK, w.Code)
+	large, w := requestQueries(r, "/articles/?limit=20", reader.ID)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal(small, large, "a bigger page should not cost more queries")
+	asserts.True(large <= 13, fmt.Sprintf("article list should take a constant number of queries, took %v", large))
+	asserts.Regexp(`"favorited":true,"favoritesCount":1`, w.Body.String(), "favorites should be loaded in batch")
+	asserts.Regexp(`"username":"user3","bio":"bio3","image":null,"following":true`, w.Body.String(),
+		"followings should be loaded in batch")
+
+	anonymous, w := requestQueries(r, "/articles/?limit=20", 0)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.True(anonymous < large, "anonymous readers should not look up favorites and followings")
+
+	small, w = requestQueries(r, "/articles/feed?limit=2", reader.ID)
+	asserts.Equal(http.StatusOK, w.Code)
+	large, w = requestQueries(r, "/articles/feed?limit=20", reader.ID)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal(small, large, "a bigger feed page should not cost more queries")
+	asserts.Regexp(`"articlesCount":20`, w.Body.String(), "feed should count the followed articles")
+
+	for i := 0; i < 10; i++ {
+		commentModel := CommentModel{ArticleID: articleModels[0].ID, Body: "comment",
+			Author: GetArticleUserModel(mockUsers[i%4])}
+		test_db.Create(&commentModel)
+	}
+	small, w = requestQueries(r, "/articles/title-1/comments?limit=2", reader.ID)
+	asserts.Equal(http.StatusOK, w.Code)
+	large, w = requestQueries(r, "/articles/title-1/comments", reader.ID)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal(small, large, "more comments should not cost more queries")
+	asserts.Regexp(`"commentsCount":10`, w.Body.String())
+}
+
+func TestArticleUpdateVersion(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	author := userModelMocker(1)[0]
+	articleModel := articleModelMocker(author, 1)[0]
+	asserts.Equal(uint(1), articleModel.Version, "new article should start at version 1")
+
+	r := newRouter()
+	update := func(ifMatch string, body string) *httptest.ResponseRecorder {
+		body = fmt.Sprintf(`{"article":{"body":"%v"}}`, body)
+		req, _ := http.NewRequest("PUT", "/articles/"+articleModel.Slug, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", fmt.Sprintf("Token %v", common.GenToken(author.ID)))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	_, w := requestQueries(r, "/articles/"+articleModel.Slug, 0)
+	asserts.Regexp(`^"1\.[0-9a-f]{40}"$`, w.Header().Get("ETag"), "article should be tagged with its version")
+	asserts.Regexp(`"version":1`, w.Body.String())
+
+	w = update(`"1"`, "first editor")
+	asserts.Equal(http.StatusOK, w.Code, "matching version should be accepted")
+	asserts.Regexp(`"body":"first editor".*"version":2`, w.Body.String())
+	asserts.Equal(`"2"`, w.Header().Get("ETag"))
+
+	w = update(`"1"`, "second editor")
+	asserts.Equal(http.StatusPreconditionFailed, w.Code, "stale version should be refused")
+	asserts.Equal(`{"errors":{"article":"has been modified since it was read","version":2}}`, w.Body.String())
+	asserts.Equal(`"2"`, w.Header().Get("ETag"), "conflict should carry the current version")
+
+	w = update("", "no precondition")
+	asserts.Equal(http.StatusOK, w.Code, "update without If-Match should still work")
+	asserts.Regexp(`"version":3`, w.Body.String())
+
+	stale, _ := FindOneArticle(&ArticleModel{Slug: articleModel.Slug})
+	asserts.NoError(stale.UpdateVersioned(ArticleModel{Body: "racing"}, 3))
+	asserts.Equal(uint(4), stale.Version)
+	asserts.Equal(ErrStaleVersion, stale.UpdateVersioned(ArticleModel{Body: "racing again"}, 3),
+		"write racing with another one should fail")
+	current, _ := FindOneArticle(&ArticleModel{Slug: articleModel.Slug})
+	asserts.Equal("racing", current.Body, "losing write should not be applied")
+}
+
+func TestCommentThreadsAndEdits(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	mockUsers := userModelMocker(2)
+	articleModel := articleModelMocker(mockUsers[0], 1)[0]
+	r := newRouter()
+	send := func(method string, url string, userID uint, body string, ifMatch string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", fmt.Sprintf("Token %v", common.GenToken(userID)))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	comments := "/articles/" + articleModel.Slug + "/comments"
+
+	defer func(depth uint) { MaxCommentDepth = depth }(MaxCommentDepth)
+	MaxCommentDepth = 2
+	asserts.Equal(http.StatusCreated, send("POST", comments, mockUsers[0].ID, `{"comment":{"body":"first"}}`, "").Code)
+	asserts.Equal(http.StatusCreated, send("POST", comments, mockUsers[1].ID, `{"comment":{"body":"second"}}`, "").Code)
+	w := send("POST", comments, mockUsers[1].ID, `{"comment":{"body":"reply","parentId":1}}`, "")
+	asserts.Equal(http.StatusCreated, w.Code)
+	asserts.Regexp(`"parentId":1`, w.Body.String())
+	asserts.Equal(http.StatusCreated, send("POST", comments, mockUsers[0].ID, `{"comment":{"body":"nested","parentId":3}}`, "").Code)
+	w = send("POST", comments, mockUsers[1].ID, `{"comment":{"body":"too deep","parentId":4}}`, "")
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code, "replies deeper than the maximum should be refused")
+	asserts.Equal(`{"errors":{"parentId":"Replies are nested too deep"}}`, w.Body.String())
+	w = send("POST", comments, mockUsers[1].ID, `{"comment":{"body":"lost","parentId":42}}`, "")
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code, "reply to an unknown comment should be refused")
+
+	_, w = requestQueries(r, comments, 0)
+	asserts.Regexp(`"commentsCount":4`, w.Body.String(), "flat mode should list every comment")
+	asserts.NotRegexp(`"replies"`, w.Body.String())
+	_, w = requestQueries(r, comments+"?mode=threaded&limit=1", 0)
+	asserts.Regexp(`"commentsCount":2`, w.Body.String(), "threaded mode should count threads")
+	asserts.Regexp(`^{"comments":\[{"id":1,"body":"first".*"replies":\[{"id":3,.*"replies":\[{"id":4,`, w.Body.String(),
+		"threads should be nested")
+	asserts.NotRegexp(`"second"`, w.Body.String(), "threads should be paginated")
+
+	w = send("PUT", comments+"/1", mockUsers[1].ID, `{"comment":{"body":"hijacked"}}`, "")
+	asserts.Equal(http.StatusForbidden, w.Code, "only the author should edit a comment")
+	w = send("PUT", comments+"/1", mockUsers[0].ID, `{"comment":{"body":"first, edited"}}`, `"1"`)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Regexp(`"body":"first, edited".*"version":2,"parentId":null,"edited":true,"editedAt":"`, w.Body.String())
+	w = send("PUT", comments+"/1", mockUsers[0].ID, `{"comment":{"body":"first, stale"}}`, `"1"`)
+	asserts.Equal(http.StatusPreconditionFailed, w.Code, "stale comment edit should be refused")
+	asserts.Equal(`{"errors":{"comment":"has been modified since it was read","version":2}}`, w.Body.String())
+	w = send("PUT", comments+"/9", mockUsers[0].ID, `{"comment":{"body":"missing"}}`, "")
+	asserts.Equal(http.StatusNotFound, w.Code)
+
+	asserts.Equal(http.StatusOK, send("DELETE", comments+"/3", mockUsers[1].ID, "", "").Code)
+	_, w = requestQueries(r, comments+"?mode=threaded", 0)
+	asserts.Regexp(`^{"comments":\[{"id":1,.*"replies":\[{"id":4,"body":"nested".*"parentId":1,`, w.Body.String(),
+		"replies of a deleted comment should move up to its parent")
+	asserts.Equal(http.StatusOK, send("DELETE", comments+"/1", mockUsers[0].ID, "", "").Code)
+	_, w = requestQueries(r, comments+"?mode=threaded", 0)
+	asserts.Regexp(`"commentsCount":2`, w.Body.String())
+	asserts.Regexp(`{"id":4,"body":"nested".*"parentId":null,`, w.Body.String(),
+		"replies of a deleted thread should start threads of their own")
+	var nested CommentModel
+	test_db.First(&nested, 4)
+	asserts.Nil(nested.RootID)
+	asserts.Equal(uint(0), nested.Depth)
+}
+
+func TestReactions(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	mockUsers := userModelMocker(2)
+	articleModel := articleModelMocker(mockUsers[0], 1)[0]
+	r := newRouter()
+	send := func(method string, url string, userID uint) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, nil)
+		req.Header.Set("Authorization", fmt.Sprintf("Token %v", common.GenToken(userID)))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	article := "/articles/" + articleModel.Slug
+
+	w := send("POST", article+"/reactions/clap", mockUsers[0].ID)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Regexp(`"reactions":{"clap":1},"myReactions":\["clap"\]`, w.Body.String())
+	w = send("POST", article+"/reactions/clap", mockUsers[0].ID)
+	asserts.Regexp(`"reactions":{"clap":1}`, w.Body.String(), "reacting twice should count once")
+	send("POST", article+"/reactions/love", mockUsers[0].ID)
+	w = send("POST", article+"/reactions/clap", mockUsers[1].ID)
+	asserts.Regexp(`"reactions":{"clap":2,"love":1},"myReactions":\["clap"\]`, w.Body.String())
+	w = send("POST", article+"/reactions/boo", mockUsers[1].ID)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code)
+	asserts.Equal(`{"errors":{"reaction":"Unknown reaction"}}`, w.Body.String())
+
+	w = send("DELETE", article+"/reactions/clap", mockUsers[0].ID)
+	asserts.Regexp(`"reactions":{"clap":1,"love":1},"myReactions":\["love"\]`, w.Body.String())
+	w = send("DELETE", article+"/reactions/clap", mockUsers[0].ID)
+	asserts.Regexp(`"reactions":{"clap":1,"love":1}`, w.Body.String(), "removing twice should count once")
+	_, w = requestQueries(r, "/articles/", 0)
+	asserts.Regexp(`"reactions":{"clap":1,"love":1},"myReactions":\[\]`, w.Body.String())
+
+	commentModel := CommentModel{Article: articleModel, Author: GetArticleUserModel(mockUsers[1]), Body: "nice"}
+	test_db.Create(&commentModel)
+	comment := fmt.Sprintf("%v/comments/%v", article, commentModel.ID)
+	w = send("POST", comment+"/reactions/laugh", mockUsers[0].ID)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Regexp(`"reactions":{"laugh":1},"myReactions":\["laugh"\]`, w.Body.String())
+	_, w = requestQueries(r, article+"/comments", mockUsers[1].ID)
+	asserts.Regexp(`"reactions":{"laugh":1},"myReactions":\[\]`, w.Body.String())
+	w = send("POST", article+"/comments/42/reactions/laugh", mockUsers[0].ID)
+	asserts.Equal(http.StatusNotFound, w.Code)
+}
+
+func TestMarkdown(t *testing.T) {
+	asserts := assert.New(t)
+
+	rendered := renderMarkdownUncached([]byte("# Intro\n\nSome *text* and [a link](http://golang.org).\n\n## Details <b>here</b>\n\n" +
+		"<script>alert(1)</script>\n\n[bad](javascript:alert(1)) ![img](https://golang.org/gopher.png)\n\n```go\nx := 1 < 2\n```\n"))
+	asserts.Equal(`<h1 id="intro">Intro</h1>
+<p>Some <em>text</em> and <a href="http://golang.org" rel="nofollow">a link</a>.</p>
+<h2 id="details-here">Details here</h2>
+
+<p><a href="" rel="nofollow">bad</a> <img src="https://golang.org/gopher.png" alt="img"></p>
+<pre><code class="language-go">x := 1 &lt; 2
+</code></pre>
+`, rendered.HTML)
+	asserts.Equal([]TocEntry{{1, "intro", "Intro"}, {2, "details-here", "Details here"}}, rendered.TOC)
+	rendered = renderMarkdownUncached([]byte("## Notes\n\n## Notes\n\n## !!!"))
+	asserts.Equal([]TocEntry{{2, "notes", "Notes"}, {2, "notes-1", "Notes"}, {2, "section", "!!!"}}, rendered.TOC)
+
+	asserts.Equal(`<p>ok</p><a href="/relative" rel="nofollow">x</a>`,
+		sanitizeHTML(`<p onclick="evil()">ok</p><style>p{}</style><iframe src="x"></iframe><a href="/relative" style="x">x</a>`))
+	asserts.Equal(`<code>y</code>`, sanitizeHTML(`<code class="x onmouseover">y</code>`))
+
+	asserts.Equal(0, readingTimeMinutes(""))
+	asserts.Equal(1, readingTimeMinutes("just a few words"))
+	asserts.Equal(3, readingTimeMinutes(strings.Repeat("word ", 401)))
+
+	resetDBWithMock()
+	defer common.SetCache(nil)
+	common.SetCache(common.NewMemoryCache(16))
+	articleModel := articleModelMocker(userModelMocker(1)[0], 1)[0]
+	r := newRouter()
+	_, w := requestQueries(r, "/articles/"+articleModel.Slug, 0)
+	asserts.Contains(w.Body.String(), `"bodyHtml":"\u003cp\u003ebody 1\u003c/p\u003e\n","readingTimeMinutes":1,"toc":[]`)
+	_, ok, _ := common.GetCache().Get(markdownCacheKey(articleModel.Body))
+	asserts.True(ok, "renderings should be cached")
+	common.GetCache().Set(markdownCacheKey("# Cached"), []byte(`{"html":"from the cache","toc":[]}`), 0)
+	asserts.Equal("from the cache", renderMarkdown("# Cached").HTML)
+}
+
+func TestLongFormLimits(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	defer func(body, comment int) { MaxArticleBodyLength, MaxCommentBodyLength = body, comment }(MaxArticleBodyLength, MaxCommentBodyLength)
+	MaxArticleBodyLength, MaxCommentBodyLength = 10, 5
+	mockUsers := userModelMocker(1)
+	r := newRouter()
+	send := func(url string, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", fmt.Sprintf("Token %v", common.GenToken(mockUsers[0].ID)))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	created := testutil.ToFloat64(articlesCreatedCounter)
+	w := send("/articles/", `{"article":{"title":"Long","body":"eleven runes"}}`)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code)
+	asserts.Equal(`{"errors":{"Body":"{max: 10}"}}`, w.Body.String())
+	w = send("/articles/", `{"article":{"title":"Long","body":"ünïcödé ok"}}`)
+	asserts.Equal(http.StatusCreated, w.Code, "the limit should count characters rather than bytes")
+	asserts.Equal(created+1, testutil.ToFloat64(articlesCreatedCounter), "only the article written should be counted")
+	w = send("/articles/long/comments", `{"comment":{"body":"too long"}}`)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code)
+	asserts.Equal(`{"errors":{"Body":"{max: 5}"}}`, w.Body.String())
+}
+
+func TestArticleListTracing(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+	mockUsers := userModelMocker(1)
+	articleModelMocker(mockUsers[0], 3)
+	r := gin.New()
+	r.Use(common.Tracing())
+	r.Use(users.AuthMiddleware(false))
+	ArticlesAnonymousRegister(r.Group("/articles"))
+	req, _ := http.NewRequest("GET", "/articles/?limit=3&tracing=true", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	asserts.Equal(http.StatusOK, w.Code)
+
+	// The listing is traced as its query, the priming of the loader and the rendering, with the queries of each inside.
+	names := map[trace.SpanID]string{}
+	for _, span := range recorder.Ended() {
+		names[span.SpanContext().SpanID()] = span.Name()
+	}
+	parents := map[string]string{}
+	for _, span := range recorder.Ended() {
+		parents[span.Name()] = names[span.Parent().SpanID()]
+	}
+	asserts.Equal("GET /articles/", parents["articles.FindManyArticle"])
+	asserts.Equal("GET /articles/", parents["articles.prime"])
+	asserts.Equal("GET /articles/", parents["articles.render"])
+	asserts.Equal("articles.FindManyArticle", parents["row_query article_models"])
+	asserts.Equal("articles.FindManyArticle", parents["query article_models"])
+	asserts.Equal("articles.prime", parents["row_query favorite_models"])
+	asserts.Equal("articles.prime", parents["query mention_models"])
+}
+
+func TestTagManagement(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	asserts.Equal("machine-learning", NormalizeTag(" Machine  Learning "))
+	asserts.Equal("go", NormalizeTag("Ｇｏ"), "full width letters should be folded")
+
+	mockUsers := userModelMocker(2)
+	test_db.Model(&mockUsers[1]).UpdateColumn("moderator", true)
+	legacy := ArticleModel{Slug: "legacy", Title: "legacy", Author: GetArticleUserModel(mockUsers[0]),
+		Tags: []TagModel{{Tag: "Golang "}}}
+	test_db.Create(&legacy)
+	asserts.NoError(NormalizeTags(test_db))
+
+	r := newRouter()
+	admin := r.Group("/moderation")
+	admin.Use(users.ModeratorMiddleware())
+	TagsAdminRegister(admin)
+	send := func(method string, url string, userID uint, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", fmt.Sprintf("Token %v", common.GenToken(userID)))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	author, moderator := mockUsers[0].ID, mockUsers[1].ID
+
+	w := send("POST", "/articles/", author, `{"article":{"title":"First","tagList":["Go","go ","Machine  Learning"]}}`)
+	asserts.Equal(http.StatusCreated, w.Code)
+	asserts.Regexp(`"tagList":\["go","machine-learning"\]`, w.Body.String())
+
+	w = send("POST", "/moderation/tags/go/aliases", author, `{"alias":{"name":"golang"}}`)
+	asserts.Equal(http.StatusForbidden, w.Code, "only moderators should manage tags")
+	w = send("POST", "/moderation/tags/go/aliases", moderator, `{"alias":{"name":"golang"}}`)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code, "an existing tag should be merged rather than aliased")
+	w = send("POST", "/moderation/tags/golang/merge", moderator, `{"tag":{"name":"Go"}}`)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Contains(w.Body.String(), `{"tag":{"tag":"go","aliases":["golang"],"articlesCount":2,`)
+	w = send("GET", "/articles/?tag=GoLang", 0, "")
+	asserts.Regexp(`"articlesCount":2`, w.Body.String(), "aliases should resolve when querying")
+	w = send("POST", "/articles/", author, `{"article":{"title":"Second","tagList":["GoLang"]}}`)
+	asserts.Regexp(`"tagList":\["go"\]`, w.Body.String(), "aliases should resolve when tagging")
+
+	w = send("PUT", "/moderation/tags/machine-learning", moderator, `{"tag":{"name":"ML"}}`)
+	asserts.Contains(w.Body.String(), `{"tag":{"tag":"ml","aliases":["machine-learning"],"articlesCount":1,`)
+	w = send("PUT", "/moderation/tags/ml", moderator, `{"tag":{"name":"go"}}`)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code)
+	w = send("PUT", "/moderation/tags/rust", moderator, `{"tag":{"name":"go"}}`)
+	asserts.Equal(http.StatusNotFound, w.Code)
+	w = send("DELETE", "/moderation/tags/ml/aliases/machine-learning", moderator, "")
+	asserts.Contains(w.Body.String(), `{"tag":{"tag":"ml","aliases":[],"articlesCount":1,`)
+
+	send("POST", "/articles/", author, `{"article":{"title":"Third","tagList":["rust"]}}`)
+	w = send("DELETE", "/articles/third", author, "")
+	asserts.Equal(http.StatusOK, w.Code)
+	w = send("GET", "/articles/?tag=rust", 0, "")
+	asserts.Regexp(`"articlesCount":0`, w.Body.String())
+	var orphans int
+	test_db.Model(&TagModel{}).Where("tag = ?", "rust").Count(&orphans)
+	asserts.Equal(1, orphans, "tags should stay until they are swept, a new article may still be tagged with them")
+	test_db.Create(&TagModel{Tag: "unused"})
+	w = send("DELETE", "/moderation/orphan-tags", moderator, "")
+	asserts.Equal(`{"removedCount":2}`, w.Body.String())
+	test_db.Model(&TagModel{}).Where("tag = ?", "rust").Count(&orphans)
+	asserts.Equal(0, orphans, "the sweep should remove the tags of deleted articles")
+}
+
+func TestTagStatsAndFollowing(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	mockUsers := userModelMocker(2)
+	author, reader := GetArticleUserModel(mockUsers[0]), mockUsers[1]
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	for i := 1; i <= 3; i++ {
+		articleModel := ArticleModel{Slug: fmt.Sprintf("old-%v", i), Title: "old", Author: author}
+		articleModel.CreatedAt = old
+		articleModel.setTags([]string{"old"})
+		test_db.Create(&articleModel)
+	}
+	fresh := ArticleModel{Slug: "fresh", Title: "fresh", Author: author}
+	fresh.setTags([]string{"fresh"})
+	test_db.Create(&fresh)
+	fresh.favoriteBy(GetArticleUserModel(reader))
+
+	r := gin.New()
+	r.Use(users.AuthMiddleware(false))
+	ArticlesAnonymousRegister(r.Group("/articles"))
+	TagsAnonymousRegister(r.Group("/tags"))
+	r.Use(users.AuthMiddleware(true))
+	TagsRegister(r.Group("/tags"))
+	send := func(method string, url string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, nil)
+		req.Header.Set("Authorization", fmt.Sprintf("Token %v", common.GenToken(reader.ID)))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("GET", "/tags/?sort=popular")
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal(`{"tagStats":[{"tag":"old","articlesCount":3,"trendingScore":0},{"tag":"fresh","articlesCount":1,"trendingScore":2}],`+
+		`"tags":["old","fresh"]}`, w.Body.String(), "activity past ten half lives should not count")
+	w = send("GET", "/tags/?sort=trending&limit=1")
+	asserts.Regexp(`"tags":\["fresh"\]`, w.Body.String(), "recent activity should trend")
+	asserts.Equal(http.StatusUnprocessableEntity, send("GET", "/tags/?sort=newest").Code)
+	asserts.Equal(http.StatusUnprocessableEntity, send("GET", "/tags/?limit=0").Code)
+
+	w = send("GET", "/tags/Fresh")
+	asserts.Equal(`{"tag":{"tag":"fresh","aliases":[],"articlesCount":1,"trendingScore":2,"followersCount":0,"following":false}}`,
+		w.Body.String())
+	asserts.Equal(http.StatusNotFound, send("GET", "/tags/missing").Code)
+
+	w = send("GET", "/articles/feed")
+	asserts.Regexp(`"articlesCount":0`, w.Body.String())
+	w = send("POST", "/tags/fresh/follow")
+	asserts.Regexp(`"followersCount":1,"following":true`, w.Body.String())
+	w = send("GET", "/articles/feed")
+	asserts.Regexp(`"articlesCount":1`, w.Body.String(), "followed tags should feed articles")
+	asserts.Regexp(`"slug":"fresh"`, w.Body.String())
+	send("DELETE", "/tags/fresh/follow")
+	w = send("GET", "/articles/feed")
+	asserts.Regexp(`"articlesCount":0`, w.Body.String())
+}
+
+func TestRelatedArticles(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	mockUsers := userModelMocker(4)
+	author, viewer, fan, other := GetArticleUserModel(mockUsers[0]), GetArticleUserModel(mockUsers[1]),
+		GetArticleUserModel(mockUsers[2]), GetArticleUserModel(mockUsers[3])
+	create := func(title string, tags []string, author ArticleUserModel) ArticleModel {
+		articleModel := ArticleModel{Slug: slug.Make(title), Title: title, Author: author}
+		articleModel.setTags(tags)
+		test_db.Create(&articleModel)
+		asserts.NoError(indexArticleTerms(articleModel))
+		return articleModel
+	}
+	source := create("Training dragons with gin", []string{"go", "web"}, author)
+	create("Unrelated words here", []string{"go", "web"}, author)
+	similar := create("A guide to training dragons", nil, author)
+	liked := create("Nothing in common", nil, other)
+	create("Cooking pasta", []string{"food"}, author)
+	create("Whatever", []string{"go"}, viewer)
+	favorite := create("Whatever else", []string{"go", "web"}, author)
+	source.favoriteBy(fan)
+	liked.favoriteBy(fan)
+	favorite.favoriteBy(viewer)
+
+	r := newRouter()
+	related := func(userID uint, query string) string {
+		_, w := requestQueries(r, "/articles/training-dragons-with-gin/related"+query, userID)
+		asserts.Equal(http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+	body := related(mockUsers[1].ID, "")
+	asserts.Regexp(`^{"articles":\[{"title":"Unrelated words here"`, body, "sharing every tag should rank first")
+	asserts.Regexp(`"articlesCount":3}$`, body)
+	asserts.Contains(body, `"title":"A guide to training dragons"`)
+	asserts.Contains(body, `"title":"Nothing in common"`)
+	asserts.NotContains(body, `"title":"Whatever"`, "the viewer's own articles should be left out")
+	asserts.NotContains(body, `"title":"Whatever else"`, "the viewer's favorites should be left out")
+	body = related(0, "?limit=10")
+	asserts.Regexp(`"articlesCount":5}$`, body)
+	asserts.NotContains(body, `"title":"Cooking pasta"`)
+	asserts.NotContains(body, `"title":"Training dragons with gin"`)
+
+	similar.Title = "Something else entirely"
+	asserts.NoError(indexArticleTerms(similar))
+	asserts.NotContains(related(mockUsers[1].ID, ""), `"title":"A guide to training dragons"`, "the index should follow edits")
+	var documents TermModel
+	test_db.Where("term = ?", "dragons").First(&documents)
+	asserts.Equal(uint(1), documents.Documents)
+	wordless := create("Go", nil, author)
+	asserts.NoError(IndexArticleTerms(test_db))
+	var marks int
+	test_db.Model(&ArticleTermModel{}).Where("article_id = ?", wordless.ID).Count(&marks)
+	asserts.Equal(1, marks, "an article without terms should be indexed once")
+	var indexed TermModel
+	test_db.Where("term = ?", indexedTerm).First(&indexed)
+	asserts.Equal(uint(8), indexed.Documents, "indexed articles should be counted as they are indexed")
+	asserts.NoError(unindexArticleTerms([]uint{wordless.ID}))
+	indexed = TermModel{}
+	test_db.Where("term = ?", indexedTerm).First(&indexed)
+	asserts.Equal(uint(7), indexed.Documents, "removed articles should not be counted")
+	long := strings.Repeat("é", maxTermLength+6)
+	asserts.Equal(map[string]uint{strings.Repeat("é", maxTermLength): 1}, termCounts(long),
+		"long words should be cut to whole letters")
+
+	_, w := requestQueries(r, "/articles/training-dragons-with-gin/related?limit=50", 0)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code)
+	_, w = requestQueries(r, "/articles/missing/related", 0)
+	asserts.Equal(http.StatusNotFound, w.Code)
+}
+
+func TestRankedFeed(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	mockUsers := userModelMocker(5)
+	viewer, followed, stranger := GetArticleUserModel(mockUsers[0]), GetArticleUserModel(mockUsers[1]),
+		GetArticleUserModel(mockUsers[2])
+	test_db.Create(&users.FollowModel{FollowingID: mockUsers[1].ID, FollowedByID: mockUsers[0].ID})
+	create := func(title string, tags []string, author ArticleUserModel, age time.Duration) ArticleModel {
+		articleModel := ArticleModel{Slug: slug.Make(title), Title: title, Author: author}
+		articleModel.CreatedAt = time.Now().Add(-age)
+		articleModel.setTags(tags)
+		test_db.Create(&articleModel)
+		return articleModel
+	}
+	old := create("old follow", nil, followed, 48*time.Hour)
+	create("new follow", nil, followed, time.Minute)
+	tagged := create("tagged", []string{"go"}, stranger, time.Hour)
+	popular := create("popular", nil, stranger, time.Hour)
+	create("ignored", nil, stranger, time.Hour)
+	create("own", []string{"go"}, viewer, time.Hour)
+	create("too old", nil, followed, 30*24*time.Hour)
+	test_db.Create(&TagFollowModel{TagID: tagged.Tags[0].ID, FollowedByID: viewer.ID})
+	popular.favoriteBy(GetArticleUserModel(mockUsers[3]))
+
+	r := newRouter()
+	feed := func(query string) string {
+		_, w := requestQueries(r, "/articles/feed?"+query, mockUsers[0].ID)
+		asserts.Equal(http.StatusOK, w.Code, query)
+		return w.Body.String()
+	}
+	body := feed("mode=ranked&debug=true")
+	asserts.Regexp(`"articlesCount":4`, body)
+	asserts.Regexp(`"title":"new follow".*"title":"popular".*"title":"tagged".*"title":"old follow"`, body)
+	asserts.NotContains(body, `"title":"ignored"`)
+	asserts.NotContains(body, `"title":"own"`, "the viewer's own articles should be left out")
+	asserts.Regexp(`"title":"tagged".*"ranking":{"score":[\d.]+,"recency":[\d.]+,"engagement":0,"affinity":0.5,`+
+		`"reasons":\["followed tag"\],"tags":\["go"\]}`, body)
+	asserts.Regexp(`"reasons":\["popular"\]`, body)
+	asserts.NotContains(feed("mode=ranked"), `"ranking"`, "rankings should only be explained in debug mode")
+
+	var seen []string
+	cursor := ""
+	for page := 0; page < 3; page++ {
+		body = feed("mode=ranked&limit=3&cursor=" + cursor)
+		for _, match := range regexp.MustCompile(`"title":"([^"]+)"`).FindAllStringSubmatch(body, -1) {
+			seen = append(seen, match[1])
+		}
+		// Favorites coming in between pages must not move articles across pages.
+		old.favoriteBy(GetArticleUserModel(mockUsers[3+page%2]))
+		cursor = regexp.MustCompile(`"nextCursor":"([^"]*)"`).FindStringSubmatch(body)[1]
+		if cursor == "" {
+			break
+		}
+	}
+	asserts.Equal([]string{"new follow", "popular", "tagged", "old follow"}, seen)
+
+	ranked := regexp.MustCompile(`"nextCursor":"([^"]*)"`).FindStringSubmatch(feed("mode=ranked&limit=1"))[1]
+	_, w := requestQueries(r, "/articles/feed?limit=1&cursor="+ranked, mockUsers[0].ID)
+	asserts.Equal(http.StatusBadRequest, w.Code, "the chronological feed should refuse a ranked cursor")
+	body = feed("mode=chronological&limit=1")
+	chronological := regexp.MustCompile(`"nextCursor":"([^"]*)"`).FindStringSubmatch(body)[1]
+	_, w = requestQueries(r, "/articles/feed?mode=ranked&limit=1&cursor="+chronological, mockUsers[0].ID)
+	asserts.Equal(http.StatusBadRequest, w.Code, "the ranked feed should refuse a chronological cursor")
+	backward := regexp.MustCompile(`"prevCursor":"([^"]*)"`).FindStringSubmatch(feed("limit=1&cursor=" + chronological))[1]
+	_, w = requestQueries(r, "/articles/feed?mode=ranked&cursor="+backward, mockUsers[0].ID)
+	asserts.Equal(http.StatusBadRequest, w.Code, "the ranked feed should refuse a backward chronological cursor")
+
+	_, w = requestQueries(r, "/articles/feed?mode=best", mockUsers[0].ID)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code)
+}
+
+func TestArticleNotifications(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	mockUsers := userModelMocker(4)
+	author := mockUsers[0]
+	articleModel := articleModelMocker(author, 1)[0]
+	r := newRouter()
+	users.UserRegister(r.Group("/user"))
+	send := func(method string, url string, userID uint, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", fmt.Sprintf("Token %v", common.GenToken(userID)))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	article := "/articles/" + articleModel.Slug
+	for _, reader := range mockUsers {
+		asserts.Equal(http.StatusOK, send("POST", article+"/favorite", reader.ID, "").Code)
+	}
+	send("POST", article+"/comments", author.ID, `{"comment":{"body":"thanks"}}`)
+	send("POST", article+"/comments", mockUsers[1].ID, `{"comment":{"body":"nice"}}`)
+	test_db.Create(&users.BlockModel{BlockingID: mockUsers[2].ID, BlockedByID: author.ID})
+	send("POST", article+"/comments", mockUsers[2].ID, `{"comment":{"body":"meh"}}`)
+
+	w := send("GET", "/user/notifications", author.ID, "")
+	body := w.Body.String()
+	asserts.Regexp(`"notificationsCount":2,"unreadCount":2`, body, "own actions and blocked users should not notify")
+	asserts.Regexp(`{"id":2,"type":"comment","message":"user2 commented on your article \\"`+articleModel.Title+`\\"",`+
+		`"actor":{"username":"user2",.*"actorsCount":1,"target":{"type":"article","slug":"`+articleModel.Slug+`","title":"`+
+		articleModel.Title+`"}`, body)
+	asserts.Regexp(`{"id":1,"type":"favorite","message":"3 people favorited your article`, body)
+
+	asserts.Equal(http.StatusOK, send("POST", "/user/notifications/1/read", author.ID, "").Code)
+	asserts.Equal(http.StatusOK, send("POST", article+"/favorite", mockUsers[1].ID, "").Code)
+	w = send("GET", "/user/notifications", author.ID, "")
+	asserts.Regexp(`"notificationsCount":2,"unreadCount":1`, w.Body.String(), "favoriting again should not notify again")
+}
+
+func TestMentions(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	asserts.Equal([]string{"ann", "bob"}, parseMentions("@ann, ask @bob or mail bob@example.com, cc @ann"))
+
+	mockUsers := userModelMocker(3)
+	author, mentioned, blocking := mockUsers[0], mockUsers[1], mockUsers[2]
+	test_db.Create(&users.BlockModel{BlockingID: author.ID, BlockedByID: blocking.ID})
+	r := newRouter()
+	users.UserRegister(r.Group("/user"))
+	send := func(method string, url string, userID uint, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", fmt.Sprintf("Token %v", common.GenToken(userID)))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("POST", "/articles/", author.ID, `{"article":{"title":"Thanks","body":"Thanks @user2 and @user3, not @nobody"}}`)
+	asserts.Equal(http.StatusCreated, w.Code)
+	asserts.Regexp(`"mentions":\[{"username":"user2","bio":"bio2","image":null,"following":false}\]`, w.Body.String(),
+		"unknown and blocking users should not be mentioned")
+	w = send("POST", "/articles/thanks/comments", author.ID, `{"comment":{"body":"@user2 again"}}`)
+	asserts.Regexp(`"mentions":\[{"username":"user2"`, w.Body.String())
+	w = send("GET", "/articles/thanks/comments", mentioned.ID, "")
+	asserts.Regexp(`"mentions":\[{"username":"user2"`, w.Body.String())
+
+	w = send("GET", "/user/notifications", mentioned.ID, "")
+	asserts.Regexp(`"message":"user1 mentioned you in a comment on \\"Thanks\\"".*`+
+		`"message":"user1 mentioned you in the article \\"Thanks\\"".*"notificationsCount":2`, w.Body.String())
+	w = send("GET", "/user/notifications", blocking.ID, "")
+	asserts.Regexp(`"notificationsCount":0`, w.Body.String())
+
+	w = send("PUT", "/articles/thanks", author.ID, `{"article":{"body":"Thanks everyone"}}`)
+	asserts.Regexp(`"mentions":\[\]`, w.Body.String(), "edits should drop the mentions taken out")
+	w = send("PUT", "/articles/thanks", author.ID, `{"article":{"body":"Thanks @user2"}}`)
+	w = send("GET", "/user/notifications", mentioned.ID, "")
+	asserts.Regexp(`"notificationsCount":2`, w.Body.String(), "mentioning again should merge into the unread notification")
+}
+
+func TestFollowSuggestions(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	users.SetSuggestionSources(FavoritedAuthorSuggestions, TagAuthorSuggestions)
+	defer users.SetSuggestionSources()
+
+	mockUsers := userModelMocker(7)
+	viewer := mockUsers[0]
+	follow := func(follower, following users.UserModel) {
+		test_db.Create(&users.FollowModel{FollowingID: following.ID, FollowedByID: follower.ID})
+	}
+	follow(viewer, mockUsers[1])
+	for _, user := range mockUsers[2:] {
+		follow(mockUsers[1], user)
+	}
+	test_db.Create(&users.BlockModel{BlockingID: mockUsers[5].ID, BlockedByID: viewer.ID})
+	test_db.Model(&mockUsers[6]).UpdateColumn("suspended_at", time.Now())
+	create := func(title string, tags []string, author users.UserModel) ArticleModel {
+		articleModel := ArticleModel{Slug: slug.Make(title), Title: title, Author: GetArticleUserModel(author)}
+		articleModel.setTags(tags)
+		test_db.Create(&articleModel)
+		return articleModel
+	}
+	favorited := create("favorited", nil, mockUsers[3])
+	favorited.favoriteBy(GetArticleUserModel(viewer))
+	goArticle := create("go", []string{"go"}, mockUsers[4])
+	create("more go", []string{"go"}, mockUsers[1])
+	create("own go", []string{"go"}, viewer)
+	create("blocked go", []string{"go"}, mockUsers[5])
+	test_db.Create(&TagFollowModel{TagID: goArticle.Tags[0].ID, FollowedByID: GetArticleUserModel(viewer).ID})
+
+	r := newRouter()
+	users.ProfileRegister(r.Group("/profiles"))
+	_, w := requestQueries(r, "/profiles/suggestions", viewer.ID)
+	asserts.Equal(http.StatusOK, w.Code)
+	body := w.Body.String()
+	asserts.Regexp(`^{"profiles":\[{"username":"user4","bio":"bio4","image":null,"following":false,"reasons":\[`+
+		`{"type":"followed_by_followings","detail":"Followed by a user you follow"},`+
+		`{"type":"favorited_author","detail":"You favorited one of their articles"}\]},`+
+		`{"username":"user5",.*"reasons":\[{"type":"followed_by_followings".*{"type":"tag_author","detail":"Writes about go"}.*`+
+		`{"username":"user3",.*"reasons":\[{"type":"followed_by_followings","detail":"Followed by a user you follow"}\]}\]}$`, body)
+	asserts.NotContains(body, `"username":"user1"`, "the viewer should not be suggested")
+	asserts.NotContains(body, `"username":"user2"`, "followed users should not be suggested")
+	asserts.NotContains(body, `"username":"user6"`, "blocked users should not be suggested")
+	asserts.NotContains(body, `"username":"user7"`, "suspended users should not be suggested")
+
+	_, w = requestQueries(r, "/profiles/suggestions?limit=1", viewer.ID)
+	asserts.Regexp(`^{"profiles":\[{"username":"user4"[^\]]*\]}\]}$`, w.Body.String())
+	_, w = requestQueries(r, "/profiles/suggestions", mockUsers[5].ID)
+	asserts.NotContains(w.Body.String(), `"username":"user1"`, "blocks should hold both ways")
+}
+
+func TestStream(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	mockUsers := userModelMocker(3)
+	author, follower, commenter := mockUsers[0], mockUsers[1], mockUsers[2]
+	test_db.Create(&users.FollowModel{FollowingID: author.ID, FollowedByID: follower.ID})
+	articleModel := articleModelMocker(author, 1)[0]
+	r := newRouter()
+	StreamRegister(r.Group("/stream"))
+	server := httptest.NewServer(r)
+	defer server.Close()
+	connect := func(url string, userID uint, lastEventID string) *http.Response {
+		req, _ := http.NewRequest("GET", server.URL+url, nil)
+		req.Header.Set("Authorization", fmt.Sprintf("Token %v", common.GenToken(userID)))
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		asserts.NoError(err)
+		return resp
+	}
+	send := func(url string, userID uint, body string) int {
+		req, _ := http.NewRequest("POST", server.URL+url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", fmt.Sprintf("Token %v", common.GenToken(userID)))
+		resp, err := http.DefaultClient.Do(req)
+		asserts.NoError(err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// Collect the fields of the next event of a Server-Sent Events body, skipping comments.
+	events := func(resp *http.Response) func() map[string]string {
+		lines := make(chan string)
+		go func() {
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				lines <- scanner.Text()
+			}
+			close(lines)
+		}()
+		return func() map[string]string {
+			event := map[string]string{}
+			for {
+				select {
+				case line, ok := <-lines:
+					if !ok || (line == "" && len(event) > 0) {
+						return event
+					}
+					if fields := strings.SplitN(line, ":", 2); len(fields) == 2 && fields[0] != "" {
+						event[fields[0]] = fields[1]
+					}
+				case <-time.After(2 * time.Second):
+					return event
+				}
+			}
+		}
+	}
+
+	resp := connect("/stream", follower.ID, "")
+	asserts.Equal(http.StatusServiceUnavailable, resp.StatusCode, "streaming should be off without a hub")
+	resp.Body.Close()
+	common.SetHub(common.NewHub(common.NewLocalBroker(), 100))
+	defer common.SetHub(nil)
+	resp = connect("/stream?article=nope", follower.ID, "")
+	asserts.Equal(http.StatusNotFound, resp.StatusCode)
+	resp.Body.Close()
+	resp = connect("/stream", follower.ID, "yesterday")
+	asserts.Equal(http.StatusUnprocessableEntity, resp.StatusCode)
+	resp.Body.Close()
+
+	resp = connect("/stream?article="+articleModel.Slug, follower.ID, "")
+	asserts.Equal("text/event-stream", resp.Header.Get("Content-Type"))
+	next := events(resp)
+	asserts.Equal(http.StatusCreated, send("/articles/", author.ID, `{"article":{"title":"Fresh","body":"news"}}`))
+	event := next()
+	asserts.Equal("article", event["event"], "followers should get the new articles of the author")
+	asserts.Regexp(`^{"slug":"fresh","title":"Fresh",.*"author":"user1"`, event["data"])
+	first := event["id"]
+	asserts.Equal(http.StatusCreated, send("/articles/"+articleModel.Slug+"/comments", commenter.ID, `{"comment":{"body":"first"}}`))
+	event = next()
+	asserts.Equal("comment", event["event"], "watchers should get the new comments of the article")
+	asserts.Regexp(`^{"id":1,"article":"`+articleModel.Slug+`","parentId":null,"body":"first",.*"author":"user3"`, event["data"])
+	resp.Body.Close()
+
+	resp = connect("/stream?article="+articleModel.Slug, follower.ID, first)
+	event = events(resp)()
+	asserts.Equal("comment", event["event"], "a reconnecting client should get the events it missed")
+	asserts.Regexp(`"body":"first"`, event["data"])
+	resp.Body.Close()
+
+	ws, err := websocket.Dial(strings.Replace(server.URL, "http", "ws", 1)+"/stream?access_token="+
+		common.GenToken(author.ID), "", server.URL)
+	asserts.NoError(err)
+	defer ws.Close()
+	asserts.Equal(http.StatusCreated, send("/articles/"+articleModel.Slug+"/comments", commenter.ID, `{"comment":{"body":"again"}}`))
+	var message common.Event
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	asserts.NoError(websocket.JSON.Receive(ws, &message))
+	asserts.Equal("notification", message.Type, "the author should get the notifications over websockets")
+	asserts.Regexp(`"message":"user3 commented on your article`, string(message.Data))
+
+	resp = connect("/stream", follower.ID, "")
+	defer resp.Body.Close()
+	common.GetHub().Stop()
+	ended := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(ioutil.Discard, resp.Body)
+		ended <- err
+	}()
+	select {
+	case err := <-ended:
+		asserts.NoError(err, "event streams should end when the hub stops")
+	case <-time.After(2 * time.Second):
+		asserts.Fail("event streams should end when the hub stops")
+	}
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	err = websocket.JSON.Receive(ws, &message)
+	asserts.Equal(io.EOF, err, "websockets should be closed when the hub stops")
+}
+
+//This is a hack way to add test database for each case, as whole test will just share one database.
+func TestMain(m *testing.M) {
+	test_db = common.TestDBInit()
+	exitVal := m.Run()
+	common.TestDBFree(test_db)
+	os.Exit(exitVal)
+}
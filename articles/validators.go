@@ -4,17 +4,29 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/gosimple/slug"
 	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/filters"
 	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+	"time"
+	"unicode/utf8"
+)
+
+// The longest texts in characters the validators accept, the columns behind them have no practical limit.
+var (
+	MaxArticleDescriptionLength = common.GetEnvInt("ARTICLE_DESCRIPTION_MAX_LENGTH", 2048)
+	MaxArticleBodyLength        = common.GetEnvInt("ARTICLE_BODY_MAX_LENGTH", 200000)
+	MaxCommentBodyLength        = common.GetEnvInt("COMMENT_BODY_MAX_LENGTH", 20000)
 )
 
 type ArticleModelValidator struct {
 	Article struct {
 		Title       string   `form:"title" json:"title" binding:"exists,min=4"`
-		Description string   `form:"description" json:"description" binding:"max=2048"`
-		Body        string   `form:"body" json:"body" binding:"max=2048"`
+		Description string   `form:"description" json:"description"`
+		Body        string   `form:"body" json:"body"`
 		Tags        []string `form:"tagList" json:"tagList"`
 	} `json:"article"`
-	articleModel ArticleModel `json:"-"`
+	articleModel ArticleModel      `json:"-"`
+	verdict      filters.Verdict   `json:"-"`
+	mentioned    []users.UserModel `json:"-"`
 }
 
 func NewArticleModelValidator() ArticleModelValidator {
@@ -23,6 +35,7 @@ func NewArticleModelValidator() ArticleModelValidator {
 
 func NewArticleModelValidatorFillWith(articleModel ArticleModel) ArticleModelValidator {
 	articleModelValidator := NewArticleModelValidator()
+	articleModelValidator.articleModel.ID = articleModel.ID
 	articleModelValidator.Article.Title = articleModel.Title
 	articleModelValidator.Article.Description = articleModel.Description
 	articleModelValidator.Article.Body = articleModel.Body
@@ -39,26 +52,56 @@ func (s *ArticleModelValidator) Bind(c *gin.Context) error {
 	if err != nil {
 		return err
 	}
+	if utf8.RuneCountInString(s.Article.Description) > MaxArticleDescriptionLength {
+		return common.NewLengthError("Description", MaxArticleDescriptionLength)
+	}
+	if utf8.RuneCountInString(s.Article.Body) > MaxArticleBodyLength {
+		return common.NewLengthError("Body", MaxArticleBodyLength)
+	}
 	s.articleModel.Slug = slug.Make(s.Article.Title)
 	s.articleModel.Title = s.Article.Title
 	s.articleModel.Description = s.Article.Description
 	s.articleModel.Body = s.Article.Body
 	s.articleModel.Author = GetArticleUserModel(myUserModel)
 	s.articleModel.setTags(s.Article.Tags)
-	return nil
+	s.mentioned = resolveMentions(myUserModel, s.articleModel.Description+"\n"+s.articleModel.Body)
+
+	var previous []ArticleModel
+	common.GetDB().Where("author_id = ? AND id <> ?", s.articleModel.Author.ID, s.articleModel.ID).
+		Order("id desc").Limit(recentContentLimit).Find(&previous)
+	content := filters.Content{Kind: "article", AuthorID: myUserModel.ID, Text: articleText(s.articleModel)}
+	for _, model := range previous {
+		content.Previous = append(content.Previous, articleText(model))
+	}
+	s.verdict = filters.Check(content)
+	return applyVerdict(s.verdict, &s.articleModel.HiddenAt)
+}
+
+func articleText(model ArticleModel) string {
+	return model.Title + "\n" + model.Description + "\n" + model.Body
 }
 
 type CommentModelValidator struct {
 	Comment struct {
-		Body string `form:"body" json:"body" binding:"max=2048"`
+		Body     string `form:"body" json:"body"`
+		ParentID uint   `form:"parentId" json:"parentId"`
 	} `json:"comment"`
-	commentModel CommentModel `json:"-"`
+	commentModel CommentModel      `json:"-"`
+	verdict      filters.Verdict   `json:"-"`
+	mentioned    []users.UserModel `json:"-"`
 }
 
 func NewCommentModelValidator() CommentModelValidator {
 	return CommentModelValidator{}
 }
 
+func NewCommentModelValidatorFillWith(commentModel CommentModel) CommentModelValidator {
+	commentModelValidator := NewCommentModelValidator()
+	commentModelValidator.commentModel.ID = commentModel.ID
+	commentModelValidator.Comment.Body = commentModel.Body
+	return commentModelValidator
+}
+
 func (s *CommentModelValidator) Bind(c *gin.Context) error {
 	myUserModel := c.MustGet("my_user_model").(users.UserModel)
 
@@ -66,7 +109,72 @@ func (s *CommentModelValidator) Bind(c *gin.Context) error {
 	if err != nil {
 		return err
 	}
+	if utf8.RuneCountInString(s.Comment.Body) > MaxCommentBodyLength {
+		return common.NewLengthError("Body", MaxCommentBodyLength)
+	}
 	s.commentModel.Body = s.Comment.Body
 	s.commentModel.Author = GetArticleUserModel(myUserModel)
+	s.mentioned = resolveMentions(myUserModel, s.commentModel.Body)
+
+	var previous []CommentModel
+	common.GetDB().Where("author_id = ? AND id <> ?", s.commentModel.Author.ID, s.commentModel.ID).
+		Order("id desc").Limit(recentContentLimit).Find(&previous)
+	content := filters.Content{Kind: "comment", AuthorID: myUserModel.ID, Text: s.commentModel.Body}
+	for _, model := range previous {
+		content.Previous = append(content.Previous, model.Body)
+	}
+	s.verdict = filters.Check(content)
+	return applyVerdict(s.verdict, &s.commentModel.HiddenAt)
+}
+
+// The new name of a tag for a rename, or the tag to merge it into.
+type TagNameValidator struct {
+	Tag struct {
+		Name string `form:"name" json:"name" binding:"exists"`
+	} `json:"tag"`
+}
+
+func NewTagNameValidator() TagNameValidator {
+	return TagNameValidator{}
+}
+
+func (s *TagNameValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, s)
+}
+
+type TagAliasValidator struct {
+	Alias struct {
+		Name string `form:"name" json:"name" binding:"exists"`
+	} `json:"alias"`
+}
+
+func NewTagAliasValidator() TagAliasValidator {
+	return TagAliasValidator{}
+}
+
+func (s *TagAliasValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, s)
+}
+
+// How many of the latest texts of the author the repetition filter compares new content with.
+const recentContentLimit = 5
+
+// Rejected content fails Bind, held content is hidden until a moderator had a look at it.
+func applyVerdict(verdict filters.Verdict, hiddenAt **time.Time) error {
+	switch verdict.Outcome {
+	case filters.Reject:
+		return &filters.RejectedError{Verdict: verdict}
+	case filters.Hold:
+		now := time.Now()
+		*hiddenAt = &now
+	}
 	return nil
 }
+
+// Bind fails with validation errors, or with a RejectedError when the content filters refused the content.
+func bindError(err error) common.CommonError {
+	if rejected, ok := err.(*filters.RejectedError); ok {
+		return filters.NewError(rejected.Verdict)
+	}
+	return common.NewValidatorError(err)
+}
@@ -0,0 +1,439 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A Cache stores opaque values by key, a zero ttl means the value never expires.
+// Get reports a miss with false and a nil error, errors are only for a broken backend.
+type Cache interface {
+	Get(key string) ([]byte, bool, error)
+	Set(key string, value []byte, ttl time.Duration) error
+	Delete(key string) error
+}
+
+var cache Cache
+
+// Pick the cache backend: the Redis server named by REDIS_ADDR if set, an in-process LRU otherwise.
+func InitCache() Cache {
+	if addr := os.Getenv("REDIS_ADDR"); addr != "" {
+		cache = NewRedisCache(addr)
+	} else {
+		cache = NewMemoryCache(4096)
+	}
+	return cache
+}
+
+// Using this function to get the cache, it is nil until InitCache is called and then nothing is cached.
+func GetCache() Cache {
+	return cache
+}
+
+// Replace the cache backend, mostly useful in tests. Pass nil to disable caching.
+func SetCache(c Cache) {
+	cache = c
+}
+
+// MemoryCache is a size bounded, least recently used cache living in the process.
+type MemoryCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List
+}
+
+type memoryEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// Create a MemoryCache keeping at most capacity entries.
+func NewMemoryCache(capacity int) *MemoryCache {
+	return &MemoryCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (m *MemoryCache) Get(key string) ([]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	element, ok := m.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	entry := element.Value.(*memoryEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		m.order.Remove(element)
+		delete(m.entries, key)
+		return nil, false, nil
+	}
+	m.order.MoveToFront(element)
+	return entry.value, true, nil
+}
+
+func (m *MemoryCache) Set(key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry := &memoryEntry{key: key, value: value}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+	if element, ok := m.entries[key]; ok {
+		element.Value = entry
+		m.order.MoveToFront(element)
+		return nil
+	}
+	m.entries[key] = m.order.PushFront(entry)
+	for m.order.Len() > m.capacity {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.entries, oldest.Value.(*memoryEntry).key)
+	}
+	return nil
+}
+
+func (m *MemoryCache) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if element, ok := m.entries[key]; ok {
+		m.order.Remove(element)
+		delete(m.entries, key)
+	}
+	return nil
+}
+
+// RedisCache talks the Redis protocol (RESP) to a server shared by every instance of the app.
+// Only GET, SET and DEL are used, so any RESP speaking store will do.
+type RedisCache struct {
+	addr    string
+	timeout time.Duration
+	pool    chan *redisConn
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Create a RedisCache for the server at addr, connections are opened lazily and reused.
+func NewRedisCache(addr string) *RedisCache {
+	return &RedisCache{
+		addr:    addr,
+		timeout: time.Second,
+		pool:    make(chan *redisConn, 8),
+	}
+}
+
+func (r *RedisCache) Get(key string) ([]byte, bool, error) {
+	reply, err := r.do("GET", key)
+	if err != nil || reply == nil {
+		return nil, false, err
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("redis: unexpected reply %v to GET", reply)
+	}
+	return value, true, nil
+}
+
+func (r *RedisCache) Set(key string, value []byte, ttl time.Duration) error {
+	args := []string{"SET", key, string(value)}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	}
+	_, err := r.do(args...)
+	return err
+}
+
+func (r *RedisCache) Delete(key string) error {
+	_, err := r.do("DEL", key)
+	return err
+}
+
+func (r *RedisCache) do(args ...string) (interface{}, error) {
+	var rc *redisConn
+	select {
+	case rc = <-r.pool:
+	default:
+		conn, err := net.DialTimeout("tcp", r.addr, r.timeout)
+		if err != nil {
+			return nil, err
+		}
+		rc = &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	}
+	rc.conn.SetDeadline(time.Now().Add(r.timeout))
+
+	var command bytes.Buffer
+	fmt.Fprintf(&command, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := rc.conn.Write(command.Bytes()); err != nil {
+		rc.conn.Close()
+		return nil, err
+	}
+	reply, err := readRedisReply(rc.reader)
+	if _, isReplyErr := err.(redisError); err != nil && !isReplyErr {
+		// The connection is in an unknown state after an I/O error, do not reuse it.
+		rc.conn.Close()
+		return nil, err
+	}
+	select {
+	case r.pool <- rc:
+	default:
+		rc.conn.Close()
+	}
+	return reply, err
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// Read one RESP reply, bulk strings come back as []byte and a nil bulk string as nil.
+func readRedisReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, errors.New("redis: malformed reply")
+	}
+	kind, payload := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, redisError(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(payload)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		value := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, value); err != nil {
+			return nil, err
+		}
+		return value[:size], nil
+	case '*':
+		size, err := strconv.Atoi(payload)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, size)
+		for i := range values {
+			if values[i], err = readRedisReply(reader); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, errors.New("redis: unknown reply type")
+}
+
+// Cached responses are grouped in namespaces. Every namespace has a generation stored in the
+// cache itself and the generations are part of each response key, so a new generation orphans
+// all the responses of a namespace at once, on every instance sharing the backend.
+// 	common.InvalidateCache("articles")
+func InvalidateCache(namespaces ...string) {
+	if cache == nil {
+		return
+	}
+	for _, namespace := range namespaces {
+		cache.Set("gen:"+namespace, []byte(newCacheGeneration()), 0)
+	}
+}
+
+// The cache namespace holding the responses that depend on who is asking.
+func ViewerCacheNamespace(userID uint) string {
+	return fmt.Sprintf("viewer:%v", userID)
+}
+
+func newCacheGeneration() string {
+	// Never restart from a fixed value, an evicted generation must not revive old responses.
+	return strconv.FormatInt(time.Now().UnixNano(), 36) + RandString(4)
+}
+
+func cacheGeneration(namespace string) (string, error) {
+	value, ok, err := cache.Get("gen:" + namespace)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return string(value), nil
+	}
+	generation := newCacheGeneration()
+	return generation, cache.Set("gen:"+namespace, []byte(generation), 0)
+}
+
+type cachedResponse struct {
+	ContentType string `json:"contentType"`
+	ETag        string `json:"etag"`
+	Body        []byte `json:"body"`
+}
+
+// Buffers what the handler writes so the middleware can tag, cache or drop it.
+type bufferedWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *bufferedWriter) Write(data []byte) (int, error) {
+	return w.body.Write(data)
+}
+
+func (w *bufferedWriter) WriteString(data string) (int, error) {
+	return w.body.WriteString(data)
+}
+
+// Serve GET requests from the cache when possible and answer conditional GETs.
+//
+// Responses are cached per viewer for logged in users (they carry following and favorited flags)
+// and shared between anonymous ones, and are dropped when one of the namespaces is invalidated.
+// Every 200 response gets an ETag and a matching If-None-Match is answered with 304.
+// 	router.GET("/", common.CacheResponse(time.Minute, "articles"), ArticleList)
+func CacheResponse(ttl time.Duration, namespaces ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method != http.MethodGet {
+			c.Next()
+			return
+		}
+		key := ""
+		if cache != nil {
+			key = responseCacheKey(c, namespaces)
+		}
+		if key != "" {
+			if data, ok, err := cache.Get(key); err == nil && ok {
+				var response cachedResponse
+				if json.Unmarshal(data, &response) == nil {
+					c.Header("X-Cache", "HIT")
+					writeTaggedResponse(c, response)
+					c.Abort()
+					return
+				}
+			}
+		}
+
+		writer := &bufferedWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
+		c.Writer = writer.ResponseWriter
+
+		if c.Writer.Written() {
+			return
+		}
+		if c.Writer.Status() != http.StatusOK {
+			c.Writer.Write(writer.body.Bytes())
+			return
+		}
+		response := cachedResponse{
+			ContentType: c.Writer.Header().Get("Content-Type"),
+			ETag:        NewETag(writer.body.Bytes()),
+			Body:        writer.body.Bytes(),
+		}
+		if version := c.Writer.Header().Get("ETag"); version != "" {
+			// Keep the version the handler tagged the resource with in front of the content hash,
+			// If-Match only looks at the version while If-None-Match needs the whole representation.
+			response.ETag = strings.TrimSuffix(version, `"`) + "." + strings.TrimPrefix(response.ETag, `"`)
+		}
+		if key != "" {
+			if data, err := json.Marshal(response); err == nil {
+				cache.Set(key, data, ttl)
+			}
+			c.Header("X-Cache", "MISS")
+		}
+		writeTaggedResponse(c, response)
+	}
+}
+
+func responseCacheKey(c *gin.Context, namespaces []string) string {
+	viewer := "anonymous"
+	if id, ok := c.Get("my_user_id"); ok && id.(uint) != 0 {
+		namespaces = append(namespaces[:len(namespaces):len(namespaces)], ViewerCacheNamespace(id.(uint)))
+		viewer = fmt.Sprintf("%v", id)
+	}
+	parts := []string{viewer, c.Request.URL.RequestURI()}
+	for _, namespace := range namespaces {
+		generation, err := cacheGeneration(namespace)
+		if err != nil {
+			return ""
+		}
+		parts = append(parts, namespace+"="+generation)
+	}
+	digest := sha1.Sum([]byte(strings.Join(parts, "\n")))
+	return "resp:" + hex.EncodeToString(digest[:])
+}
+
+func writeTaggedResponse(c *gin.Context, response cachedResponse) {
+	c.Header("ETag", response.ETag)
+	if ETagMatches(c.GetHeader("If-None-Match"), response.ETag) {
+		c.Status(http.StatusNotModified)
+		c.Writer.WriteHeaderNow()
+		return
+	}
+	c.Data(http.StatusOK, response.ContentType, response.Body)
+}
+
+// A strong ETag derived from the content.
+func NewETag(body []byte) string {
+	digest := sha1.Sum(body)
+	return `"` + hex.EncodeToString(digest[:]) + `"`
+}
+
+// Whether an If-None-Match or If-Match header lists the etag, weak validators included.
+func ETagMatches(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// The entity tag of a versioned row, CacheResponse appends a content hash to it.
+// 	c.Header("ETag", common.VersionETag(articleModel.Version))
+func VersionETag(version uint) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// Whether an If-Match header accepts the current version of a row. Tags written by VersionETag
+// and by CacheResponse are both understood, "*" matches any version.
+// 	if !common.IfMatchVersion(c.GetHeader("If-Match"), articleModel.Version) { 412 }
+func IfMatchVersion(header string, version uint) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" {
+			return true
+		}
+		candidate = strings.SplitN(strings.Trim(candidate, `"`), ".", 2)[0]
+		if parsed, err := strconv.ParseUint(candidate, 10, 32); err == nil && uint(parsed) == version {
+			return true
+		}
+	}
+	return false
+}
@@ -1,10 +1,11 @@
 package common
 
 import (
-	"fmt"
+	"database/sql"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
 	"os"
+	"strings"
 )
 
 type Database struct {
@@ -17,10 +18,14 @@ var DB *gorm.DB
 func Init() *gorm.DB {
 	db, err := gorm.Open("sqlite3", "./../gorm.db")
 	if err != nil {
-		fmt.Println("db err: (Init) ", err)
+		logger.Error().Err(err).Str("func", "common.Init").Msg("db err")
 	}
 	db.DB().SetMaxIdleConns(10)
-	//db.LogMode(true)
+	// Every query is handed to gormLogger, the level of the logger decides which are written.
+	db.SetLogger(gormLogger{})
+	db.LogMode(true)
+	instrumentDB(db)
+	traceDB(db)
 	DB = db
 	return DB
 }
@@ -29,10 +34,13 @@ func Init() *gorm.DB {
 func TestDBInit() *gorm.DB {
 	test_db, err := gorm.Open("sqlite3", "./../gorm_test.db")
 	if err != nil {
-		fmt.Println("db err: (TestDBInit) ", err)
+		logger.Error().Err(err).Str("func", "common.TestDBInit").Msg("db err")
 	}
 	test_db.DB().SetMaxIdleConns(3)
+	test_db.SetLogger(gormLogger{})
 	test_db.LogMode(true)
+	instrumentDB(test_db)
+	traceDB(test_db)
 	DB = test_db
 	return DB
 }
@@ -48,3 +56,39 @@ func TestDBFree(test_db *gorm.DB) error {
 func GetDB() *gorm.DB {
 	return DB
 }
+
+// The column type for text without a practical length limit in the dialect of db.
+// Use it for long-form content rather than a sized varchar, TEXT of MySQL stops at 64KB.
+func LargeTextType(db *gorm.DB) string {
+	switch db.Dialect().GetName() {
+	case "mysql":
+		return "longtext"
+	case "mssql":
+		return "nvarchar(max)"
+	}
+	return "text"
+}
+
+// Widen an existing column to LargeTextType, values are kept and nothing is done if it is wide already.
+// SQLite does not enforce declared lengths and can not alter columns anyway, so it is left alone.
+// 	err := WidenTextColumn(db, "article_models", "body")
+func WidenTextColumn(db *gorm.DB, table string, column string) error {
+	dialect := db.Dialect().GetName()
+	if dialect == "sqlite3" {
+		return nil
+	}
+	target := LargeTextType(db)
+	query := "SELECT data_type, character_maximum_length FROM information_schema.columns WHERE table_name = ? AND column_name = ?"
+	if dialect == "mysql" {
+		query += " AND table_schema = DATABASE()"
+	}
+	var dataType string
+	var maxLength sql.NullInt64
+	if err := db.Raw(query, table, column).Row().Scan(&dataType, &maxLength); err != nil {
+		return err
+	}
+	if strings.EqualFold(dataType, strings.TrimSuffix(target, "(max)")) && (dialect != "mssql" || maxLength.Int64 == -1) {
+		return nil
+	}
+	return db.Table(table).ModifyColumn(column, target).Error
+}
@@ -0,0 +1,284 @@
+package common
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// An event pushed to the streams subscribed to its topic. IDs are taken from the clock and only grow,
+// so a client resuming with the ID of the last event it got can be served by any instance.
+type Event struct {
+	ID    int64           `json:"id"`
+	Topic string          `json:"topic"`
+	Type  string          `json:"type"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// A Broker carries events between the instances of the app. Publish sends an event to every instance,
+// Subscribe hands over every event published by any instance, this one included.
+type Broker interface {
+	Publish(event Event) error
+	Subscribe(deliver func(Event)) error
+}
+
+// LocalBroker only reaches the process it lives in, enough when the app runs as a single instance.
+type LocalBroker struct {
+	mu          sync.RWMutex
+	subscribers []func(Event)
+}
+
+func NewLocalBroker() *LocalBroker {
+	return &LocalBroker{}
+}
+
+func (b *LocalBroker) Publish(event Event) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, deliver := range b.subscribers {
+		deliver(event)
+	}
+	return nil
+}
+
+func (b *LocalBroker) Subscribe(deliver func(Event)) error {
+	b.mu.Lock()
+	b.subscribers = append(b.subscribers, deliver)
+	b.mu.Unlock()
+	return nil
+}
+
+// RedisBroker shares events through a Redis channel with PUBLISH and SUBSCRIBE. Publishing goes
+// through the pooled connections of a RedisCache, subscribing holds a connection of its own and
+// reconnects whenever it is lost. Events published meanwhile are lost, clients resume from the
+// replay buffer of their hub.
+type RedisBroker struct {
+	addr      string
+	channel   string
+	publisher *RedisCache
+}
+
+func NewRedisBroker(addr string, channel string) *RedisBroker {
+	return &RedisBroker{addr: addr, channel: channel, publisher: NewRedisCache(addr)}
+}
+
+func (b *RedisBroker) Publish(event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = b.publisher.do("PUBLISH", b.channel, string(payload))
+	return err
+}
+
+func (b *RedisBroker) Subscribe(deliver func(Event)) error {
+	go func() {
+		for {
+			if err := b.listen(deliver); err != nil {
+				logger.Error().Err(err).Str("func", "common.RedisBroker").Msg("redis err")
+			}
+			time.Sleep(time.Second)
+		}
+	}()
+	return nil
+}
+
+func (b *RedisBroker) listen(deliver func(Event)) error {
+	conn, err := net.DialTimeout("tcp", b.addr, b.publisher.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintf(conn, "*2\r\n$9\r\nSUBSCRIBE\r\n$%d\r\n%s\r\n", len(b.channel), b.channel); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	for {
+		reply, err := readRedisReply(reader)
+		if err != nil {
+			return err
+		}
+		// Pushed messages look like ["message", channel, payload], the subscribe confirmation is skipped.
+		values, ok := reply.([]interface{})
+		if !ok || len(values) != 3 {
+			continue
+		}
+		if kind, _ := values[0].([]byte); string(kind) != "message" {
+			continue
+		}
+		payload, _ := values[2].([]byte)
+		var event Event
+		if err := json.Unmarshal(payload, &event); err == nil {
+			deliver(event)
+		}
+	}
+}
+
+// A Hub fans the events of its broker out to the streams of this instance and keeps the latest of them,
+// so that a client reconnecting with Last-Event-ID gets what it missed while it was away.
+type Hub struct {
+	broker      Broker
+	mu          sync.Mutex
+	subscribers map[*Subscription]bool
+	recent      []Event
+	replaySize  int
+	lastID      int64
+	done        chan struct{}
+	stopOnce    sync.Once
+}
+
+// The events of the topics a stream asked for. Events is closed when the subscriber falls too far
+// behind, the client is expected to reconnect and resume from the last event it got.
+type Subscription struct {
+	Events chan Event
+	topics map[string]bool
+	hub    *Hub
+}
+
+// How many events a subscriber may have waiting before it is dropped.
+const subscriptionBuffer = 64
+
+// Create a hub on top of broker remembering the last replaySize events.
+// 	hub := common.NewHub(common.NewLocalBroker(), 256)
+func NewHub(broker Broker, replaySize int) *Hub {
+	h := &Hub{broker: broker, subscribers: map[*Subscription]bool{}, replaySize: replaySize, done: make(chan struct{})}
+	broker.Subscribe(h.deliver)
+	return h
+}
+
+// Publish an event of type kind with data encoded as JSON to every stream subscribed to topic.
+// 	err := hub.Publish("article:3", "comment", commentResponse)
+func (h *Hub) Publish(topic string, kind string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return h.broker.Publish(Event{ID: h.nextID(), Topic: topic, Type: kind, Data: payload})
+}
+
+func (h *Hub) nextID() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	id := time.Now().UnixNano()
+	if id <= h.lastID {
+		id = h.lastID + 1
+	}
+	h.lastID = id
+	return id
+}
+
+func (h *Hub) deliver(event Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if event.ID > h.lastID {
+		h.lastID = event.ID
+	}
+	h.recent = append(h.recent, event)
+	if len(h.recent) > h.replaySize {
+		h.recent = h.recent[len(h.recent)-h.replaySize:]
+	}
+	for subscription := range h.subscribers {
+		if !subscription.topics[event.Topic] {
+			continue
+		}
+		select {
+		case subscription.Events <- event:
+		default:
+			delete(h.subscribers, subscription)
+			close(subscription.Events)
+		}
+	}
+}
+
+// Subscribe to topics. With a lastID the remembered events after it come back too, to be sent
+// before anything from the subscription.
+// 	subscription, missed := hub.Subscribe([]string{"user:1"}, lastEventID)
+// 	defer subscription.Close()
+func (h *Hub) Subscribe(topics []string, lastID int64) (*Subscription, []Event) {
+	subscription := &Subscription{Events: make(chan Event, subscriptionBuffer), topics: map[string]bool{}, hub: h}
+	for _, topic := range topics {
+		subscription.topics[topic] = true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subscribers[subscription] = true
+	missed := []Event{}
+	if lastID == 0 {
+		return subscription, missed
+	}
+	for _, event := range h.recent {
+		if event.ID > lastID && subscription.topics[event.Topic] {
+			missed = append(missed, event)
+		}
+	}
+	return subscription, missed
+}
+
+// Tell the streams to end when the server shuts down, register it with http.Server.RegisterOnShutdown:
+// the streams outlive Shutdown otherwise, it does not wait for hijacked connections and would wait for
+// the others until its context ends. Stopping twice is fine.
+// 	server.RegisterOnShutdown(hub.Stop)
+func (h *Hub) Stop() {
+	h.stopOnce.Do(func() { close(h.done) })
+}
+
+// Closed once the hub is stopped, the stream of the subscription should close it and return.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.hub.done
+}
+
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	if s.hub.subscribers[s] {
+		delete(s.hub.subscribers, s)
+		close(s.Events)
+	}
+}
+
+var hub *Hub
+
+// Pick the broker: a Redis channel shared by every instance if REDIS_ADDR is set, the process otherwise.
+func InitHub() *Hub {
+	replaySize := GetEnvInt("STREAM_REPLAY_SIZE", 1024)
+	if addr := os.Getenv("REDIS_ADDR"); addr != "" {
+		hub = NewHub(NewRedisBroker(addr, "events"), replaySize)
+	} else {
+		hub = NewHub(NewLocalBroker(), replaySize)
+	}
+	return hub
+}
+
+// Using this function to get the hub, it is nil until InitHub is called and then nothing is streamed.
+func GetHub() *Hub {
+	return hub
+}
+
+// Replace the hub, mostly useful in tests. Pass nil to disable streaming.
+func SetHub(h *Hub) {
+	hub = h
+}
+
+// Publish on the hub if there is one, streaming is best effort and never fails the request behind the event.
+// 	common.PublishEvent("user:1", "notification", notification)
+func PublishEvent(topic string, kind string, data interface{}) {
+	if hub != nil {
+		hub.Publish(topic, kind, data)
+	}
+}
+
+// The domain events of the app, recorded in the outbox of the jobs package with the changes they are about.
+const (
+	ArticleCreated = "article.created"
+	ArticleUpdated = "article.updated"
+	ArticleDeleted = "article.deleted"
+	CommentCreated = "comment.created"
+	FavoriteAdded  = "favorite.added"
+	UserFollowed   = "user.followed"
+)
+
+var DomainEvents = []string{ArticleCreated, ArticleUpdated, ArticleDeleted, CommentCreated, FavoriteAdded, UserFollowed}
@@ -0,0 +1,314 @@
+package common
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+)
+
+// Queries taking SLOW_QUERY_MS (default 200) or longer are logged as warnings.
+var SlowQueryThreshold = time.Duration(GetEnvInt("SLOW_QUERY_MS", 200)) * time.Millisecond
+
+// The header carrying the id of a request, both ways.
+const RequestIDHeader = "X-Request-ID"
+
+// Incoming request ids are only trusted when they look like one, anything else could forge log lines.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// The values of query parameters and route params with these names never make it into the logs.
+var redactedKeys = map[string]bool{
+	"token":        true,
+	"access_token": true,
+	"password":     true,
+	"secret":       true,
+	"api_key":      true,
+}
+
+const redacted = "[REDACTED]"
+
+var logger = newLogger(os.Stderr, zerolog.InfoLevel)
+
+func newLogger(out io.Writer, level zerolog.Level) zerolog.Logger {
+	return zerolog.New(out).Level(level).With().Timestamp().Logger()
+}
+
+// Set up the logger of the app from LOG_LEVEL (trace, debug, info, warn or error, default info) and
+// LOG_FORMAT: JSON lines on stderr, or colored lines for humans when it is console.
+func InitLogger() zerolog.Logger {
+	level, err := zerolog.ParseLevel(strings.ToLower(GetEnv("LOG_LEVEL", "info")))
+	if err != nil || level == zerolog.NoLevel {
+		level = zerolog.InfoLevel
+	}
+	var out io.Writer = os.Stderr
+	if GetEnv("LOG_FORMAT", "json") == "console" {
+		out = zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339}
+	}
+	logger = newLogger(out, level)
+	return logger
+}
+
+// The logger of the app, for code running outside of any request or job.
+func GetLogger() *zerolog.Logger {
+	return &logger
+}
+
+// Replace the logger of the app, tests use it to read what is logged.
+func SetLogger(l zerolog.Logger) {
+	logger = l
+}
+
+// The logger carried by ctx, with the id of the request or job it runs for, or the logger of the app.
+// Model functions given the context of a request log through it.
+// 	common.LoggerFrom(ctx).Warn().Err(err).Msg("delivery failed")
+func LoggerFrom(ctx context.Context) *zerolog.Logger {
+	if ctx != nil {
+		if l := zerolog.Ctx(ctx); l.GetLevel() != zerolog.Disabled {
+			return l
+		}
+	}
+	return &logger
+}
+
+// The logger of the request, with its id and the id of the user once AuthMiddleware knows them.
+// 	common.RequestLogger(c).Error().Err(err).Msg("db err")
+func RequestLogger(c *gin.Context) *zerolog.Logger {
+	l := LoggerFrom(c.Request.Context())
+	if id, ok := c.Get("my_user_id"); ok {
+		if userID, ok := id.(uint); ok && userID != 0 {
+			withUser := l.With().Uint("user_id", userID).Logger()
+			return &withUser
+		}
+	}
+	return l
+}
+
+func newRequestID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Give every request an id and a logger carrying it. The id of the X-Request-ID header a client or a
+// proxy sent is kept when it looks like one, and the id is sent back in the same header.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+		c.Set("request_id", id)
+		c.Header(RequestIDHeader, id)
+		requestLogger := logger.With().Str("request_id", id).Logger()
+		c.Request = c.Request.WithContext(requestLogger.WithContext(c.Request.Context()))
+		c.Next()
+	}
+}
+
+// Log every request once it is answered as one line: its route, status, latency and size. Server
+// errors are logged as errors and client errors as warnings. Tokens and passwords of the URL are redacted.
+func AccessLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		l := RequestLogger(c)
+		status := c.Writer.Status()
+		event := l.Info()
+		if status >= 500 {
+			event = l.Error()
+		} else if status >= 400 {
+			event = l.Warn()
+		}
+		size := c.Writer.Size()
+		if size < 0 {
+			size = 0
+		}
+		event = event.Str("method", c.Request.Method).
+			Str("path", redactedURL(c)).
+			Str("route", RouteTemplate(c)).
+			Int("status", status).
+			Float64("latency_ms", milliseconds(time.Since(start))).
+			Int("bytes", size).
+			Str("client_ip", c.ClientIP()).
+			Str("user_agent", c.Request.UserAgent())
+		if len(c.Errors) > 0 {
+			event = event.Str("errors", c.Errors.String())
+		}
+		event.Msg("request")
+	}
+}
+
+// The key of the gin context holding the template of the route a request matched, see RouteTemplates.
+const routeTemplateKey = "route_template"
+
+// Find the template of the route every request matched among the routes of engine, read at the first
+// request once they are all registered. The params of a request are then found by their position in
+// the template rather than by their value, which may well be the same as a fixed segment of the path.
+// 	r.Use(common.RouteTemplates(r))
+func RouteTemplates(engine *gin.Engine) gin.HandlerFunc {
+	var once sync.Once
+	templates := map[string][][]string{}
+	return func(c *gin.Context) {
+		once.Do(func() {
+			for _, route := range engine.Routes() {
+				templates[route.Method] = append(templates[route.Method], strings.Split(route.Path, "/"))
+			}
+		})
+		if template := matchTemplate(templates[c.Request.Method], strings.Split(c.Request.URL.Path, "/"), c.Params); template != nil {
+			c.Set(routeTemplateKey, template)
+		}
+		c.Next()
+	}
+}
+
+// The template matching the segments of a path with params in the same order, nil if there is none.
+func matchTemplate(templates [][]string, segments []string, params gin.Params) []string {
+	for _, template := range templates {
+		if templateMatches(template, segments, params) {
+			return template
+		}
+	}
+	return nil
+}
+
+func templateMatches(template []string, segments []string, params gin.Params) bool {
+	next := 0
+	for i, part := range template {
+		if i >= len(segments) {
+			return false
+		}
+		if part == "" || (part[0] != ':' && part[0] != '*') {
+			if part != segments[i] {
+				return false
+			}
+			continue
+		}
+		if next >= len(params) || params[next].Key != part[1:] {
+			return false
+		}
+		next++
+		// A catch-all param is the last one and takes the rest of the path.
+		if part[0] == '*' {
+			return next == len(params)
+		}
+	}
+	return len(template) == len(segments) && next == len(params)
+}
+
+// Registered with NoRoute, so that requests matching no route are logged and counted together.
+func UnmatchedRoute(c *gin.Context) {
+	c.Set("route_unmatched", true)
+}
+
+// The route a request matched with its params as in the template, /api/articles/:slug rather than the
+// slug, so that requests to the same route are logged and counted together.
+func RouteTemplate(c *gin.Context) string {
+	if c.GetBool("route_unmatched") {
+		return "unmatched"
+	}
+	return rewriteParams(c, func(param gin.Param) string {
+		return ":" + param.Key
+	})
+}
+
+// The path and query of the request with the values of sensitive params replaced.
+func redactedURL(c *gin.Context) string {
+	path := rewriteParams(c, func(param gin.Param) string {
+		if redactedKeys[strings.ToLower(param.Key)] {
+			return redacted
+		}
+		return param.Value
+	})
+	if c.Request.URL.RawQuery == "" {
+		return path
+	}
+	query, err := url.ParseQuery(c.Request.URL.RawQuery)
+	if err != nil {
+		return path + "?" + redacted
+	}
+	for key, values := range query {
+		if redactedKeys[strings.ToLower(key)] {
+			for i := range values {
+				values[i] = redacted
+			}
+		}
+	}
+	return path + "?" + query.Encode()
+}
+
+// Rewrite the segments of the path the params of the route matched, found by their position in the
+// template of the route, see RouteTemplates. Without a template they are found by their value, in order.
+func rewriteParams(c *gin.Context, rewrite func(param gin.Param) string) string {
+	segments := strings.Split(c.Request.URL.Path, "/")
+	if value, ok := c.Get(routeTemplateKey); ok {
+		template := value.([]string)
+		next := 0
+		for i, segment := range template {
+			if !strings.HasPrefix(segment, ":") && !strings.HasPrefix(segment, "*") {
+				continue
+			}
+			rewritten := rewrite(c.Params[next])
+			next++
+			if segment[0] == '*' {
+				// The value of a catch-all param starts with the slash before it.
+				return strings.Join(segments[:i], "/") + "/" + strings.TrimPrefix(rewritten, "/")
+			}
+			segments[i] = rewritten
+		}
+		return strings.Join(segments, "/")
+	}
+	next := 0
+	for _, param := range c.Params {
+		for i := next; i < len(segments); i++ {
+			if segments[i] == param.Value {
+				segments[i] = rewrite(param)
+				next = i + 1
+				break
+			}
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// The SQL of gorm goes through the logger of the app: every query at debug level, the slow ones as
+// warnings and database errors as errors. The values of the queries are left out, they carry
+// password hashes and tokens. Queries run through GetDBContext log with the logger of their context,
+// with the id of the request or job.
+type gormLogger struct {
+	ctx context.Context
+}
+
+func (l gormLogger) Print(values ...interface{}) {
+	if len(values) < 3 {
+		return
+	}
+	log := LoggerFrom(l.ctx)
+	source, _ := values[1].(string)
+	if values[0] != "sql" || len(values) < 6 {
+		log.Error().Str("source", source).Str("error", fmt.Sprint(values[2:]...)).Msg("db err")
+		return
+	}
+	duration, _ := values[2].(time.Duration)
+	query, _ := values[3].(string)
+	rows, _ := values[5].(int64)
+	event := log.Debug()
+	if duration >= SlowQueryThreshold {
+		event = log.Warn().Bool("slow", true)
+	}
+	event.Str("source", source).Str("sql", strings.TrimSpace(query)).Float64("duration_ms", milliseconds(duration)).
+		Int64("rows", rows).Msg("query")
+}
@@ -0,0 +1,176 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// An email to one recipient. It goes out as multipart/alternative when it has both bodies.
+// Headers are added as they are, List-Unsubscribe for instance.
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+	Headers map[string]string
+}
+
+// A Mailer sends emails, Send returns once the message was handed over.
+type Mailer interface {
+	Send(message Message) error
+}
+
+// SMTPMailer hands the messages to an SMTP server, a local sink such as MailHog in development.
+// STARTTLS is used when the server offers it, the credentials are only sent over TLS or to localhost.
+type SMTPMailer struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+func NewSMTPMailer(addr, from, username, password string) *SMTPMailer {
+	mailer := &SMTPMailer{Addr: addr, From: from}
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		mailer.Auth = smtp.PlainAuth("", username, password, host)
+	}
+	return mailer
+}
+
+func (m *SMTPMailer) Send(message Message) error {
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{message.To}, message.Bytes(m.From))
+}
+
+// LogMailer only logs who would have got what, the default when no SMTP server is configured.
+type LogMailer struct{}
+
+func (LogMailer) Send(message Message) error {
+	logger.Info().Str("to", message.To).Str("subject", message.Subject).Msg("mail")
+	return nil
+}
+
+// MemoryMailer keeps the messages it is given, useful in tests.
+type MemoryMailer struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+func (m *MemoryMailer) Send(message Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, message)
+	return nil
+}
+
+// The messages sent so far, oldest first.
+func (m *MemoryMailer) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message{}, m.messages...)
+}
+
+// Encode the message with its headers as it goes over the wire, from is the sender.
+func (message Message) Bytes(from string) []byte {
+	var buffer bytes.Buffer
+	headers := map[string]string{
+		"From":         from,
+		"To":           message.To,
+		"Subject":      mime.QEncoding.Encode("utf-8", message.Subject),
+		"Date":         time.Now().Format(time.RFC1123Z),
+		"MIME-Version": "1.0",
+	}
+	for key, value := range message.Headers {
+		headers[key] = value
+	}
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&buffer, "%s: %s\r\n", key, headers[key])
+	}
+
+	if message.HTML == "" || message.Text == "" {
+		kind, body := "text/plain", message.Text
+		if message.Text == "" {
+			kind, body = "text/html", message.HTML
+		}
+		fmt.Fprintf(&buffer, "Content-Type: %s; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n", kind)
+		writeQuotedPrintable(&buffer, body)
+		return buffer.Bytes()
+	}
+	boundary := "alternative-" + RandString(24)
+	fmt.Fprintf(&buffer, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", boundary)
+	for _, part := range []struct{ kind, body string }{{"text/plain", message.Text}, {"text/html", message.HTML}} {
+		fmt.Fprintf(&buffer, "--%s\r\nContent-Type: %s; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n", boundary, part.kind)
+		writeQuotedPrintable(&buffer, part.body)
+		buffer.WriteString("\r\n")
+	}
+	fmt.Fprintf(&buffer, "--%s--\r\n", boundary)
+	return buffer.Bytes()
+}
+
+func writeQuotedPrintable(buffer *bytes.Buffer, body string) {
+	writer := quotedprintable.NewWriter(buffer)
+	writer.Write([]byte(body))
+	writer.Close()
+}
+
+var mailer Mailer
+
+// Pick the mailer: the SMTP server named by SMTP_ADDR (host:port) if set, printing the messages otherwise.
+// SMTP_FROM is the sender, SMTP_USERNAME and SMTP_PASSWORD the credentials if the server wants any.
+func InitMailer() Mailer {
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		from := os.Getenv("SMTP_FROM")
+		if from == "" {
+			from = "no-reply@localhost"
+		}
+		mailer = NewSMTPMailer(addr, from, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"))
+	} else {
+		mailer = LogMailer{}
+	}
+	return mailer
+}
+
+// Using this function to get the mailer, it is nil until InitMailer is called and then nothing is sent.
+func GetMailer() Mailer {
+	return mailer
+}
+
+// Send message with the mailer of the app in a span of its own, a child of the span of ctx. Nothing is
+// sent until InitMailer is called.
+// 	err := common.SendMail(ctx, message)
+func SendMail(ctx context.Context, message Message) error {
+	if mailer == nil {
+		return nil
+	}
+	_, span := StartSpan(ctx, "mail.send", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("mail.mailer", fmt.Sprintf("%T", mailer))))
+	defer span.End()
+	err := mailer.Send(message)
+	RecordSpanError(span, err)
+	return err
+}
+
+// Replace the mailer, mostly useful in tests.
+func SetMailer(m Mailer) {
+	mailer = m
+}
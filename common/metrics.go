@@ -0,0 +1,176 @@
+package common
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// The registry GET /metrics exposes, with the runtime of Go and the process besides the metrics of the app.
+var MetricsRegistry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests answered, by method, route template and status.",
+	}, []string{"method", "route", "status"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Time taken to answer HTTP requests, by method and route template.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+	httpInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "http_requests_in_flight",
+		Help: "HTTP requests being answered.",
+	})
+	dbQueries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_queries_total",
+		Help: "Queries run through gorm, by operation and table.",
+	}, []string{"operation", "table"})
+	dbQueryErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_query_errors_total",
+		Help: "Queries run through gorm that failed, records not found aside, by operation and table.",
+	}, []string{"operation", "table"})
+	dbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_query_duration_seconds",
+		Help:    "Time taken by the queries run through gorm, by operation.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"operation"})
+)
+
+func init() {
+	MetricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests, httpDuration, httpInFlight,
+		dbQueries, dbQueryErrors, dbQueryDuration,
+		dbStatsCollector{},
+	)
+}
+
+// A counter of the app registered to MetricsRegistry, for the packages counting what happens in their domain.
+// 	var articlesCreated = common.NewCounter("articles_created_total", "Articles written.")
+func NewCounter(name string, help string) prometheus.Counter {
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: name, Help: help})
+	MetricsRegistry.MustRegister(counter)
+	return counter
+}
+
+// Like NewCounter, with labels.
+// 	var failedLogins = common.NewCounterVec("user_logins_failed_total", "Logins refused.", "reason")
+func NewCounterVec(name string, help string, labels ...string) *prometheus.CounterVec {
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+	MetricsRegistry.MustRegister(counter)
+	return counter
+}
+
+// Count every request and time it by route template, see RouteTemplate, so that the slugs and ids of
+// the URLs don't make a series each.
+func RequestMetrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		httpInFlight.Inc()
+		defer httpInFlight.Dec()
+		c.Next()
+		route := RouteTemplate(c)
+		httpRequests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		httpDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// Serve MetricsRegistry in the format of Prometheus to scrapers sending METRICS_TOKEN as a bearer token.
+// Without a token nobody gets the metrics, they tell too much about the traffic and the failed logins.
+// 	r.GET("/metrics", common.MetricsHandler())
+func MetricsHandler() gin.HandlerFunc {
+	token := GetEnv("METRICS_TOKEN", "")
+	handler := promhttp.HandlerFor(MetricsRegistry, promhttp.HandlerOpts{})
+	return func(c *gin.Context) {
+		if token == "" {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), []byte("Bearer "+token)) != 1 {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// The connection pool of the database of GetDB, read at every scrape since tests swap the database.
+type dbStatsCollector struct{}
+
+var (
+	dbOpenDesc      = prometheus.NewDesc("db_open_connections", "Connections open, in use or idle.", nil, nil)
+	dbInUseDesc     = prometheus.NewDesc("db_in_use_connections", "Connections in use.", nil, nil)
+	dbIdleDesc      = prometheus.NewDesc("db_idle_connections", "Connections idle.", nil, nil)
+	dbMaxOpenDesc   = prometheus.NewDesc("db_max_open_connections", "Most connections the pool opens, 0 for no limit.", nil, nil)
+	dbWaitsDesc     = prometheus.NewDesc("db_wait_count_total", "Times a connection was waited for.", nil, nil)
+	dbWaitedDesc    = prometheus.NewDesc("db_wait_duration_seconds_total", "Time spent waiting for connections.", nil, nil)
+	dbIdleClosed    = prometheus.NewDesc("db_max_idle_closed_total", "Connections closed for the idle limit of the pool.", nil, nil)
+	dbLifetimeClose = prometheus.NewDesc("db_max_lifetime_closed_total", "Connections closed for their lifetime limit.", nil, nil)
+)
+
+func (dbStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{dbOpenDesc, dbInUseDesc, dbIdleDesc, dbMaxOpenDesc, dbWaitsDesc, dbWaitedDesc, dbIdleClosed, dbLifetimeClose} {
+		ch <- desc
+	}
+}
+
+func (dbStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	db := GetDB()
+	if db == nil || db.DB() == nil {
+		return
+	}
+	stats := db.DB().Stats()
+	ch <- prometheus.MustNewConstMetric(dbOpenDesc, prometheus.GaugeValue, float64(stats.OpenConnections))
+	ch <- prometheus.MustNewConstMetric(dbInUseDesc, prometheus.GaugeValue, float64(stats.InUse))
+	ch <- prometheus.MustNewConstMetric(dbIdleDesc, prometheus.GaugeValue, float64(stats.Idle))
+	ch <- prometheus.MustNewConstMetric(dbMaxOpenDesc, prometheus.GaugeValue, float64(stats.MaxOpenConnections))
+	ch <- prometheus.MustNewConstMetric(dbWaitsDesc, prometheus.CounterValue, float64(stats.WaitCount))
+	ch <- prometheus.MustNewConstMetric(dbWaitedDesc, prometheus.CounterValue, stats.WaitDuration.Seconds())
+	ch <- prometheus.MustNewConstMetric(dbIdleClosed, prometheus.CounterValue, float64(stats.MaxIdleClosed))
+	ch <- prometheus.MustNewConstMetric(dbLifetimeClose, prometheus.CounterValue, float64(stats.MaxLifetimeClosed))
+}
+
+// Count and time the queries of gorm. Every database opened gets its own copy of the callbacks, so
+// Init and TestDBInit both instrument theirs.
+func instrumentDB(db *gorm.DB) {
+	callback := db.Callback()
+	callback.Create().Before("gorm:begin_transaction").Register("metrics:before_create", startQuery)
+	callback.Create().After("gorm:commit_or_rollback_transaction").Register("metrics:after_create", endQuery("create"))
+	callback.Query().Before("gorm:query").Register("metrics:before_query", startQuery)
+	callback.Query().After("gorm:after_query").Register("metrics:after_query", endQuery("query"))
+	callback.Update().Before("gorm:begin_transaction").Register("metrics:before_update", startQuery)
+	callback.Update().After("gorm:commit_or_rollback_transaction").Register("metrics:after_update", endQuery("update"))
+	callback.Delete().Before("gorm:begin_transaction").Register("metrics:before_delete", startQuery)
+	callback.Delete().After("gorm:commit_or_rollback_transaction").Register("metrics:after_delete", endQuery("delete"))
+	callback.RowQuery().Before("gorm:row_query").Register("metrics:before_row_query", startQuery)
+	callback.RowQuery().After("gorm:row_query").Register("metrics:after_row_query", endQuery("row_query"))
+}
+
+func startQuery(scope *gorm.Scope) {
+	scope.Set("metrics:started_at", time.Now())
+}
+
+func endQuery(operation string) func(scope *gorm.Scope) {
+	return func(scope *gorm.Scope) {
+		value, ok := scope.Get("metrics:started_at")
+		if !ok {
+			return
+		}
+		table := scope.TableName()
+		dbQueries.WithLabelValues(operation, table).Inc()
+		dbQueryDuration.WithLabelValues(operation).Observe(time.Since(value.(time.Time)).Seconds())
+		if err := scope.DB().Error; err != nil && !gorm.IsRecordNotFoundError(err) {
+			dbQueryErrors.WithLabelValues(operation, table).Inc()
+		}
+	}
+}
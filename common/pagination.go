@@ -0,0 +1,217 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Cursors are signed with their own key so that a leaked cursor can never be replayed as a JWT.
+const NBCursorSecret = "A Cursor Key Very Very Very Opaque!!@##$!@#$"
+
+const DefaultPageLimit = 20
+
+var ErrInvalidCursor = errors.New("Invalid cursor")
+
+// A well signed cursor handed out by another listing, or by the same listing with other filters.
+var ErrCursorMismatch = errors.New("Cursor of another listing")
+
+// A keyset position in a listing. The client only ever sees the signed, encoded form.
+//
+// Forward pages continue after ID in the listing order, backward pages return the rows before it.
+// Listings ordered by a computed score also keep the Score of the row and the time At (unix nanoseconds)
+// they were ranked at. Listing names the listing and the filters the cursor was handed out for, see
+// NewListing.
+type Cursor struct {
+	ID       uint    `json:"i"`
+	Backward bool    `json:"b,omitempty"`
+	Score    float64 `json:"s,omitempty"`
+	At       int64   `json:"t,omitempty"`
+	Listing  string  `json:"l,omitempty"`
+}
+
+// Encode the cursor as "<payload>.<signature>", both base64url without padding.
+// 	next := EncodeCursor(Cursor{ID: lastID})
+func EncodeCursor(cursor Cursor) string {
+	payload, _ := json.Marshal(cursor)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + signCursor(encoded)
+}
+
+// Check the signature and decode a cursor received from a client.
+// 	cursor, err := DecodeCursor(c.Query("cursor"))
+func DecodeCursor(token string) (Cursor, error) {
+	var cursor Cursor
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return cursor, ErrInvalidCursor
+	}
+	if !hmac.Equal([]byte(parts[1]), []byte(signCursor(parts[0]))) {
+		return cursor, ErrInvalidCursor
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return cursor, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(payload, &cursor); err != nil || cursor.ID == 0 {
+		return cursor, ErrInvalidCursor
+	}
+	return cursor, nil
+}
+
+func signCursor(encoded string) string {
+	mac := hmac.New(sha256.New, []byte(NBCursorSecret))
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// The key of a listing and its filters, kept in the cursors it hands out so that they are refused by
+// any other listing. Only a short hash is kept, the filters can be long.
+// 	listing := NewListing("articles", tag, author, favorited)
+func NewListing(name string, filters ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(append([]string{name}, filters...), "\x00")))
+	return base64.RawURLEncoding.EncodeToString(sum[:8])
+}
+
+// The status to answer a cursor refused by NewPagination with: 400 for the cursor of another listing,
+// 422 for a malformed one.
+func CursorErrorStatus(err error) int {
+	if err == ErrCursorMismatch {
+		return http.StatusBadRequest
+	}
+	return http.StatusUnprocessableEntity
+}
+
+// Pagination describes which page of a listing is requested, either by the legacy
+// limit/offset pair or by a keyset cursor. A zero Limit means no limit at all.
+type Pagination struct {
+	Limit   int
+	Offset  int
+	Cursor  *Cursor
+	Listing string
+}
+
+// Build a Pagination of the listing from raw query strings. The cursor wins over the offset when both
+// are given, and a malformed limit or offset falls back to the defaults like it always did. A cursor
+// handed out by another listing is refused with ErrCursorMismatch.
+// 	page, err := NewPagination(NewListing("articles", tag), c.Query("limit"), c.Query("offset"), c.Query("cursor"), DefaultPageLimit)
+func NewPagination(listing, limit, offset, cursor string, defaultLimit int) (Pagination, error) {
+	page := Pagination{Limit: defaultLimit, Listing: listing}
+	if limitInt, err := strconv.Atoi(limit); err == nil && limitInt > 0 {
+		page.Limit = limitInt
+	}
+	if cursor != "" {
+		decoded, err := DecodeCursor(cursor)
+		if err != nil {
+			return page, err
+		}
+		if decoded.Listing != listing {
+			return page, ErrCursorMismatch
+		}
+		page.Cursor = &decoded
+		return page, nil
+	}
+	if offsetInt, err := strconv.Atoi(offset); err == nil && offsetInt > 0 {
+		page.Offset = offsetInt
+	}
+	return page, nil
+}
+
+// Apply the page window on a query ordered by the `id` column of table.
+// One extra row is fetched in cursor mode so that Info knows whether another page exists,
+// backward pages come out in reverse and have to be flipped by the caller, see Reverse.
+// 	tx = page.Scope(tx, "article_models", true)
+func (p Pagination) Scope(tx *gorm.DB, table string, desc bool) *gorm.DB {
+	column := table + ".id"
+	backward := p.Cursor != nil && p.Cursor.Backward
+	if p.Cursor != nil {
+		if desc != backward {
+			tx = tx.Where(column+" < ?", p.Cursor.ID)
+		} else {
+			tx = tx.Where(column+" > ?", p.Cursor.ID)
+		}
+	}
+	if desc != backward {
+		tx = tx.Order(column + " desc")
+	} else {
+		tx = tx.Order(column + " asc")
+	}
+	if p.Cursor == nil && p.Offset > 0 {
+		tx = tx.Offset(p.Offset)
+	}
+	if p.Limit > 0 {
+		if p.Cursor != nil {
+			tx = tx.Limit(p.Limit + 1)
+		} else {
+			tx = tx.Limit(p.Limit)
+		}
+	}
+	return tx
+}
+
+// Encode a cursor of the listing of the page, for listings that compute their own cursors.
+// 	info.NextCursor = page.EncodeCursor(Cursor{ID: last.ID, At: last.UpdatedAt.UnixNano()})
+func (p Pagination) EncodeCursor(cursor Cursor) string {
+	cursor.Listing = p.Listing
+	return EncodeCursor(cursor)
+}
+
+// Whether rows fetched by Scope have to be reversed before they are returned.
+func (p Pagination) Reverse() bool {
+	return p.Cursor != nil && p.Cursor.Backward
+}
+
+// PageInfo carries the cursors around a page that was just loaded.
+type PageInfo struct {
+	NextCursor string
+	PrevCursor string
+}
+
+// Trim the extra row fetched by Scope and compute the cursors around the page.
+// ids are the ids of the fetched rows in the order Scope returned them, the returned int is how many
+// rows to keep. Cut the rows to that length first, then flip them if Reverse says so.
+// 	keep, info := page.Info(ids, count)
+func (p Pagination) Info(ids []uint, total int) (int, PageInfo) {
+	var info PageInfo
+	keep := len(ids)
+	more := false
+	if p.Cursor != nil && p.Limit > 0 && keep > p.Limit {
+		keep = p.Limit
+		more = true
+	}
+	if keep == 0 {
+		return 0, info
+	}
+	first, last := ids[0], ids[keep-1]
+	if p.Reverse() {
+		first, last = last, first
+	}
+
+	switch {
+	case p.Cursor == nil:
+		if p.Limit > 0 && p.Offset+keep < total {
+			info.NextCursor = p.EncodeCursor(Cursor{ID: last})
+		}
+		if p.Offset > 0 {
+			info.PrevCursor = p.EncodeCursor(Cursor{ID: first, Backward: true})
+		}
+	case p.Cursor.Backward:
+		info.NextCursor = p.EncodeCursor(Cursor{ID: last})
+		if more {
+			info.PrevCursor = p.EncodeCursor(Cursor{ID: first, Backward: true})
+		}
+	default:
+		if more {
+			info.NextCursor = p.EncodeCursor(Cursor{ID: last})
+		}
+		info.PrevCursor = p.EncodeCursor(Cursor{ID: first, Backward: true})
+	}
+	return keep, info
+}
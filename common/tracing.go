@@ -0,0 +1,205 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The name the spans of the app are reported under.
+const tracerName = "github.com/gothinkster/golang-gin-realworld-example-app"
+
+// The key of the context a gorm query runs for, see GetDBContext.
+const traceContextKey = "tracing:context"
+
+// The database systems of the dialects of gorm, as OpenTelemetry names them.
+var dbSystems = map[string]string{
+	"sqlite3":  "sqlite",
+	"postgres": "postgresql",
+	"mysql":    "mysql",
+	"mssql":    "mssql",
+}
+
+// Set up tracing from OTEL_TRACES_EXPORTER: otlp sends the spans over HTTP to the collector named by the
+// OTEL_EXPORTER_OTLP_* variables (http://localhost:4318 by default), stdout prints them, away from the
+// logs on stderr, file appends them as JSON lines to OTEL_TRACES_FILE (default traces.jsonl) and none, the
+// default, records nothing but still passes the trace context of incoming requests on. OTEL_SERVICE_NAME
+// names the app (default conduit) and OTEL_TRACES_SAMPLER samples the traces as usual. The returned
+// function flushes the spans left when the app stops.
+// 	shutdown := common.InitTracer()
+// 	defer shutdown(ctx)
+func InitTracer() func(ctx context.Context) error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	var exporter sdktrace.SpanExporter
+	var err error
+	var file *os.File
+	switch name := strings.ToLower(GetEnv("OTEL_TRACES_EXPORTER", "none")); name {
+	case "otlp":
+		exporter, err = otlptracehttp.New(context.Background())
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint(), stdouttrace.WithWriter(os.Stdout))
+	case "file":
+		file, err = os.OpenFile(GetEnv("OTEL_TRACES_FILE", "traces.jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err == nil {
+			exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+		}
+	case "none", "":
+	default:
+		logger.Warn().Str("exporter", name).Msg("unknown traces exporter, tracing is off")
+	}
+	if err != nil {
+		logger.Error().Err(err).Str("func", "common.InitTracer").Msg("tracing err")
+	}
+	if exporter == nil {
+		return func(ctx context.Context) error { return nil }
+	}
+	service, err := resource.Merge(resource.Default(),
+		resource.NewSchemaless(semconv.ServiceName(GetEnv("OTEL_SERVICE_NAME", "conduit"))))
+	if err != nil {
+		service = resource.Default()
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(service))
+	otel.SetTracerProvider(provider)
+	if file == nil {
+		return provider.Shutdown
+	}
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+}
+
+// Start a span as a child of the one in ctx, the caller ends it once the work is done.
+// 	ctx, span := common.StartSpan(ctx, "articles.serialize")
+// 	defer span.End()
+func StartSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, opts...)
+}
+
+// Mark the span as failed with err, if there is one.
+func RecordSpanError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// Add the trace context of ctx to the headers of an outgoing request, so that the server called carries
+// on the same trace.
+func InjectTraceContext(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// Trace every request in a span named after its route template, as a child of the span of the caller when
+// it sends a traceparent header. The logger of the request gets the id of the trace. The context of the
+// request carries the span, the queries run through GetDBContext with it are its children.
+func Tracing() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		ctx, span := StartSpan(ctx, c.Request.Method, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPMethod(c.Request.Method),
+				semconv.HTTPTarget(redactedURL(c)),
+				semconv.UserAgentOriginal(c.Request.UserAgent()),
+				semconv.ClientAddress(c.ClientIP()),
+				attribute.String("request_id", c.GetString("request_id")),
+			))
+		defer span.End()
+		if spanContext := span.SpanContext(); spanContext.HasTraceID() {
+			traced := LoggerFrom(ctx).With().Str("trace_id", spanContext.TraceID().String()).Logger()
+			ctx = traced.WithContext(ctx)
+		}
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		route := RouteTemplate(c)
+		status := c.Writer.Status()
+		span.SetName(c.Request.Method + " " + route)
+		span.SetAttributes(semconv.HTTPRoute(route), semconv.HTTPStatusCode(status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		if len(c.Errors) > 0 {
+			span.SetAttributes(attribute.String("errors", c.Errors.String()))
+		}
+	}
+}
+
+// The database for work done for ctx: its queries are traced as children of the span of ctx and logged
+// with the logger of ctx, see LoggerFrom. Queries run through GetDB are not traced, they would make a
+// trace each.
+// 	db := common.GetDBContext(c.Request.Context())
+func GetDBContext(ctx context.Context) *gorm.DB {
+	db := GetDB().Set(traceContextKey, ctx)
+	db.SetLogger(gormLogger{ctx})
+	return db
+}
+
+// Trace the queries of gorm run for a context, see GetDBContext. Like instrumentDB, every database
+// opened gets its own copy of the callbacks.
+func traceDB(db *gorm.DB) {
+	callback := db.Callback()
+	callback.Create().Before("gorm:begin_transaction").Register("tracing:before_create", startQuerySpan("create"))
+	callback.Create().After("gorm:commit_or_rollback_transaction").Register("tracing:after_create", endQuerySpan)
+	callback.Query().Before("gorm:query").Register("tracing:before_query", startQuerySpan("query"))
+	callback.Query().After("gorm:after_query").Register("tracing:after_query", endQuerySpan)
+	callback.Update().Before("gorm:begin_transaction").Register("tracing:before_update", startQuerySpan("update"))
+	callback.Update().After("gorm:commit_or_rollback_transaction").Register("tracing:after_update", endQuerySpan)
+	callback.Delete().Before("gorm:begin_transaction").Register("tracing:before_delete", startQuerySpan("delete"))
+	callback.Delete().After("gorm:commit_or_rollback_transaction").Register("tracing:after_delete", endQuerySpan)
+	callback.RowQuery().Before("gorm:row_query").Register("tracing:before_row_query", startQuerySpan("row_query"))
+	callback.RowQuery().After("gorm:row_query").Register("tracing:after_row_query", endQuerySpan)
+}
+
+func startQuerySpan(operation string) func(scope *gorm.Scope) {
+	return func(scope *gorm.Scope) {
+		value, ok := scope.Get(traceContextKey)
+		if !ok {
+			return
+		}
+		ctx, ok := value.(context.Context)
+		if !ok || !trace.SpanContextFromContext(ctx).IsValid() {
+			return
+		}
+		table := scope.TableName()
+		system := dbSystems[scope.Dialect().GetName()]
+		if system == "" {
+			system = scope.Dialect().GetName()
+		}
+		_, span := StartSpan(ctx, operation+" "+table, trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(semconv.DBSystemKey.String(system), semconv.DBSQLTable(table), attribute.String("db.operation", operation)))
+		scope.Set("tracing:span", span)
+	}
+}
+
+// The statement is recorded without its values, they carry password hashes and tokens.
+func endQuerySpan(scope *gorm.Scope) {
+	value, ok := scope.Get("tracing:span")
+	if !ok {
+		return
+	}
+	span := value.(trace.Span)
+	span.SetAttributes(semconv.DBStatement(strings.TrimSpace(scope.SQL)), attribute.Int64("db.rows_affected", scope.DB().RowsAffected))
+	if err := scope.DB().Error; !gorm.IsRecordNotFoundError(err) {
+		RecordSpanError(span, err)
+	}
+	span.End()
+}
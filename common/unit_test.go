@@ -1,15 +1,34 @@
 package common
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func TestConnectingDatabase(t *testing.T) {
@@ -163,3 +182,720 @@ func TestNewError(t *testing.T) {
 	assert.Equal(map[string]interface{}(map[string]interface{}{"database": "no such table: not_exists"}),
 		commenError.Errors, "commenError should have right error info")
 }
+
+func TestBodySizeLimit(t *testing.T) {
+	asserts := assert.New(t)
+
+	r := gin.New()
+	r.Use(BodySizeLimit(16))
+	r.POST("/echo", func(c *gin.Context) {
+		body, _ := ioutil.ReadAll(c.Request.Body)
+		c.String(http.StatusOK, string(body))
+	})
+	post := func(body io.Reader) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/echo", body)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := post(bytes.NewBufferString("sixteen bytes!!!"))
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal("sixteen bytes!!!", w.Body.String())
+	w = post(bytes.NewBufferString("seventeen bytes!!"))
+	asserts.Equal(http.StatusRequestEntityTooLarge, w.Code)
+	asserts.Equal(`{"errors":{"body":"Request body is larger than 16 bytes"}}`, w.Body.String())
+	// Without a known length the body is only caught while reading it.
+	w = post(ioutil.NopCloser(strings.NewReader("seventeen bytes!!")))
+	asserts.Equal(http.StatusRequestEntityTooLarge, w.Code)
+
+	asserts.Equal(`{"errors":{"Body":"{max: 10}"}}`, mustJSON(NewValidatorError(NewLengthError("Body", 10))))
+	asserts.Equal("text", LargeTextType(TestDBInit()))
+}
+
+func mustJSON(value interface{}) string {
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+func TestCursor(t *testing.T) {
+	asserts := assert.New(t)
+
+	token := EncodeCursor(Cursor{ID: 42, Backward: true})
+	cursor, err := DecodeCursor(token)
+	asserts.NoError(err, "encoded cursor should decode")
+	asserts.Equal(Cursor{ID: 42, Backward: true}, cursor, "cursor should survive a round trip")
+
+	forged := strings.Split(EncodeCursor(Cursor{ID: 43}), ".")[0] + "." + strings.Split(token, ".")[1]
+	_, err = DecodeCursor(forged)
+	asserts.Equal(ErrInvalidCursor, err, "cursor with a bad signature should be rejected")
+	_, err = DecodeCursor("eyJpIjo0Mn0")
+	asserts.Equal(ErrInvalidCursor, err, "unsigned cursor should be rejected")
+
+	page, err := NewPagination("", "", "10", "", DefaultPageLimit)
+	asserts.NoError(err)
+	asserts.Equal(Pagination{Limit: DefaultPageLimit, Offset: 10}, page, "offset mode should be kept")
+
+	page, err = NewPagination("", "2", "10", EncodeCursor(Cursor{ID: 7}), DefaultPageLimit)
+	asserts.NoError(err)
+	asserts.Equal(Pagination{Limit: 2, Cursor: &Cursor{ID: 7}}, page, "cursor should win over offset")
+
+	keep, info := page.Info([]uint{6, 5, 4}, 10)
+	asserts.Equal(2, keep, "extra row should be trimmed")
+	asserts.Equal(EncodeCursor(Cursor{ID: 5}), info.NextCursor, "next cursor should point after the last row")
+	asserts.Equal(EncodeCursor(Cursor{ID: 6, Backward: true}), info.PrevCursor, "prev cursor should point before the first row")
+
+	page = Pagination{Limit: 2, Cursor: &Cursor{ID: 4, Backward: true}}
+	keep, info = page.Info([]uint{5, 6}, 10)
+	asserts.Equal(2, keep)
+	asserts.Equal(EncodeCursor(Cursor{ID: 5}), info.NextCursor, "backward page should link forward again")
+	asserts.Equal("", info.PrevCursor, "first page should not have a prev cursor")
+
+	rust := NewListing("articles", "rust", "", "")
+	asserts.NotEqual(rust, NewListing("articles", "go", "", ""), "filters should make another listing")
+	asserts.NotEqual(rust, NewListing("articles", "", "rust", ""), "filters should be told apart by position")
+	page = Pagination{Limit: 1, Listing: rust}
+	_, info = page.Info([]uint{9}, 2)
+	page, err = NewPagination(rust, "1", "", info.NextCursor, DefaultPageLimit)
+	asserts.NoError(err, "cursor should be accepted by its own listing")
+	asserts.Equal(&Cursor{ID: 9, Listing: rust}, page.Cursor)
+	_, err = NewPagination(NewListing("articles", "go", "", ""), "1", "", info.NextCursor, DefaultPageLimit)
+	asserts.Equal(ErrCursorMismatch, err, "cursor should be refused with other filters")
+	asserts.Equal(http.StatusBadRequest, CursorErrorStatus(err))
+	_, err = NewPagination(NewListing("feed", "chronological"), "1", "", info.NextCursor, DefaultPageLimit)
+	asserts.Equal(ErrCursorMismatch, err, "cursor should be refused by another listing")
+}
+
+func TestMemoryCache(t *testing.T) {
+	asserts := assert.New(t)
+
+	cache := NewMemoryCache(2)
+	cache.Set("a", []byte("1"), 0)
+	cache.Set("b", []byte("2"), 0)
+	value, ok, err := cache.Get("a")
+	asserts.NoError(err)
+	asserts.True(ok, "value should be cached")
+	asserts.Equal([]byte("1"), value)
+
+	cache.Set("c", []byte("3"), 0)
+	_, ok, _ = cache.Get("b")
+	asserts.False(ok, "least recently used value should be evicted")
+	_, ok, _ = cache.Get("a")
+	asserts.True(ok, "recently used value should be kept")
+
+	cache.Set("d", []byte("4"), time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	_, ok, _ = cache.Get("d")
+	asserts.False(ok, "expired value should be gone")
+
+	cache.Delete("a")
+	_, ok, _ = cache.Get("a")
+	asserts.False(ok, "deleted value should be gone")
+}
+
+// A tiny stand-in speaking just enough RESP for RedisCache.
+func fakeRedisServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	store := map[string]string{}
+	subscribers := map[string][]net.Conn{}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					reply, err := readRedisReply(reader)
+					if err != nil {
+						return
+					}
+					var args []string
+					for _, arg := range reply.([]interface{}) {
+						args = append(args, string(arg.([]byte)))
+					}
+					mu.Lock()
+					switch strings.ToUpper(args[0]) {
+					case "GET":
+						if value, ok := store[args[1]]; ok {
+							fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(value), value)
+						} else {
+							conn.Write([]byte("$-1\r\n"))
+						}
+					case "SET":
+						store[args[1]] = args[2]
+						conn.Write([]byte("+OK\r\n"))
+					case "DEL":
+						delete(store, args[1])
+						conn.Write([]byte(":1\r\n"))
+					case "SUBSCRIBE":
+						subscribers[args[1]] = append(subscribers[args[1]], conn)
+						fmt.Fprintf(conn, "*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(args[1]), args[1])
+					case "PUBLISH":
+						for _, subscriber := range subscribers[args[1]] {
+							fmt.Fprintf(subscriber, "*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n",
+								len(args[1]), args[1], len(args[2]), args[2])
+						}
+						fmt.Fprintf(conn, ":%d\r\n", len(subscribers[args[1]]))
+					default:
+						conn.Write([]byte("-ERR unknown command\r\n"))
+					}
+					mu.Unlock()
+				}
+			}(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestRedisCache(t *testing.T) {
+	asserts := assert.New(t)
+
+	cache := NewRedisCache(fakeRedisServer(t))
+	_, ok, err := cache.Get("missing")
+	asserts.NoError(err)
+	asserts.False(ok, "missing key should be a miss")
+
+	asserts.NoError(cache.Set("key", []byte("multi\r\nline"), time.Minute))
+	value, ok, err := cache.Get("key")
+	asserts.NoError(err)
+	asserts.True(ok, "value should be stored")
+	asserts.Equal([]byte("multi\r\nline"), value, "binary safe values should survive")
+
+	asserts.NoError(cache.Delete("key"))
+	_, ok, _ = cache.Get("key")
+	asserts.False(ok, "deleted key should be a miss")
+
+	_, err = cache.do("PING")
+	asserts.EqualError(err, "redis: ERR unknown command", "server errors should be reported")
+
+	_, _, err = NewRedisCache("127.0.0.1:1").Get("key")
+	asserts.Error(err, "unreachable server should be an error")
+}
+
+func TestEventHub(t *testing.T) {
+	asserts := assert.New(t)
+
+	hub := NewHub(NewLocalBroker(), 3)
+	first, _ := hub.Subscribe([]string{"user:1"}, 0)
+	second, _ := hub.Subscribe([]string{"user:2", "article:1"}, 0)
+	asserts.NoError(hub.Publish("user:1", "notification", map[string]int{"id": 1}))
+	asserts.NoError(hub.Publish("article:1", "comment", map[string]int{"id": 2}))
+	event := <-first.Events
+	asserts.Equal("notification", event.Type)
+	asserts.Equal(`{"id":1}`, string(event.Data))
+	asserts.Equal("comment", (<-second.Events).Type)
+	asserts.Len(first.Events, 0, "events should only reach the subscribers of their topic")
+
+	hub.Publish("user:1", "notification", map[string]int{"id": 3})
+	hub.Publish("user:1", "notification", map[string]int{"id": 4})
+	resumed, missed := hub.Subscribe([]string{"user:1"}, event.ID)
+	asserts.Len(missed, 2, "events after the last event id should be replayed")
+	asserts.True(missed[0].ID > event.ID && missed[1].ID > missed[0].ID, "event ids should grow")
+	resumed.Close()
+	_, missed = hub.Subscribe([]string{"user:1"}, 1)
+	asserts.Len(missed, 2, "only the latest events should be remembered")
+
+	for i := 0; i <= subscriptionBuffer; i++ {
+		hub.Publish("article:1", "comment", i)
+	}
+	var received int
+	for range second.Events {
+		received++
+	}
+	asserts.Equal(subscriptionBuffer, received, "subscribers falling behind should be dropped")
+	first.Close()
+	first.Close()
+	select {
+	case <-first.Done():
+		asserts.Fail("subscriptions should not be done before the hub stops")
+	default:
+	}
+	hub.Stop()
+	hub.Stop()
+	_, ok := <-resumed.Done()
+	asserts.False(ok, "subscriptions should be done once the hub stops")
+
+	addr := fakeRedisServer(t)
+	publisher := NewHub(NewRedisBroker(addr, "events"), 10)
+	listener := NewHub(NewRedisBroker(addr, "events"), 10)
+	subscription, _ := listener.Subscribe([]string{"user:1"}, 0)
+	deadline := time.After(2 * time.Second)
+	// The brokers subscribe in the background, publish until the first event makes it through.
+	for delivered := false; !delivered; {
+		publisher.Publish("user:1", "notification", "hello")
+		select {
+		case event := <-subscription.Events:
+			asserts.Equal(`"hello"`, string(event.Data), "events should reach the other instances")
+			delivered = true
+		case <-time.After(20 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("events should be shared through redis")
+		}
+	}
+}
+
+func TestCacheResponse(t *testing.T) {
+	asserts := assert.New(t)
+
+	SetCache(NewMemoryCache(16))
+	defer SetCache(nil)
+
+	calls := 0
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		id, _ := strconv.Atoi(c.GetHeader("X-User"))
+		c.Set("my_user_id", uint(id))
+	})
+	r.GET("/articles", CacheResponse(time.Minute, "articles"), func(c *gin.Context) {
+		calls++
+		c.JSON(http.StatusOK, gin.H{"calls": calls, "viewer": c.GetHeader("X-User")})
+	})
+	get := func(user string, etag string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/articles", nil)
+		req.Header.Set("X-User", user)
+		req.Header.Set("If-None-Match", etag)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	first := get("0", "")
+	asserts.Equal(http.StatusOK, first.Code)
+	asserts.Equal("MISS", first.Header().Get("X-Cache"))
+	second := get("0", "")
+	asserts.Equal("HIT", second.Header().Get("X-Cache"), "anonymous response should be shared")
+	asserts.Equal(first.Body.String(), second.Body.String())
+	asserts.Equal(first.Header().Get("ETag"), second.Header().Get("ETag"))
+	asserts.Equal(1, calls)
+
+	notModified := get("0", first.Header().Get("ETag"))
+	asserts.Equal(http.StatusNotModified, notModified.Code, "matching ETag should return 304")
+	asserts.Equal("", notModified.Body.String())
+
+	viewer := get("1", "")
+	asserts.Equal("MISS", viewer.Header().Get("X-Cache"), "logged in users should have their own entry")
+	asserts.Equal(2, calls)
+
+	InvalidateCache(ViewerCacheNamespace(1))
+	asserts.Equal("MISS", get("1", "").Header().Get("X-Cache"), "viewer invalidation should drop their responses")
+	asserts.Equal("HIT", get("0", "").Header().Get("X-Cache"), "viewer invalidation should not touch others")
+
+	InvalidateCache("articles")
+	fresh := get("0", first.Header().Get("ETag"))
+	asserts.Equal(http.StatusOK, fresh.Code, "changed content should not match the old ETag")
+	asserts.Equal("MISS", fresh.Header().Get("X-Cache"))
+}
+
+func TestIfMatchVersion(t *testing.T) {
+	asserts := assert.New(t)
+
+	asserts.True(IfMatchVersion(VersionETag(3), 3))
+	asserts.True(IfMatchVersion(`W/"3.0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33"`, 3), "cached tags should match by version")
+	asserts.True(IfMatchVersion(`"1", "3"`, 3), "any tag of the list may match")
+	asserts.True(IfMatchVersion("*", 3))
+	asserts.False(IfMatchVersion(`"2"`, 3))
+	asserts.False(IfMatchVersion(`"garbage"`, 3))
+}
+
+// An SMTP sink keeping the envelope and the data of every message it gets.
+type sunkMail struct {
+	from string
+	to   []string
+	data string
+}
+
+func fakeSMTPServer(t *testing.T) (string, chan sunkMail) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sunk := make(chan sunkMail, 8)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				fmt.Fprint(conn, "220 localhost sink\r\n")
+				var mail sunkMail
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					command := strings.ToUpper(strings.TrimSpace(line))
+					switch {
+					case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+						fmt.Fprint(conn, "250 localhost\r\n")
+					case strings.HasPrefix(command, "MAIL FROM:"):
+						mail.from = strings.Trim(strings.TrimSpace(line)[10:], "<>")
+						fmt.Fprint(conn, "250 OK\r\n")
+					case strings.HasPrefix(command, "RCPT TO:"):
+						mail.to = append(mail.to, strings.Trim(strings.TrimSpace(line)[8:], "<>"))
+						fmt.Fprint(conn, "250 OK\r\n")
+					case command == "DATA":
+						fmt.Fprint(conn, "354 Go ahead\r\n")
+						var data strings.Builder
+						for {
+							line, err := reader.ReadString('\n')
+							if err != nil {
+								return
+							}
+							if line == ".\r\n" {
+								break
+							}
+							data.WriteString(line)
+						}
+						mail.data = data.String()
+						sunk <- mail
+						mail = sunkMail{}
+						fmt.Fprint(conn, "250 OK\r\n")
+					case command == "QUIT":
+						fmt.Fprint(conn, "221 Bye\r\n")
+						return
+					default:
+						fmt.Fprint(conn, "250 OK\r\n")
+					}
+				}
+			}(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return listener.Addr().String(), sunk
+}
+
+func TestSMTPMailer(t *testing.T) {
+	asserts := assert.New(t)
+
+	addr, sunk := fakeSMTPServer(t)
+	mailer := NewSMTPMailer(addr, "digest@example.com", "", "")
+	err := mailer.Send(Message{
+		To:      "reader@example.com",
+		Subject: "Your weekly digest: Ünïcode",
+		Text:    "Hello reader",
+		HTML:    "<p>Hello reader</p>",
+		Headers: map[string]string{"List-Unsubscribe": "<https://example.com/unsubscribe>"},
+	})
+	asserts.NoError(err)
+	mail := <-sunk
+	asserts.Equal("digest@example.com", mail.from)
+	asserts.Equal([]string{"reader@example.com"}, mail.to)
+	asserts.Contains(mail.data, "From: digest@example.com\r\n")
+	asserts.Contains(mail.data, "To: reader@example.com\r\n")
+	asserts.Contains(mail.data, "Subject: =?utf-8?q?Your_weekly_digest:_=C3=9Cn=C3=AFcode?=\r\n", "subjects should be encoded")
+	asserts.Contains(mail.data, "List-Unsubscribe: <https://example.com/unsubscribe>\r\n")
+	asserts.Contains(mail.data, "Content-Type: multipart/alternative; boundary=")
+	asserts.Contains(mail.data, "Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nHello reader")
+	asserts.Contains(mail.data, "Content-Type: text/html; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n<p>Hello reader</p>")
+
+	asserts.NoError(mailer.Send(Message{To: "reader@example.com", Subject: "Plain", Text: "Only text"}))
+	mail = <-sunk
+	asserts.NotContains(mail.data, "multipart")
+	asserts.Contains(mail.data, "Content-Type: text/plain; charset=utf-8\r\n")
+
+	asserts.Error(NewSMTPMailer("127.0.0.1:1", "digest@example.com", "", "").Send(Message{To: "reader@example.com"}),
+		"an unreachable server should be an error")
+
+	memory := NewMemoryMailer()
+	asserts.NoError(memory.Send(Message{To: "reader@example.com", Subject: "Kept"}))
+	asserts.Equal("Kept", memory.Messages()[0].Subject)
+}
+
+func TestAccessLog(t *testing.T) {
+	asserts := assert.New(t)
+
+	var out bytes.Buffer
+	SetLogger(newLogger(&out, zerolog.InfoLevel))
+	defer SetLogger(newLogger(os.Stderr, zerolog.InfoLevel))
+
+	r := gin.New()
+	r.Use(RequestID(), RouteTemplates(r), AccessLog())
+	r.NoRoute(UnmatchedRoute)
+	r.GET("/articles/:slug/comments/:id", func(c *gin.Context) {
+		c.Set("my_user_id", uint(7))
+		RequestLogger(c).Info().Msg("handled")
+		c.String(http.StatusOK, "ok")
+	})
+	r.POST("/feeds/personal/:token", func(c *gin.Context) {
+		c.String(http.StatusInternalServerError, "boom")
+	})
+	send := func(method string, url string, requestID string) (*httptest.ResponseRecorder, []map[string]interface{}) {
+		out.Reset()
+		req, _ := http.NewRequest(method, url, nil)
+		if requestID != "" {
+			req.Header.Set(RequestIDHeader, requestID)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var lines []map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			var fields map[string]interface{}
+			asserts.NoError(json.Unmarshal([]byte(line), &fields), line)
+			lines = append(lines, fields)
+		}
+		return w, lines
+	}
+
+	// The handler logs with the id of the request, which is sent back and ends up in the access log.
+	w, lines := send("GET", "/articles/comments/comments/12?token=abc&limit=5&password=hunter2", "")
+	asserts.Equal(http.StatusOK, w.Code)
+	id := w.Header().Get(RequestIDHeader)
+	asserts.Regexp(`^[0-9a-f]{32}$`, id)
+	asserts.Len(lines, 2)
+	asserts.Equal("handled", lines[0]["message"])
+	asserts.Equal(id, lines[0]["request_id"])
+	asserts.Equal(float64(7), lines[0]["user_id"])
+	access := lines[1]
+	asserts.Equal("request", access["message"])
+	asserts.Equal("info", access["level"])
+	asserts.Equal(id, access["request_id"])
+	asserts.Equal(float64(7), access["user_id"])
+	asserts.Equal("GET", access["method"])
+	asserts.Equal("/articles/:slug/comments/:id", access["route"], "the route should be the template, not the slug")
+	asserts.Equal("/articles/comments/comments/12?limit=5&password=%5BREDACTED%5D&token=%5BREDACTED%5D", access["path"])
+	asserts.Equal(float64(200), access["status"])
+	asserts.Equal(float64(2), access["bytes"])
+	asserts.Contains(access, "latency_ms")
+	asserts.NotContains(out.String(), "hunter2")
+	asserts.NotContains(out.String(), "abc")
+
+	// Ids looking like one are kept, anything else is replaced.
+	w, lines = send("POST", "/feeds/personal/0123abcd.atom", "proxy-id.42")
+	asserts.Equal("proxy-id.42", w.Header().Get(RequestIDHeader))
+	asserts.Equal("error", lines[0]["level"])
+	asserts.Equal("/feeds/personal/:token", lines[0]["route"])
+	asserts.Equal("/feeds/personal/[REDACTED]", lines[0]["path"])
+	asserts.NotContains(out.String(), "0123abcd")
+
+	// Params are found by their place in the route, whatever their value.
+	_, lines = send("GET", "/articles/articles/comments/articles", "")
+	asserts.Equal("/articles/:slug/comments/:id", lines[1]["route"])
+	asserts.Equal("/articles/articles/comments/articles", lines[1]["path"])
+	_, lines = send("POST", "/feeds/personal/personal", "")
+	asserts.Equal("/feeds/personal/:token", lines[0]["route"])
+	asserts.Equal("/feeds/personal/[REDACTED]", lines[0]["path"])
+	w, _ = send("GET", "/nowhere", "forged\"id\nwith a line break")
+	asserts.Regexp(`^[0-9a-f]{32}$`, w.Header().Get(RequestIDHeader))
+
+	w, lines = send("GET", "/nowhere/at/all", "")
+	asserts.Equal(http.StatusNotFound, w.Code)
+	asserts.Equal("warn", lines[0]["level"])
+	asserts.Equal("unmatched", lines[0]["route"])
+}
+
+func TestGormLogger(t *testing.T) {
+	asserts := assert.New(t)
+
+	var out bytes.Buffer
+	SetLogger(newLogger(&out, zerolog.InfoLevel))
+	defer SetLogger(newLogger(os.Stderr, zerolog.InfoLevel))
+
+	// Queries are debug logs, hidden at the info level, slow ones are warnings without their values.
+	gormLogger{}.Print("sql", "articles/models.go:12", 3*time.Millisecond, "SELECT * FROM users WHERE password = ?", []interface{}{"hash"}, int64(1))
+	asserts.Empty(out.String())
+	gormLogger{}.Print("sql", "articles/models.go:12", SlowQueryThreshold, "SELECT * FROM users WHERE password = ?", []interface{}{"hash"}, int64(1))
+	var fields map[string]interface{}
+	asserts.NoError(json.Unmarshal(out.Bytes(), &fields))
+	asserts.Equal("warn", fields["level"])
+	asserts.Equal(true, fields["slow"])
+	asserts.Equal("SELECT * FROM users WHERE password = ?", fields["sql"])
+	asserts.Equal("articles/models.go:12", fields["source"])
+	asserts.Equal(float64(1), fields["rows"])
+	asserts.NotContains(out.String(), "hash")
+
+	out.Reset()
+	gormLogger{}.Print("log", "users/models.go:40", errors.New("UNIQUE constraint failed"))
+	asserts.NoError(json.Unmarshal(out.Bytes(), &fields))
+	asserts.Equal("error", fields["level"])
+	asserts.Equal("UNIQUE constraint failed", fields["error"])
+
+	// Queries run for a request log with its id.
+	out.Reset()
+	requestLogger := GetLogger().With().Str("request_id", "proxy-id.42").Logger()
+	gormLogger{requestLogger.WithContext(context.Background())}.Print("log", "users/models.go:40", errors.New("UNIQUE constraint failed"))
+	asserts.NoError(json.Unmarshal(out.Bytes(), &fields))
+	asserts.Equal("proxy-id.42", fields["request_id"])
+
+	SetLogger(newLogger(&out, zerolog.DebugLevel))
+	out.Reset()
+	gormLogger{}.Print("sql", "articles/models.go:12", time.Millisecond, "SELECT 1", []interface{}{}, int64(1))
+	asserts.Contains(out.String(), `"level":"debug"`)
+}
+
+func TestMetrics(t *testing.T) {
+	asserts := assert.New(t)
+
+	db := TestDBInit()
+	defer TestDBFree(db)
+	type metricsModel struct {
+		ID   uint
+		Name string
+	}
+	db.AutoMigrate(&metricsModel{})
+
+	os.Setenv("METRICS_TOKEN", "scraper")
+	defer os.Unsetenv("METRICS_TOKEN")
+	r := gin.New()
+	r.Use(RouteTemplates(r), RequestMetrics())
+	r.NoRoute(UnmatchedRoute)
+	r.GET("/metrics", MetricsHandler())
+	r.GET("/articles/:slug", func(c *gin.Context) {
+		var model metricsModel
+		GetDB().Where("name = ?", c.Param("slug")).First(&model)
+		c.String(http.StatusOK, "ok")
+	})
+	r.GET("/articles/:slug/comments", func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+	send := func(url string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("Authorization", "Bearer scraper")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	db.Create(&metricsModel{Name: "first"})
+	send("/articles/first")
+	send("/articles/second")
+	send("/articles/comments/comments")
+	send("/articles/articles/comments")
+	send("/nowhere")
+
+	w := send("/metrics")
+	asserts.Equal(http.StatusOK, w.Code)
+	body := w.Body.String()
+	asserts.Contains(body, `http_requests_total{method="GET",route="/articles/:slug",status="200"} 2`)
+	asserts.Contains(body, `http_requests_total{method="GET",route="unmatched",status="404"} 1`)
+	asserts.Contains(body, `http_request_duration_seconds_count{method="GET",route="/articles/:slug"} 2`)
+	asserts.NotContains(body, "/articles/second", "slugs should not make series")
+	asserts.Contains(body, `http_requests_total{method="GET",route="/articles/:slug/comments",status="200"} 2`,
+		"slugs equal to a fixed segment of the route should be counted with the route")
+	asserts.Contains(body, "http_requests_in_flight 1")
+	asserts.Regexp(`db_queries_total{operation="query",table="metrics_models"} [2-9]`, body)
+	asserts.Regexp(`db_queries_total{operation="create",table="metrics_models"} 1`, body)
+	asserts.Regexp(`db_query_duration_seconds_count{operation="query"} \d+`, body)
+	asserts.Regexp(`db_open_connections \d+`, body)
+	asserts.Contains(body, "db_max_open_connections 0")
+	asserts.Contains(body, "go_goroutines")
+
+	errorsBefore := testutil.ToFloat64(dbQueryErrors.WithLabelValues("create", "metrics_models"))
+	db.Create(&metricsModel{ID: 1, Name: "taken"})
+	asserts.Equal(errorsBefore+1, testutil.ToFloat64(dbQueryErrors.WithLabelValues("create", "metrics_models")))
+
+	counter := NewCounterVec("test_events_total", "Events of the test.", "kind")
+	counter.WithLabelValues("a").Inc()
+	asserts.Contains(send("/metrics").Body.String(), `test_events_total{kind="a"} 1`)
+}
+
+func TestMetricsToken(t *testing.T) {
+	asserts := assert.New(t)
+
+	os.Setenv("METRICS_TOKEN", "scraper")
+	defer os.Unsetenv("METRICS_TOKEN")
+	r := gin.New()
+	r.GET("/metrics", MetricsHandler())
+	for _, test := range []struct {
+		authorization string
+		code          int
+	}{{"", http.StatusUnauthorized}, {"Bearer other", http.StatusUnauthorized}, {"Bearer scraper", http.StatusOK}} {
+		req, _ := http.NewRequest("GET", "/metrics", nil)
+		req.Header.Set("Authorization", test.authorization)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		asserts.Equal(test.code, w.Code, test.authorization)
+	}
+
+	// Without a token nobody gets the metrics.
+	os.Unsetenv("METRICS_TOKEN")
+	r = gin.New()
+	r.GET("/metrics", MetricsHandler())
+	for _, authorization := range []string{"", "Bearer ", "Bearer scraper"} {
+		req, _ := http.NewRequest("GET", "/metrics", nil)
+		req.Header.Set("Authorization", authorization)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		asserts.Equal(http.StatusForbidden, w.Code, authorization)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	asserts := assert.New(t)
+
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	db := TestDBInit()
+	defer TestDBFree(db)
+	type tracingModel struct {
+		ID   uint
+		Name string
+	}
+	db.AutoMigrate(&tracingModel{})
+
+	var out bytes.Buffer
+	SetLogger(newLogger(&out, zerolog.InfoLevel))
+	defer SetLogger(newLogger(os.Stderr, zerolog.InfoLevel))
+	r := gin.New()
+	r.Use(RequestID(), Tracing(), AccessLog())
+	r.NoRoute(UnmatchedRoute)
+	r.GET("/articles/:slug", func(c *gin.Context) {
+		var model tracingModel
+		GetDBContext(c.Request.Context()).Where("name = ?", c.Param("slug")).First(&model)
+		GetDB().Where("name = ?", c.Param("slug")).First(&model)
+		c.String(http.StatusOK, "ok")
+	})
+	r.GET("/broken", func(c *gin.Context) {
+		c.String(http.StatusInternalServerError, "broken")
+	})
+	req, _ := http.NewRequest("GET", "/articles/first?token=secret", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	asserts.Len(spans, 2, "queries run without the context of a request should not be traced")
+	query, request := spans[0], spans[1]
+	asserts.Equal("GET /articles/:slug", request.Name())
+	asserts.Equal(trace.SpanKindServer, request.SpanKind())
+	asserts.Equal("4bf92f3577b34da6a3ce929d0e0e4736", request.SpanContext().TraceID().String(), "the trace of the caller should go on")
+	asserts.Equal("00f067aa0ba902b7", request.Parent().SpanID().String())
+	attributes := map[string]string{}
+	for _, kv := range request.Attributes() {
+		attributes[string(kv.Key)] = kv.Value.Emit()
+	}
+	asserts.Equal("/articles/:slug", attributes["http.route"])
+	asserts.Equal("200", attributes["http.status_code"])
+	asserts.Equal("/articles/first?token=%5BREDACTED%5D", attributes["http.target"])
+	asserts.Equal("query tracing_models", query.Name())
+	asserts.Equal(request.SpanContext().SpanID(), query.Parent().SpanID(), "queries should be children of the request")
+	for _, kv := range query.Attributes() {
+		attributes[string(kv.Key)] = kv.Value.Emit()
+	}
+	asserts.Equal("sqlite", attributes["db.system"])
+	asserts.Contains(attributes["db.statement"], `WHERE (name = ?)`, "statements should be recorded without their values")
+	asserts.Contains(out.String(), `"trace_id":"4bf92f3577b34da6a3ce929d0e0e4736"`)
+
+	req, _ = http.NewRequest("GET", "/broken", nil)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	spans = recorder.Ended()[2:]
+	asserts.Len(spans, 1)
+	asserts.Equal(codes.Error, spans[0].Status().Code, "server errors should fail their span")
+	asserts.True(spans[0].SpanContext().IsValid())
+	asserts.False(spans[0].Parent().IsValid(), "requests without a traceparent should start a trace")
+
+	header := http.Header{}
+	ctx, span := StartSpan(context.Background(), "outgoing")
+	InjectTraceContext(ctx, header)
+	span.End()
+	asserts.Equal("00-"+span.SpanContext().TraceID().String()+"-"+span.SpanContext().SpanID().String()+"-01", header.Get("traceparent"))
+}
@@ -2,8 +2,14 @@
 package common
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -24,6 +30,32 @@ func RandString(n int) string {
 	return string(b)
 }
 
+// Read an integer setting from the environment, falling back when it is unset or malformed.
+// 	var MaxCommentDepth = common.GetEnvInt("COMMENT_MAX_DEPTH", 5)
+func GetEnvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// Read a setting from the environment, falling back when it is unset.
+// 	var AppURL = common.GetEnv("APP_URL", "http://localhost:4100")
+func GetEnv(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Where the links the app hands out go: the articles and profiles are pages of the frontend at AppURL,
+// everything else is served by the API at APIURL.
+var (
+	AppURL = GetEnv("APP_URL", "http://localhost:4100")
+	APIURL = GetEnv("API_URL", "http://localhost:8080/api")
+)
+
 // Keep this two config private, it should not expose to open source
 const NBSecretPassword = "A String Very Very Very Strong!!@##$!@#$"
 const NBRandomPassword = "A String Very Very Very Niubilty!!@##$!@#4"
@@ -66,6 +98,41 @@ func NewValidatorError(err error) CommonError {
 	return res
 }
 
+// A validation error for a string longer than max, for the limits that are configured at run time
+// and so can not be binding tags. It renders like the max tag does.
+// 	return common.NewLengthError("Body", MaxArticleBodyLength)
+func NewLengthError(field string, max int) error {
+	return validator.ValidationErrors{
+		field: &validator.FieldError{Field: field, Name: field, Tag: "max", ActualTag: "max", Param: strconv.Itoa(max)},
+	}
+}
+
+// Refuse request bodies over maxBytes with 413 before any handler reads them. The body is read
+// up front, so a client sending more than its Content-Length announced is caught as well.
+//  r.Use(common.BodySizeLimit(2 << 20))
+func BodySizeLimit(maxBytes int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Body == nil {
+			return
+		}
+		tooLarge := NewError("body", fmt.Errorf("Request body is larger than %v bytes", maxBytes))
+		if c.Request.ContentLength > maxBytes {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, tooLarge)
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(c.Request.Body, maxBytes+1))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError("body", err))
+			return
+		}
+		if int64(len(body)) > maxBytes {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, tooLarge)
+			return
+		}
+		c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+}
+
 // Warp the error info in a object
 func NewError(key string, err error) CommonError {
 	res := CommonError{}
@@ -0,0 +1,263 @@
+package digests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"net/url"
+	"time"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/articles"
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/jobs"
+	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+)
+
+// How many articles a digest has at most and how often the due digests are looked for.
+var (
+	DigestSize   = common.GetEnvInt("DIGEST_SIZE", 10)
+	PollInterval = time.Duration(common.GetEnvInt("DIGEST_POLL_MINUTES", 60)) * time.Minute
+)
+
+// The jobs of the digests: looking for the due digests, sending one digest and sending a newsletter to one reader.
+const (
+	ScheduleJob   = "digests.schedule"
+	SendJob       = "digests.send"
+	NewsletterJob = "newsletters.send"
+)
+
+type digestJob struct {
+	UserID uint      `json:"userId"`
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until"`
+}
+
+type newsletterJob struct {
+	NewsletterID uint `json:"newsletterId"`
+	UserID       uint `json:"userId"`
+}
+
+// Register the jobs of the digests, before the runner starts. Emails go through the mail queue.
+func RegisterJobs() {
+	// Warn about a missing unsubscribe key at start rather than with the first email.
+	unsubscribeKey()
+	jobs.Register(ScheduleJob, jobs.Options{Queue: "mail", MaxAttempts: 1}, func(ctx context.Context, job jobs.Job) error {
+		ScheduleDue(time.Now())
+		return nil
+	})
+	jobs.Register(SendJob, jobs.Options{Queue: "mail"}, sendDigest)
+	jobs.Register(NewsletterJob, jobs.Options{Queue: "mail"}, sendNewsletter)
+	jobs.Schedule(ScheduleJob, PollInterval)
+}
+
+// Enqueue the digests due at now, returning how many were enqueued.
+func ScheduleDue(now time.Time) int {
+	ids, err := dueUserIDs(now)
+	if err != nil {
+		common.GetLogger().Error().Err(err).Str("func", "digests.ScheduleDue").Msg("db err")
+		return 0
+	}
+	enqueued := 0
+	for _, id := range ids {
+		if err := enqueueDigest(id, now); err != nil {
+			common.GetLogger().Error().Err(err).Str("func", "digests.ScheduleDue").Msg("db err")
+			continue
+		}
+		enqueued++
+	}
+	return enqueued
+}
+
+// A digest as the templates see it.
+type Digest struct {
+	User           users.UserModel
+	Frequency      string
+	Since          time.Time
+	Articles       []DigestArticle
+	UnsubscribeURL string
+}
+
+type DigestArticle struct {
+	Slug           string
+	Title          string
+	Description    string
+	Author         string
+	Tags           []string
+	FavoritesCount uint
+	URL            string
+	AuthorURL      string
+}
+
+// The top articles of the feed of the user written since since, see GetFeedDigest. Emails are read away
+// from the app, so moderators get what everyone gets and no hidden articles.
+// 	digest, err := buildDigest(userModel, setting.Frequency, lastWeek)
+func buildDigest(user users.UserModel, frequency string, since time.Time) (Digest, error) {
+	digest := Digest{
+		User:           user,
+		Frequency:      frequency,
+		Since:          since,
+		Articles:       []DigestArticle{},
+		UnsubscribeURL: unsubscribeURL(user.ID, ListDigest),
+	}
+	reader := articles.GetArticleUserModel(user)
+	reader.UserModel.Moderator = false
+	articleModels, favorites, err := reader.GetFeedDigest(since, DigestSize)
+	if err != nil {
+		return digest, err
+	}
+	for _, model := range articleModels {
+		article := DigestArticle{
+			Slug:           model.Slug,
+			Title:          model.Title,
+			Description:    model.Description,
+			Author:         model.Author.UserModel.Username,
+			Tags:           []string{},
+			FavoritesCount: favorites[model.ID],
+			URL:            common.AppURL + "/article/" + url.PathEscape(model.Slug),
+			AuthorURL:      profileURL(model.Author.UserModel.Username),
+		}
+		for _, tag := range model.Tags {
+			article.Tags = append(article.Tags, tag.Tag)
+		}
+		digest.Articles = append(digest.Articles, article)
+	}
+	return digest, nil
+}
+
+func profileURL(username string) string {
+	return common.AppURL + "/profile/" + url.PathEscape(username)
+}
+
+func unsubscribeURL(userID uint, list string) string {
+	return common.APIURL + "/digests/unsubscribe?token=" + url.QueryEscape(UnsubscribeToken(userID, list))
+}
+
+// Headers letting mail clients offer unsubscribing with one click, RFC 8058.
+func unsubscribeHeaders(link string) map[string]string {
+	return map[string]string{
+		"List-Unsubscribe":      "<" + link + ">",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	}
+}
+
+func (digest Digest) Subject() string {
+	if len(digest.Articles) == 0 {
+		return fmt.Sprintf("Your %v digest", digest.Frequency)
+	}
+	return fmt.Sprintf("Your %v digest: %v", digest.Frequency, digest.Articles[0].Title)
+}
+
+// Render the digest into the email to its user.
+func (digest Digest) Message() (common.Message, error) {
+	message := common.Message{To: digest.User.Email, Subject: digest.Subject(), Headers: unsubscribeHeaders(digest.UnsubscribeURL)}
+	var text, html bytes.Buffer
+	if err := digestText.Execute(&text, digest); err != nil {
+		return message, err
+	}
+	if err := digestHTML.Execute(&html, digest); err != nil {
+		return message, err
+	}
+	message.Text = text.String()
+	message.HTML = html.String()
+	return message, nil
+}
+
+// A newsletter as the templates see it.
+type Newsletter struct {
+	Subject        string
+	Body           string
+	BodyHTML       htmltemplate.HTML
+	Author         string
+	AuthorURL      string
+	UnsubscribeURL string
+}
+
+// Render the newsletter into the email to recipient.
+func (model NewsletterModel) Message(recipient users.UserModel) (common.Message, error) {
+	newsletter := Newsletter{
+		Subject:        model.Subject,
+		Body:           model.Body,
+		BodyHTML:       htmltemplate.HTML(articles.RenderMarkdownHTML(model.Body)),
+		Author:         model.Author.Username,
+		AuthorURL:      profileURL(model.Author.Username),
+		UnsubscribeURL: unsubscribeURL(recipient.ID, ListNewsletter),
+	}
+	message := common.Message{To: recipient.Email, Subject: model.Subject, Headers: unsubscribeHeaders(newsletter.UnsubscribeURL)}
+	var text, html bytes.Buffer
+	if err := newsletterText.Execute(&text, newsletter); err != nil {
+		return message, err
+	}
+	if err := newsletterHTML.Execute(&html, newsletter); err != nil {
+		return message, err
+	}
+	message.Text = text.String()
+	message.HTML = html.String()
+	return message, nil
+}
+
+// Send the digest of a job. Nothing is sent to readers who turned the digest off meanwhile or when
+// nothing new is in their feed. The digest counts as sent only once this succeeds.
+func sendDigest(ctx context.Context, job jobs.Job) error {
+	var payload digestJob
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return jobs.Permanent(err)
+	}
+	user, err := users.FindOneUser(&users.UserModel{ID: payload.UserID})
+	if err != nil {
+		return jobs.Permanent(err)
+	}
+	until := payload.Until
+	if until.IsZero() {
+		until = time.Now()
+	}
+	setting := settingOf(user.ID)
+	if setting.Frequency == FrequencyOff || user.Email == "" {
+		return nil
+	}
+	digest, err := buildDigest(user, setting.Frequency, payload.Since)
+	if err != nil {
+		return err
+	}
+	if len(digest.Articles) == 0 {
+		return markSent(user.ID, until)
+	}
+	message, err := digest.Message()
+	if err != nil {
+		return jobs.Permanent(err)
+	}
+	if err := common.SendMail(ctx, message); err != nil {
+		return err
+	}
+	// The email is out, a retry would send it twice.
+	if err := markSent(user.ID, until); err != nil {
+		common.LoggerFrom(ctx).Error().Err(err).Str("func", "digests.sendDigest").Msg("db err")
+	}
+	return nil
+}
+
+// Send a newsletter to the reader of a job, unless they stopped getting newsletters meanwhile.
+func sendNewsletter(ctx context.Context, job jobs.Job) error {
+	var payload newsletterJob
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return jobs.Permanent(err)
+	}
+	db := common.GetDB()
+	var model NewsletterModel
+	if err := db.Preload("Author").Where("id = ?", payload.NewsletterID).First(&model).Error; err != nil {
+		return jobs.Permanent(err)
+	}
+	recipient, err := users.FindOneUser(&users.UserModel{ID: payload.UserID})
+	if err != nil {
+		return jobs.Permanent(err)
+	}
+	if !settingOf(recipient.ID).Newsletters || recipient.Email == "" {
+		return nil
+	}
+	message, err := model.Message(recipient)
+	if err != nil {
+		return jobs.Permanent(err)
+	}
+	return common.SendMail(ctx, message)
+}
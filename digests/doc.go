@@ -0,0 +1,16 @@
+/*
+The digests module containing the emails sent to readers: the digest of the top articles of their feed and the newsletters of the authors they follow.
+
+model.go: definition of orm based data model, the settings of the readers and the unsubscribe tokens
+
+digest.go: building, rendering and sending the digests and newsletters as jobs
+
+templates.go: the templates of the emails and of the unsubscribe pages
+
+routers.go: router binding and core logic
+
+serializers.go: definition the schema of return data
+
+validators.go: definition the validator of form data
+*/
+package digests
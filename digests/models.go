@@ -0,0 +1,323 @@
+package digests
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/jobs"
+	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+	"github.com/jinzhu/gorm"
+)
+
+// How often a reader gets the digest.
+const (
+	FrequencyOff    = "off"
+	FrequencyDaily  = "daily"
+	FrequencyWeekly = "weekly"
+)
+
+var Frequencies = []string{FrequencyOff, FrequencyDaily, FrequencyWeekly}
+
+// The emails a reader can unsubscribe from with the link at their bottom.
+const (
+	ListDigest     = "digest"
+	ListNewsletter = "newsletter"
+)
+
+// Unsubscribe links are signed with the key in DIGEST_UNSUBSCRIBE_SECRET and work for UnsubscribeTokenTTL.
+// Without a key one is made up at start, the links of the emails sent before stop working on restart.
+var UnsubscribeTokenTTL = time.Duration(common.GetEnvInt("DIGEST_UNSUBSCRIBE_DAYS", 90)) * 24 * time.Hour
+
+var (
+	unsubscribeSecretOnce sync.Once
+	unsubscribeSecret     []byte
+)
+
+func unsubscribeKey() []byte {
+	unsubscribeSecretOnce.Do(func() {
+		if secret := common.GetEnv("DIGEST_UNSUBSCRIBE_SECRET", ""); secret != "" {
+			unsubscribeSecret = []byte(secret)
+			return
+		}
+		unsubscribeSecret = make([]byte, 32)
+		if _, err := rand.Read(unsubscribeSecret); err != nil {
+			panic(err)
+		}
+		common.GetLogger().Warn().Msg("DIGEST_UNSUBSCRIBE_SECRET is not set, unsubscribe links last until the app restarts")
+	})
+	return unsubscribeSecret
+}
+
+var ErrUnknownFrequency = errors.New("Unknown frequency")
+
+var ErrInvalidToken = errors.New("Invalid token")
+
+// How often readers who never changed their settings get the digest, off by default so that it is opt-in.
+var DefaultFrequency = common.GetEnv("DIGEST_DEFAULT_FREQUENCY", FrequencyOff)
+
+// What a reader wants to get. Readers without a row get the digest at DefaultFrequency and the newsletters.
+// Sent counts the digests enqueued for the reader, so that only one runner enqueues each of them. QueuedAt
+// is when the last one was enqueued and LastSentAt where the last one sent ended: a digest whose job died
+// is enqueued again once its period is over.
+type DigestSettingModel struct {
+	gorm.Model
+	UserID      uint   `gorm:"unique_index"`
+	Frequency   string `gorm:"size:16"`
+	Newsletters bool
+	LastSentAt  *time.Time
+	QueuedAt    *time.Time
+	Sent        uint
+}
+
+// An email an author wrote to their followers, sent to every one of them who gets newsletters.
+type NewsletterModel struct {
+	gorm.Model
+	Author          users.UserModel
+	AuthorID        uint   `gorm:"index"`
+	Subject         string `gorm:"size:255"`
+	Body            string `gorm:"type:text"`
+	RecipientsCount uint
+}
+
+// Migrate the schema of database if needed
+func AutoMigrate() {
+	db := common.GetDB()
+
+	db.AutoMigrate(&DigestSettingModel{})
+	db.AutoMigrate(&NewsletterModel{})
+}
+
+func defaultSetting(userID uint) DigestSettingModel {
+	return DigestSettingModel{UserID: userID, Frequency: DefaultFrequency, Newsletters: true}
+}
+
+// The settings of the user, the defaults if they never changed them.
+func settingOf(userID uint) DigestSettingModel {
+	db := common.GetDB()
+	var model DigestSettingModel
+	db.Where(DigestSettingModel{UserID: userID}).First(&model)
+	if model.ID == 0 {
+		return defaultSetting(userID)
+	}
+	return model
+}
+
+// Change the settings of the user, nil leaves a setting as it is.
+// 	model, err := setSetting(myUserModel.ID, &frequency, nil)
+func setSetting(userID uint, frequency *string, newsletters *bool) (DigestSettingModel, error) {
+	var model DigestSettingModel
+	if frequency != nil && !isFrequency(*frequency) {
+		return model, ErrUnknownFrequency
+	}
+	db := common.GetDB()
+	if err := db.Where(DigestSettingModel{UserID: userID}).Attrs(defaultSetting(userID)).FirstOrCreate(&model).Error; err != nil {
+		return model, err
+	}
+	changes := map[string]interface{}{}
+	if frequency != nil {
+		changes["frequency"] = *frequency
+	}
+	if newsletters != nil {
+		changes["newsletters"] = *newsletters
+	}
+	if len(changes) == 0 {
+		return model, nil
+	}
+	err := db.Model(&model).UpdateColumns(changes).Error
+	return model, err
+}
+
+func isFrequency(frequency string) bool {
+	for _, known := range Frequencies {
+		if frequency == known {
+			return true
+		}
+	}
+	return false
+}
+
+// How long a digest covers.
+func (model DigestSettingModel) period() time.Duration {
+	if model.Frequency == FrequencyDaily {
+		return 24 * time.Hour
+	}
+	return 7 * 24 * time.Hour
+}
+
+// Whether the next digest of the user is due at now: the last one was sent a period ago and none was
+// enqueued since, or long enough ago to have failed.
+func (model DigestSettingModel) due(now time.Time) bool {
+	if model.Frequency == FrequencyOff {
+		return false
+	}
+	cutoff := now.Add(-model.period())
+	return (model.LastSentAt == nil || !model.LastSentAt.After(cutoff)) && (model.QueuedAt == nil || !model.QueuedAt.After(cutoff))
+}
+
+// Where the next digest starts: the last one, or one period back for the first.
+func (model DigestSettingModel) since(now time.Time) time.Time {
+	if model.LastSentAt != nil {
+		return *model.LastSentAt
+	}
+	return now.Add(-model.period())
+}
+
+// The ids of the users whose digest is due at now, users without an email or suspended are left out.
+func dueUserIDs(now time.Time) ([]uint, error) {
+	db := common.GetDB()
+	var ids []uint
+	err := db.Table("user_models").
+		Joins("LEFT JOIN digest_setting_models ON digest_setting_models.user_id = user_models.id AND digest_setting_models.deleted_at IS NULL").
+		Where("user_models.email <> '' AND user_models.suspended_at IS NULL").
+		Where("(digest_setting_models.id IS NULL AND ?) OR "+
+			"(digest_setting_models.frequency = ? AND (digest_setting_models.last_sent_at IS NULL OR digest_setting_models.last_sent_at <= ?) AND "+
+			"(digest_setting_models.queued_at IS NULL OR digest_setting_models.queued_at <= ?)) OR "+
+			"(digest_setting_models.frequency = ? AND (digest_setting_models.last_sent_at IS NULL OR digest_setting_models.last_sent_at <= ?) AND "+
+			"(digest_setting_models.queued_at IS NULL OR digest_setting_models.queued_at <= ?))",
+			DefaultFrequency != FrequencyOff,
+			FrequencyDaily, now.Add(-24*time.Hour), now.Add(-24*time.Hour),
+			FrequencyWeekly, now.Add(-7*24*time.Hour), now.Add(-7*24*time.Hour)).
+		Order("user_models.id asc").Pluck("user_models.id", &ids).Error
+	return ids, err
+}
+
+// Enqueue the digest of the user if it is due at now. Counting it in Sent makes sure only one runner does,
+// it counts as sent once its job succeeds, see markSent.
+func enqueueDigest(userID uint, now time.Time) error {
+	db := common.GetDB()
+	return db.Transaction(func(tx *gorm.DB) error {
+		var model DigestSettingModel
+		if err := tx.Where(DigestSettingModel{UserID: userID}).Attrs(defaultSetting(userID)).FirstOrCreate(&model).Error; err != nil {
+			return err
+		}
+		if !model.due(now) {
+			return nil
+		}
+		result := tx.Model(&DigestSettingModel{}).Where("id = ? AND sent = ?", model.ID, model.Sent).
+			UpdateColumns(map[string]interface{}{"sent": model.Sent + 1, "queued_at": now})
+		if result.Error != nil || result.RowsAffected != 1 {
+			return result.Error
+		}
+		return jobs.EnqueueTx(tx, SendJob, digestJob{UserID: userID, Since: model.since(now), Until: now})
+	})
+}
+
+// Record that the digest of the user up to until went out, the next one starts there.
+func markSent(userID uint, until time.Time) error {
+	db := common.GetDB()
+	return db.Model(&DigestSettingModel{}).Where("user_id = ?", userID).UpdateColumn("last_sent_at", until).Error
+}
+
+// Save a newsletter and enqueue it for every follower of its author who gets newsletters, in one transaction.
+func createNewsletter(model *NewsletterModel) error {
+	db := common.GetDB()
+	return db.Transaction(func(tx *gorm.DB) error {
+		var followers []uint
+		err := tx.Model(&users.FollowModel{}).Where("following_id = ?", model.AuthorID).
+			Order("followed_by_id asc").Pluck("followed_by_id", &followers).Error
+		if err != nil {
+			return err
+		}
+		var optedOut []uint
+		err = tx.Model(&DigestSettingModel{}).Where("user_id in (?) AND newsletters = ?", followers, false).
+			Pluck("user_id", &optedOut).Error
+		if err != nil {
+			return err
+		}
+		skip := map[uint]bool{}
+		for _, id := range optedOut {
+			skip[id] = true
+		}
+		var recipients []uint
+		for _, id := range followers {
+			if !skip[id] {
+				recipients = append(recipients, id)
+			}
+		}
+		model.RecipientsCount = uint(len(recipients))
+		if err := tx.Create(model).Error; err != nil {
+			return err
+		}
+		for _, id := range recipients {
+			if err := jobs.EnqueueTx(tx, NewsletterJob, newsletterJob{NewsletterID: model.ID, UserID: id}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// The newsletters the author sent, newest first.
+func findNewslettersOf(author users.UserModel) ([]NewsletterModel, error) {
+	db := common.GetDB()
+	var models []NewsletterModel
+	err := db.Where("author_id = ?", author.ID).Order("id desc").Find(&models).Error
+	return models, err
+}
+
+type unsubscribeClaims struct {
+	UserID  uint   `json:"u"`
+	List    string `json:"l"`
+	Expires int64  `json:"e"`
+}
+
+// The token of the unsubscribe link of an email of list sent to the user, "<payload>.<signature>".
+// It expires after UnsubscribeTokenTTL.
+// 	token := digests.UnsubscribeToken(userModel.ID, digests.ListDigest)
+func UnsubscribeToken(userID uint, list string) string {
+	return unsubscribeToken(unsubscribeClaims{UserID: userID, List: list, Expires: time.Now().Add(UnsubscribeTokenTTL).Unix()})
+}
+
+func unsubscribeToken(claims unsubscribeClaims) string {
+	payload, _ := json.Marshal(claims)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + signUnsubscribe(encoded)
+}
+
+func parseUnsubscribeToken(token string) (unsubscribeClaims, error) {
+	var claims unsubscribeClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(signUnsubscribe(parts[0]))) {
+		return claims, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, ErrInvalidToken
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.UserID == 0 {
+		return claims, ErrInvalidToken
+	}
+	if claims.List != ListDigest && claims.List != ListNewsletter {
+		return claims, ErrInvalidToken
+	}
+	if time.Now().Unix() > claims.Expires {
+		return claims, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+func signUnsubscribe(encoded string) string {
+	mac := hmac.New(sha256.New, unsubscribeKey())
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Turn off what the token was made for.
+func unsubscribe(claims unsubscribeClaims) error {
+	off, no := FrequencyOff, false
+	var err error
+	if claims.List == ListDigest {
+		_, err = setSetting(claims.UserID, &off, nil)
+	} else {
+		_, err = setSetting(claims.UserID, nil, &no)
+	}
+	return err
+}
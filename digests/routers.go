@@ -0,0 +1,134 @@
+package digests
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+)
+
+// Every user manages their own digest, the group is the authenticated /digests one.
+func DigestsRegister(router *gin.RouterGroup) {
+	router.GET("/settings", DigestSettingRetrieve)
+	router.PUT("/settings", DigestSettingUpdate)
+	router.GET("/preview", DigestPreview)
+}
+
+// The unsubscribe links of the emails work without logging in, the token is all they need.
+func DigestsAnonymousRegister(router *gin.RouterGroup) {
+	router.GET("/unsubscribe", DigestUnsubscribe)
+	router.POST("/unsubscribe", DigestUnsubscribe)
+}
+
+// Authors send newsletters to their followers, the group is the authenticated /newsletters one.
+func NewslettersRegister(router *gin.RouterGroup) {
+	router.GET("", NewsletterList)
+	router.POST("", NewsletterCreate)
+}
+
+func DigestSettingRetrieve(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	serializer := DigestSettingSerializer{c, settingOf(myUserModel.ID)}
+	c.JSON(http.StatusOK, gin.H{"digest": serializer.Response()})
+}
+
+// 	PUT /api/digests/settings {"digest":{"frequency":"daily"}}
+func DigestSettingUpdate(c *gin.Context) {
+	validator := DigestSettingValidator{}
+	if err := validator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	model, err := setSetting(myUserModel.ID, validator.Digest.Frequency, validator.Digest.Newsletters)
+	if err == ErrUnknownFrequency {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("frequency", err))
+		return
+	} else if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := DigestSettingSerializer{c, settingOf(model.UserID)}
+	c.JSON(http.StatusOK, gin.H{"digest": serializer.Response()})
+}
+
+// The next digest of the user as it would be sent now, with the rendered email. Readers who turned
+// the digest off see what a weekly one would look like.
+func DigestPreview(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	setting := settingOf(myUserModel.ID)
+	if setting.Frequency == FrequencyOff {
+		setting.Frequency = FrequencyWeekly
+	}
+	digest, err := buildDigest(myUserModel, setting.Frequency, setting.since(time.Now()))
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("digest", errors.New("Invalid param")))
+		return
+	}
+	serializer := DigestSerializer{c, digest}
+	response, err := serializer.Response()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, common.NewError("digest", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"digest": response})
+}
+
+// Following an unsubscribe link asks for a confirmation, posting to it unsubscribes. Mail clients
+// offering one-click unsubscribing post to it as well.
+// 	POST /api/digests/unsubscribe?token=...
+func DigestUnsubscribe(c *gin.Context) {
+	claims, err := parseUnsubscribeToken(c.Query("token"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("token", err))
+		return
+	}
+	page := unsubscribePageData{What: "the digest"}
+	if claims.List == ListNewsletter {
+		page.What = "newsletters"
+	}
+	if c.Request.Method == http.MethodPost {
+		if err := unsubscribe(claims); err != nil {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+			return
+		}
+		page.Done = true
+	}
+	var body bytes.Buffer
+	if err := unsubscribePage.Execute(&body, page); err != nil {
+		c.JSON(http.StatusInternalServerError, common.NewError("page", err))
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", body.Bytes())
+}
+
+func NewsletterList(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	newsletterModels, err := findNewslettersOf(myUserModel)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("newsletters", errors.New("Invalid param")))
+		return
+	}
+	serializer := NewslettersSerializer{c, newsletterModels}
+	c.JSON(http.StatusOK, gin.H{"newsletters": serializer.Response(), "newslettersCount": len(newsletterModels)})
+}
+
+// Send a newsletter to the followers of the user, the body is markdown.
+// 	POST /api/newsletters {"newsletter":{"subject":"News","body":"# Hello"}}
+func NewsletterCreate(c *gin.Context) {
+	newsletterModelValidator := NewNewsletterModelValidator()
+	if err := newsletterModelValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	if err := createNewsletter(&newsletterModelValidator.newsletterModel); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := NewsletterSerializer{c, newsletterModelValidator.newsletterModel}
+	c.JSON(http.StatusCreated, gin.H{"newsletter": serializer.Response()})
+}
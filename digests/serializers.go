@@ -0,0 +1,117 @@
+package digests
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/gothinkster/golang-gin-realworld-example-app/articles"
+)
+
+type DigestSettingSerializer struct {
+	C *gin.Context
+	DigestSettingModel
+}
+
+type DigestSettingResponse struct {
+	Frequency   string  `json:"frequency"`
+	Newsletters bool    `json:"newsletters"`
+	LastSentAt  *string `json:"lastSentAt"`
+}
+
+func (s *DigestSettingSerializer) Response() DigestSettingResponse {
+	response := DigestSettingResponse{
+		Frequency:   s.Frequency,
+		Newsletters: s.Newsletters,
+	}
+	if s.LastSentAt != nil {
+		lastSentAt := s.LastSentAt.UTC().Format("2006-01-02T15:04:05.999Z")
+		response.LastSentAt = &lastSentAt
+	}
+	return response
+}
+
+type DigestSerializer struct {
+	C *gin.Context
+	Digest
+}
+
+type DigestArticleResponse struct {
+	Slug           string   `json:"slug"`
+	Title          string   `json:"title"`
+	Description    string   `json:"description"`
+	Author         string   `json:"author"`
+	Tags           []string `json:"tagList"`
+	FavoritesCount uint     `json:"favoritesCount"`
+}
+
+type DigestResponse struct {
+	Subject   string                  `json:"subject"`
+	Frequency string                  `json:"frequency"`
+	Since     string                  `json:"since"`
+	Articles  []DigestArticleResponse `json:"articles"`
+	Text      string                  `json:"text"`
+	HTML      string                  `json:"html"`
+}
+
+func (s *DigestSerializer) Response() (DigestResponse, error) {
+	response := DigestResponse{
+		Subject:   s.Subject(),
+		Frequency: s.Frequency,
+		Since:     s.Since.UTC().Format("2006-01-02T15:04:05.999Z"),
+		Articles:  []DigestArticleResponse{},
+	}
+	for _, article := range s.Articles {
+		response.Articles = append(response.Articles, DigestArticleResponse{
+			Slug:           article.Slug,
+			Title:          article.Title,
+			Description:    article.Description,
+			Author:         article.Author,
+			Tags:           article.Tags,
+			FavoritesCount: article.FavoritesCount,
+		})
+	}
+	message, err := s.Message()
+	if err != nil {
+		return response, err
+	}
+	response.Text = message.Text
+	response.HTML = message.HTML
+	return response, nil
+}
+
+type NewsletterSerializer struct {
+	C *gin.Context
+	NewsletterModel
+}
+
+type NewslettersSerializer struct {
+	C           *gin.Context
+	Newsletters []NewsletterModel
+}
+
+type NewsletterResponse struct {
+	ID              uint   `json:"id"`
+	Subject         string `json:"subject"`
+	Body            string `json:"body"`
+	BodyHTML        string `json:"bodyHtml"`
+	RecipientsCount uint   `json:"recipientsCount"`
+	CreatedAt       string `json:"createdAt"`
+}
+
+func (s *NewsletterSerializer) Response() NewsletterResponse {
+	return NewsletterResponse{
+		ID:              s.ID,
+		Subject:         s.Subject,
+		Body:            s.Body,
+		BodyHTML:        articles.RenderMarkdownHTML(s.Body),
+		RecipientsCount: s.RecipientsCount,
+		CreatedAt:       s.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+	}
+}
+
+func (s *NewslettersSerializer) Response() []NewsletterResponse {
+	response := []NewsletterResponse{}
+	for _, newsletter := range s.Newsletters {
+		serializer := NewsletterSerializer{s.C, newsletter}
+		response = append(response, serializer.Response())
+	}
+	return response
+}
@@ -0,0 +1,75 @@
+package digests
+
+import (
+	htmltemplate "html/template"
+	texttemplate "text/template"
+)
+
+// Every email has a text and an HTML body, the HTML is kept simple with inline styles for the mail clients.
+
+var digestText = texttemplate.Must(texttemplate.New("digest.txt").Parse(`Your {{.Frequency}} digest
+The top articles from the authors and tags you follow since {{.Since.Format "January 2"}}.
+{{range .Articles}}
+{{.Title}}
+by {{.Author}}{{if .FavoritesCount}}, {{.FavoritesCount}} favorites{{end}}
+{{if .Description}}{{.Description}}
+{{end}}{{.URL}}
+{{end}}
+--
+You get this digest {{.Frequency}}. Unsubscribe: {{.UnsubscribeURL}}
+`))
+
+var digestHTML = htmltemplate.Must(htmltemplate.New("digest.html").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif; max-width: 600px; margin: 0 auto; color: #333;">
+<h1 style="color: #5cb85c;">Your {{.Frequency}} digest</h1>
+<p>The top articles from the authors and tags you follow since {{.Since.Format "January 2"}}.</p>
+{{range .Articles}}<div style="margin: 24px 0;">
+<h2 style="margin: 0;"><a href="{{.URL}}" style="color: #333;">{{.Title}}</a></h2>
+<p style="margin: 4px 0; color: #999;">by <a href="{{.AuthorURL}}" style="color: #5cb85c;">{{.Author}}</a>{{if .FavoritesCount}} &middot; {{.FavoritesCount}} favorites{{end}}</p>
+{{if .Description}}<p style="margin: 4px 0;">{{.Description}}</p>{{end}}
+{{if .Tags}}<p style="margin: 4px 0; color: #999;">{{range $i, $tag := .Tags}}{{if $i}}, {{end}}#{{$tag}}{{end}}</p>{{end}}
+</div>
+{{end}}<p style="font-size: 12px; color: #999;">You get this digest {{.Frequency}}. <a href="{{.UnsubscribeURL}}" style="color: #999;">Unsubscribe</a></p>
+</body>
+</html>
+`))
+
+var newsletterText = texttemplate.Must(texttemplate.New("newsletter.txt").Parse(`{{.Subject}}
+From {{.Author}}, {{.AuthorURL}}
+
+{{.Body}}
+
+--
+You get this newsletter because you follow {{.Author}}. Unsubscribe from newsletters: {{.UnsubscribeURL}}
+`))
+
+var newsletterHTML = htmltemplate.Must(htmltemplate.New("newsletter.html").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif; max-width: 600px; margin: 0 auto; color: #333;">
+<h1>{{.Subject}}</h1>
+<p style="color: #999;">From <a href="{{.AuthorURL}}" style="color: #5cb85c;">{{.Author}}</a></p>
+{{.BodyHTML}}
+<p style="font-size: 12px; color: #999;">You get this newsletter because you follow {{.Author}}. <a href="{{.UnsubscribeURL}}" style="color: #999;">Unsubscribe from newsletters</a></p>
+</body>
+</html>
+`))
+
+// The page behind the unsubscribe links. Following the link only asks, so that mail scanners opening
+// links do not unsubscribe anyone, the button posts to the same URL like a one-click client would.
+var unsubscribePage = htmltemplate.Must(htmltemplate.New("unsubscribe.html").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif; max-width: 600px; margin: 40px auto; color: #333;">
+{{if .Done}}<p>You will not get {{.What}} anymore.</p>
+{{else}}<form method="post">
+<p>Stop getting {{.What}}?</p>
+<button type="submit">Unsubscribe</button>
+</form>
+{{end}}</body>
+</html>
+`))
+
+type unsubscribePageData struct {
+	What string
+	Done bool
+}
@@ -0,0 +1,305 @@
+package digests
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/articles"
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/filters"
+	"github.com/gothinkster/golang-gin-realworld-example-app/jobs"
+	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+)
+
+var test_db *gorm.DB
+
+//Reset test DB and create new one with mock data
+func resetDBWithMock() {
+	common.TestDBFree(test_db)
+	test_db = common.TestDBInit()
+	users.AutoMigrate()
+	jobs.AutoMigrate()
+	test_db.AutoMigrate(&articles.ArticleModel{}, &articles.TagModel{}, &articles.TagAliasModel{}, &articles.TagFollowModel{},
+		&articles.FavoriteModel{}, &articles.ArticleUserModel{}, &articles.CommentModel{}, &articles.ReactionModel{},
+		&articles.ReactionCountModel{}, &articles.ArticleTermModel{}, &articles.TermModel{}, &articles.MentionModel{})
+	filters.AutoMigrate()
+	AutoMigrate()
+}
+
+func userModelMocker(names ...string) []users.UserModel {
+	var ret []users.UserModel
+	for _, name := range names {
+		userModel := users.UserModel{Username: name, Email: name + "@linkedin.com"}
+		test_db.Create(&userModel)
+		ret = append(ret, userModel)
+	}
+	return ret
+}
+
+func newRouter() *gin.Engine {
+	r := gin.New()
+	r.Use(users.AuthMiddleware(false))
+	DigestsAnonymousRegister(r.Group("/digests"))
+	r.Use(users.AuthMiddleware(true))
+	articles.ArticlesRegister(r.Group("/articles"))
+	articles.TagsRegister(r.Group("/tags"))
+	users.ProfileRegister(r.Group("/profiles"))
+	DigestsRegister(r.Group("/digests"))
+	NewslettersRegister(r.Group("/newsletters"))
+	return r
+}
+
+func TestDigests(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	RegisterJobs()
+	mailer := common.NewMemoryMailer()
+	common.SetMailer(mailer)
+	defer common.SetMailer(nil)
+
+	mockUsers := userModelMocker("alice", "bob", "carol", "dave")
+	alice, bob, carol, dave := mockUsers[0], mockUsers[1], mockUsers[2], mockUsers[3]
+	r := newRouter()
+	send := func(method string, url string, userID uint, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		if userID != 0 {
+			req.Header.Set("Authorization", fmt.Sprintf("Token %v", common.GenToken(userID)))
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	write := func(author users.UserModel, title string, tags string) {
+		w := send("POST", "/articles/", author.ID, `{"article":{"title":"`+title+`","description":"About `+title+`",`+
+			`"body":"Body","tagList":[`+tags+`]}}`)
+		asserts.Equal(http.StatusCreated, w.Code)
+	}
+
+	asserts.Equal(http.StatusOK, send("POST", "/profiles/alice/follow", carol.ID, "").Code)
+	write(alice, "Older", "")
+	test_db.Model(&articles.ArticleModel{}).Where("slug = ?", "older").UpdateColumn("created_at", time.Now().Add(-10*24*time.Hour))
+	write(alice, "First", "")
+	write(alice, "Second", "")
+	write(bob, "Gophers", `"go"`)
+	write(bob, "Unrelated", `"rust"`)
+	asserts.Equal(http.StatusOK, send("POST", "/tags/go/follow", carol.ID, "").Code)
+	for _, favorite := range []struct {
+		user users.UserModel
+		slug string
+	}{{dave, "second"}, {bob, "second"}, {dave, "gophers"}} {
+		asserts.Equal(http.StatusOK, send("POST", "/articles/"+favorite.slug+"/favorite", favorite.user.ID, "").Code)
+	}
+
+	w := send("GET", "/digests/settings", carol.ID, "")
+	asserts.Equal(`{"digest":{"frequency":"off","newsletters":true,"lastSentAt":null}}`, w.Body.String(), "the digest should be opt-in")
+	asserts.Equal(0, ScheduleDue(time.Now()))
+	defer func(frequency string) { DefaultFrequency = frequency }(DefaultFrequency)
+	DefaultFrequency = FrequencyWeekly
+	w = send("GET", "/digests/settings", carol.ID, "")
+	asserts.Equal(`{"digest":{"frequency":"weekly","newsletters":true,"lastSentAt":null}}`, w.Body.String())
+
+	// The top articles of the week from the followed authors and tags, the most favorited first.
+	w = send("GET", "/digests/preview", carol.ID, "")
+	asserts.Equal(http.StatusOK, w.Code)
+	body := w.Body.String()
+	asserts.Contains(body, `"subject":"Your weekly digest: Second"`)
+	asserts.Regexp(`"articles":\[{"slug":"second","title":"Second","description":"About Second","author":"alice","tagList":\[\],"favoritesCount":2},`+
+		`{"slug":"gophers","title":"Gophers","description":"About Gophers","author":"bob","tagList":\["go"\],"favoritesCount":1},`+
+		`{"slug":"first",[^}]*"favoritesCount":0}\]`, body)
+	asserts.NotContains(body, `"older"`, "articles from before the digest should be left out")
+	asserts.NotContains(body, `"unrelated"`, "articles from strangers should be left out")
+
+	// Every user is due, only those with something new in their feed get an email.
+	now := time.Now()
+	asserts.Equal(4, ScheduleDue(now))
+	jobs.RunDue(time.Now())
+	messages := mailer.Messages()
+	asserts.Len(messages, 1)
+	message := messages[0]
+	asserts.Equal("carol@linkedin.com", message.To)
+	asserts.Equal("Your weekly digest: Second", message.Subject)
+	asserts.Contains(message.Text, "Second\nby alice, 2 favorites\nAbout Second\nhttp://localhost:4100/article/second\n")
+	asserts.Contains(message.HTML, `<a href="http://localhost:4100/article/gophers" style="color: #333;">Gophers</a>`)
+	asserts.Contains(message.HTML, `#go`)
+	asserts.Equal("List-Unsubscribe=One-Click", message.Headers["List-Unsubscribe-Post"])
+	link := regexp.MustCompile(`^<(.+)>$`).FindStringSubmatch(message.Headers["List-Unsubscribe"])
+	asserts.Len(link, 2)
+	asserts.Contains(message.Text, link[1])
+	asserts.Equal(0, ScheduleDue(now.Add(time.Hour)), "a digest should not be sent twice in its period")
+	asserts.Equal(4, ScheduleDue(now.Add(8*24*time.Hour)))
+
+	w = send("PUT", "/digests/settings", carol.ID, `{"digest":{"frequency":"hourly"}}`)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code)
+	asserts.Equal(`{"errors":{"frequency":"Unknown frequency"}}`, w.Body.String())
+	w = send("PUT", "/digests/settings", carol.ID, `{"digest":{"frequency":"daily"}}`)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Regexp(`{"digest":{"frequency":"daily","newsletters":true,"lastSentAt":"`, w.Body.String())
+
+	// Following the link asks first, posting to it unsubscribes.
+	unsubscribe, _ := url.Parse(link[1])
+	path := "/digests/unsubscribe?" + unsubscribe.RawQuery
+	w = send("GET", path, 0, "")
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Contains(w.Body.String(), "Stop getting the digest?")
+	asserts.Equal(FrequencyDaily, settingOf(carol.ID).Frequency, "following the link should not unsubscribe")
+	w = send("POST", path, 0, "List-Unsubscribe=One-Click")
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Contains(w.Body.String(), "You will not get the digest anymore.")
+	asserts.Equal(FrequencyOff, settingOf(carol.ID).Frequency)
+	asserts.True(settingOf(carol.ID).Newsletters, "unsubscribing from the digest should leave the newsletters alone")
+	asserts.Equal(3, ScheduleDue(now.Add(30*24*time.Hour)), "readers who unsubscribed should not be due")
+	w = send("POST", "/digests/unsubscribe?token="+strings.Replace(unsubscribe.Query().Get("token"), ".", "x.", 1), 0, "")
+	asserts.Equal(http.StatusNotFound, w.Code)
+	asserts.Equal(`{"errors":{"token":"Invalid token"}}`, w.Body.String())
+}
+
+func TestNewsletters(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	RegisterJobs()
+	mailer := common.NewMemoryMailer()
+	common.SetMailer(mailer)
+	defer common.SetMailer(nil)
+
+	defer func(frequency string) { DefaultFrequency = frequency }(DefaultFrequency)
+	DefaultFrequency = FrequencyWeekly
+
+	mockUsers := userModelMocker("alice", "carol", "dave", "erin")
+	alice, carol, dave, erin := mockUsers[0], mockUsers[1], mockUsers[2], mockUsers[3]
+	r := newRouter()
+	send := func(method string, url string, userID uint, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", fmt.Sprintf("Token %v", common.GenToken(userID)))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	asserts.Equal(http.StatusOK, send("POST", "/profiles/alice/follow", carol.ID, "").Code)
+	asserts.Equal(http.StatusOK, send("POST", "/profiles/alice/follow", dave.ID, "").Code)
+	w := send("PUT", "/digests/settings", dave.ID, `{"digest":{"newsletters":false}}`)
+	asserts.Equal(`{"digest":{"frequency":"weekly","newsletters":false,"lastSentAt":null}}`, w.Body.String())
+
+	w = send("POST", "/newsletters", alice.ID, `{"newsletter":{"subject":"","body":"Hello"}}`)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code)
+	w = send("POST", "/newsletters", alice.ID, `{"newsletter":{"subject":"News","body":"# Hello\n\nfrom *alice*"}}`)
+	asserts.Equal(http.StatusCreated, w.Code)
+	asserts.Regexp(`^{"newsletter":{"id":1,"subject":"News","body":"# Hello\\n\\nfrom \*alice\*",`+
+		`"bodyHtml":"\\u003ch1 id=\\"hello\\"\\u003eHello\\u003c/h1\\u003e\\n\\u003cp\\u003efrom \\u003cem\\u003ealice\\u003c/em\\u003e\\u003c/p\\u003e\\n",`+
+		`"recipientsCount":1,"createdAt":"`, w.Body.String(), "followers who opted out should not be counted")
+
+	jobs.RunDue(time.Now())
+	messages := mailer.Messages()
+	asserts.Len(messages, 1)
+	asserts.Equal("carol@linkedin.com", messages[0].To)
+	asserts.Equal("News", messages[0].Subject)
+	asserts.Contains(messages[0].Text, "# Hello\n\nfrom *alice*")
+	asserts.Contains(messages[0].HTML, "<p>from <em>alice</em></p>")
+	asserts.Contains(messages[0].HTML, "You get this newsletter because you follow alice.")
+
+	// Unsubscribing from the newsletters leaves the digest alone.
+	claims, err := parseUnsubscribeToken(UnsubscribeToken(carol.ID, ListNewsletter))
+	asserts.NoError(err)
+	asserts.NoError(unsubscribe(claims))
+	asserts.False(settingOf(carol.ID).Newsletters)
+	asserts.Equal(FrequencyWeekly, settingOf(carol.ID).Frequency)
+
+	w = send("GET", "/newsletters", alice.ID, "")
+	asserts.Regexp(`^{"newsletters":\[{"id":1,"subject":"News",.*\],"newslettersCount":1}$`, w.Body.String())
+	w = send("GET", "/newsletters", erin.ID, "")
+	asserts.Equal(`{"newsletters":[],"newslettersCount":0}`, w.Body.String())
+}
+
+type failingMailer struct{}
+
+func (failingMailer) Send(message common.Message) error {
+	return errors.New("Mail server down")
+}
+
+func TestFailedDigest(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	RegisterJobs()
+	common.SetMailer(failingMailer{})
+	defer common.SetMailer(nil)
+	defer func(frequency string) { DefaultFrequency = frequency }(DefaultFrequency)
+	DefaultFrequency = FrequencyWeekly
+
+	mockUsers := userModelMocker("alice", "carol")
+	alice, carol := mockUsers[0], mockUsers[1]
+	test_db.Model(&carol).UpdateColumn("moderator", true)
+	r := newRouter()
+	send := func(method string, url string, userID uint, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", fmt.Sprintf("Token %v", common.GenToken(userID)))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	asserts.Equal(http.StatusOK, send("POST", "/profiles/alice/follow", carol.ID, "").Code)
+	for _, title := range []string{"Shown", "Hidden"} {
+		w := send("POST", "/articles/", alice.ID, `{"article":{"title":"`+title+`","description":"About","body":"Body"}}`)
+		asserts.Equal(http.StatusCreated, w.Code)
+	}
+	test_db.Model(&articles.ArticleModel{}).Where("slug = ?", "hidden").UpdateColumn("hidden_at", time.Now())
+
+	now := time.Now()
+	asserts.Equal(2, ScheduleDue(now))
+	jobs.RunDue(now)
+	asserts.Nil(settingOf(carol.ID).LastSentAt, "a digest that failed should not count as sent")
+	asserts.NotNil(settingOf(alice.ID).LastSentAt, "an empty digest should count as sent")
+	asserts.Equal(0, ScheduleDue(now.Add(time.Hour)), "a digest waiting for a retry should not be enqueued again")
+
+	mailer := common.NewMemoryMailer()
+	common.SetMailer(mailer)
+	jobs.RunDue(now.Add(time.Hour))
+	messages := mailer.Messages()
+	asserts.Len(messages, 1)
+	asserts.Contains(messages[0].Text, "Shown")
+	asserts.NotContains(messages[0].Text, "Hidden", "the digests of moderators should leave hidden articles out")
+	asserts.NotNil(settingOf(carol.ID).LastSentAt)
+	asserts.Equal(0, ScheduleDue(now.Add(2*time.Hour)))
+}
+
+func TestUnsubscribeToken(t *testing.T) {
+	asserts := assert.New(t)
+	claims, err := parseUnsubscribeToken(UnsubscribeToken(3, ListDigest))
+	asserts.NoError(err)
+	asserts.Equal(uint(3), claims.UserID)
+	asserts.Equal(ListDigest, claims.List)
+
+	token := UnsubscribeToken(3, ListDigest)
+	forged := strings.Replace(token, token[:strings.Index(token, ".")], UnsubscribeToken(4, ListDigest)[:strings.Index(token, ".")], 1)
+	_, err = parseUnsubscribeToken(forged)
+	asserts.Equal(ErrInvalidToken, err, "a token of someone else should not pass with the signature of another")
+	_, err = parseUnsubscribeToken(UnsubscribeToken(3, "everything"))
+	asserts.Equal(ErrInvalidToken, err)
+	_, err = parseUnsubscribeToken("")
+	asserts.Equal(ErrInvalidToken, err)
+	expired := unsubscribeToken(unsubscribeClaims{UserID: 3, List: ListDigest, Expires: time.Now().Add(-time.Minute).Unix()})
+	_, err = parseUnsubscribeToken(expired)
+	asserts.Equal(ErrInvalidToken, err, "an expired token should not pass")
+}
+
+//This is a hack way to add test database for each case, as whole test will just share one database.
+func TestMain(m *testing.M) {
+	test_db = common.TestDBInit()
+	exitVal := m.Run()
+	common.TestDBFree(test_db)
+	os.Exit(exitVal)
+}
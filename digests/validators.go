@@ -0,0 +1,46 @@
+package digests
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+)
+
+// Only the settings given are changed.
+// 	{"digest":{"frequency":"daily","newsletters":false}}
+type DigestSettingValidator struct {
+	Digest struct {
+		Frequency   *string `form:"frequency" json:"frequency"`
+		Newsletters *bool   `form:"newsletters" json:"newsletters"`
+	} `json:"digest"`
+}
+
+func (s *DigestSettingValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, s)
+}
+
+type NewsletterModelValidator struct {
+	Newsletter struct {
+		Subject string `form:"subject" json:"subject" binding:"exists,min=1,max=255"`
+		Body    string `form:"body" json:"body" binding:"exists,min=1,max=200000"`
+	} `json:"newsletter"`
+	newsletterModel NewsletterModel `json:"-"`
+}
+
+func NewNewsletterModelValidator() NewsletterModelValidator {
+	return NewsletterModelValidator{}
+}
+
+func (s *NewsletterModelValidator) Bind(c *gin.Context) error {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+
+	err := common.Bind(c, s)
+	if err != nil {
+		return err
+	}
+	s.newsletterModel.Author = myUserModel
+	s.newsletterModel.AuthorID = myUserModel.ID
+	s.newsletterModel.Subject = s.Newsletter.Subject
+	s.newsletterModel.Body = s.Newsletter.Body
+	return nil
+}
@@ -0,0 +1,12 @@
+/*
+The feeds module containing the RSS and Atom feeds of the articles, for feed readers following the site without the API.
+
+models.go: definition of orm based data model, the tokens of the personal feeds
+
+feeds.go: building the feeds and writing them as Atom and RSS
+
+routers.go: router binding and core logic
+
+serializers.go: definition the schema of return data
+*/
+package feeds
@@ -0,0 +1,243 @@
+package feeds
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/articles"
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+)
+
+// How many of the latest articles a feed has and where the feeds are served, by default next to the API.
+var (
+	FeedSize = common.GetEnvInt("FEED_SIZE", 20)
+	FeedsURL = common.GetEnv("FEEDS_URL", strings.TrimSuffix(common.APIURL, "/api")+"/feeds")
+)
+
+// The formats a feed is written in, the extension of its URL picks one.
+const (
+	FormatAtom = "atom"
+	FormatRSS  = "rss"
+)
+
+var contentTypes = map[string]string{
+	FormatAtom: "application/atom+xml; charset=utf-8",
+	FormatRSS:  "application/rss+xml; charset=utf-8",
+}
+
+// A feed before it is written in one of the formats. Link is the page of the frontend the feed
+// stands for and Self where the feed itself is served.
+type Feed struct {
+	Title       string
+	Description string
+	Link        string
+	Self        string
+	Updated     time.Time
+	Articles    []articles.ArticleModel
+}
+
+// The feed of the articles, updated when the latest of them was. An empty feed was never updated.
+// 	feed := newFeed("Articles by jake", "", profileURL, self, articleModels)
+func newFeed(title, description, link, self string, articleModels []articles.ArticleModel) Feed {
+	feed := Feed{Title: title, Description: description, Link: link, Self: self, Updated: time.Unix(0, 0).UTC(), Articles: articleModels}
+	for _, model := range articleModels {
+		if model.UpdatedAt.After(feed.Updated) {
+			feed.Updated = model.UpdatedAt
+		}
+	}
+	// HTTP dates have no fractions of seconds, Last-Modified and If-Modified-Since compare whole ones.
+	feed.Updated = feed.Updated.UTC().Truncate(time.Second)
+	return feed
+}
+
+// The feed updated by an article leaving the listings at removedAt as well, its readers have to drop it.
+func (feed Feed) removedAt(at time.Time) Feed {
+	if at = at.UTC().Truncate(time.Second); at.After(feed.Updated) {
+		feed.Updated = at
+	}
+	return feed
+}
+
+func articleURL(model articles.ArticleModel) string {
+	return common.AppURL + "/article/" + url.PathEscape(model.Slug)
+}
+
+func profileURL(username string) string {
+	return common.AppURL + "/profile/" + url.PathEscape(username)
+}
+
+// A tag URI, RFC 4151, identifying the article for good even when its slug changes.
+func articleID(model articles.ArticleModel) string {
+	host := "localhost"
+	if parsed, err := url.Parse(common.AppURL); err == nil && parsed.Hostname() != "" {
+		host = parsed.Hostname()
+	}
+	return fmt.Sprintf("tag:%v,%v:article/%d", host, model.CreatedAt.UTC().Format("2006-01-02"), model.ID)
+}
+
+func tagsOf(model articles.ArticleModel) []string {
+	tags := []string{}
+	for _, tag := range model.Tags {
+		tags = append(tags, tag.Tag)
+	}
+	return tags
+}
+
+// Write the feed in the format, FormatAtom or FormatRSS.
+func (feed Feed) Render(format string) ([]byte, error) {
+	var document interface{}
+	if format == FormatRSS {
+		document = feed.rss()
+	} else {
+		document = feed.atom()
+	}
+	body, err := xml.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), body...), nil
+}
+
+type atomFeed struct {
+	XMLName  xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title    string      `xml:"title"`
+	Subtitle string      `xml:"subtitle,omitempty"`
+	ID       string      `xml:"id"`
+	Updated  string      `xml:"updated"`
+	Links    []atomLink  `xml:"link"`
+	Entries  []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Published  string         `xml:"published"`
+	Updated    string         `xml:"updated"`
+	Links      []atomLink     `xml:"link"`
+	Author     atomPerson     `xml:"author"`
+	Categories []atomCategory `xml:"category"`
+	Summary    *atomText      `xml:"summary,omitempty"`
+	Content    atomText       `xml:"content"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+func (feed Feed) atom() atomFeed {
+	document := atomFeed{
+		Title:    feed.Title,
+		Subtitle: feed.Description,
+		ID:       feed.Self,
+		Updated:  feed.Updated.Format(time.RFC3339),
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: feed.Self},
+			{Rel: "alternate", Type: "text/html", Href: feed.Link},
+		},
+		Entries: []atomEntry{},
+	}
+	for _, model := range feed.Articles {
+		author := model.Author.UserModel.Username
+		entry := atomEntry{
+			Title:      model.Title,
+			ID:         articleID(model),
+			Published:  model.CreatedAt.UTC().Format(time.RFC3339),
+			Updated:    model.UpdatedAt.UTC().Format(time.RFC3339),
+			Links:      []atomLink{{Rel: "alternate", Type: "text/html", Href: articleURL(model)}},
+			Author:     atomPerson{Name: author, URI: profileURL(author)},
+			Categories: []atomCategory{},
+			Content:    atomText{Type: "html", Body: articles.RenderMarkdownHTML(model.Body)},
+		}
+		for _, tag := range tagsOf(model) {
+			entry.Categories = append(entry.Categories, atomCategory{Term: tag})
+		}
+		if model.Description != "" {
+			entry.Summary = &atomText{Type: "text", Body: model.Description}
+		}
+		document.Entries = append(document.Entries, entry)
+	}
+	return document
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	AtomNS  string     `xml:"xmlns:atom,attr"`
+	DCNS    string     `xml:"xmlns:dc,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	AtomLink      atomLink  `xml:"atom:link"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	GUID        rssGUID  `xml:"guid"`
+	PubDate     string   `xml:"pubDate"`
+	Creator     string   `xml:"dc:creator"`
+	Categories  []string `xml:"category"`
+	Description string   `xml:"description"`
+}
+
+type rssGUID struct {
+	IsPermaLink string `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+func (feed Feed) rss() rssFeed {
+	description := feed.Description
+	if description == "" {
+		description = feed.Title
+	}
+	document := rssFeed{
+		Version: "2.0",
+		AtomNS:  "http://www.w3.org/2005/Atom",
+		DCNS:    "http://purl.org/dc/elements/1.1/",
+		Channel: rssChannel{
+			Title:         feed.Title,
+			Link:          feed.Link,
+			Description:   description,
+			AtomLink:      atomLink{Rel: "self", Type: "application/rss+xml", Href: feed.Self},
+			LastBuildDate: feed.Updated.Format(time.RFC1123Z),
+			Items:         []rssItem{},
+		},
+	}
+	for _, model := range feed.Articles {
+		document.Channel.Items = append(document.Channel.Items, rssItem{
+			Title:       model.Title,
+			Link:        articleURL(model),
+			GUID:        rssGUID{IsPermaLink: "false", Value: articleID(model)},
+			PubDate:     model.CreatedAt.UTC().Format(time.RFC1123Z),
+			Creator:     model.Author.UserModel.Username,
+			Categories:  tagsOf(model),
+			Description: articles.RenderMarkdownHTML(model.Body),
+		})
+	}
+	return document
+}
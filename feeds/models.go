@@ -0,0 +1,58 @@
+package feeds
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+	"github.com/jinzhu/gorm"
+)
+
+var ErrInvalidToken = errors.New("Invalid token")
+
+// The secret part of the URL of the personal feed of a user. Feed readers can't log in, whoever knows
+// the URL reads the feed, so users can revoke it and get a new one.
+type FeedTokenModel struct {
+	gorm.Model
+	UserID uint   `gorm:"unique_index"`
+	Token  string `gorm:"unique_index;size:64"`
+}
+
+// Migrate the schema of database if needed
+func AutoMigrate() {
+	db := common.GetDB()
+
+	db.AutoMigrate(&FeedTokenModel{})
+}
+
+func newToken() string {
+	buf := make([]byte, 24)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// The token of the personal feed of the user, made up the first time it is asked for.
+func tokenOf(userID uint) (FeedTokenModel, error) {
+	db := common.GetDB()
+	var model FeedTokenModel
+	err := db.Where(FeedTokenModel{UserID: userID}).Attrs(FeedTokenModel{Token: newToken()}).FirstOrCreate(&model).Error
+	return model, err
+}
+
+// Revoke the token of the user, the URL of their personal feed stops working.
+func revokeToken(userID uint) error {
+	db := common.GetDB()
+	return db.Unscoped().Where(FeedTokenModel{UserID: userID}).Delete(FeedTokenModel{}).Error
+}
+
+// The user whose personal feed the token opens.
+func findTokenOwner(token string) (users.UserModel, error) {
+	db := common.GetDB()
+	var model FeedTokenModel
+	if token == "" || db.Where(FeedTokenModel{Token: token}).First(&model).Error != nil {
+		return users.UserModel{}, ErrInvalidToken
+	}
+	return users.FindOneUser(&users.UserModel{ID: model.UserID})
+}
@@ -0,0 +1,188 @@
+package feeds
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gothinkster/golang-gin-realworld-example-app/articles"
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+)
+
+// Feed readers fetch the feeds without logging in, the group is the /feeds one outside of the API.
+// The extension of the last segment picks the format.
+// 	GET /feeds/authors/jake.rss
+func FeedsRegister(router *gin.RouterGroup) {
+	router.GET("/articles.atom", FeedArticles)
+	router.GET("/articles.rss", FeedArticles)
+	router.GET("/authors/:file", FeedAuthor)
+	router.GET("/tags/:file", FeedTag)
+	router.GET("/personal/:token", FeedPersonal)
+}
+
+// Every user manages the URL of their own personal feed, the group is the authenticated /feeds one.
+func FeedTokenRegister(router *gin.RouterGroup) {
+	router.GET("/personal", FeedTokenRetrieve)
+	router.DELETE("/personal", FeedTokenDelete)
+}
+
+// Split the last segment of a feed URL into its name and format, "jake.rss" into "jake" and "rss".
+func splitFormat(file string) (string, string, bool) {
+	dot := strings.LastIndex(file, ".")
+	if dot <= 0 {
+		return "", "", false
+	}
+	name, format := file[:dot], file[dot+1:]
+	if _, ok := contentTypes[format]; !ok {
+		return "", "", false
+	}
+	return name, format, true
+}
+
+// Where the feed at path is served, see FeedsURL. The headers of the request are not trusted with it.
+// 	self := selfURL("/authors/" + url.PathEscape(c.Param("file")))
+func selfURL(path string) string {
+	return FeedsURL + path
+}
+
+// Write the feed in the format, or answer 304 when the reader has it already. If-None-Match wins
+// over If-Modified-Since when both are sent.
+func serveFeed(c *gin.Context, feed Feed, format string) {
+	removedAt, err := articles.LastRemovedAt()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, common.NewError("database", err))
+		return
+	}
+	feed = feed.removedAt(removedAt)
+	body, err := feed.Render(format)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, common.NewError("feed", err))
+		return
+	}
+	etag := common.NewETag(body)
+	c.Header("ETag", etag)
+	c.Header("Last-Modified", feed.Updated.Format(http.TimeFormat))
+	if match := c.GetHeader("If-None-Match"); match != "" {
+		if common.ETagMatches(match, etag) {
+			c.Status(http.StatusNotModified)
+			c.Writer.WriteHeaderNow()
+			return
+		}
+	} else if since, err := http.ParseTime(c.GetHeader("If-Modified-Since")); err == nil && !feed.Updated.After(since) {
+		c.Status(http.StatusNotModified)
+		c.Writer.WriteHeaderNow()
+		return
+	}
+	c.Data(http.StatusOK, contentTypes[format], body)
+}
+
+func latestPage() common.Pagination {
+	return common.Pagination{Limit: FeedSize}
+}
+
+// The latest articles of everyone.
+// 	GET /feeds/articles.atom
+func FeedArticles(c *gin.Context) {
+	format := FormatAtom
+	if strings.HasSuffix(c.Request.URL.Path, "."+FormatRSS) {
+		format = FormatRSS
+	}
+	articleModels, _, _, err := articles.FindManyArticle(c.Request.Context(), "", "", "", articles.ArticleUserModel{}, latestPage())
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("feed", errors.New("Invalid param")))
+		return
+	}
+	serveFeed(c, newFeed("Latest articles", "The latest articles of everyone", common.AppURL+"/", selfURL("/articles."+format), articleModels), format)
+}
+
+// The latest articles of one author.
+// 	GET /feeds/authors/jake.rss
+func FeedAuthor(c *gin.Context) {
+	username, format, ok := splitFormat(c.Param("file"))
+	if !ok {
+		c.JSON(http.StatusNotFound, common.NewError("feed", errors.New("Unknown format")))
+		return
+	}
+	if _, err := users.FindOneUser(&users.UserModel{Username: username}); err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("profile", errors.New("Invalid username")))
+		return
+	}
+	articleModels, _, _, err := articles.FindManyArticle(c.Request.Context(), "", username, "", articles.ArticleUserModel{}, latestPage())
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("feed", errors.New("Invalid param")))
+		return
+	}
+	self := selfURL("/authors/" + url.PathEscape(c.Param("file")))
+	serveFeed(c, newFeed("Articles by "+username, "", profileURL(username), self, articleModels), format)
+}
+
+// The latest articles with one tag, an alias of the tag gives the same articles.
+// 	GET /feeds/tags/golang.atom
+func FeedTag(c *gin.Context) {
+	name, format, ok := splitFormat(c.Param("file"))
+	if !ok {
+		c.JSON(http.StatusNotFound, common.NewError("feed", errors.New("Unknown format")))
+		return
+	}
+	tagModel, err := articles.ResolveTag(name)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("tag", errors.New("Invalid tag")))
+		return
+	}
+	articleModels, _, _, err := articles.FindManyArticle(c.Request.Context(), tagModel.Tag, "", "", articles.ArticleUserModel{}, latestPage())
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("feed", errors.New("Invalid param")))
+		return
+	}
+	link := common.AppURL + "/?tag=" + url.QueryEscape(tagModel.Tag)
+	serveFeed(c, newFeed("Articles tagged "+tagModel.Tag, "", link, selfURL("/tags/"+url.PathEscape(c.Param("file"))), articleModels), format)
+}
+
+// The feed of the user the token belongs to: the articles of the authors and tags they follow. Whoever
+// holds the URL reads it, so moderators get what everyone gets and no hidden articles.
+// 	GET /feeds/personal/<token>.atom
+func FeedPersonal(c *gin.Context) {
+	token, format, ok := splitFormat(c.Param("token"))
+	if !ok {
+		c.JSON(http.StatusNotFound, common.NewError("feed", errors.New("Unknown format")))
+		return
+	}
+	userModel, err := findTokenOwner(token)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("token", ErrInvalidToken))
+		return
+	}
+	reader := articles.GetArticleUserModel(userModel)
+	reader.UserModel.Moderator = false
+	articleModels, _, _, err := reader.GetArticleFeed(c.Request.Context(), latestPage())
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("feed", errors.New("Invalid param")))
+		return
+	}
+	serveFeed(c, newFeed("Your feed", "The articles of the authors and tags "+userModel.Username+" follows", common.AppURL+"/", selfURL("/personal/"+c.Param("token")), articleModels), format)
+}
+
+// The URLs of the personal feed of the user, with a token made up the first time.
+func FeedTokenRetrieve(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	tokenModel, err := tokenOf(myUserModel.ID)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := FeedTokenSerializer{c, tokenModel, FeedsURL}
+	c.JSON(http.StatusOK, gin.H{"feed": serializer.Response()})
+}
+
+// Revoke the URLs of the personal feed of the user, the next retrieve makes new ones.
+func FeedTokenDelete(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	if err := revokeToken(myUserModel.ID); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"feed": "Delete success"})
+}
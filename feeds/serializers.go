@@ -0,0 +1,24 @@
+package feeds
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// Base is where the feeds are served, the URLs of the personal feed are under it.
+type FeedTokenSerializer struct {
+	C *gin.Context
+	FeedTokenModel
+	Base string
+}
+
+type FeedTokenResponse struct {
+	Atom string `json:"atom"`
+	RSS  string `json:"rss"`
+}
+
+func (s *FeedTokenSerializer) Response() FeedTokenResponse {
+	return FeedTokenResponse{
+		Atom: s.Base + "/personal/" + s.Token + "." + FormatAtom,
+		RSS:  s.Base + "/personal/" + s.Token + "." + FormatRSS,
+	}
+}
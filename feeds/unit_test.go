@@ -0,0 +1,246 @@
+package feeds
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/articles"
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/filters"
+	"github.com/gothinkster/golang-gin-realworld-example-app/jobs"
+	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+)
+
+var test_db *gorm.DB
+
+//Reset test DB and create new one with mock data
+func resetDBWithMock() {
+	common.TestDBFree(test_db)
+	test_db = common.TestDBInit()
+	users.AutoMigrate()
+	jobs.AutoMigrate()
+	test_db.AutoMigrate(&articles.ArticleModel{}, &articles.TagModel{}, &articles.TagAliasModel{}, &articles.TagFollowModel{},
+		&articles.FavoriteModel{}, &articles.ArticleUserModel{}, &articles.CommentModel{}, &articles.ReactionModel{},
+		&articles.ReactionCountModel{}, &articles.ArticleTermModel{}, &articles.TermModel{}, &articles.MentionModel{})
+	filters.AutoMigrate()
+	AutoMigrate()
+}
+
+func userModelMocker(names ...string) []users.UserModel {
+	var ret []users.UserModel
+	for _, name := range names {
+		userModel := users.UserModel{Username: name, Email: name + "@linkedin.com"}
+		test_db.Create(&userModel)
+		ret = append(ret, userModel)
+	}
+	return ret
+}
+
+func newRouter() *gin.Engine {
+	r := gin.New()
+	FeedsRegister(r.Group("/feeds"))
+	r.Use(users.AuthMiddleware(true))
+	articles.ArticlesRegister(r.Group("/articles"))
+	articles.TagsRegister(r.Group("/tags"))
+	users.ProfileRegister(r.Group("/profiles"))
+	FeedTokenRegister(r.Group("/api/feeds"))
+	return r
+}
+
+func TestFeeds(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	mockUsers := userModelMocker("alice", "bob", "carol")
+	alice, bob, carol := mockUsers[0], mockUsers[1], mockUsers[2]
+	r := newRouter()
+	send := func(method string, url string, userID uint, headers map[string]string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(""))
+		req.Host = "example.com"
+		req.Header.Set("X-Forwarded-Proto", "https")
+		if userID != 0 {
+			req.Header.Set("Authorization", fmt.Sprintf("Token %v", common.GenToken(userID)))
+		}
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	write := func(author users.UserModel, title string, tags string) {
+		req, _ := http.NewRequest("POST", "/articles/", bytes.NewBufferString(`{"article":{"title":"`+title+`",`+
+			`"description":"About `+title+`","body":"Hello *`+title+`*","tagList":[`+tags+`]}}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", fmt.Sprintf("Token %v", common.GenToken(author.ID)))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		asserts.Equal(http.StatusCreated, w.Code)
+	}
+
+	write(alice, "First", `"go"`)
+	write(alice, "Second", "")
+	write(bob, "Gophers", `"go","rust"`)
+	write(bob, "Hidden", "")
+	hiddenAt := time.Now().Add(-time.Minute)
+	test_db.Model(&articles.ArticleModel{}).Where("slug = ?", "hidden").UpdateColumn("hidden_at", hiddenAt)
+
+	// The global feed has the latest visible articles, the newest first, with their rendered bodies.
+	w := send("GET", "/feeds/articles.atom", 0, nil)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal("application/atom+xml; charset=utf-8", w.Header().Get("Content-Type"))
+	body := w.Body.String()
+	asserts.True(strings.HasPrefix(body, `<?xml version="1.0" encoding="UTF-8"?>`))
+	asserts.Contains(body, `<feed xmlns="http://www.w3.org/2005/Atom">`)
+	asserts.Contains(body, `<link rel="self" type="application/atom+xml" href="http://localhost:8080/feeds/articles.atom"></link>`)
+	asserts.Regexp(`(?s)<title>Gophers</title>.*<title>Second</title>.*<title>First</title>`, body)
+	asserts.Regexp(`<id>tag:localhost,\d{4}-\d{2}-\d{2}:article/\d+</id>`, body)
+	asserts.Contains(body, `<link rel="alternate" type="text/html" href="http://localhost:4100/article/gophers"></link>`)
+	asserts.Contains(body, `<name>bob</name>`)
+	asserts.Contains(body, `<category term="rust"></category>`)
+	asserts.Contains(body, `<summary type="text">About Gophers</summary>`)
+	asserts.Contains(body, `<content type="html">&lt;p&gt;Hello &lt;em&gt;Gophers&lt;/em&gt;&lt;/p&gt;`)
+	asserts.NotContains(body, "Hidden", "hidden articles should be left out")
+
+	w = send("GET", "/feeds/articles.rss", 0, nil)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Equal("application/rss+xml; charset=utf-8", w.Header().Get("Content-Type"))
+	body = w.Body.String()
+	asserts.Contains(body, `<rss version="2.0" xmlns:atom="http://www.w3.org/2005/Atom" xmlns:dc="http://purl.org/dc/elements/1.1/">`)
+	asserts.Contains(body, `<atom:link rel="self" type="application/rss+xml" href="http://localhost:8080/feeds/articles.rss"></atom:link>`)
+	asserts.Contains(body, `<dc:creator>alice</dc:creator>`)
+	asserts.Regexp(`<guid isPermaLink="false">tag:localhost,[^<]+</guid>`, body)
+	asserts.Regexp(`<pubDate>\w{3}, \d{2} \w{3} \d{4} \d{2}:\d{2}:\d{2} \+0000</pubDate>`, body)
+	asserts.Contains(body, `<description>&lt;p&gt;Hello &lt;em&gt;First&lt;/em&gt;&lt;/p&gt;`)
+
+	// Readers having the latest feed get a 304, by its ETag or by its date.
+	w = send("GET", "/feeds/articles.atom", 0, nil)
+	etag, lastModified := w.Header().Get("ETag"), w.Header().Get("Last-Modified")
+	asserts.NotEmpty(etag)
+	asserts.NotEmpty(lastModified)
+	w = send("GET", "/feeds/articles.atom", 0, map[string]string{"If-None-Match": etag})
+	asserts.Equal(http.StatusNotModified, w.Code)
+	asserts.Empty(w.Body.String())
+	w = send("GET", "/feeds/articles.atom", 0, map[string]string{"If-Modified-Since": lastModified})
+	asserts.Equal(http.StatusNotModified, w.Code)
+	w = send("GET", "/feeds/articles.atom", 0, map[string]string{"If-None-Match": `"stale"`, "If-Modified-Since": lastModified})
+	asserts.Equal(http.StatusOK, w.Code, "If-None-Match should win over If-Modified-Since")
+
+	test_db.Model(&articles.ArticleModel{}).Where("slug = ?", "first").UpdateColumn("updated_at", time.Now().Add(time.Hour))
+	w = send("GET", "/feeds/articles.atom", 0, map[string]string{"If-Modified-Since": lastModified})
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.NotEqual(lastModified, w.Header().Get("Last-Modified"))
+	w = send("GET", "/feeds/articles.atom", 0, map[string]string{"If-None-Match": etag})
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Contains(w.Body.String(), "<updated>"+time.Now().Add(time.Hour).UTC().Format("2006-01-02T15"))
+
+	// An article leaving the feed updates it, though none of the articles left changed.
+	lastModified = w.Header().Get("Last-Modified")
+	test_db.Model(&articles.ArticleModel{}).Where("slug = ?", "gophers").UpdateColumn("hidden_at", time.Now().Add(2*time.Hour))
+	w = send("GET", "/feeds/articles.atom", 0, map[string]string{"If-Modified-Since": lastModified})
+	asserts.Equal(http.StatusOK, w.Code, "hiding an article should update the feed")
+	asserts.NotContains(w.Body.String(), "<title>Gophers</title>")
+	test_db.Model(&articles.ArticleModel{}).Where("slug = ?", "gophers").UpdateColumn("hidden_at", nil)
+	lastModified = w.Header().Get("Last-Modified")
+	test_db.Model(&articles.ArticleModel{}).Where("slug = ?", "second").UpdateColumn("deleted_at", time.Now().Add(3*time.Hour))
+	w = send("GET", "/feeds/articles.atom", 0, map[string]string{"If-Modified-Since": lastModified})
+	asserts.Equal(http.StatusOK, w.Code, "deleting an article should update the feed")
+	asserts.NotContains(w.Body.String(), "<title>Second</title>")
+	test_db.Unscoped().Model(&articles.ArticleModel{}).Where("slug = ?", "second").UpdateColumn("deleted_at", nil)
+
+	// The feeds of one author and of one tag.
+	w = send("GET", "/feeds/authors/alice.rss", 0, nil)
+	asserts.Equal(http.StatusOK, w.Code)
+	body = w.Body.String()
+	asserts.Contains(body, `<title>Articles by alice</title>`)
+	asserts.Contains(body, `<link>http://localhost:4100/profile/alice</link>`)
+	asserts.Contains(body, `<title>First</title>`)
+	asserts.NotContains(body, `<title>Gophers</title>`)
+	asserts.Equal(http.StatusNotFound, send("GET", "/feeds/authors/nobody.rss", 0, nil).Code)
+	asserts.Equal(http.StatusNotFound, send("GET", "/feeds/authors/alice.json", 0, nil).Code)
+	asserts.Equal(http.StatusNotFound, send("GET", "/feeds/authors/alice", 0, nil).Code)
+
+	w = send("GET", "/feeds/tags/go.atom", 0, nil)
+	asserts.Equal(http.StatusOK, w.Code)
+	body = w.Body.String()
+	asserts.Contains(body, `<title>Articles tagged go</title>`)
+	asserts.Regexp(`(?s)<title>Gophers</title>.*<title>First</title>`, body)
+	asserts.NotContains(body, `<title>Second</title>`)
+	asserts.Equal(http.StatusNotFound, send("GET", "/feeds/tags/nothing.atom", 0, nil).Code)
+
+	// An empty feed was updated when an article last left the listings.
+	w = send("GET", "/feeds/authors/carol.atom", 0, nil)
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.NotContains(w.Body.String(), "<entry>")
+	asserts.Equal(hiddenAt.UTC().Format(http.TimeFormat), w.Header().Get("Last-Modified"))
+
+	// The personal feed is served at a private URL, which its owner can revoke.
+	asserts.Equal(http.StatusUnauthorized, send("GET", "/api/feeds/personal", 0, nil).Code)
+	asserts.Equal(http.StatusOK, send("POST", "/profiles/alice/follow", carol.ID, nil).Code)
+	w = send("GET", "/api/feeds/personal", carol.ID, nil)
+	asserts.Equal(http.StatusOK, w.Code)
+	urls := regexp.MustCompile(`^{"feed":{"atom":"http://localhost:8080(/feeds/personal/([0-9a-f]{48})\.atom)","rss":"http://localhost:8080(/feeds/personal/([0-9a-f]{48})\.rss)"}}$`).
+		FindStringSubmatch(w.Body.String())
+	asserts.Len(urls, 5)
+	asserts.Equal(urls[2], urls[4])
+	asserts.Equal(w.Body.String(), send("GET", "/api/feeds/personal", carol.ID, nil).Body.String(), "the token should be kept")
+
+	w = send("GET", urls[1], 0, nil)
+	asserts.Equal(http.StatusOK, w.Code)
+	body = w.Body.String()
+	asserts.Contains(body, `<title>Your feed</title>`)
+	asserts.Regexp(`(?s)<title>Second</title>.*<title>First</title>`, body)
+	asserts.NotContains(body, `<title>Gophers</title>`)
+	asserts.Equal(http.StatusOK, send("GET", urls[3], 0, nil).Code)
+	test_db.Model(&carol).UpdateColumn("moderator", true)
+	test_db.Model(&articles.ArticleModel{}).Where("slug = ?", "first").UpdateColumn("hidden_at", time.Now())
+	w = send("GET", urls[1], 0, nil)
+	asserts.Contains(w.Body.String(), `<title>Second</title>`)
+	asserts.NotContains(w.Body.String(), `<title>First</title>`, "the personal feed of a moderator should leave hidden articles out")
+	asserts.Equal(http.StatusNotFound, send("GET", "/feeds/personal/0123.atom", 0, nil).Code)
+
+	asserts.Equal(http.StatusOK, send("DELETE", "/api/feeds/personal", carol.ID, nil).Code)
+	asserts.Equal(http.StatusNotFound, send("GET", urls[1], 0, nil).Code)
+	w = send("GET", "/api/feeds/personal", carol.ID, nil)
+	asserts.NotContains(w.Body.String(), urls[2], "a revoked token should be replaced")
+}
+
+func TestSplitFormat(t *testing.T) {
+	asserts := assert.New(t)
+	for _, test := range []struct {
+		file   string
+		name   string
+		format string
+		ok     bool
+	}{
+		{"jake.rss", "jake", FormatRSS, true},
+		{"jake.atom", "jake", FormatAtom, true},
+		{"john.doe.atom", "john.doe", FormatAtom, true},
+		{"jake.xml", "", "", false},
+		{"jake", "", "", false},
+		{".rss", "", "", false},
+	} {
+		name, format, ok := splitFormat(test.file)
+		asserts.Equal(test.name, name, test.file)
+		asserts.Equal(test.format, format, test.file)
+		asserts.Equal(test.ok, ok, test.file)
+	}
+}
+
+func TestMain(m *testing.M) {
+	test_db = common.TestDBInit()
+	exitVal := m.Run()
+	common.TestDBFree(test_db)
+	os.Exit(exitVal)
+}
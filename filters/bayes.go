@@ -0,0 +1,108 @@
+package filters
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/jinzhu/gorm"
+)
+
+// Add a text to the training set of the spam classifier, moderators train it with their decisions.
+// 	err := filters.Train(articleModel.Body, true)
+func Train(text string, spam bool) error {
+	class := ClassHam
+	if spam {
+		class = ClassSpam
+	}
+	tokens := map[string]bool{"": true}
+	for _, token := range tokenize(text) {
+		tokens[token] = true
+	}
+
+	db := common.GetDB()
+	tx := db.Begin()
+	for token := range tokens {
+		var counter BayesTokenModel
+		// A struct condition would leave the empty token out.
+		err := tx.Where("class = ? AND token = ?", class, token).
+			Attrs(BayesTokenModel{Class: class, Token: token}).FirstOrCreate(&counter).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Model(&counter).UpdateColumn("count", gorm.Expr("count + 1")).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// The probability that the text is spam, ok is false until both classes have at least minDocs texts.
+//
+// Train counts every token once per text, so a token is weighed by the share of texts of each class
+// using it, with add-one smoothing for the tokens a class never saw.
+func SpamProbability(text string, minDocs uint) (float64, bool) {
+	tokens := map[string]bool{}
+	for _, token := range tokenize(text) {
+		tokens[token] = true
+	}
+	lookup := []string{""}
+	for token := range tokens {
+		lookup = append(lookup, token)
+	}
+
+	db := common.GetDB()
+	var counters []BayesTokenModel
+	if err := db.Where("token in (?)", lookup).Find(&counters).Error; err != nil {
+		return 0, false
+	}
+	counts := map[string]map[string]uint{ClassSpam: {}, ClassHam: {}}
+	for _, counter := range counters {
+		if counts[counter.Class] != nil {
+			counts[counter.Class][counter.Token] = counter.Count
+		}
+	}
+	spamDocs, hamDocs := counts[ClassSpam][""], counts[ClassHam][""]
+	if minDocs == 0 {
+		minDocs = 1
+	}
+	if spamDocs < minDocs || hamDocs < minDocs {
+		return 0, false
+	}
+
+	logSpam := math.Log(float64(spamDocs) / float64(spamDocs+hamDocs))
+	logHam := math.Log(float64(hamDocs) / float64(spamDocs+hamDocs))
+	for token := range tokens {
+		logSpam += math.Log(float64(counts[ClassSpam][token]+1) / float64(spamDocs+2))
+		logHam += math.Log(float64(counts[ClassHam][token]+1) / float64(hamDocs+2))
+	}
+	return 1 / (1 + math.Exp(logHam-logSpam)), true
+}
+
+// Holds or rejects content the trained classifier takes for spam, it allows everything until trained.
+type BayesFilter struct {
+	HoldAt   float64
+	RejectAt float64
+	MinDocs  uint
+}
+
+func (f *BayesFilter) Name() string {
+	return "spam"
+}
+
+func (f *BayesFilter) Check(content Content) (Outcome, string) {
+	probability, ok := SpamProbability(content.Text, f.MinDocs)
+	if !ok {
+		return Allow, ""
+	}
+	detail := fmt.Sprintf("%.0f%% spam", probability*100)
+	if f.RejectAt > 0 && probability >= f.RejectAt {
+		return Reject, detail
+	}
+	if f.HoldAt > 0 && probability >= f.HoldAt {
+		return Hold, detail
+	}
+	return Allow, ""
+}
@@ -0,0 +1,10 @@
+/*
+The filters module containing the content filters run on every article and comment that is created or updated.
+
+filters.go: the pipeline and the word list, link and repetition heuristics
+
+bayes.go: the naive Bayes spam classifier trained with moderator decisions
+
+models.go: definition of orm based data model
+*/
+package filters
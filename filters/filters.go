@@ -0,0 +1,268 @@
+package filters
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+)
+
+// What happens to content once the filters had a look at it.
+type Outcome string
+
+const (
+	Allow  Outcome = "allow"
+	Hold   Outcome = "hold"
+	Reject Outcome = "reject"
+)
+
+func (o Outcome) rank() int {
+	switch o {
+	case Reject:
+		return 2
+	case Hold:
+		return 1
+	}
+	return 0
+}
+
+// Why a filter did not simply allow the content.
+type Reason struct {
+	Filter string `json:"filter"`
+	Detail string `json:"detail"`
+}
+
+// The strictest outcome of all the filters and the reasons of each one that did not allow the content.
+type Verdict struct {
+	Outcome Outcome  `json:"outcome"`
+	Reasons []Reason `json:"reasons"`
+}
+
+// Bind returns it when the filters rejected the content, serve it with NewError.
+type RejectedError struct {
+	Verdict Verdict
+}
+
+func (e *RejectedError) Error() string {
+	return "Content rejected by the filters"
+}
+
+// The structured error served for rejected content:
+// 	{"errors":{"content":{"outcome":"reject","reasons":[{"filter":"links","detail":"12 links"}]}}}
+func NewError(verdict Verdict) common.CommonError {
+	res := common.CommonError{}
+	res.Errors = map[string]interface{}{"content": verdict}
+	return res
+}
+
+// The text a filter looks at. Previous holds the latest texts of the same kind by the same author.
+type Content struct {
+	Kind     string
+	AuthorID uint
+	Text     string
+	Previous []string
+}
+
+// A Filter returns Allow with no detail when it has nothing against the content.
+type Filter interface {
+	Name() string
+	Check(content Content) (Outcome, string)
+}
+
+// The filters run in order on every article and comment that is created or updated.
+type Pipeline struct {
+	mutex   sync.RWMutex
+	filters []Filter
+}
+
+// Add a filter at the end of the pipeline.
+func (p *Pipeline) Register(filter Filter) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.filters = append(p.filters, filter)
+}
+
+// Run every filter, the strictest outcome wins.
+func (p *Pipeline) Check(content Content) Verdict {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	verdict := Verdict{Outcome: Allow, Reasons: []Reason{}}
+	for _, filter := range p.filters {
+		outcome, detail := filter.Check(content)
+		if outcome == Allow {
+			continue
+		}
+		verdict.Reasons = append(verdict.Reasons, Reason{Filter: filter.Name(), Detail: detail})
+		if outcome.rank() > verdict.Outcome.rank() {
+			verdict.Outcome = outcome
+		}
+	}
+	return verdict
+}
+
+// The pipeline used by the article and comment validators, Register more filters on it at start up.
+var DefaultPipeline = NewDefaultPipeline()
+
+// The word list, link and repetition heuristics and the spam classifier, configured from the environment.
+func NewDefaultPipeline() *Pipeline {
+	pipeline := &Pipeline{}
+	pipeline.Register(&WordFilter{
+		RejectWords: wordsFromEnv("FILTER_REJECT_WORDS"),
+		HoldWords:   wordsFromEnv("FILTER_HOLD_WORDS"),
+	})
+	pipeline.Register(&LinkFilter{
+		HoldAt:   common.GetEnvInt("FILTER_HOLD_LINKS", 5),
+		RejectAt: common.GetEnvInt("FILTER_REJECT_LINKS", 20),
+	})
+	pipeline.Register(&RepetitionFilter{MinWords: 20, MaxShare: 0.4, MaxRun: 30})
+	pipeline.Register(&BayesFilter{
+		HoldAt:   float64(common.GetEnvInt("FILTER_SPAM_HOLD", 90)) / 100,
+		RejectAt: float64(common.GetEnvInt("FILTER_SPAM_REJECT", 99)) / 100,
+		MinDocs:  uint(common.GetEnvInt("FILTER_SPAM_MIN_DOCS", 20)),
+	})
+	return pipeline
+}
+
+// Run the default pipeline.
+// 	verdict := filters.Check(filters.Content{Kind: "comment", AuthorID: 3, Text: body})
+func Check(content Content) Verdict {
+	return DefaultPipeline.Check(content)
+}
+
+// Told about content held for review once it is saved, see SetHoldHandler.
+type HoldHandler func(targetType string, targetID uint, verdict Verdict)
+
+var holdHandler HoldHandler
+
+// Hand held content over, usually to the moderation queue. Held content is hidden until then anyway.
+// 	filters.SetHoldHandler(moderation.HoldForReview)
+func SetHoldHandler(handler HoldHandler) {
+	holdHandler = handler
+}
+
+// Called by the article and comment handlers after saving content the filters held.
+func NotifyHold(targetType string, targetID uint, verdict Verdict) {
+	if holdHandler != nil {
+		holdHandler(targetType, targetID, verdict)
+	}
+}
+
+func wordsFromEnv(key string) []string {
+	var words []string
+	for _, word := range strings.Split(os.Getenv(key), ",") {
+		if word = strings.ToLower(strings.TrimSpace(word)); word != "" {
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// Lower cased words of the text, links and other punctuation split into words as well.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '\''
+	})
+}
+
+// Rejects or holds content using any of the listed words.
+type WordFilter struct {
+	RejectWords []string
+	HoldWords   []string
+}
+
+func (f *WordFilter) Name() string {
+	return "words"
+}
+
+func (f *WordFilter) Check(content Content) (Outcome, string) {
+	words := map[string]bool{}
+	for _, token := range tokenize(content.Text) {
+		words[token] = true
+	}
+	for _, word := range f.RejectWords {
+		if words[word] {
+			return Reject, fmt.Sprintf("uses %q", word)
+		}
+	}
+	for _, word := range f.HoldWords {
+		if words[word] {
+			return Hold, fmt.Sprintf("uses %q", word)
+		}
+	}
+	return Allow, ""
+}
+
+var linkPattern = regexp.MustCompile(`(?i)\b(https?://|www\.)\S+`)
+
+// Holds or rejects content with too many links, a zero limit is never reached.
+type LinkFilter struct {
+	HoldAt   int
+	RejectAt int
+}
+
+func (f *LinkFilter) Name() string {
+	return "links"
+}
+
+func (f *LinkFilter) Check(content Content) (Outcome, string) {
+	links := len(linkPattern.FindAllString(content.Text, -1))
+	detail := fmt.Sprintf("%v links", links)
+	if f.RejectAt > 0 && links >= f.RejectAt {
+		return Reject, detail
+	}
+	if f.HoldAt > 0 && links >= f.HoldAt {
+		return Hold, detail
+	}
+	return Allow, ""
+}
+
+// Holds content posted before by the same author, content made of one word over and over,
+// and long runs of the same character.
+type RepetitionFilter struct {
+	MinWords int
+	MaxShare float64
+	MaxRun   int
+}
+
+func (f *RepetitionFilter) Name() string {
+	return "repetition"
+}
+
+func (f *RepetitionFilter) Check(content Content) (Outcome, string) {
+	text := strings.Join(tokenize(content.Text), " ")
+	for _, previous := range content.Previous {
+		if text != "" && text == strings.Join(tokenize(previous), " ") {
+			return Hold, "already posted"
+		}
+	}
+
+	tokens := tokenize(content.Text)
+	if len(tokens) >= f.MinWords {
+		counts := map[string]int{}
+		for _, token := range tokens {
+			counts[token]++
+			if float64(counts[token]) > f.MaxShare*float64(len(tokens)) {
+				return Hold, fmt.Sprintf("%q repeated %v times", token, counts[token])
+			}
+		}
+	}
+
+	run := 0
+	var last rune
+	for _, r := range content.Text {
+		if r == last && !unicode.IsSpace(r) {
+			run++
+		} else {
+			run = 1
+		}
+		last = r
+		if f.MaxRun > 0 && run >= f.MaxRun {
+			return Hold, fmt.Sprintf("%q repeated %v times in a row", r, run)
+		}
+	}
+	return Allow, ""
+}
@@ -0,0 +1,27 @@
+package filters
+
+import (
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	ClassSpam = "spam"
+	ClassHam  = "ham"
+)
+
+// How many times a token was seen in the training texts of a class. The row with an empty Token,
+// which tokenize never produces, counts the training texts themselves.
+type BayesTokenModel struct {
+	gorm.Model
+	Class string `gorm:"unique_index:idx_bayes_token"`
+	Token string `gorm:"unique_index:idx_bayes_token"`
+	Count uint
+}
+
+// Migrate the schema of database if needed
+func AutoMigrate() {
+	db := common.GetDB()
+
+	db.AutoMigrate(&BayesTokenModel{})
+}
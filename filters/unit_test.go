@@ -0,0 +1,81 @@
+package filters
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+)
+
+var test_db *gorm.DB
+
+func TestHeuristics(t *testing.T) {
+	asserts := assert.New(t)
+
+	pipeline := &Pipeline{}
+	pipeline.Register(&WordFilter{RejectWords: []string{"scam"}, HoldWords: []string{"darn"}})
+	pipeline.Register(&LinkFilter{HoldAt: 2, RejectAt: 4})
+	pipeline.Register(&RepetitionFilter{MinWords: 10, MaxShare: 0.4, MaxRun: 10})
+
+	verdict := pipeline.Check(Content{Text: "A perfectly fine text about http://golang.org"})
+	asserts.Equal(Verdict{Outcome: Allow, Reasons: []Reason{}}, verdict)
+
+	verdict = pipeline.Check(Content{Text: "Darn, see http://a.example and www.b.example"})
+	asserts.Equal(Hold, verdict.Outcome)
+	asserts.Equal([]Reason{{"words", `uses "darn"`}, {"links", "2 links"}}, verdict.Reasons)
+
+	verdict = pipeline.Check(Content{Text: "Darn, what a SCAM"})
+	asserts.Equal(Reject, verdict.Outcome, "the strictest outcome should win")
+	verdict = pipeline.Check(Content{Text: strings.Repeat("http://spam.example ", 4)})
+	asserts.Equal(Reject, verdict.Outcome)
+
+	verdict = pipeline.Check(Content{Text: strings.Repeat("buy ", 5) + "one two three four five six"})
+	asserts.Equal([]Reason{{"repetition", `"buy" repeated 5 times`}}, verdict.Reasons)
+	verdict = pipeline.Check(Content{Text: "so good!!!!!!!!!!"})
+	asserts.Equal([]Reason{{"repetition", `'!' repeated 10 times in a row`}}, verdict.Reasons)
+	verdict = pipeline.Check(Content{Text: "Same old, same old.", Previous: []string{"same old same OLD"}})
+	asserts.Equal([]Reason{{"repetition", "already posted"}}, verdict.Reasons)
+}
+
+func TestBayes(t *testing.T) {
+	asserts := assert.New(t)
+	common.TestDBFree(test_db)
+	test_db = common.TestDBInit()
+	AutoMigrate()
+
+	filter := &BayesFilter{HoldAt: 0.9, RejectAt: 0.99, MinDocs: 3}
+	outcome, _ := filter.Check(Content{Text: "cheap pills online"})
+	asserts.Equal(Allow, outcome, "an untrained classifier should allow everything")
+
+	spam := []string{"cheap pills online now", "buy cheap pills", "cheap watches online", "pills pills cheap offer"}
+	ham := []string{"how goroutines are scheduled", "notes on the gin router", "a gentle intro to gorm", "writing go tests"}
+	for i := range spam {
+		asserts.NoError(Train(spam[i], true))
+		asserts.NoError(Train(ham[i], false))
+	}
+	probability, ok := SpamProbability("cheap pills", 3)
+	asserts.True(ok)
+	asserts.True(probability > 0.9, "spammy text should score high, got %v", probability)
+	probability, _ = SpamProbability("tests for the gin router", 3)
+	asserts.True(probability < 0.1, "regular text should score low, got %v", probability)
+	_, ok = SpamProbability("cheap pills", 5)
+	asserts.False(ok, "the classifier should wait for enough training texts")
+
+	outcome, detail := filter.Check(Content{Text: "cheap pills online offer"})
+	asserts.Equal(Reject, outcome)
+	asserts.Regexp(`^\d+% spam$`, detail)
+	outcome, _ = filter.Check(Content{Text: "gorm tests"})
+	asserts.Equal(Allow, outcome)
+}
+
+//This is a hack way to add test database for each case, as whole test will just share one database.
+func TestMain(m *testing.M) {
+	test_db = common.TestDBInit()
+	exitVal := m.Run()
+	common.TestDBFree(test_db)
+	os.Exit(exitVal)
+}
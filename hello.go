@@ -1,44 +1,108 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
 	"github.com/jinzhu/gorm"
 	"github.com/gothinkster/golang-gin-realworld-example-app/articles"
 	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/digests"
+	"github.com/gothinkster/golang-gin-realworld-example-app/feeds"
+	"github.com/gothinkster/golang-gin-realworld-example-app/filters"
+	"github.com/gothinkster/golang-gin-realworld-example-app/jobs"
+	"github.com/gothinkster/golang-gin-realworld-example-app/moderation"
 	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+	"github.com/gothinkster/golang-gin-realworld-example-app/webhooks"
 )
 
 func Migrate(db *gorm.DB) {
 	users.AutoMigrate()
 	db.AutoMigrate(&articles.ArticleModel{})
 	db.AutoMigrate(&articles.TagModel{})
+	db.AutoMigrate(&articles.TagAliasModel{})
+	db.AutoMigrate(&articles.TagFollowModel{})
 	db.AutoMigrate(&articles.FavoriteModel{})
 	db.AutoMigrate(&articles.ArticleUserModel{})
 	db.AutoMigrate(&articles.CommentModel{})
+	db.AutoMigrate(&articles.ReactionModel{})
+	db.AutoMigrate(&articles.ReactionCountModel{})
+	db.AutoMigrate(&articles.ArticleTermModel{})
+	db.AutoMigrate(&articles.TermModel{})
+	db.AutoMigrate(&articles.MentionModel{})
+	if err := articles.WidenTextColumns(db); err != nil {
+		common.GetLogger().Error().Err(err).Str("func", "WidenTextColumns").Msg("db err")
+	}
+	if err := articles.NormalizeTags(db); err != nil {
+		common.GetLogger().Error().Err(err).Str("func", "NormalizeTags").Msg("db err")
+	}
+	if err := articles.IndexArticleTerms(db); err != nil {
+		common.GetLogger().Error().Err(err).Str("func", "IndexArticleTerms").Msg("db err")
+	}
+	moderation.AutoMigrate()
+	filters.AutoMigrate()
+	webhooks.AutoMigrate()
+	jobs.AutoMigrate()
+	digests.AutoMigrate()
+	feeds.AutoMigrate()
 }
 
 func main() {
 
+	common.InitLogger()
+	shutdownTracer := common.InitTracer()
 	db := common.Init()
 	Migrate(db)
 	defer db.Close()
+	common.InitCache()
+	common.InitHub()
+	common.InitMailer()
+	filters.SetHoldHandler(moderation.HoldForReview)
+	users.SetSuggestionSources(articles.FavoritedAuthorSuggestions, articles.TagAuthorSuggestions)
+	webhooks.RegisterJobs()
+	digests.RegisterJobs()
+	runner := jobs.NewRunner()
+	runner.Start()
 
-	r := gin.Default()
+	r := gin.New()
+	r.Use(common.RequestID(), common.RouteTemplates(r), common.Tracing(), common.AccessLog(), common.RequestMetrics(), gin.Recovery())
+	r.NoRoute(common.UnmatchedRoute)
+	r.GET("/metrics", common.MetricsHandler())
+	r.Use(common.BodySizeLimit(int64(common.GetEnvInt("MAX_BODY_BYTES", 2<<20))))
+
+	feeds.FeedsRegister(r.Group("/feeds"))
 
 	v1 := r.Group("/api")
 	users.UsersRegister(v1.Group("/users"))
 	v1.Use(users.AuthMiddleware(false))
 	articles.ArticlesAnonymousRegister(v1.Group("/articles"))
 	articles.TagsAnonymousRegister(v1.Group("/tags"))
+	digests.DigestsAnonymousRegister(v1.Group("/digests"))
 
 	v1.Use(users.AuthMiddleware(true))
 	users.UserRegister(v1.Group("/user"))
 	users.ProfileRegister(v1.Group("/profiles"))
 
 	articles.ArticlesRegister(v1.Group("/articles"))
+	articles.TagsRegister(v1.Group("/tags"))
+	articles.StreamRegister(v1.Group("/stream"))
+	webhooks.WebhooksRegister(v1.Group("/webhooks"))
+	digests.DigestsRegister(v1.Group("/digests"))
+	digests.NewslettersRegister(v1.Group("/newsletters"))
+	feeds.FeedTokenRegister(v1.Group("/feeds"))
+	moderation.ReportsRegister(v1.Group("/articles"))
+
+	moderationGroup := v1.Group("/moderation")
+	moderationGroup.Use(users.ModeratorMiddleware())
+	moderation.ModerationRegister(moderationGroup)
+	jobs.JobsAdminRegister(moderationGroup)
+	articles.TagsAdminRegister(moderationGroup)
 
 	testAuth := r.Group("/api/ping")
 
@@ -58,7 +122,7 @@ func main() {
 	}
 	tx1.Save(&userA)
 	tx1.Commit()
-	fmt.Println(userA)
+	common.GetLogger().Debug().Uint("id", userA.ID).Str("username", userA.Username).Msg("test user")
 
 	//db.Save(&ArticleUserModel{
 	//    UserModelID:userA.ID,
@@ -69,5 +133,39 @@ func main() {
 	//}).First(&userAA)
 	//fmt.Println(userAA)
 
-	r.Run() // listen and serve on 0.0.0.0:8080
+	// listen and serve on 0.0.0.0:8080, until SIGINT or SIGTERM lets the requests and the jobs in flight finish
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	server := &http.Server{Addr: ":" + port, Handler: r}
+	server.RegisterOnShutdown(common.GetHub().Stop)
+	failed := make(chan error, 1)
+	go func() {
+		failed <- server.ListenAndServe()
+	}()
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-failed:
+		common.GetLogger().Error().Err(err).Msg("server err")
+	case <-quit:
+	}
+	// The requests, the jobs and the spans left get a timeout each, a slow step doesn't eat into the next one.
+	shutdownTimeout := time.Duration(common.GetEnvInt("SHUTDOWN_TIMEOUT_SECONDS", 30)) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		common.GetLogger().Error().Err(err).Str("func", "Shutdown").Msg("server err")
+	}
+	jobsCtx, cancelJobs := context.WithTimeout(context.Background(), time.Duration(common.GetEnvInt("JOBS_SHUTDOWN_TIMEOUT_SECONDS", 30))*time.Second)
+	defer cancelJobs()
+	if err := runner.Stop(jobsCtx); err != nil {
+		common.GetLogger().Error().Err(err).Str("func", "Stop").Msg("jobs err")
+	}
+	tracerCtx, cancelTracer := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelTracer()
+	if err := shutdownTracer(tracerCtx); err != nil {
+		common.GetLogger().Error().Err(err).Str("func", "shutdownTracer").Msg("tracing err")
+	}
 }
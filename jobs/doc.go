@@ -0,0 +1,12 @@
+/*
+The jobs module containing the job queue kept in the database, the outbox domain events are recorded in and the runner working both off in the background.
+
+model.go: definition of orm based data model, enqueueing jobs and recording events
+
+runner.go: claiming, running, retrying and scheduling jobs, relaying the outbox
+
+routers.go: router binding and core logic
+
+serializers.go: definition the schema of return data
+*/
+package jobs
@@ -0,0 +1,191 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	StatusPending = "pending"
+	StatusRunning = "running"
+	StatusDone    = "done"
+	StatusDead    = "dead"
+)
+
+// The queue of the jobs registered without one.
+const DefaultQueue = "default"
+
+var ErrNotDead = errors.New("Only dead jobs can be retried")
+
+// A unit of background work. Pending jobs run once RunAt is due, failures are retried with a backoff
+// until MaxAttempts and then left dead for someone to look at. A running job whose LockedUntil passed
+// was dropped by a runner that went away and is claimed again.
+type JobModel struct {
+	gorm.Model
+	Queue       string    `gorm:"size:64;index:idx_job_due"`
+	Kind        string    `gorm:"size:64;index"`
+	Payload     string    `gorm:"type:text"`
+	Status      string    `gorm:"size:16;index:idx_job_due"`
+	RunAt       time.Time `gorm:"index:idx_job_due"`
+	Attempts    uint
+	MaxAttempts uint
+	LockedBy    string `gorm:"size:128"`
+	LockedUntil *time.Time
+	LastError   string `gorm:"size:1024"`
+	FinishedAt  *time.Time
+}
+
+// A domain event recorded in the transaction of the change it is about, so that it exists if and only if
+// the change does. The runner relays it to the subscribers as jobs and sets RelayedAt.
+type OutboxModel struct {
+	gorm.Model
+	Kind      string `gorm:"size:64"`
+	UserIDs   string
+	Data      string     `gorm:"type:text"`
+	RelayedAt *time.Time `gorm:"index"`
+}
+
+// A job enqueued every Every seconds, Runs counts the times it was enqueued so that only one runner does it.
+type ScheduleModel struct {
+	gorm.Model
+	Kind      string `gorm:"unique_index;size:64"`
+	Every     int64
+	NextRunAt time.Time
+	Runs      uint
+}
+
+// A domain event as handed to the subscribers.
+type Event struct {
+	ID        uint            `json:"id"`
+	Kind      string          `json:"kind"`
+	UserIDs   []uint          `json:"userIds"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+// Migrate the schema of database if needed
+func AutoMigrate() {
+	db := common.GetDB()
+
+	db.AutoMigrate(&JobModel{})
+	db.AutoMigrate(&OutboxModel{})
+	db.AutoMigrate(&ScheduleModel{})
+}
+
+// Enqueue a job of kind for now, payload is encoded as JSON.
+// 	err := jobs.Enqueue("webhooks.deliver", nil)
+func Enqueue(kind string, payload interface{}) error {
+	return EnqueueAt(common.GetDB(), kind, payload, time.Now())
+}
+
+// Enqueue a job with tx, so that it only runs if tx commits.
+// 	err := jobs.EnqueueTx(tx, "webhooks.deliver", nil)
+func EnqueueTx(tx *gorm.DB, kind string, payload interface{}) error {
+	return EnqueueAt(tx, kind, payload, time.Now())
+}
+
+// Enqueue a job with tx that runs at runAt at the earliest.
+// 	err := jobs.EnqueueAt(tx, "digest.send", digest, tomorrow)
+func EnqueueAt(tx *gorm.DB, kind string, payload interface{}, runAt time.Time) error {
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	options := optionsOf(kind)
+	return tx.Create(&JobModel{
+		Queue:       options.Queue,
+		Kind:        kind,
+		Payload:     string(encoded),
+		Status:      StatusPending,
+		RunAt:       runAt,
+		MaxAttempts: options.MaxAttempts,
+	}).Error
+}
+
+// Record a domain event in the outbox with tx, the transaction writing the change the event is about.
+// userIDs are the users the event concerns and data is encoded as JSON.
+// 	err := jobs.RecordEvent(tx, common.ArticleCreated, []uint{authorID}, articleEvent)
+func RecordEvent(tx *gorm.DB, kind string, userIDs []uint, data interface{}) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	ids := make([]string, len(userIDs))
+	for i, id := range userIDs {
+		ids[i] = strconv.FormatUint(uint64(id), 10)
+	}
+	return tx.Create(&OutboxModel{Kind: kind, UserIDs: strings.Join(ids, ","), Data: string(encoded)}).Error
+}
+
+func (model OutboxModel) event() Event {
+	event := Event{ID: model.ID, Kind: model.Kind, UserIDs: []uint{}, Data: json.RawMessage(model.Data), CreatedAt: model.CreatedAt}
+	for _, id := range strings.Split(model.UserIDs, ",") {
+		if id64, err := strconv.ParseUint(id, 10, 32); err == nil {
+			event.UserIDs = append(event.UserIDs, uint(id64))
+		}
+	}
+	return event
+}
+
+func FindOneJob(condition interface{}) (JobModel, error) {
+	db := common.GetDB()
+	var model JobModel
+	err := db.Where(condition).First(&model).Error
+	return model, err
+}
+
+// Load one page of jobs, newest first. Empty filters match everything.
+func findJobPage(status, queue, kind string, page common.Pagination) ([]JobModel, int, common.PageInfo, error) {
+	db := common.GetDB()
+	var models []JobModel
+	var count int
+	query := db.Model(&JobModel{})
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if queue != "" {
+		query = query.Where("queue = ?", queue)
+	}
+	if kind != "" {
+		query = query.Where("kind = ?", kind)
+	}
+	if err := query.Count(&count).Error; err != nil {
+		return models, count, common.PageInfo{}, err
+	}
+	if err := page.Scope(query, "job_models", true).Find(&models).Error; err != nil {
+		return models, count, common.PageInfo{}, err
+	}
+	ids := make([]uint, len(models))
+	for i, model := range models {
+		ids[i] = model.ID
+	}
+	keep, info := page.Info(ids, count)
+	models = models[:keep]
+	if page.Reverse() {
+		for i, j := 0, len(models)-1; i < j; i, j = i+1, j-1 {
+			models[i], models[j] = models[j], models[i]
+		}
+	}
+	return models, count, info, nil
+}
+
+// Give a dead job a fresh set of attempts, starting now.
+func (model *JobModel) retry() error {
+	if model.Status != StatusDead {
+		return ErrNotDead
+	}
+	db := common.GetDB()
+	return db.Model(model).UpdateColumns(map[string]interface{}{
+		"status":       StatusPending,
+		"attempts":     0,
+		"run_at":       time.Now(),
+		"finished_at":  nil,
+		"locked_until": nil,
+	}).Error
+}
@@ -0,0 +1,61 @@
+package jobs
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/jinzhu/gorm"
+)
+
+// The job queue as seen by moderators, the group has to be restricted with users.ModeratorMiddleware.
+func JobsAdminRegister(router *gin.RouterGroup) {
+	router.GET("/jobs", JobList)
+	router.POST("/jobs/:id/retry", JobRetry)
+}
+
+// Jobs newest first, status=dead lists the dead letters. status, queue and kind narrow the list down.
+func JobList(c *gin.Context) {
+	page, err := common.NewPagination(common.NewListing("jobs", c.Query("status"), c.Query("queue"), c.Query("kind")), c.Query("limit"), c.Query("offset"), c.Query("cursor"), common.DefaultPageLimit)
+	if err != nil {
+		c.JSON(common.CursorErrorStatus(err), common.NewError("cursor", err))
+		return
+	}
+	jobModels, count, pageInfo, err := findJobPage(c.Query("status"), c.Query("queue"), c.Query("kind"), page)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("jobs", errors.New("Invalid param")))
+		return
+	}
+	serializer := JobsSerializer{c, jobModels}
+	c.JSON(http.StatusOK, gin.H{
+		"jobs":       serializer.Response(),
+		"jobsCount":  count,
+		"nextCursor": pageInfo.NextCursor,
+		"prevCursor": pageInfo.PrevCursor,
+	})
+}
+
+// Run a dead job again with a fresh set of attempts, once whatever killed it is fixed.
+func JobRetry(c *gin.Context) {
+	id64, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("job", errors.New("Invalid id")))
+		return
+	}
+	jobModel, err := FindOneJob(&JobModel{Model: gorm.Model{ID: uint(id64)}})
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("job", errors.New("Invalid id")))
+		return
+	}
+	if err := jobModel.retry(); err == ErrNotDead {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("status", err))
+		return
+	} else if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := JobSerializer{c, jobModel}
+	c.JSON(http.StatusOK, gin.H{"job": serializer.Response()})
+}
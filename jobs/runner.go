@@ -0,0 +1,528 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/jinzhu/gorm"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The defaults of the jobs: how many run at once in every queue, how often a job is tried, how long
+// one attempt may take and how long to wait before the next one, doubling after every failure.
+var (
+	DefaultConcurrency = common.GetEnvInt("JOBS_CONCURRENCY", 4)
+	DefaultMaxAttempts = uint(common.GetEnvInt("JOBS_MAX_ATTEMPTS", 5))
+	DefaultTimeout     = time.Duration(common.GetEnvInt("JOBS_TIMEOUT_SECONDS", 60)) * time.Second
+	RetryBase          = time.Duration(common.GetEnvInt("JOBS_RETRY_BASE_SECONDS", 10)) * time.Second
+	RetryMax           = time.Duration(common.GetEnvInt("JOBS_RETRY_MAX_SECONDS", 60*60)) * time.Second
+	PollInterval       = time.Duration(common.GetEnvInt("JOBS_POLL_MS", 1000)) * time.Millisecond
+)
+
+// How long a runner may take on top of the timeout before its job is claimed again.
+const lockGrace = time.Minute
+
+// How many outbox events one round relays at most.
+const relayBatch = 100
+
+// How long finished jobs and relayed events are kept, see CleanupJob.
+var Retention = time.Duration(common.GetEnvInt("JOBS_RETENTION_HOURS", 7*24)) * time.Hour
+
+// The job deleting what is older than Retention once an hour: done jobs and relayed events. Dead jobs stay.
+const CleanupJob = "jobs.cleanup"
+
+// The job as its handler sees it, Attempt counts from 1.
+type Job struct {
+	ID      uint
+	Kind    string
+	Payload json.RawMessage
+	Attempt uint
+}
+
+// Does the work of a job. An error gets the job retried, unless it is Permanent. The context is done
+// when the timeout of the job passes or the runner gives up draining.
+type Handler func(ctx context.Context, job Job) error
+
+// How the jobs of a kind run, zero values take the defaults.
+type Options struct {
+	Queue       string
+	MaxAttempts uint
+	Timeout     time.Duration
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+// Wrap the error of a job that no retry can fix, the job is left dead right away.
+// 	return jobs.Permanent(errors.New("Unknown article"))
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+var (
+	registryMu  sync.RWMutex
+	handlers    = map[string]Handler{}
+	options     = map[string]Options{}
+	subscribers = map[string]bool{}
+	schedules   = map[string]time.Duration{}
+	pollers     = map[string]poller{}
+)
+
+type poller struct {
+	every time.Duration
+	poll  func(ctx context.Context)
+}
+
+// Register the handler of a kind of job, do it before the runner starts.
+// 	jobs.Register("webhooks.deliver", jobs.Options{Queue: "webhooks"}, deliver)
+func Register(kind string, opts Options, handler Handler) {
+	if opts.Queue == "" {
+		opts.Queue = DefaultQueue
+	}
+	if opts.MaxAttempts == 0 {
+		opts.MaxAttempts = DefaultMaxAttempts
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	handlers[kind] = handler
+	options[kind] = opts
+}
+
+// Subscribe a handler to the domain events of the outbox, every event becomes a job of kind for it.
+// 	jobs.Subscribe("webhooks.enqueue", jobs.Options{Queue: "webhooks"}, webhooks.HandleEvent)
+func Subscribe(kind string, opts Options, handler func(ctx context.Context, event Event) error) {
+	Register(kind, opts, func(ctx context.Context, job Job) error {
+		var event Event
+		if err := json.Unmarshal(job.Payload, &event); err != nil {
+			return Permanent(err)
+		}
+		return handler(ctx, event)
+	})
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	subscribers[kind] = true
+}
+
+// Enqueue a job of kind every interval, whichever runner gets to it first.
+// 	jobs.Schedule("digests.schedule", digests.PollInterval)
+func Schedule(kind string, every time.Duration) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	schedules[kind] = every
+}
+
+// Call poll every interval in a loop of every runner, for work cheap enough to look for that often. Unlike
+// Schedule no job is enqueued, so nothing is recorded or traced unless poll does it.
+// 	jobs.Poll("webhooks.retry", webhooks.PollInterval, retry)
+func Poll(name string, every time.Duration, poll func(ctx context.Context)) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	pollers[name] = poller{every: every, poll: poll}
+}
+
+func optionsOf(kind string) Options {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	if opts, ok := options[kind]; ok {
+		return opts
+	}
+	return Options{Queue: DefaultQueue, MaxAttempts: DefaultMaxAttempts, Timeout: DefaultTimeout}
+}
+
+func handlerOf(kind string) Handler {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return handlers[kind]
+}
+
+func subscriberKinds() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	var kinds []string
+	for kind := range subscribers {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+func queues() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	seen := map[string]bool{DefaultQueue: true}
+	names := []string{DefaultQueue}
+	for _, opts := range options {
+		if !seen[opts.Queue] {
+			seen[opts.Queue] = true
+			names = append(names, opts.Queue)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// How long to wait after the given number of failed attempts: RetryBase, then twice as long every time, up to RetryMax.
+func Backoff(attempts uint) time.Duration {
+	wait := RetryBase
+	for i := uint(1); i < attempts && wait < RetryMax; i++ {
+		wait *= 2
+	}
+	if wait > RetryMax {
+		wait = RetryMax
+	}
+	return wait
+}
+
+// A Runner works off the queues in the background: every queue runs up to its concurrency jobs at once,
+// DefaultConcurrency unless Concurrency says otherwise. It also relays the outbox and enqueues the
+// scheduled jobs. Any number of runners may share a database.
+type Runner struct {
+	Concurrency map[string]int
+	id          string
+	stop        chan struct{}
+	loops       sync.WaitGroup
+	running     sync.WaitGroup
+	ctx         context.Context
+	cancel      context.CancelFunc
+}
+
+func NewRunner() *Runner {
+	hostname, _ := os.Hostname()
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Runner{
+		Concurrency: map[string]int{},
+		id:          fmt.Sprintf("%v-%v", hostname, os.Getpid()),
+		stop:        make(chan struct{}),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+// Start a loop for every queue and poller known by now and one relaying the outbox and enqueueing the
+// scheduled jobs.
+func (r *Runner) Start() {
+	Register(CleanupJob, Options{}, cleanup)
+	Schedule(CleanupJob, time.Hour)
+	for _, queue := range queues() {
+		concurrency := r.Concurrency[queue]
+		if concurrency <= 0 {
+			concurrency = DefaultConcurrency
+		}
+		r.loops.Add(1)
+		go r.work(queue, concurrency)
+	}
+	registryMu.RLock()
+	for name, p := range pollers {
+		r.loops.Add(1)
+		go r.poll(name, p)
+	}
+	registryMu.RUnlock()
+	r.loops.Add(1)
+	go func() {
+		defer r.loops.Done()
+		ticker := time.NewTicker(PollInterval)
+		defer ticker.Stop()
+		for {
+			now := time.Now()
+			fireSchedules(now)
+			relay(now)
+			select {
+			case <-ticker.C:
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+// A round in progress is finished on Stop like a running job, its context is cancelled when Stop gives up.
+func (r *Runner) poll(name string, p poller) {
+	defer r.loops.Done()
+	ticker := time.NewTicker(p.every)
+	defer ticker.Stop()
+	logger := common.GetLogger().With().Str("poller", name).Logger()
+	ctx := logger.WithContext(r.ctx)
+	for {
+		func() {
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					logger.Error().Interface("panic", recovered).Msg("poll panic")
+				}
+			}()
+			p.poll(ctx)
+		}()
+		select {
+		case <-ticker.C:
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+func (r *Runner) work(queue string, concurrency int) {
+	defer r.loops.Done()
+	slots := make(chan struct{}, concurrency)
+	ticker := time.NewTicker(PollInterval)
+	defer ticker.Stop()
+	for {
+		if free := concurrency - len(slots); free > 0 {
+			now := time.Now()
+			for _, job := range claim(queue, free, now, r.id) {
+				slots <- struct{}{}
+				r.running.Add(1)
+				go func(job JobModel) {
+					defer func() {
+						<-slots
+						r.running.Done()
+					}()
+					execute(r.ctx, job, r.id)
+				}(job)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Stop claiming jobs and wait for the running ones to finish. When ctx is done first, the running jobs
+// see their context cancelled and Stop returns the error of ctx: whatever they leave unfinished is
+// claimed again once their lock runs out.
+// 	err := runner.Stop(ctx)
+func (r *Runner) Stop(ctx context.Context) error {
+	close(r.stop)
+	drained := make(chan struct{})
+	go func() {
+		r.loops.Wait()
+		r.running.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		r.cancel()
+		return nil
+	case <-ctx.Done():
+		r.cancel()
+		return ctx.Err()
+	}
+}
+
+// Do everything due at now in this goroutine: the scheduled jobs, the outbox and the jobs of every queue,
+// again and again until nothing is left. Jobs enqueued on the way are stamped with the clock, so now
+// follows it once it has gone past. Returns how many jobs ran, mostly useful in tests.
+func RunDue(now time.Time) int {
+	ran := 0
+	fireSchedules(now)
+	for {
+		if clock := time.Now(); clock.After(now) {
+			now = clock
+		}
+		relayed := relay(now)
+		due := claim("", relayBatch, now, "RunDue")
+		for _, job := range due {
+			execute(context.Background(), job, "RunDue")
+		}
+		ran += len(due)
+		if relayed == 0 && len(due) == 0 {
+			return ran
+		}
+	}
+}
+
+// Claim up to limit jobs of queue (every queue if empty) due at now for worker. A job is only claimed
+// by the runner whose update counted the attempt.
+func claim(queue string, limit int, now time.Time, worker string) []JobModel {
+	db := common.GetDB()
+	var due []JobModel
+	query := db.Where("(status = ? AND run_at <= ?) OR (status = ? AND locked_until < ?)", StatusPending, now, StatusRunning, now)
+	if queue != "" {
+		query = query.Where("queue = ?", queue)
+	}
+	if err := query.Order("run_at asc, id asc").Limit(limit).Find(&due).Error; err != nil {
+		common.GetLogger().Error().Err(err).Str("func", "jobs.claim").Msg("db err")
+		return nil
+	}
+	var claimed []JobModel
+	for _, job := range due {
+		lockedUntil := now.Add(optionsOf(job.Kind).Timeout + lockGrace)
+		result := db.Model(&JobModel{}).Where("id = ? AND status = ? AND attempts = ?", job.ID, job.Status, job.Attempts).
+			UpdateColumns(map[string]interface{}{
+				"status":       StatusRunning,
+				"attempts":     job.Attempts + 1,
+				"locked_by":    worker,
+				"locked_until": lockedUntil,
+			})
+		if result.Error != nil || result.RowsAffected != 1 {
+			continue
+		}
+		job.Status = StatusRunning
+		job.Attempts++
+		job.LockedBy = worker
+		job.LockedUntil = &lockedUntil
+		claimed = append(claimed, job)
+	}
+	return claimed
+}
+
+// Run a claimed job and settle its fate: done, retried later or dead. The handler finds a logger
+// carrying the id and kind of the job in its context, and the span of the attempt, a trace of its own.
+func execute(ctx context.Context, job JobModel, worker string) {
+	ctx, span := common.StartSpan(ctx, "job "+job.Kind, trace.WithNewRoot(), trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attribute.Int64("job.id", int64(job.ID)), attribute.String("job.kind", job.Kind),
+			attribute.Int64("job.attempt", int64(job.Attempts)), attribute.String("job.queue", job.Queue)))
+	defer span.End()
+	jobLogger := common.GetLogger().With().Uint("job_id", job.ID).Str("kind", job.Kind).Uint("attempt", job.Attempts).Logger()
+	if spanContext := span.SpanContext(); spanContext.HasTraceID() {
+		jobLogger = jobLogger.With().Str("trace_id", spanContext.TraceID().String()).Logger()
+	}
+	err := run(jobLogger.WithContext(ctx), job)
+	common.RecordSpanError(span, err)
+	now := time.Now()
+	changes := map[string]interface{}{"locked_until": nil, "last_error": ""}
+	_, permanent := err.(permanentError)
+	switch {
+	case err == nil:
+		changes["status"] = StatusDone
+		changes["finished_at"] = now
+	case permanent || job.Attempts >= job.MaxAttempts:
+		changes["status"] = StatusDead
+		changes["finished_at"] = now
+		changes["last_error"] = truncate(err.Error(), 1024)
+		jobLogger.Error().Err(err).Msg("job dead")
+	default:
+		changes["status"] = StatusPending
+		changes["run_at"] = now.Add(Backoff(job.Attempts))
+		changes["last_error"] = truncate(err.Error(), 1024)
+		jobLogger.Warn().Err(err).Time("retry_at", now.Add(Backoff(job.Attempts))).Msg("job failed")
+	}
+	db := common.GetDB()
+	// Another runner may have claimed the job again if this one took longer than its lock, its outcome wins.
+	err = db.Model(&JobModel{}).Where("id = ? AND attempts = ? AND locked_by = ?", job.ID, job.Attempts, worker).
+		UpdateColumns(changes).Error
+	if err != nil {
+		jobLogger.Error().Err(err).Str("func", "jobs.execute").Msg("db err")
+	}
+}
+
+func run(ctx context.Context, job JobModel) (err error) {
+	handler := handlerOf(job.Kind)
+	if handler == nil {
+		return Permanent(fmt.Errorf("No handler for %v jobs", job.Kind))
+	}
+	ctx, cancel := context.WithTimeout(ctx, optionsOf(job.Kind).Timeout)
+	defer cancel()
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("panic: %v", recovered)
+		}
+	}()
+	return handler(ctx, Job{ID: job.ID, Kind: job.Kind, Payload: json.RawMessage(job.Payload), Attempt: job.Attempts})
+}
+
+// Turn the outbox events recorded by now into jobs for the subscribers, returning how many were relayed.
+// Every event is relayed in a transaction of its own, together with the jobs made of it.
+func relay(now time.Time) int {
+	db := common.GetDB()
+	var pending []OutboxModel
+	err := db.Where("relayed_at IS NULL AND created_at <= ?", now).Order("id asc").Limit(relayBatch).Find(&pending).Error
+	if err != nil {
+		common.GetLogger().Error().Err(err).Str("func", "jobs.relay").Msg("db err")
+		return 0
+	}
+	kinds := subscriberKinds()
+	relayed := 0
+	for _, model := range pending {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			result := tx.Model(&OutboxModel{}).Where("id = ? AND relayed_at IS NULL", model.ID).UpdateColumn("relayed_at", now)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected != 1 {
+				return errRelayed
+			}
+			for _, kind := range kinds {
+				if err := EnqueueAt(tx, kind, model.event(), now); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err == nil {
+			relayed++
+		} else if err != errRelayed {
+			common.GetLogger().Error().Err(err).Str("func", "jobs.relay").Msg("db err")
+		}
+	}
+	return relayed
+}
+
+var errRelayed = errors.New("Relayed by another runner")
+
+// Enqueue the scheduled jobs due at now. The first run of a new schedule is due right away.
+func fireSchedules(now time.Time) {
+	registryMu.RLock()
+	due := map[string]time.Duration{}
+	for kind, every := range schedules {
+		due[kind] = every
+	}
+	registryMu.RUnlock()
+
+	db := common.GetDB()
+	for kind, every := range due {
+		var model ScheduleModel
+		err := db.Where(ScheduleModel{Kind: kind}).Attrs(ScheduleModel{Every: int64(every / time.Second), NextRunAt: now}).FirstOrCreate(&model).Error
+		if err != nil || model.NextRunAt.After(now) {
+			continue
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			result := tx.Model(&ScheduleModel{}).Where("id = ? AND runs = ?", model.ID, model.Runs).
+				UpdateColumns(map[string]interface{}{
+					"runs":        model.Runs + 1,
+					"every":       int64(every / time.Second),
+					"next_run_at": now.Add(every),
+				})
+			if result.Error != nil || result.RowsAffected != 1 {
+				return result.Error
+			}
+			return EnqueueAt(tx, kind, nil, now)
+		})
+		if err != nil {
+			common.GetLogger().Error().Err(err).Str("func", "jobs.fireSchedules").Msg("db err")
+		}
+	}
+}
+
+func cleanup(ctx context.Context, job Job) error {
+	db := common.GetDB()
+	before := time.Now().Add(-Retention)
+	err := db.Unscoped().Where("status = ? AND finished_at < ?", StatusDone, before).Delete(&JobModel{}).Error
+	if err != nil {
+		return err
+	}
+	return db.Unscoped().Where("relayed_at < ?", before).Delete(&OutboxModel{}).Error
+}
+
+func truncate(text string, limit int) string {
+	if len(text) > limit {
+		return text[:limit]
+	}
+	return text
+}
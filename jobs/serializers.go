@@ -0,0 +1,60 @@
+package jobs
+
+import (
+	"encoding/json"
+
+	"github.com/gin-gonic/gin"
+)
+
+type JobSerializer struct {
+	C *gin.Context
+	JobModel
+}
+
+type JobsSerializer struct {
+	C    *gin.Context
+	Jobs []JobModel
+}
+
+type JobResponse struct {
+	ID          uint            `json:"id"`
+	Queue       string          `json:"queue"`
+	Kind        string          `json:"kind"`
+	Status      string          `json:"status"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    uint            `json:"attempts"`
+	MaxAttempts uint            `json:"maxAttempts"`
+	LastError   string          `json:"lastError"`
+	RunAt       string          `json:"runAt"`
+	CreatedAt   string          `json:"createdAt"`
+	FinishedAt  *string         `json:"finishedAt"`
+}
+
+func (s *JobSerializer) Response() JobResponse {
+	response := JobResponse{
+		ID:          s.ID,
+		Queue:       s.Queue,
+		Kind:        s.Kind,
+		Status:      s.Status,
+		Payload:     json.RawMessage(s.Payload),
+		Attempts:    s.Attempts,
+		MaxAttempts: s.MaxAttempts,
+		LastError:   s.LastError,
+		RunAt:       s.RunAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		CreatedAt:   s.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+	}
+	if s.FinishedAt != nil {
+		finishedAt := s.FinishedAt.UTC().Format("2006-01-02T15:04:05.999Z")
+		response.FinishedAt = &finishedAt
+	}
+	return response
+}
+
+func (s *JobsSerializer) Response() []JobResponse {
+	response := []JobResponse{}
+	for _, job := range s.Jobs {
+		serializer := JobSerializer{s.C, job}
+		response = append(response, serializer.Response())
+	}
+	return response
+}
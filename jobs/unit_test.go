@@ -0,0 +1,404 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+)
+
+var test_db *gorm.DB
+
+//Reset test DB and create new one with mock data
+func resetDBWithMock() {
+	common.TestDBFree(test_db)
+	test_db = common.TestDBInit()
+	AutoMigrate()
+	registryMu.Lock()
+	handlers = map[string]Handler{}
+	options = map[string]Options{}
+	subscribers = map[string]bool{}
+	schedules = map[string]time.Duration{}
+	registryMu.Unlock()
+}
+
+func findJob(id uint) JobModel {
+	model, _ := FindOneJob(&JobModel{Model: gorm.Model{ID: id}})
+	return model
+}
+
+func TestRunDue(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	var got []string
+	Register("test.echo", Options{}, func(ctx context.Context, job Job) error {
+		var text string
+		json.Unmarshal(job.Payload, &text)
+		got = append(got, text)
+		return nil
+	})
+	asserts.NoError(Enqueue("test.echo", "hello"))
+	asserts.NoError(EnqueueAt(common.GetDB(), "test.echo", "later", time.Now().Add(time.Hour)))
+	asserts.Equal(1, RunDue(time.Now()))
+	asserts.Equal([]string{"hello"}, got)
+	job := findJob(1)
+	asserts.Equal(StatusDone, job.Status)
+	asserts.Equal(DefaultQueue, job.Queue)
+	asserts.Equal(uint(1), job.Attempts)
+	asserts.NotNil(job.FinishedAt)
+	asserts.Equal(StatusPending, findJob(2).Status, "a job should wait for its time")
+	asserts.Equal(0, RunDue(time.Now()), "a done job should not run again")
+	asserts.Equal(1, RunDue(time.Now().Add(2*time.Hour)))
+	asserts.Equal([]string{"hello", "later"}, got)
+
+	// Failures are retried with a backoff until the attempts run out, then the job is dead.
+	attempts := 0
+	Register("test.flaky", Options{MaxAttempts: 3}, func(ctx context.Context, job Job) error {
+		attempts++
+		asserts.Equal(uint(attempts), job.Attempt)
+		return fmt.Errorf("attempt %v failed", job.Attempt)
+	})
+	asserts.NoError(Enqueue("test.flaky", nil))
+	asserts.Equal(1, RunDue(time.Now()))
+	job = findJob(3)
+	asserts.Equal(StatusPending, job.Status)
+	asserts.Equal("attempt 1 failed", job.LastError)
+	asserts.True(job.RunAt.After(time.Now().Add(RetryBase-time.Second)), "a failed job should wait for its backoff")
+	asserts.Equal(0, RunDue(time.Now()))
+	asserts.Equal(2, RunDue(time.Now().Add(time.Hour)))
+	job = findJob(3)
+	asserts.Equal(StatusDead, job.Status)
+	asserts.Equal(uint(3), job.Attempts)
+	asserts.Equal("attempt 3 failed", job.LastError)
+	asserts.Equal(0, RunDue(time.Now().Add(24*time.Hour)), "a dead job should stay dead")
+
+	// Permanent errors, panics and unknown kinds.
+	Register("test.permanent", Options{}, func(ctx context.Context, job Job) error {
+		return Permanent(errors.New("Unknown article"))
+	})
+	Register("test.panic", Options{MaxAttempts: 1}, func(ctx context.Context, job Job) error {
+		panic("boom")
+	})
+	asserts.NoError(Enqueue("test.permanent", nil))
+	asserts.NoError(Enqueue("test.panic", nil))
+	asserts.NoError(Enqueue("test.unknown", nil))
+	asserts.Equal(3, RunDue(time.Now()))
+	job = findJob(4)
+	asserts.Equal(StatusDead, job.Status)
+	asserts.Equal(uint(1), job.Attempts, "a permanent error should not be retried")
+	asserts.Equal("Unknown article", job.LastError)
+	asserts.Equal(StatusDead, findJob(5).Status)
+	asserts.Equal("panic: boom", findJob(5).LastError)
+	asserts.Equal(StatusDead, findJob(6).Status)
+	asserts.Equal("No handler for test.unknown jobs", findJob(6).LastError)
+
+	// A job running past its timeout sees its context done.
+	Register("test.slow", Options{Timeout: 10 * time.Millisecond, MaxAttempts: 1}, func(ctx context.Context, job Job) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	asserts.NoError(Enqueue("test.slow", nil))
+	asserts.Equal(1, RunDue(time.Now()))
+	asserts.Equal(context.DeadlineExceeded.Error(), findJob(7).LastError)
+}
+
+func TestOutbox(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	var got []Event
+	Subscribe("test.subscriber", Options{Queue: "events"}, func(ctx context.Context, event Event) error {
+		got = append(got, event)
+		return nil
+	})
+	db := common.GetDB()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		asserts.NoError(RecordEvent(tx, "thing.created", []uint{3}, map[string]string{"name": "rolled back"}))
+		return errors.New("Rollback")
+	})
+	asserts.Error(err)
+	asserts.Equal(0, RunDue(time.Now()), "a rolled back change should leave no event")
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return RecordEvent(tx, "thing.created", []uint{3, 4}, map[string]string{"name": "kept"})
+	})
+	asserts.NoError(err)
+	asserts.Equal(1, RunDue(time.Now()))
+	asserts.Len(got, 1)
+	asserts.Equal("thing.created", got[0].Kind)
+	asserts.Equal([]uint{3, 4}, got[0].UserIDs)
+	asserts.Equal(`{"name":"kept"}`, string(got[0].Data))
+	job := findJob(1)
+	asserts.Equal("events", job.Queue)
+	asserts.Equal("test.subscriber", job.Kind)
+	asserts.Equal(StatusDone, job.Status)
+
+	var outbox OutboxModel
+	db.First(&outbox)
+	asserts.NotNil(outbox.RelayedAt)
+	asserts.Equal(0, relay(time.Now()), "an event should be relayed once")
+	asserts.Equal(0, RunDue(time.Now()))
+	asserts.Len(got, 1)
+}
+
+func TestSchedule(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	runs := 0
+	Register("test.tick", Options{}, func(ctx context.Context, job Job) error {
+		runs++
+		return nil
+	})
+	Schedule("test.tick", time.Minute)
+	now := time.Now()
+	asserts.Equal(1, RunDue(now), "a new schedule should be due right away")
+	asserts.Equal(0, RunDue(now.Add(30*time.Second)))
+	asserts.Equal(1, RunDue(now.Add(61*time.Second)))
+	asserts.Equal(2, runs)
+
+	var schedule ScheduleModel
+	test_db.Where(ScheduleModel{Kind: "test.tick"}).First(&schedule)
+	asserts.Equal(uint(2), schedule.Runs)
+	asserts.Equal(int64(60), schedule.Every)
+}
+
+func TestStaleLock(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	runs := 0
+	Register("test.stale", Options{Timeout: time.Second}, func(ctx context.Context, job Job) error {
+		runs++
+		if runs > 1 {
+			return errors.New("Ran twice")
+		}
+		return nil
+	})
+	asserts.NoError(Enqueue("test.stale", nil))
+	claimed := claim("", 10, time.Now(), "gone")
+	asserts.Len(claimed, 1)
+	asserts.Len(claim("", 10, time.Now(), "other"), 0, "a claimed job should not be claimed twice")
+	asserts.Equal(0, RunDue(time.Now()), "a locked job should be left alone")
+
+	// The runner holding the lock went away, once the lock runs out the job runs again.
+	asserts.Equal(1, RunDue(time.Now().Add(time.Second+lockGrace+time.Second)))
+	asserts.Equal(1, runs)
+	job := findJob(1)
+	asserts.Equal(StatusDone, job.Status)
+	asserts.Equal(uint(2), job.Attempts)
+
+	// The outcome of the runner that went away does not count anymore.
+	execute(context.Background(), claimed[0], "gone")
+	job = findJob(1)
+	asserts.Equal(StatusDone, job.Status)
+	asserts.Equal("", job.LastError)
+}
+
+func TestRunner(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	defer func(interval time.Duration) { PollInterval = interval }(PollInterval)
+	PollInterval = 10 * time.Millisecond
+	// One connection, so that the loops of the runner do not lock each other out of the sqlite file.
+	test_db.DB().SetMaxOpenConns(1)
+	defer test_db.DB().SetMaxOpenConns(0)
+
+	var mu sync.Mutex
+	running, most := 0, 0
+	started := make(chan bool, 4)
+	release := make(chan bool)
+	Register("test.block", Options{Queue: "blocking"}, func(ctx context.Context, job Job) error {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+		started <- true
+		<-release
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	})
+	for i := 0; i < 4; i++ {
+		asserts.NoError(Enqueue("test.block", i))
+	}
+
+	runner := NewRunner()
+	runner.Concurrency["blocking"] = 2
+	runner.Start()
+	<-started
+	<-started
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	asserts.Equal(2, most, "a queue should not run more jobs at once than its concurrency")
+	mu.Unlock()
+	release <- true
+	release <- true
+	<-started
+	<-started
+
+	// Stop waits for the running jobs.
+	stopped := make(chan error)
+	go func() {
+		stopped <- runner.Stop(context.Background())
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("Stop should wait for the running jobs")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release <- true
+	release <- true
+	asserts.NoError(<-stopped)
+	var count int
+	test_db.Model(&JobModel{}).Where("kind = ? AND status = ?", "test.block", StatusDone).Count(&count)
+	asserts.Equal(4, count)
+	asserts.Equal(2, most)
+}
+
+func TestRunnerStopTimeout(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	defer func(interval time.Duration) { PollInterval = interval }(PollInterval)
+	PollInterval = 10 * time.Millisecond
+	test_db.DB().SetMaxOpenConns(1)
+	defer test_db.DB().SetMaxOpenConns(0)
+
+	started := make(chan bool, 1)
+	Register("test.stuck", Options{MaxAttempts: 1}, func(ctx context.Context, job Job) error {
+		started <- true
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	asserts.NoError(Enqueue("test.stuck", nil))
+	runner := NewRunner()
+	runner.Start()
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	asserts.Equal(context.DeadlineExceeded, runner.Stop(ctx), "Stop should give up when its context is done")
+}
+
+func TestPoll(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	polled := make(chan bool, 10)
+	Poll("test.poll", 5*time.Millisecond, func(ctx context.Context) {
+		select {
+		case polled <- true:
+		default:
+		}
+	})
+	defer func() {
+		registryMu.Lock()
+		delete(pollers, "test.poll")
+		registryMu.Unlock()
+	}()
+	runner := NewRunner()
+	runner.Start()
+	<-polled
+	<-polled
+	asserts.NoError(runner.Stop(context.Background()))
+	for len(polled) > 0 {
+		<-polled
+	}
+	time.Sleep(20 * time.Millisecond)
+	asserts.Len(polled, 0, "a stopped runner should not poll")
+
+	var count int
+	test_db.Model(&JobModel{}).Where("kind = ?", "test.poll").Count(&count)
+	asserts.Equal(0, count, "polling should not enqueue jobs")
+}
+
+func TestJobsAdmin(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	Register("test.broken", Options{Queue: "broken", MaxAttempts: 1}, func(ctx context.Context, job Job) error {
+		return errors.New("Broken")
+	})
+	Register("test.fine", Options{}, func(ctx context.Context, job Job) error {
+		return nil
+	})
+	asserts.NoError(Enqueue("test.broken", map[string]int{"n": 1}))
+	asserts.NoError(Enqueue("test.fine", nil))
+	asserts.NoError(Enqueue("test.fine", nil))
+	RunDue(time.Now())
+
+	r := gin.New()
+	JobsAdminRegister(r.Group("/admin"))
+	send := func(method, path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	list := func(query string) []JobResponse {
+		w := send("GET", "/admin/jobs"+query)
+		asserts.Equal(http.StatusOK, w.Code)
+		var body struct {
+			Jobs []JobResponse `json:"jobs"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return body.Jobs
+	}
+
+	jobs := list("")
+	asserts.Len(jobs, 3)
+	asserts.Equal(uint(3), jobs[0].ID, "the newest job should come first")
+	jobs = list("?status=dead")
+	asserts.Len(jobs, 1)
+	asserts.Equal("test.broken", jobs[0].Kind)
+	asserts.Equal("broken", jobs[0].Queue)
+	asserts.Equal("Broken", jobs[0].LastError)
+	asserts.Equal(`{"n":1}`, string(jobs[0].Payload))
+	asserts.NotNil(jobs[0].FinishedAt)
+	asserts.Len(list("?kind=test.fine"), 2)
+	asserts.Len(list("?queue=broken&status=done"), 0)
+	asserts.Len(list("?limit=1"), 1)
+	asserts.Equal(http.StatusUnprocessableEntity, send("GET", "/admin/jobs?cursor=nope").Code)
+
+	asserts.Equal(http.StatusUnprocessableEntity, send("POST", "/admin/jobs/2/retry").Code, "only dead jobs can be retried")
+	asserts.Equal(http.StatusNotFound, send("POST", "/admin/jobs/42/retry").Code)
+	asserts.Equal(http.StatusNotFound, send("POST", "/admin/jobs/nope/retry").Code)
+	w := send("POST", "/admin/jobs/1/retry")
+	asserts.Equal(http.StatusOK, w.Code)
+	job := findJob(1)
+	asserts.Equal(StatusPending, job.Status)
+	asserts.Equal(uint(0), job.Attempts)
+	asserts.Nil(job.FinishedAt)
+	asserts.Equal(1, RunDue(time.Now()))
+	asserts.Equal(StatusDead, findJob(1).Status)
+}
+
+func TestBackoff(t *testing.T) {
+	asserts := assert.New(t)
+	asserts.Equal(RetryBase, Backoff(1))
+	asserts.Equal(2*RetryBase, Backoff(2))
+	asserts.Equal(RetryMax, Backoff(100))
+}
+
+//This is a hack way to add test database for each case, as whole test will just share one database.
+func TestMain(m *testing.M) {
+	test_db = common.TestDBInit()
+	exitVal := m.Run()
+	common.TestDBFree(test_db)
+	os.Exit(exitVal)
+}
@@ -0,0 +1,12 @@
+/*
+The moderation module containing the reports readers file on articles and comments, the moderation queue and the actions moderators take on it.
+
+model.go: definition of orm based data model
+
+routers.go: router binding and core logic
+
+serializers.go: definition the schema of return data
+
+validators.go: definition the validator of form data
+*/
+package moderation
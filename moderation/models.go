@@ -0,0 +1,311 @@
+package moderation
+
+import (
+	"errors"
+	"github.com/gothinkster/golang-gin-realworld-example-app/articles"
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/filters"
+	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+	"github.com/jinzhu/gorm"
+	"strings"
+	"time"
+)
+
+const (
+	TargetArticle = "article"
+	TargetComment = "comment"
+)
+
+const (
+	StatusOpen      = "open"
+	StatusActioned  = "actioned"
+	StatusDismissed = "dismissed"
+)
+
+const (
+	ActionDismiss = "dismiss"
+	ActionHide    = "hide"
+	ActionDelete  = "delete"
+	ActionSuspend = "suspend"
+)
+
+// The reason codes a reader may pick when reporting content.
+var Reasons = []string{"spam", "harassment", "hate", "violence", "sexual", "misinformation", "other"}
+
+// The reason of the reports filed by the content filters for the content they held, readers can not pick it.
+const ReasonFiltered = "filtered"
+
+var Actions = []string{ActionDismiss, ActionHide, ActionDelete, ActionSuspend}
+
+var ErrUnknownReason = errors.New("Unknown reason")
+var ErrUnknownAction = errors.New("Unknown action")
+var ErrTargetGone = errors.New("The reported content no longer exists")
+var ErrReportClosed = errors.New("The report has already been resolved")
+
+// A report of an article or a comment by a reader. A reader has at most one open report per target,
+// reporting it again only updates the reason. Reports are closed by the first action taken on their target.
+type ReportModel struct {
+	gorm.Model
+	TargetType string `gorm:"index:idx_report_target"`
+	TargetID   uint   `gorm:"index:idx_report_target"`
+	Reporter   users.UserModel
+	ReporterID uint
+	Reason     string `gorm:"index"`
+	Note       string `gorm:"size:1024"`
+	Status     string `gorm:"index"`
+	ActionID   *uint
+	ResolvedAt *time.Time
+}
+
+// Every action a moderator takes is kept, whether or not it came from a report.
+//
+// AuthorID is the UserModel id of the author of the target at the time of the action.
+type ActionModel struct {
+	gorm.Model
+	TargetType  string `gorm:"index:idx_action_target"`
+	TargetID    uint   `gorm:"index:idx_action_target"`
+	Action      string
+	Moderator   users.UserModel
+	ModeratorID uint
+	AuthorID    uint
+	Note        string `gorm:"size:1024"`
+}
+
+// Migrate the schema of database if needed
+func AutoMigrate() {
+	db := common.GetDB()
+
+	db.AutoMigrate(&ReportModel{})
+	db.AutoMigrate(&ActionModel{})
+}
+
+func isReason(reason string) bool {
+	for _, allowed := range Reasons {
+		if reason == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func isAction(action string) bool {
+	for _, allowed := range Actions {
+		if action == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Open a report of reporter on a target, or update the reason of the report still open.
+// 	report, err := fileReport(TargetArticle, articleModel.ID, myUserModel, "spam", "")
+func fileReport(targetType string, targetID uint, reporter users.UserModel, reason string, note string) (ReportModel, error) {
+	db := common.GetDB()
+	var report ReportModel
+	if !isReason(reason) {
+		return report, ErrUnknownReason
+	}
+	db.Where(ReportModel{
+		TargetType: targetType,
+		TargetID:   targetID,
+		ReporterID: reporter.ID,
+		Status:     StatusOpen,
+	}).FirstOrInit(&report)
+	report.Reporter = reporter
+	report.Reason = reason
+	report.Note = note
+	err := db.Save(&report).Error
+	return report, err
+}
+
+func FindOneReport(condition interface{}) (ReportModel, error) {
+	db := common.GetDB()
+	var model ReportModel
+	err := db.Preload("Reporter").Where(condition).First(&model).Error
+	return model, err
+}
+
+// Load one page of the moderation queue, oldest first. Empty filters match everything.
+func findReportPage(status, reason, targetType string, page common.Pagination) ([]ReportModel, int, common.PageInfo, error) {
+	db := common.GetDB()
+	var models []ReportModel
+	var count int
+	query := db.Model(&ReportModel{})
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if reason != "" {
+		query = query.Where("reason = ?", reason)
+	}
+	if targetType != "" {
+		query = query.Where("target_type = ?", targetType)
+	}
+	if err := query.Count(&count).Error; err != nil {
+		return models, count, common.PageInfo{}, err
+	}
+	if err := page.Scope(query.Preload("Reporter"), "report_models", false).Find(&models).Error; err != nil {
+		return models, count, common.PageInfo{}, err
+	}
+	keep, info := page.Info(reportIDs(models), count)
+	models = models[:keep]
+	if page.Reverse() {
+		for i, j := 0, len(models)-1; i < j; i, j = i+1, j-1 {
+			models[i], models[j] = models[j], models[i]
+		}
+	}
+	return models, count, info, nil
+}
+
+// Load one page of the actions taken by moderators, newest first.
+func findActionPage(page common.Pagination) ([]ActionModel, int, common.PageInfo, error) {
+	db := common.GetDB()
+	var models []ActionModel
+	var count int
+	query := db.Model(&ActionModel{})
+	if err := query.Count(&count).Error; err != nil {
+		return models, count, common.PageInfo{}, err
+	}
+	if err := page.Scope(query.Preload("Moderator"), "action_models", true).Find(&models).Error; err != nil {
+		return models, count, common.PageInfo{}, err
+	}
+	ids := make([]uint, len(models))
+	for i, model := range models {
+		ids[i] = model.ID
+	}
+	keep, info := page.Info(ids, count)
+	models = models[:keep]
+	if page.Reverse() {
+		for i, j := 0, len(models)-1; i < j; i, j = i+1, j-1 {
+			models[i], models[j] = models[j], models[i]
+		}
+	}
+	return models, count, info, nil
+}
+
+func reportIDs(models []ReportModel) []uint {
+	ids := make([]uint, len(models))
+	for i, model := range models {
+		ids[i] = model.ID
+	}
+	return ids
+}
+
+// Take an action on the target of a report: the content is changed, the action recorded and every report
+// still open on the same target closed with it. Dismissing leaves the content as it is, unless the content
+// filters held it. Resolved reports can't be acted on again.
+// 	action, err := takeAction(reportModel, myUserModel, ActionHide, "")
+func takeAction(report ReportModel, moderator users.UserModel, action string, note string) (ActionModel, error) {
+	actionModel := ActionModel{
+		TargetType: report.TargetType,
+		TargetID:   report.TargetID,
+		Action:     action,
+		Moderator:  moderator,
+		Note:       note,
+	}
+	if !isAction(action) {
+		return actionModel, ErrUnknownAction
+	}
+	if report.Status != StatusOpen {
+		return actionModel, ErrReportClosed
+	}
+
+	var text string
+	var err error
+	switch report.TargetType {
+	case TargetArticle:
+		text, err = actOnArticle(&actionModel, report)
+	case TargetComment:
+		text, err = actOnComment(&actionModel, report)
+	}
+	if err != nil && action != ActionDismiss {
+		return actionModel, err
+	}
+	if err == nil && (report.Reason == "spam" || report.Reason == ReasonFiltered) {
+		// The decisions on spam reports are what the spam classifier learns from.
+		if err := filters.Train(text, action != ActionDismiss); err != nil {
+			return actionModel, err
+		}
+	}
+
+	db := common.GetDB()
+	tx := db.Begin()
+	if err := tx.Create(&actionModel).Error; err != nil {
+		tx.Rollback()
+		return actionModel, err
+	}
+	status := StatusActioned
+	if action == ActionDismiss {
+		status = StatusDismissed
+	}
+	err = tx.Model(&ReportModel{}).
+		Where("target_type = ? AND target_id = ? AND status = ?", report.TargetType, report.TargetID, StatusOpen).
+		Updates(map[string]interface{}{"status": status, "action_id": actionModel.ID, "resolved_at": time.Now()}).Error
+	if err != nil {
+		tx.Rollback()
+		return actionModel, err
+	}
+	return actionModel, tx.Commit().Error
+}
+
+// Apply the action on the article and return its text. Dismissing a report of the filters releases the held article.
+func actOnArticle(actionModel *ActionModel, report ReportModel) (string, error) {
+	articleModel, err := articles.FindOneArticle(&articles.ArticleModel{Model: gorm.Model{ID: actionModel.TargetID}})
+	if err != nil || articleModel.ID == 0 {
+		return "", ErrTargetGone
+	}
+	actionModel.AuthorID = articleModel.Author.UserModelID
+	text := articleModel.Title + "\n" + articleModel.Description + "\n" + articleModel.Body
+	switch actionModel.Action {
+	case ActionDismiss:
+		if report.Reason == ReasonFiltered {
+			err = articleModel.Release()
+		}
+	case ActionHide:
+		err = articleModel.SetHidden(true)
+	case ActionDelete:
+		err = articles.DeleteArticleModel(&articles.ArticleModel{Model: gorm.Model{ID: articleModel.ID}})
+	case ActionSuspend:
+		err = articleModel.Author.UserModel.Suspend()
+	}
+	return text, err
+}
+
+// Apply the action on the comment and return its text. Dismissing a report of the filters releases the held comment.
+func actOnComment(actionModel *ActionModel, report ReportModel) (string, error) {
+	commentModel, err := articles.FindOneComment(&articles.CommentModel{Model: gorm.Model{ID: actionModel.TargetID}})
+	if err != nil {
+		return "", ErrTargetGone
+	}
+	actionModel.AuthorID = commentModel.Author.UserModelID
+	switch actionModel.Action {
+	case ActionDismiss:
+		if report.Reason == ReasonFiltered {
+			err = commentModel.Release()
+		}
+	case ActionHide:
+		err = commentModel.SetHidden(true)
+	case ActionDelete:
+		err = articles.DeleteCommentModel([]uint{commentModel.ID})
+	case ActionSuspend:
+		err = commentModel.Author.UserModel.Suspend()
+	}
+	return commentModel.Body, err
+}
+
+// Put content held by the content filters in the queue, plug it in with filters.SetHoldHandler.
+func HoldForReview(targetType string, targetID uint, verdict filters.Verdict) {
+	var details []string
+	for _, reason := range verdict.Reasons {
+		details = append(details, reason.Filter+": "+reason.Detail)
+	}
+	db := common.GetDB()
+	var report ReportModel
+	db.Where(ReportModel{
+		TargetType: targetType,
+		TargetID:   targetID,
+		Reason:     ReasonFiltered,
+		Status:     StatusOpen,
+	}).FirstOrInit(&report)
+	report.Note = strings.Join(details, "; ")
+	db.Save(&report)
+}
@@ -0,0 +1,160 @@
+package moderation
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/gothinkster/golang-gin-realworld-example-app/articles"
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+	"github.com/jinzhu/gorm"
+	"net/http"
+	"strconv"
+)
+
+// Reports are filed next to the content they are about, the group is the authenticated /articles one.
+func ReportsRegister(router *gin.RouterGroup) {
+	router.POST("/:slug/report", ArticleReport)
+	router.POST("/:slug/comments/:id/report", CommentReport)
+}
+
+// The moderation queue, the group has to be restricted to moderators with users.ModeratorMiddleware.
+func ModerationRegister(router *gin.RouterGroup) {
+	router.GET("/reports", ReportList)
+	router.POST("/reports/:id/actions", ReportAction)
+	router.GET("/actions", ActionList)
+}
+
+func ArticleReport(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	articleModel, err := articles.FindOneArticle(&articles.ArticleModel{Slug: c.Param("slug")})
+	if err != nil || articleModel.ID == 0 || !articleModel.VisibleTo(articles.GetArticleUserModel(myUserModel)) {
+		c.JSON(http.StatusNotFound, common.NewError("articles", errors.New("Invalid slug")))
+		return
+	}
+	fileReportOn(c, TargetArticle, articleModel.ID)
+}
+
+func CommentReport(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	viewer := articles.GetArticleUserModel(myUserModel)
+	articleModel, err := articles.FindOneArticle(&articles.ArticleModel{Slug: c.Param("slug")})
+	if err != nil || articleModel.ID == 0 || !articleModel.VisibleTo(viewer) {
+		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid slug")))
+		return
+	}
+	id64, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid id")))
+		return
+	}
+	commentModel, err := articles.FindOneComment(&articles.CommentModel{Model: gorm.Model{ID: uint(id64)}, ArticleID: articleModel.ID})
+	if err != nil || !commentModel.VisibleTo(viewer) {
+		c.JSON(http.StatusNotFound, common.NewError("comment", errors.New("Invalid id")))
+		return
+	}
+	fileReportOn(c, TargetComment, commentModel.ID)
+}
+
+func fileReportOn(c *gin.Context, targetType string, targetID uint) {
+	reportValidator := NewReportValidator()
+	if err := reportValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	reportModel, err := fileReport(targetType, targetID, myUserModel, reportValidator.Report.Reason, reportValidator.Report.Note)
+	if err == ErrUnknownReason {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("reason", err))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := ReportSerializer{c, reportModel}
+	c.JSON(http.StatusCreated, gin.H{"report": serializer.Response()})
+}
+
+// Open reports are listed unless another status is asked for, status=all lists every report.
+func ReportList(c *gin.Context) {
+	status := c.DefaultQuery("status", StatusOpen)
+	if status == "all" {
+		status = ""
+	}
+	page, err := common.NewPagination(common.NewListing("reports", status, c.Query("reason"), c.Query("type")), c.Query("limit"), c.Query("offset"), c.Query("cursor"), common.DefaultPageLimit)
+	if err != nil {
+		c.JSON(common.CursorErrorStatus(err), common.NewError("cursor", err))
+		return
+	}
+	reportModels, count, pageInfo, err := findReportPage(status, c.Query("reason"), c.Query("type"), page)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("reports", errors.New("Invalid param")))
+		return
+	}
+	serializer := ReportsSerializer{c, reportModels}
+	c.JSON(http.StatusOK, gin.H{
+		"reports":      serializer.Response(),
+		"reportsCount": count,
+		"nextCursor":   pageInfo.NextCursor,
+		"prevCursor":   pageInfo.PrevCursor,
+	})
+}
+
+func ReportAction(c *gin.Context) {
+	id64, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("report", errors.New("Invalid id")))
+		return
+	}
+	reportModel, err := FindOneReport(&ReportModel{Model: gorm.Model{ID: uint(id64)}})
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("report", errors.New("Invalid id")))
+		return
+	}
+	actionValidator := NewActionValidator()
+	if err := actionValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	actionModel, err := takeAction(reportModel, myUserModel, actionValidator.Action.Type, actionValidator.Action.Note)
+	switch err {
+	case nil:
+	case ErrUnknownAction:
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("type", err))
+		return
+	case ErrTargetGone:
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("target", err))
+		return
+	case ErrReportClosed:
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("report", err))
+		return
+	default:
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	// Even a dismissal changes what is listed when it releases held content.
+	common.InvalidateCache("articles")
+	serializer := ActionSerializer{c, actionModel}
+	c.JSON(http.StatusCreated, gin.H{"action": serializer.Response()})
+}
+
+func ActionList(c *gin.Context) {
+	page, err := common.NewPagination(common.NewListing("actions"), c.Query("limit"), c.Query("offset"), c.Query("cursor"), common.DefaultPageLimit)
+	if err != nil {
+		c.JSON(common.CursorErrorStatus(err), common.NewError("cursor", err))
+		return
+	}
+	actionModels, count, pageInfo, err := findActionPage(page)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("actions", errors.New("Invalid param")))
+		return
+	}
+	serializer := ActionsSerializer{c, actionModels}
+	c.JSON(http.StatusOK, gin.H{
+		"actions":      serializer.Response(),
+		"actionsCount": count,
+		"nextCursor":   pageInfo.NextCursor,
+		"prevCursor":   pageInfo.PrevCursor,
+	})
+}
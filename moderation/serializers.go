@@ -0,0 +1,170 @@
+package moderation
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/gothinkster/golang-gin-realworld-example-app/articles"
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+)
+
+// What a moderator needs to know about reported content without opening it, deleted content included.
+type TargetResponse struct {
+	Slug    string `json:"slug"`
+	Title   string `json:"title"`
+	Body    string `json:"body"`
+	Author  string `json:"author"`
+	Hidden  bool   `json:"hidden"`
+	Deleted bool   `json:"deleted"`
+}
+
+type ReportSerializer struct {
+	C *gin.Context
+	ReportModel
+}
+
+type ReportsSerializer struct {
+	C       *gin.Context
+	Reports []ReportModel
+}
+
+type ReportResponse struct {
+	ID         uint            `json:"id"`
+	TargetType string          `json:"targetType"`
+	TargetID   uint            `json:"targetId"`
+	Target     *TargetResponse `json:"target"`
+	Reason     string          `json:"reason"`
+	Note       string          `json:"note"`
+	Status     string          `json:"status"`
+	Reporter   string          `json:"reporter"`
+	ActionID   *uint           `json:"actionId"`
+	CreatedAt  string          `json:"createdAt"`
+	ResolvedAt *string         `json:"resolvedAt"`
+}
+
+// The reporter gets the report back without its target, the queue fills targets in with ReportsSerializer.
+func (s *ReportSerializer) Response() ReportResponse {
+	response := ReportResponse{
+		ID:         s.ID,
+		TargetType: s.TargetType,
+		TargetID:   s.TargetID,
+		Reason:     s.Reason,
+		Note:       s.Note,
+		Status:     s.Status,
+		Reporter:   s.Reporter.Username,
+		ActionID:   s.ActionID,
+		CreatedAt:  s.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+	}
+	if s.ResolvedAt != nil {
+		resolvedAt := s.ResolvedAt.UTC().Format("2006-01-02T15:04:05.999Z")
+		response.ResolvedAt = &resolvedAt
+	}
+	return response
+}
+
+func (s *ReportsSerializer) Response() []ReportResponse {
+	targets := loadTargets(s.Reports)
+	response := []ReportResponse{}
+	for _, report := range s.Reports {
+		serializer := ReportSerializer{s.C, report}
+		reportResponse := serializer.Response()
+		reportResponse.Target = targets[report.TargetType][report.TargetID]
+		response = append(response, reportResponse)
+	}
+	return response
+}
+
+// Load the targets of a page of reports in a few queries, comments first as they point to their article.
+func loadTargets(reports []ReportModel) map[string]map[uint]*TargetResponse {
+	targets := map[string]map[uint]*TargetResponse{TargetArticle: {}, TargetComment: {}}
+	var articleIDs, commentIDs []uint
+	for _, report := range reports {
+		switch report.TargetType {
+		case TargetArticle:
+			articleIDs = append(articleIDs, report.TargetID)
+		case TargetComment:
+			commentIDs = append(commentIDs, report.TargetID)
+		}
+	}
+
+	db := common.GetDB()
+	var commentModels []articles.CommentModel
+	if len(commentIDs) > 0 {
+		db.Unscoped().Preload("Author.UserModel").Where("id in (?)", commentIDs).Find(&commentModels)
+		for _, commentModel := range commentModels {
+			articleIDs = append(articleIDs, commentModel.ArticleID)
+		}
+	}
+	articleModels := map[uint]articles.ArticleModel{}
+	if len(articleIDs) > 0 {
+		var models []articles.ArticleModel
+		db.Unscoped().Preload("Author.UserModel").Where("id in (?)", articleIDs).Find(&models)
+		for _, model := range models {
+			articleModels[model.ID] = model
+		}
+	}
+
+	for _, articleModel := range articleModels {
+		targets[TargetArticle][articleModel.ID] = &TargetResponse{
+			Slug:    articleModel.Slug,
+			Title:   articleModel.Title,
+			Body:    articleModel.Body,
+			Author:  articleModel.Author.UserModel.Username,
+			Hidden:  articleModel.HiddenAt != nil,
+			Deleted: articleModel.DeletedAt != nil,
+		}
+	}
+	for _, commentModel := range commentModels {
+		articleModel := articleModels[commentModel.ArticleID]
+		targets[TargetComment][commentModel.ID] = &TargetResponse{
+			Slug:    articleModel.Slug,
+			Title:   articleModel.Title,
+			Body:    commentModel.Body,
+			Author:  commentModel.Author.UserModel.Username,
+			Hidden:  commentModel.HiddenAt != nil,
+			Deleted: commentModel.DeletedAt != nil,
+		}
+	}
+	return targets
+}
+
+type ActionSerializer struct {
+	C *gin.Context
+	ActionModel
+}
+
+type ActionsSerializer struct {
+	C       *gin.Context
+	Actions []ActionModel
+}
+
+type ActionResponse struct {
+	ID         uint   `json:"id"`
+	TargetType string `json:"targetType"`
+	TargetID   uint   `json:"targetId"`
+	Action     string `json:"action"`
+	Moderator  string `json:"moderator"`
+	AuthorID   uint   `json:"authorId"`
+	Note       string `json:"note"`
+	CreatedAt  string `json:"createdAt"`
+}
+
+func (s *ActionSerializer) Response() ActionResponse {
+	return ActionResponse{
+		ID:         s.ID,
+		TargetType: s.TargetType,
+		TargetID:   s.TargetID,
+		Action:     s.Action,
+		Moderator:  s.Moderator.Username,
+		AuthorID:   s.AuthorID,
+		Note:       s.Note,
+		CreatedAt:  s.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+	}
+}
+
+func (s *ActionsSerializer) Response() []ActionResponse {
+	response := []ActionResponse{}
+	for _, action := range s.Actions {
+		serializer := ActionSerializer{s.C, action}
+		response = append(response, serializer.Response())
+	}
+	return response
+}
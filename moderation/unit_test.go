@@ -0,0 +1,244 @@
+package moderation
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/articles"
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/filters"
+	"github.com/gothinkster/golang-gin-realworld-example-app/jobs"
+	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+)
+
+var test_db *gorm.DB
+
+//Reset test DB and create new one with mock data
+func resetDBWithMock() {
+	common.TestDBFree(test_db)
+	test_db = common.TestDBInit()
+	users.AutoMigrate()
+	jobs.AutoMigrate()
+	test_db.AutoMigrate(&articles.ArticleModel{}, &articles.TagModel{}, &articles.TagAliasModel{}, &articles.TagFollowModel{},
+		&articles.FavoriteModel{}, &articles.ArticleUserModel{}, &articles.CommentModel{}, &articles.ReactionModel{},
+		&articles.ReactionCountModel{}, &articles.ArticleTermModel{}, &articles.TermModel{}, &articles.MentionModel{})
+	AutoMigrate()
+	filters.AutoMigrate()
+}
+
+func userModelMocker(names ...string) []users.UserModel {
+	var ret []users.UserModel
+	for _, name := range names {
+		userModel := users.UserModel{Username: name, Email: name + "@linkedin.com"}
+		test_db.Create(&userModel)
+		ret = append(ret, userModel)
+	}
+	return ret
+}
+
+func newRouter() *gin.Engine {
+	r := gin.New()
+	r.Use(users.AuthMiddleware(false))
+	articles.ArticlesAnonymousRegister(r.Group("/articles"))
+	r.Use(users.AuthMiddleware(true))
+	articles.ArticlesRegister(r.Group("/articles"))
+	ReportsRegister(r.Group("/articles"))
+	moderationGroup := r.Group("/moderation")
+	moderationGroup.Use(users.ModeratorMiddleware())
+	ModerationRegister(moderationGroup)
+	return r
+}
+
+func TestModeration(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	mockUsers := userModelMocker("author", "reader", "moderator")
+	author, reader, moderator := mockUsers[0], mockUsers[1], mockUsers[2]
+	test_db.Model(&moderator).UpdateColumn("moderator", true)
+	articleModel := articles.ArticleModel{Slug: "spam", Title: "spam", Body: "buy now", Author: articles.GetArticleUserModel(author)}
+	test_db.Create(&articleModel)
+	test_db.Create(&articles.ArticleModel{Slug: "fine", Title: "fine", Body: "fine", Author: articles.GetArticleUserModel(author)})
+	commentModel := articles.CommentModel{ArticleID: articleModel.ID, Author: articles.GetArticleUserModel(author), Body: "rude"}
+	test_db.Create(&commentModel)
+
+	r := newRouter()
+	send := func(method string, url string, userID uint, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		if userID != 0 {
+			req.Header.Set("Authorization", fmt.Sprintf("Token %v", common.GenToken(userID)))
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("POST", "/articles/spam/report", reader.ID, `{"report":{"reason":"nonsense"}}`)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code)
+	asserts.Equal(`{"errors":{"reason":"Unknown reason"}}`, w.Body.String())
+	w = send("POST", "/articles/spam/report", reader.ID, `{"report":{"reason":"other"}}`)
+	asserts.Equal(http.StatusCreated, w.Code)
+	w = send("POST", "/articles/spam/report", reader.ID, `{"report":{"reason":"spam","note":"ads"}}`)
+	asserts.Equal(http.StatusCreated, w.Code)
+	asserts.Regexp(`"id":1,"targetType":"article","targetId":1,"target":null,"reason":"spam","note":"ads","status":"open"`,
+		w.Body.String(), "reporting twice should update the open report")
+	w = send("POST", fmt.Sprintf("/articles/spam/comments/%v/report", commentModel.ID), reader.ID, `{"report":{"reason":"harassment"}}`)
+	asserts.Equal(http.StatusCreated, w.Code)
+	w = send("POST", "/articles/missing/report", reader.ID, `{"report":{"reason":"spam"}}`)
+	asserts.Equal(http.StatusNotFound, w.Code)
+
+	w = send("GET", "/moderation/reports", reader.ID, "")
+	asserts.Equal(http.StatusForbidden, w.Code, "only moderators should see the queue")
+	w = send("GET", "/moderation/reports", moderator.ID, "")
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Regexp(`"reportsCount":2`, w.Body.String())
+	asserts.Regexp(`"target":{"slug":"spam","title":"spam","body":"rude","author":"author","hidden":false,"deleted":false}`, w.Body.String())
+	w = send("GET", "/moderation/reports?reason=harassment&type=comment", moderator.ID, "")
+	asserts.Regexp(`"reportsCount":1`, w.Body.String(), "the queue should be filtered")
+
+	w = send("POST", "/moderation/reports/1/actions", moderator.ID, `{"action":{"type":"ban"}}`)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code)
+	w = send("POST", "/moderation/reports/1/actions", moderator.ID, `{"action":{"type":"hide","note":"ads"}}`)
+	asserts.Equal(http.StatusCreated, w.Code)
+	asserts.Regexp(`"action":"hide","moderator":"moderator","authorId":1,"note":"ads"`, w.Body.String())
+	w = send("GET", "/moderation/reports", moderator.ID, "")
+	asserts.Regexp(`"reportsCount":1`, w.Body.String(), "acting should close the report")
+	w = send("GET", "/moderation/reports?status=actioned", moderator.ID, "")
+	asserts.Regexp(`"status":"actioned","reporter":"reader","actionId":1`, w.Body.String())
+
+	w = send("GET", "/articles/", reader.ID, "")
+	asserts.Regexp(`"articlesCount":1`, w.Body.String(), "hidden articles should not be listed")
+	asserts.Equal(http.StatusNotFound, send("GET", "/articles/spam", 0, "").Code)
+	w = send("GET", "/articles/", author.ID, "")
+	asserts.Regexp(`"articlesCount":2`, w.Body.String(), "authors should still see their hidden articles")
+	asserts.Regexp(`"slug":"spam".*"hidden":true`, w.Body.String())
+	w = send("GET", "/articles/", moderator.ID, "")
+	asserts.Regexp(`"articlesCount":2`, w.Body.String(), "moderators should see hidden articles")
+	for _, hidden := range []struct{ method, url, body string }{
+		{"POST", "/articles/spam/favorite", ""},
+		{"DELETE", "/articles/spam/favorite", ""},
+		{"POST", "/articles/spam/reactions/clap", ""},
+		{"POST", "/articles/spam/comments", `{"comment":{"body":"nice"}}`},
+		{"POST", fmt.Sprintf("/articles/spam/comments/%v/reactions/clap", commentModel.ID), ""},
+	} {
+		w = send(hidden.method, hidden.url, reader.ID, hidden.body)
+		asserts.Equal(http.StatusNotFound, w.Code, "hidden articles should not be reachable through "+hidden.url)
+	}
+
+	w = send("POST", "/moderation/reports/2/actions", moderator.ID, `{"action":{"type":"hide"}}`)
+	asserts.Equal(http.StatusCreated, w.Code)
+	w = send("GET", "/articles/spam/comments", moderator.ID, "")
+	asserts.Regexp(`"commentsCount":1`, w.Body.String())
+	test_db.Model(&articleModel).UpdateColumn("hidden_at", gorm.Expr("NULL"))
+	w = send("GET", "/articles/spam/comments", reader.ID, "")
+	asserts.Regexp(`"commentsCount":0`, w.Body.String(), "hidden comments should not be listed")
+
+	w = send("POST", "/moderation/reports/2/actions", moderator.ID, `{"action":{"type":"suspend"}}`)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code, "resolved reports should not be acted on again")
+	asserts.Equal(`{"errors":{"report":"The report has already been resolved"}}`, w.Body.String())
+	w = send("POST", fmt.Sprintf("/articles/spam/comments/%v/report", commentModel.ID), moderator.ID, `{"report":{"reason":"harassment"}}`)
+	asserts.Equal(http.StatusCreated, w.Code)
+	w = send("POST", "/moderation/reports/3/actions", moderator.ID, `{"action":{"type":"suspend"}}`)
+	asserts.Equal(http.StatusCreated, w.Code)
+	w = send("POST", "/articles/", author.ID, `{"article":{"title":"more spam","body":"buy"}}`)
+	asserts.Equal(http.StatusForbidden, w.Code, "suspended authors should not post")
+	asserts.Equal(`{"errors":{"user":"Account suspended"}}`, w.Body.String())
+	asserts.Equal(http.StatusOK, send("GET", "/articles/fine", author.ID, "").Code, "suspended authors should still read")
+
+	w = send("GET", "/moderation/actions", moderator.ID, "")
+	asserts.Regexp(`"actionsCount":3`, w.Body.String())
+	asserts.Regexp(`^{"actions":\[{"id":3,"targetType":"comment","targetId":1,"action":"suspend"`, w.Body.String())
+}
+
+func TestFilteredContent(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	defer func(pipeline *filters.Pipeline) { filters.DefaultPipeline = pipeline }(filters.DefaultPipeline)
+	filters.DefaultPipeline = &filters.Pipeline{}
+	filters.DefaultPipeline.Register(&filters.WordFilter{RejectWords: []string{"scam"}, HoldWords: []string{"crypto"}})
+	filters.SetHoldHandler(HoldForReview)
+	defer filters.SetHoldHandler(nil)
+
+	mockUsers := userModelMocker("author", "reader", "moderator")
+	author, reader, moderator := mockUsers[0], mockUsers[1], mockUsers[2]
+	test_db.Model(&moderator).UpdateColumn("moderator", true)
+	r := newRouter()
+	send := func(method string, url string, userID uint, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", fmt.Sprintf("Token %v", common.GenToken(userID)))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("POST", "/articles/", author.ID, `{"article":{"title":"Easy money","body":"It is a scam"}}`)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code)
+	asserts.Equal(`{"errors":{"content":{"outcome":"reject","reasons":[{"filter":"words","detail":"uses \"scam\""}]}}}`,
+		w.Body.String())
+
+	mentions := func(userModel users.UserModel) int {
+		var count int
+		test_db.Model(&users.NotificationModel{}).Where("recipient_id = ? AND type = ?", userModel.ID, users.NotificationMention).
+			Count(&count)
+		return count
+	}
+	events := func(kind string) int {
+		var count int
+		test_db.Model(&jobs.OutboxModel{}).Where("kind = ?", kind).Count(&count)
+		return count
+	}
+	w = send("POST", "/articles/", author.ID, `{"article":{"title":"Easy money","body":"Buy crypto, asks @reader"}}`)
+	asserts.Equal(http.StatusCreated, w.Code)
+	asserts.Regexp(`"hidden":true`, w.Body.String(), "held articles should be hidden")
+	asserts.Regexp(`"mentions":\[\]`, w.Body.String(), "held articles should not mention anyone yet")
+	asserts.Equal(0, mentions(reader))
+	asserts.Equal(0, events(common.ArticleCreated), "held articles should not be announced")
+	w = send("GET", "/articles/", reader.ID, "")
+	asserts.Regexp(`"articlesCount":0`, w.Body.String())
+	w = send("GET", "/moderation/reports", moderator.ID, "")
+	asserts.Regexp(`"reason":"filtered","note":"words: uses \\"crypto\\"","status":"open","reporter":""`, w.Body.String())
+
+	w = send("POST", "/moderation/reports/1/actions", moderator.ID, `{"action":{"type":"dismiss"}}`)
+	asserts.Equal(http.StatusCreated, w.Code)
+	w = send("GET", "/articles/", reader.ID, "")
+	asserts.Regexp(`"articlesCount":1`, w.Body.String(), "dismissing should release held content")
+	asserts.Equal(1, mentions(reader), "released articles should notify the users they mention")
+	asserts.Equal(1, events(common.ArticleCreated), "released articles should be announced")
+	var trained int
+	test_db.Model(&filters.BayesTokenModel{}).Where("class = ? AND token = ?", filters.ClassHam, "crypto").Count(&trained)
+	asserts.Equal(1, trained, "moderator decisions should train the spam classifier")
+
+	w = send("POST", "/articles/easy-money/comments", reader.ID, `{"comment":{"body":"crypto! @author"}}`)
+	asserts.Equal(http.StatusCreated, w.Code)
+	asserts.Regexp(`"hidden":true`, w.Body.String(), "held comments should be hidden")
+	w = send("GET", "/moderation/reports?type=comment", moderator.ID, "")
+	asserts.Regexp(`"reportsCount":1`, w.Body.String())
+	asserts.Equal(0, mentions(author))
+	asserts.Equal(0, events(common.CommentCreated), "held comments should not be announced")
+	w = send("POST", "/moderation/reports/2/actions", moderator.ID, `{"action":{"type":"dismiss"}}`)
+	asserts.Equal(http.StatusCreated, w.Code)
+	asserts.Equal(1, mentions(author), "released comments should notify the users they mention")
+	asserts.Equal(1, events(common.CommentCreated), "released comments should be announced")
+	var notified int
+	test_db.Model(&users.NotificationModel{}).Where("recipient_id = ? AND type = ?", author.ID, users.NotificationComment).Count(&notified)
+	asserts.Equal(1, notified, "released comments should notify the author of the article")
+}
+
+//This is a hack way to add test database for each case, as whole test will just share one database.
+func TestMain(m *testing.M) {
+	test_db = common.TestDBInit()
+	exitVal := m.Run()
+	common.TestDBFree(test_db)
+	os.Exit(exitVal)
+}
@@ -0,0 +1,36 @@
+package moderation
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+)
+
+type ReportValidator struct {
+	Report struct {
+		Reason string `form:"reason" json:"reason" binding:"exists"`
+		Note   string `form:"note" json:"note" binding:"max=1024"`
+	} `json:"report"`
+}
+
+func NewReportValidator() ReportValidator {
+	return ReportValidator{}
+}
+
+func (s *ReportValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, s)
+}
+
+type ActionValidator struct {
+	Action struct {
+		Type string `form:"type" json:"type" binding:"exists"`
+		Note string `form:"note" json:"note" binding:"max=1024"`
+	} `json:"action"`
+}
+
+func NewActionValidator() ActionValidator {
+	return ActionValidator{}
+}
+
+func (s *ActionValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, s)
+}
@@ -1,6 +1,7 @@
 package users
 
 import (
+	"errors"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/dgrijalva/jwt-go/request"
 	"github.com/gothinkster/golang-gin-realworld-example-app/common"
@@ -63,5 +64,20 @@ func AuthMiddleware(auto401 bool) gin.HandlerFunc {
 			//fmt.Println(my_user_id,claims["id"])
 			UpdateContextUserModel(c, my_user_id)
 		}
+		myUserModel := c.MustGet("my_user_model").(UserModel)
+		if auto401 && myUserModel.SuspendedAt != nil && c.Request.Method != "GET" && c.Request.Method != "HEAD" {
+			c.AbortWithStatusJSON(http.StatusForbidden, common.NewError("user", errors.New("Account suspended")))
+		}
+	}
+}
+
+// Only lets moderators through, it has to run after AuthMiddleware(true).
+//  moderationGroup.Use(ModeratorMiddleware())
+func ModeratorMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		myUserModel := c.MustGet("my_user_model").(UserModel)
+		if !myUserModel.Moderator {
+			c.AbortWithStatusJSON(http.StatusForbidden, common.NewError("moderation", errors.New("Moderators only")))
+		}
 	}
 }
@@ -1,10 +1,13 @@
 package users
 
 import (
+	"context"
 	"errors"
 	"github.com/jinzhu/gorm"
 	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/jobs"
 	"golang.org/x/crypto/bcrypt"
+	"time"
 )
 
 // Models should only be concerned with database schema, more strict checking should be put in validator.
@@ -12,13 +15,17 @@ import (
 // More detail you can find here: http://jinzhu.me/gorm/models.html#model-definition
 //
 // HINT: If you want to split null and "", you should use *string instead of string.
+//
+// Moderators are only made by hand in the database, SuspendedAt is set by a moderator action.
 type UserModel struct {
-	ID           uint    `gorm:"primary_key"`
-	Username     string  `gorm:"column:username"`
-	Email        string  `gorm:"column:email;unique_index"`
-	Bio          string  `gorm:"column:bio;size:1024"`
-	Image        *string `gorm:"column:image"`
-	PasswordHash string  `gorm:"column:password;not null"`
+	ID           uint       `gorm:"primary_key"`
+	Username     string     `gorm:"column:username"`
+	Email        string     `gorm:"column:email;unique_index"`
+	Bio          string     `gorm:"column:bio;size:1024"`
+	Image        *string    `gorm:"column:image"`
+	PasswordHash string     `gorm:"column:password;not null"`
+	Moderator    bool       `gorm:"column:moderator;not null;default:false"`
+	SuspendedAt  *time.Time `gorm:"column:suspended_at"`
 }
 
 // A hack way to save ManyToMany relationship,
@@ -39,12 +46,28 @@ type FollowModel struct {
 	FollowedByID uint
 }
 
+// BlockedBy does not want to deal with Blocking anymore. Blocks hold both ways: neither of the two
+// can follow the other and neither is suggested to the other.
+//
+// DB schema looks like: id, created_at, updated_at, deleted_at, blocking_id, blocked_by_id.
+type BlockModel struct {
+	gorm.Model
+	Blocking    UserModel
+	BlockingID  uint
+	BlockedBy   UserModel
+	BlockedByID uint
+}
+
 // Migrate the schema of database if needed
 func AutoMigrate() {
 	db := common.GetDB()
 
 	db.AutoMigrate(&UserModel{})
 	db.AutoMigrate(&FollowModel{})
+	db.AutoMigrate(&BlockModel{})
+	db.AutoMigrate(&NotificationModel{})
+	db.AutoMigrate(&NotificationActorModel{})
+	db.AutoMigrate(&NotificationPreferenceModel{})
 }
 
 // What's bcrypt? https://en.wikipedia.org/wiki/Bcrypt
@@ -96,15 +119,28 @@ func (model *UserModel) Update(data interface{}) error {
 }
 
 // You could add a following relationship as userModel1 following userModel2
-// 	err = userModel1.following(userModel2)
-func (u UserModel) following(v UserModel) error {
+// Following again changes nothing, the first follow records a UserFollowed event with it and is the
+// only one to return true.
+// 	added, err = userModel1.following(userModel2)
+func (u UserModel) following(v UserModel) (bool, error) {
 	db := common.GetDB()
-	var follow FollowModel
-	err := db.FirstOrCreate(&follow, &FollowModel{
-		FollowingID:  v.ID,
-		FollowedByID: u.ID,
-	}).Error
-	return err
+	added := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var follow FollowModel
+		tx.Where(FollowModel{
+			FollowingID:  v.ID,
+			FollowedByID: u.ID,
+		}).FirstOrInit(&follow)
+		if follow.ID != 0 {
+			return nil
+		}
+		if err := tx.Create(&follow).Error; err != nil {
+			return err
+		}
+		added = true
+		return jobs.RecordEvent(tx, common.UserFollowed, []uint{v.ID, u.ID}, FollowEvent{User: v.Username, Follower: u.Username})
+	})
+	return added && err == nil, err
 }
 
 // You could check whether  userModel1 following userModel2
@@ -119,6 +155,22 @@ func (u UserModel) isFollowing(v UserModel) bool {
 	return follow.ID != 0
 }
 
+// You could check which of many users userModel1 is following with a single query
+// 	followed := myUserModel.followingSet(ctx, []uint{2, 3})
+func (u UserModel) followingSet(ctx context.Context, ids []uint) map[uint]bool {
+	followed := make(map[uint]bool, len(ids))
+	if u.ID == 0 || len(ids) == 0 {
+		return followed
+	}
+	db := common.GetDBContext(ctx)
+	var follows []FollowModel
+	db.Where("followed_by_id = ? AND following_id in (?)", u.ID, ids).Find(&follows)
+	for _, follow := range follows {
+		followed[follow.FollowingID] = true
+	}
+	return followed
+}
+
 // You could delete a following relationship as userModel1 following userModel2
 // 	err = userModel1.unFollowing(userModel2)
 func (u UserModel) unFollowing(v UserModel) error {
@@ -130,6 +182,65 @@ func (u UserModel) unFollowing(v UserModel) error {
 	return err
 }
 
+// Blocking someone also ends the follows between the two users, in both directions.
+// 	err = userModel1.blocking(userModel2)
+func (u UserModel) blocking(v UserModel) error {
+	db := common.GetDB()
+	tx := db.Begin()
+	var block BlockModel
+	if err := tx.FirstOrCreate(&block, &BlockModel{BlockingID: v.ID, BlockedByID: u.ID}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	err := tx.Where("(following_id = ? AND followed_by_id = ?) OR (following_id = ? AND followed_by_id = ?)",
+		v.ID, u.ID, u.ID, v.ID).Delete(FollowModel{}).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// 	err = userModel1.unBlocking(userModel2)
+func (u UserModel) unBlocking(v UserModel) error {
+	db := common.GetDB()
+	err := db.Where(BlockModel{
+		BlockingID:  v.ID,
+		BlockedByID: u.ID,
+	}).Delete(BlockModel{}).Error
+	return err
+}
+
+// Whether either of the users blocks the other.
+// 	if myUserModel.IsBlockedWith(userModel) { ... }
+func (u UserModel) IsBlockedWith(v UserModel) bool {
+	db := common.GetDB()
+	var count int
+	db.Model(&BlockModel{}).Where("(blocking_id = ? AND blocked_by_id = ?) OR (blocking_id = ? AND blocked_by_id = ?)",
+		v.ID, u.ID, u.ID, v.ID).Count(&count)
+	return count > 0
+}
+
+// The ids of the users userModel blocks and of the users blocking userModel.
+// 	ids := myUserModel.BlockedIDs()
+func (u UserModel) BlockedIDs() []uint {
+	ids := []uint{}
+	if u.ID == 0 {
+		return ids
+	}
+	db := common.GetDB()
+	var blocks []BlockModel
+	db.Where("blocking_id = ? OR blocked_by_id = ?", u.ID, u.ID).Find(&blocks)
+	for _, block := range blocks {
+		if block.BlockingID == u.ID {
+			ids = append(ids, block.BlockedByID)
+		} else {
+			ids = append(ids, block.BlockingID)
+		}
+	}
+	return ids
+}
+
 // You could get a following list of userModel
 // 	followings := userModel.GetFollowings()
 func (u UserModel) GetFollowings() []UserModel {
@@ -148,3 +259,15 @@ func (u UserModel) GetFollowings() []UserModel {
 	tx.Commit()
 	return followings
 }
+
+// Suspended users can still sign in and read, but AuthMiddleware refuses everything they would write.
+// 	err := userModel.Suspend()
+func (u *UserModel) Suspend() error {
+	db := common.GetDB()
+	now := time.Now()
+	err := db.Model(u).UpdateColumn("suspended_at", &now).Error
+	if err == nil {
+		u.SuspendedAt = &now
+	}
+	return err
+}
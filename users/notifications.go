@@ -0,0 +1,278 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/jinzhu/gorm"
+)
+
+// The types of notifications, every one of them can be turned off in the preferences.
+const (
+	NotificationFollow   = "follow"
+	NotificationFavorite = "favorite"
+	NotificationComment  = "comment"
+	NotificationMention  = "mention"
+)
+
+var NotificationTypes = []string{NotificationFollow, NotificationFavorite, NotificationComment, NotificationMention}
+
+var ErrUnknownNotificationType = errors.New("Unknown notification type")
+
+var ErrNotificationNotFound = errors.New("Notification not found")
+
+// What a notification is about, nil for follows which are about the recipient.
+type NotificationTarget struct {
+	Type  string `json:"type"`
+	ID    uint   `json:"-"`
+	Slug  string `json:"slug"`
+	Title string `json:"title"`
+}
+
+// Something that happened to Recipient. While it is unread, the same thing happening again merges into it:
+// Actor is the latest of the ActorsCount users who did it, so "5 people favorited your article" is one row.
+type NotificationModel struct {
+	gorm.Model
+	Recipient   UserModel
+	RecipientID uint   `gorm:"index"`
+	Type        string `gorm:"size:32"`
+	TargetType  string `gorm:"size:32"`
+	TargetID    uint
+	TargetSlug  string
+	TargetTitle string
+	Actor       UserModel
+	ActorID     uint
+	ActorsCount uint
+	ReadAt      *time.Time
+}
+
+// The users behind a notification, each of them is counted once however often they do it again.
+type NotificationActorModel struct {
+	gorm.Model
+	NotificationID uint `gorm:"unique_index:idx_notification_actor"`
+	ActorID        uint `gorm:"unique_index:idx_notification_actor"`
+}
+
+// A type of notification a user turned off or back on, every type is on without a row.
+type NotificationPreferenceModel struct {
+	gorm.Model
+	UserID  uint   `gorm:"unique_index:idx_notification_preference"`
+	Type    string `gorm:"unique_index:idx_notification_preference;size:32"`
+	Enabled bool
+}
+
+func (model NotificationModel) Target() *NotificationTarget {
+	if model.TargetType == "" {
+		return nil
+	}
+	return &NotificationTarget{Type: model.TargetType, ID: model.TargetID, Slug: model.TargetSlug, Title: model.TargetTitle}
+}
+
+// Tell recipient that actor followed them, favorited or commented on target, or mentioned them in it. Nothing is sent to oneself,
+// between blocked users or when the recipient turned the type off.
+// 	err := users.Notify(users.NotificationFavorite, author.ID, myUserModel.ID, &users.NotificationTarget{...})
+func Notify(kind string, recipientID, actorID uint, target *NotificationTarget) error {
+	if recipientID == 0 || recipientID == actorID {
+		return nil
+	}
+	recipient := UserModel{ID: recipientID}
+	if !recipient.notificationEnabled(kind) || recipient.IsBlockedWith(UserModel{ID: actorID}) {
+		return nil
+	}
+	notification := NotificationModel{RecipientID: recipientID, Type: kind}
+	if target != nil {
+		notification.TargetType = target.Type
+		notification.TargetID = target.ID
+	}
+
+	db := common.GetDB()
+	tx := db.Begin()
+	var unread NotificationModel
+	tx.Where(notification).Where("read_at IS NULL").First(&unread)
+	if unread.ID == 0 {
+		if target != nil {
+			notification.TargetSlug = target.Slug
+			notification.TargetTitle = target.Title
+		}
+		notification.ActorID = actorID
+		notification.ActorsCount = 1
+		if err := tx.Create(&notification).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Create(&NotificationActorModel{NotificationID: notification.ID, ActorID: actorID}).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit().Error; err != nil {
+			return err
+		}
+		publishNotification(notification)
+		return nil
+	}
+
+	var actor NotificationActorModel
+	tx.Where(NotificationActorModel{NotificationID: unread.ID, ActorID: actorID}).First(&actor)
+	changes := map[string]interface{}{"actor_id": actorID}
+	if target != nil {
+		changes["target_slug"] = target.Slug
+		changes["target_title"] = target.Title
+	}
+	if actor.ID == 0 {
+		if err := tx.Create(&NotificationActorModel{NotificationID: unread.ID, ActorID: actorID}).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		changes["actors_count"] = unread.ActorsCount + 1
+	}
+	if err := tx.Model(&unread).Updates(changes).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	publishNotification(unread)
+	return nil
+}
+
+// The topic of the stream events meant for one user only.
+func UserTopic(userID uint) string {
+	return fmt.Sprintf("user:%v", userID)
+}
+
+func publishNotification(model NotificationModel) {
+	if common.GetHub() == nil {
+		return
+	}
+	actor, err := FindOneUser(&UserModel{ID: model.ActorID})
+	if err != nil {
+		return
+	}
+	model.Actor = actor
+	serializer := NotificationSerializer{NotificationModel: model}
+	common.PublishEvent(UserTopic(model.RecipientID), "notification", serializer.Event())
+}
+
+// Load one page of the notifications of u, the latest first. A notification moves up when someone
+// else joins it, so pages are keyed on the time of the last change rather than on the id.
+// 	models, count, unreadCount, info, err := myUserModel.notifications(page, false)
+func (u UserModel) notifications(page common.Pagination, unreadOnly bool) ([]NotificationModel, int, int, common.PageInfo, error) {
+	db := common.GetDB()
+	var info common.PageInfo
+	query := db.Model(&NotificationModel{}).Where("recipient_id = ?", u.ID)
+	var unreadCount int
+	if err := query.Where("read_at IS NULL").Count(&unreadCount).Error; err != nil {
+		return nil, 0, 0, info, err
+	}
+	if unreadOnly {
+		query = query.Where("read_at IS NULL")
+	}
+	var count int
+	if err := query.Count(&count).Error; err != nil {
+		return nil, 0, 0, info, err
+	}
+
+	if page.Cursor != nil {
+		at := time.Unix(0, page.Cursor.At)
+		query = query.Where("updated_at < ? OR (updated_at = ? AND id < ?)", at, at, page.Cursor.ID)
+	} else if page.Offset > 0 {
+		query = query.Offset(page.Offset)
+	}
+	if page.Limit > 0 {
+		query = query.Limit(page.Limit + 1)
+	}
+	var models []NotificationModel
+	if err := query.Preload("Actor").Order("updated_at desc, id desc").Find(&models).Error; err != nil {
+		return nil, 0, 0, info, err
+	}
+	if page.Limit > 0 && len(models) > page.Limit {
+		models = models[:page.Limit]
+		last := models[len(models)-1]
+		info.NextCursor = page.EncodeCursor(common.Cursor{ID: last.ID, At: last.UpdatedAt.UnixNano()})
+	}
+	return models, count, unreadCount, info, nil
+}
+
+// 	notification, err := myUserModel.readNotification(3)
+func (u UserModel) readNotification(id uint) (NotificationModel, error) {
+	db := common.GetDB()
+	var model NotificationModel
+	db.Preload("Actor").Where("id = ? AND recipient_id = ?", id, u.ID).First(&model)
+	if model.ID == 0 {
+		return model, ErrNotificationNotFound
+	}
+	if model.ReadAt != nil {
+		return model, nil
+	}
+	// Leave updated_at alone so that reading does not reorder the list.
+	now := time.Now()
+	if err := db.Model(&model).UpdateColumn("read_at", &now).Error; err != nil {
+		return model, err
+	}
+	model.ReadAt = &now
+	return model, nil
+}
+
+// Mark every notification of u read, returning how many were unread.
+func (u UserModel) readAllNotifications() (int64, error) {
+	db := common.GetDB()
+	result := db.Model(&NotificationModel{}).Where("recipient_id = ? AND read_at IS NULL", u.ID).
+		UpdateColumn("read_at", time.Now())
+	return result.RowsAffected, result.Error
+}
+
+// Every notification type with whether u gets it.
+func (u UserModel) notificationPreferences() map[string]bool {
+	preferences := map[string]bool{}
+	for _, kind := range NotificationTypes {
+		preferences[kind] = true
+	}
+	db := common.GetDB()
+	var models []NotificationPreferenceModel
+	db.Where("user_id = ?", u.ID).Find(&models)
+	for _, model := range models {
+		preferences[model.Type] = model.Enabled
+	}
+	return preferences
+}
+
+func (u UserModel) notificationEnabled(kind string) bool {
+	db := common.GetDB()
+	var model NotificationPreferenceModel
+	db.Where(NotificationPreferenceModel{UserID: u.ID, Type: kind}).First(&model)
+	return model.ID == 0 || model.Enabled
+}
+
+// Turn the given notification types on or off, the others stay as they are.
+// 	err := myUserModel.setNotificationPreferences(map[string]bool{"favorite": false})
+func (u UserModel) setNotificationPreferences(preferences map[string]bool) error {
+	for kind := range preferences {
+		if !isNotificationType(kind) {
+			return ErrUnknownNotificationType
+		}
+	}
+	db := common.GetDB()
+	tx := db.Begin()
+	for kind, enabled := range preferences {
+		var model NotificationPreferenceModel
+		err := tx.Where(NotificationPreferenceModel{UserID: u.ID, Type: kind}).
+			Assign(map[string]interface{}{"enabled": enabled}).FirstOrCreate(&model).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+func isNotificationType(kind string) bool {
+	for _, known := range NotificationTypes {
+		if kind == known {
+			return true
+		}
+	}
+	return false
+}
@@ -5,6 +5,14 @@ import (
 	"github.com/gothinkster/golang-gin-realworld-example-app/common"
 	"github.com/gin-gonic/gin"
 	"net/http"
+	"strconv"
+)
+
+// What users do at the door, counted for GET /metrics. Refused logins are counted by reason.
+var (
+	registrationsCounter = common.NewCounter("user_registrations_total", "Users who signed up.")
+	loginsCounter        = common.NewCounter("user_logins_total", "Logins accepted.")
+	failedLoginsCounter  = common.NewCounterVec("user_logins_failed_total", "Logins refused, by reason.", "reason")
 )
 
 func UsersRegister(router *gin.RouterGroup) {
@@ -15,16 +23,30 @@ func UsersRegister(router *gin.RouterGroup) {
 func UserRegister(router *gin.RouterGroup) {
 	router.GET("/", UserRetrieve)
 	router.PUT("/", UserUpdate)
+	router.GET("/notifications", NotificationList)
+	router.GET("/notifications/preferences", NotificationPreferencesRetrieve)
+	router.PUT("/notifications/preferences", NotificationPreferencesUpdate)
+	router.POST("/notifications/:id/read", NotificationRead)
 }
 
 func ProfileRegister(router *gin.RouterGroup) {
 	router.GET("/:username", ProfileRetrieve)
 	router.POST("/:username/follow", ProfileFollow)
 	router.DELETE("/:username/follow", ProfileUnfollow)
+	router.POST("/:username/block", ProfileBlock)
+	router.DELETE("/:username/block", ProfileUnblock)
 }
 
+const defaultSuggestionsLimit = 10
+const maxSuggestionsLimit = 50
+
 func ProfileRetrieve(c *gin.Context) {
 	username := c.Param("username")
+	// The name is reserved, see reservedUsernames, so no user is hidden behind the suggestions.
+	if username == "suggestions" {
+		ProfileSuggestions(c)
+		return
+	}
 	userModel, err := FindOneUser(&UserModel{Username: username})
 	if err != nil {
 		c.JSON(http.StatusNotFound, common.NewError("profile", errors.New("Invalid username")))
@@ -42,11 +64,21 @@ func ProfileFollow(c *gin.Context) {
 		return
 	}
 	myUserModel := c.MustGet("my_user_model").(UserModel)
-	err = myUserModel.following(userModel)
+	if myUserModel.IsBlockedWith(userModel) {
+		c.JSON(http.StatusForbidden, common.NewError("profile", errors.New("Blocked")))
+		return
+	}
+	added, err := myUserModel.following(userModel)
 	if err != nil {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
 	}
+	if added {
+		if err := Notify(NotificationFollow, userModel.ID, myUserModel.ID, nil); err != nil {
+			common.RequestLogger(c).Error().Err(err).Str("func", "users.Notify").Msg("db err")
+		}
+	}
+	common.InvalidateCache(common.ViewerCacheNamespace(myUserModel.ID))
 	serializer := ProfileSerializer{c, userModel}
 	c.JSON(http.StatusOK, gin.H{"profile": serializer.Response()})
 }
@@ -65,10 +97,72 @@ func ProfileUnfollow(c *gin.Context) {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
 	}
+	common.InvalidateCache(common.ViewerCacheNamespace(myUserModel.ID))
+	serializer := ProfileSerializer{c, userModel}
+	c.JSON(http.StatusOK, gin.H{"profile": serializer.Response()})
+}
+
+func ProfileBlock(c *gin.Context) {
+	username := c.Param("username")
+	userModel, err := FindOneUser(&UserModel{Username: username})
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("profile", errors.New("Invalid username")))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	if userModel.ID == myUserModel.ID {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("profile", errors.New("Cannot block yourself")))
+		return
+	}
+	err = myUserModel.blocking(userModel)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	common.InvalidateCache(common.ViewerCacheNamespace(myUserModel.ID))
+	common.InvalidateCache(common.ViewerCacheNamespace(userModel.ID))
 	serializer := ProfileSerializer{c, userModel}
 	c.JSON(http.StatusOK, gin.H{"profile": serializer.Response()})
 }
 
+func ProfileUnblock(c *gin.Context) {
+	username := c.Param("username")
+	userModel, err := FindOneUser(&UserModel{Username: username})
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("profile", errors.New("Invalid username")))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	err = myUserModel.unBlocking(userModel)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := ProfileSerializer{c, userModel}
+	c.JSON(http.StatusOK, gin.H{"profile": serializer.Response()})
+}
+
+// Users to follow, ranked by the users the viewer follows and by the sources set with SetSuggestionSources.
+// Every suggestion says why it is made.
+func ProfileSuggestions(c *gin.Context) {
+	limit := defaultSuggestionsLimit
+	if value := c.Query("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxSuggestionsLimit {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("limit", errors.New("Invalid limit")))
+			return
+		}
+	}
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	suggested, err := findSuggestions(myUserModel, limit)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := SuggestionsSerializer{c, suggested}
+	c.JSON(http.StatusOK, gin.H{"profiles": serializer.Response()})
+}
+
 func UsersRegistration(c *gin.Context) {
 	userModelValidator := NewUserModelValidator()
 	if err := userModelValidator.Bind(c); err != nil {
@@ -80,6 +174,7 @@ func UsersRegistration(c *gin.Context) {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
 	}
+	registrationsCounter.Inc()
 	c.Set("my_user_model", userModelValidator.userModel)
 	serializer := UserSerializer{c}
 	c.JSON(http.StatusCreated, gin.H{"user": serializer.Response()})
@@ -94,14 +189,18 @@ func UsersLogin(c *gin.Context) {
 	userModel, err := FindOneUser(&UserModel{Email: loginValidator.userModel.Email})
 
 	if err != nil {
+		failedLoginsCounter.WithLabelValues("unknown_email").Inc()
 		c.JSON(http.StatusForbidden, common.NewError("login", errors.New("Not Registered email or invalid password")))
 		return
 	}
 
 	if userModel.checkPassword(loginValidator.User.Password) != nil {
+		failedLoginsCounter.WithLabelValues("wrong_password").Inc()
+		common.RequestLogger(c).Warn().Uint("login_user_id", userModel.ID).Msg("wrong password")
 		c.JSON(http.StatusForbidden, common.NewError("login", errors.New("Not Registered email or invalid password")))
 		return
 	}
+	loginsCounter.Inc()
 	UpdateContextUserModel(c, userModel.ID)
 	serializer := UserSerializer{c}
 	c.JSON(http.StatusOK, gin.H{"user": serializer.Response()})
@@ -125,7 +224,82 @@ func UserUpdate(c *gin.Context) {
 		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
 		return
 	}
+	// Cached articles embed their author's profile.
+	common.InvalidateCache("articles")
 	UpdateContextUserModel(c, myUserModel.ID)
 	serializer := UserSerializer{c}
 	c.JSON(http.StatusOK, gin.H{"user": serializer.Response()})
 }
+
+// The notifications of the user, the latest first, with unread=true for the unread ones only.
+func NotificationList(c *gin.Context) {
+	page, err := common.NewPagination(common.NewListing("notifications", c.Query("unread")), c.Query("limit"), c.Query("offset"), c.Query("cursor"), common.DefaultPageLimit)
+	if err != nil {
+		c.JSON(common.CursorErrorStatus(err), common.NewError("cursor", err))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	models, count, unreadCount, pageInfo, err := myUserModel.notifications(page, c.Query("unread") == "true")
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := NotificationsSerializer{c, models}
+	c.JSON(http.StatusOK, gin.H{
+		"notifications":      serializer.Response(),
+		"notificationsCount": count,
+		"unreadCount":        unreadCount,
+		"nextCursor":         pageInfo.NextCursor,
+	})
+}
+
+// Mark one notification read, or all of them with the id "all".
+func NotificationRead(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	if c.Param("id") == "all" {
+		readCount, err := myUserModel.readAllNotifications()
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"readCount": readCount, "unreadCount": 0})
+		return
+	}
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("notification", ErrNotificationNotFound))
+		return
+	}
+	model, err := myUserModel.readNotification(uint(id))
+	if err == ErrNotificationNotFound {
+		c.JSON(http.StatusNotFound, common.NewError("notification", err))
+		return
+	} else if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := NotificationSerializer{c, model}
+	c.JSON(http.StatusOK, gin.H{"notification": serializer.Response()})
+}
+
+func NotificationPreferencesRetrieve(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	c.JSON(http.StatusOK, gin.H{"preferences": myUserModel.notificationPreferences()})
+}
+
+func NotificationPreferencesUpdate(c *gin.Context) {
+	validator := NotificationPreferencesValidator{}
+	if err := validator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	if err := myUserModel.setNotificationPreferences(validator.Preferences); err == ErrUnknownNotificationType {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("preferences", err))
+		return
+	} else if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"preferences": myUserModel.notificationPreferences()})
+}
@@ -1,6 +1,8 @@
 package users
 
 import (
+	"fmt"
+
 	"github.com/gin-gonic/gin"
 
 	"github.com/gothinkster/golang-gin-realworld-example-app/common"
@@ -24,15 +26,161 @@ type ProfileResponse struct {
 func (self *ProfileSerializer) Response() ProfileResponse {
 	myUserModel := self.C.MustGet("my_user_model").(UserModel)
 	profile := ProfileResponse{
-		ID:        self.ID,
-		Username:  self.Username,
-		Bio:       self.Bio,
-		Image:     self.Image,
-		Following: myUserModel.isFollowing(self.UserModel),
+		ID:       self.ID,
+		Username: self.Username,
+		Bio:      self.Bio,
+		Image:    self.Image,
+	}
+	if followings, ok := self.C.Get("my_followings"); ok {
+		if following, primed := followings.(map[uint]bool)[self.ID]; primed {
+			profile.Following = following
+			return profile
+		}
 	}
+	profile.Following = myUserModel.isFollowing(self.UserModel)
 	return profile
 }
 
+// Serializers of a whole page can load the following flags of all profiles in one query first,
+// ProfileSerializer will then read them from the context instead of asking the database each time.
+// 	users.PrimeFollowings(c, []uint{2, 3})
+func PrimeFollowings(c *gin.Context, ids []uint) {
+	myUserModel := c.MustGet("my_user_model").(UserModel)
+	followings := map[uint]bool{}
+	if primed, ok := c.Get("my_followings"); ok {
+		followings = primed.(map[uint]bool)
+	}
+	var missing []uint
+	for _, id := range ids {
+		if _, ok := followings[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	followed := myUserModel.followingSet(c.Request.Context(), missing)
+	for _, id := range missing {
+		followings[id] = followed[id]
+	}
+	c.Set("my_followings", followings)
+}
+
+// A follow as handed to the webhooks.
+type FollowEvent struct {
+	User     string `json:"user"`
+	Follower string `json:"follower"`
+}
+
+type SuggestionsSerializer struct {
+	C         *gin.Context
+	Suggested []suggestedUser
+}
+
+type SuggestionResponse struct {
+	ProfileResponse
+	Reasons []SuggestionReason `json:"reasons"`
+}
+
+func (self *SuggestionsSerializer) Response() []SuggestionResponse {
+	ids := make([]uint, len(self.Suggested))
+	for i, suggested := range self.Suggested {
+		ids[i] = suggested.ID
+	}
+	PrimeFollowings(self.C, ids)
+	response := []SuggestionResponse{}
+	for _, suggested := range self.Suggested {
+		serializer := ProfileSerializer{self.C, suggested.UserModel}
+		response = append(response, SuggestionResponse{serializer.Response(), suggested.Reasons})
+	}
+	return response
+}
+
+type NotificationSerializer struct {
+	C *gin.Context
+	NotificationModel
+}
+
+type NotificationResponse struct {
+	ID          uint                `json:"id"`
+	Type        string              `json:"type"`
+	Message     string              `json:"message"`
+	Actor       ProfileResponse     `json:"actor"`
+	ActorsCount uint                `json:"actorsCount"`
+	Target      *NotificationTarget `json:"target"`
+	Read        bool                `json:"read"`
+	CreatedAt   string              `json:"createdAt"`
+	UpdatedAt   string              `json:"updatedAt"`
+}
+
+type NotificationsSerializer struct {
+	C             *gin.Context
+	Notifications []NotificationModel
+}
+
+func (self *NotificationSerializer) Response() NotificationResponse {
+	actorSerializer := ProfileSerializer{self.C, self.Actor}
+	return self.response(actorSerializer.Response())
+}
+
+// Notifications pushed to the stream of the recipient are serialized outside of any request.
+func (self *NotificationSerializer) Event() NotificationResponse {
+	return self.response(ProfileResponse{
+		ID:        self.Actor.ID,
+		Username:  self.Actor.Username,
+		Bio:       self.Actor.Bio,
+		Image:     self.Actor.Image,
+		Following: UserModel{ID: self.RecipientID}.isFollowing(self.Actor),
+	})
+}
+
+func (self *NotificationSerializer) response(actor ProfileResponse) NotificationResponse {
+	return NotificationResponse{
+		ID:          self.ID,
+		Type:        self.Type,
+		Message:     self.message(),
+		Actor:       actor,
+		ActorsCount: self.ActorsCount,
+		Target:      self.Target(),
+		Read:        self.ReadAt != nil,
+		CreatedAt:   self.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		UpdatedAt:   self.UpdatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+	}
+}
+
+// 	"user2 favorited your article \"Title\"", "5 people favorited your article \"Title\""
+func (self *NotificationSerializer) message() string {
+	who := self.Actor.Username
+	if self.ActorsCount > 1 {
+		who = fmt.Sprintf("%v people", self.ActorsCount)
+	}
+	switch self.Type {
+	case NotificationFollow:
+		return who + " followed you"
+	case NotificationFavorite:
+		return fmt.Sprintf("%v favorited your %v %q", who, self.TargetType, self.TargetTitle)
+	case NotificationComment:
+		return fmt.Sprintf("%v commented on your %v %q", who, self.TargetType, self.TargetTitle)
+	case NotificationMention:
+		if self.TargetType == "comment" {
+			return fmt.Sprintf("%v mentioned you in a comment on %q", who, self.TargetTitle)
+		}
+		return fmt.Sprintf("%v mentioned you in the %v %q", who, self.TargetType, self.TargetTitle)
+	}
+	return who + " " + self.Type
+}
+
+func (self *NotificationsSerializer) Response() []NotificationResponse {
+	ids := make([]uint, len(self.Notifications))
+	for i, notification := range self.Notifications {
+		ids[i] = notification.ActorID
+	}
+	PrimeFollowings(self.C, ids)
+	response := []NotificationResponse{}
+	for _, notification := range self.Notifications {
+		serializer := NotificationSerializer{self.C, notification}
+		response = append(response, serializer.Response())
+	}
+	return response
+}
+
 type UserSerializer struct {
 	c *gin.Context
 }
@@ -0,0 +1,141 @@
+package users
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+)
+
+// Why a user is suggested to follow, Type is one of the Suggestion* constants of its source.
+type SuggestionReason struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+// One user worth following according to a SuggestionSource. Scores of all sources are added up.
+type Suggestion struct {
+	UserID uint
+	Score  float64
+	Reason SuggestionReason
+}
+
+// Finds users for the viewer to follow, at most limit of them. Sources don't need to leave out
+// the viewer, the users the viewer follows or blocked users, findSuggestions does.
+type SuggestionSource func(viewer UserModel, limit int) ([]Suggestion, error)
+
+const SuggestionFollowedByFollowings = "followed_by_followings"
+
+// The weight of every user the viewer follows who follows the suggested user.
+const followedByFollowingsWeight = 1.0
+
+// Sources plugged in by other packages, the social graph of the users themselves is always asked.
+var suggestionSources []SuggestionSource
+
+// Plug in sources of suggestions that need more than the follows, usually from the articles.
+// 	users.SetSuggestionSources(articles.FavoritedAuthorSuggestions, articles.TagAuthorSuggestions)
+func SetSuggestionSources(sources ...SuggestionSource) {
+	suggestionSources = sources
+}
+
+// Friends of friends: the users followed by the users the viewer follows, those followed by more of them first.
+func FollowedByFollowings(viewer UserModel, limit int) ([]Suggestion, error) {
+	db := common.GetDB()
+	rows, err := db.Model(&FollowModel{}).Select("following_id, count(*)").
+		Where("followed_by_id IN ?", db.Model(&FollowModel{}).Select("following_id").Where("followed_by_id = ?", viewer.ID).SubQuery()).
+		Group("following_id").Order("count(*) desc, following_id").Limit(limit).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var suggestions []Suggestion
+	for rows.Next() {
+		var id uint
+		var count int
+		if err := rows.Scan(&id, &count); err != nil {
+			return nil, err
+		}
+		detail := "Followed by a user you follow"
+		if count > 1 {
+			detail = fmt.Sprintf("Followed by %v users you follow", count)
+		}
+		suggestions = append(suggestions, Suggestion{
+			UserID: id,
+			Score:  followedByFollowingsWeight * float64(count),
+			Reason: SuggestionReason{Type: SuggestionFollowedByFollowings, Detail: detail},
+		})
+	}
+	return suggestions, nil
+}
+
+type suggestedUser struct {
+	UserModel
+	Score   float64
+	Reasons []SuggestionReason
+}
+
+// Merge what every source suggests and rank it, leaving out the viewer, the users already followed,
+// blocked and blocking users and suspended users.
+// 	suggested, err := findSuggestions(myUserModel, 10)
+func findSuggestions(viewer UserModel, limit int) ([]suggestedUser, error) {
+	db := common.GetDB()
+	excluded := map[uint]bool{viewer.ID: true}
+	var followings []uint
+	if err := db.Model(&FollowModel{}).Where("followed_by_id = ?", viewer.ID).Pluck("following_id", &followings).Error; err != nil {
+		return nil, err
+	}
+	for _, id := range append(followings, viewer.BlockedIDs()...) {
+		excluded[id] = true
+	}
+
+	// Sources are asked for more than needed since some of what they find is left out.
+	candidateLimit := 5*limit + len(excluded)
+	scores := map[uint]float64{}
+	reasons := map[uint][]Suggestion{}
+	for _, source := range append([]SuggestionSource{FollowedByFollowings}, suggestionSources...) {
+		suggestions, err := source(viewer, candidateLimit)
+		if err != nil {
+			return nil, err
+		}
+		for _, suggestion := range suggestions {
+			if excluded[suggestion.UserID] || suggestion.Score <= 0 {
+				continue
+			}
+			scores[suggestion.UserID] += suggestion.Score
+			reasons[suggestion.UserID] = append(reasons[suggestion.UserID], suggestion)
+		}
+	}
+	if len(scores) == 0 {
+		return []suggestedUser{}, nil
+	}
+	ids := make([]uint, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+	var models []UserModel
+	if err := db.Where("id IN (?) AND suspended_at IS NULL", ids).Find(&models).Error; err != nil {
+		return nil, err
+	}
+
+	suggested := make([]suggestedUser, len(models))
+	for i, model := range models {
+		sort.SliceStable(reasons[model.ID], func(a, b int) bool {
+			return reasons[model.ID][a].Score > reasons[model.ID][b].Score
+		})
+		suggested[i] = suggestedUser{UserModel: model, Score: scores[model.ID]}
+		for _, suggestion := range reasons[model.ID] {
+			suggested[i].Reasons = append(suggested[i].Reasons, suggestion.Reason)
+		}
+	}
+	// Older accounts first among equals, so that the order does not depend on the map.
+	sort.Slice(suggested, func(i, j int) bool {
+		if suggested[i].Score != suggested[j].Score {
+			return suggested[i].Score > suggested[j].Score
+		}
+		return suggested[i].ID < suggested[j].ID
+	})
+	if len(suggested) > limit {
+		suggested = suggested[:limit]
+	}
+	return suggested, nil
+}
@@ -8,11 +8,13 @@ import (
 	"fmt"
 	"github.com/jinzhu/gorm"
 	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/jobs"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
-	_ "regexp"
+	"regexp"
 )
 
 var image_url = "https://golang.org/doc/gopher/frontpage.png"
@@ -96,6 +98,7 @@ func resetDBWithMock() {
 	common.TestDBFree(test_db)
 	test_db = common.TestDBInit()
 	AutoMigrate()
+	jobs.AutoMigrate()
 	userModelMocker(3)
 }
 
@@ -146,6 +149,15 @@ var unauthRequestTests = []struct {
 		`{"errors":{"Username":"{min: 4}"}}`,
 		"too short username should return error",
 	},
+	{
+		func(req *http.Request) {},
+		"/users/",
+		"POST",
+		`{"user":{"username": "suggestions","email": "wzt@gg.cn","password": "jakejxke"}}`,
+		http.StatusUnprocessableEntity,
+		`{"errors":{"Username":"{key: reserved}"}}`,
+		"reserved username should return error",
+	},
 	{
 		func(req *http.Request) {},
 		"/users/",
@@ -451,6 +463,61 @@ var unauthRequestTests = []struct {
 		`{"profile":{"username":"user1","bio":"bio1","image":"http://image/1.jpg","following":false}}`,
 		"user cancel follow another should make sure database changed",
 	},
+	{
+		func(req *http.Request) {
+			HeaderTokenMock(req, 2)
+		},
+		"/profiles/user1/block",
+		"POST",
+		``,
+		http.StatusOK,
+		`{"profile":{"username":"user1","bio":"bio1","image":"http://image/1.jpg","following":false}}`,
+		"user block another should work",
+	},
+	{
+		func(req *http.Request) {
+			HeaderTokenMock(req, 1)
+		},
+		"/profiles/user2/follow",
+		"POST",
+		``,
+		http.StatusForbidden,
+		`{"errors":{"profile":"Blocked"}}`,
+		"blocked user should not follow the blocking user",
+	},
+	{
+		func(req *http.Request) {
+			HeaderTokenMock(req, 2)
+		},
+		"/profiles/user1/block",
+		"DELETE",
+		``,
+		http.StatusOK,
+		`{"profile":{"username":"user1","bio":"bio1","image":"http://image/1.jpg","following":false}}`,
+		"user unblock another should work",
+	},
+	{
+		func(req *http.Request) {
+			HeaderTokenMock(req, 1)
+		},
+		"/profiles/user2/follow",
+		"POST",
+		``,
+		http.StatusOK,
+		`{"profile":{"username":"user2","bio":"bio2","image":"http://image/2.jpg","following":true}}`,
+		"user should follow again once unblocked",
+	},
+	{
+		func(req *http.Request) {
+			HeaderTokenMock(req, 1)
+		},
+		"/profiles/suggestions?limit=0",
+		"GET",
+		``,
+		http.StatusUnprocessableEntity,
+		`{"errors":{"limit":"Invalid limit"}}`,
+		"suggestions should refuse a bad limit",
+	},
 }
 
 func TestWithoutAuth(t *testing.T) {
@@ -479,11 +546,104 @@ func TestWithoutAuth(t *testing.T) {
 	}
 }
 
+func TestNotifications(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	mockUsers := userModelMocker(3)
+	recipient := mockUsers[0]
+
+	r := gin.New()
+	r.Use(AuthMiddleware(true))
+	UserRegister(r.Group("/user"))
+	ProfileRegister(r.Group("/profiles"))
+	send := func(method string, url string, userID uint, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		HeaderTokenMock(req, userID)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, follower := range mockUsers[1:] {
+		asserts.Equal(http.StatusOK, send("POST", "/profiles/"+recipient.Username+"/follow", follower.ID, "").Code)
+	}
+	send("DELETE", "/profiles/"+recipient.Username+"/follow", mockUsers[1].ID, "")
+	send("POST", "/profiles/"+recipient.Username+"/follow", mockUsers[1].ID, "")
+	w := send("GET", "/user/notifications", recipient.ID, "")
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Regexp(`^{"nextCursor":"","notifications":\[{"id":1,"type":"follow","message":"2 people followed you",`+
+		`"actor":{"username":"user5",.*"actorsCount":2,"target":null,"read":false,.*}\],"notificationsCount":1,"unreadCount":1}$`,
+		w.Body.String(), "follows should be merged and each follower counted once")
+	w = send("GET", "/user/notifications", mockUsers[1].ID, "")
+	asserts.Regexp(`"notificationsCount":0`, w.Body.String())
+
+	w = send("POST", "/user/notifications/1/read", mockUsers[1].ID, "")
+	asserts.Equal(http.StatusNotFound, w.Code, "only the recipient should read a notification")
+	w = send("POST", "/user/notifications/1/read", recipient.ID, "")
+	asserts.Equal(http.StatusOK, w.Code)
+	asserts.Regexp(`"read":true`, w.Body.String())
+	send("DELETE", "/profiles/"+recipient.Username+"/follow", mockUsers[2].ID, "")
+	send("POST", "/profiles/"+recipient.Username+"/follow", mockUsers[2].ID, "")
+	w = send("GET", "/user/notifications?unread=true", recipient.ID, "")
+	asserts.Regexp(`"message":"user6 followed you".*"notificationsCount":1,"unreadCount":1`, w.Body.String(),
+		"read notifications should not be merged into")
+	w = send("GET", "/user/notifications?limit=1", recipient.ID, "")
+	asserts.Regexp(`"message":"user6 followed you"`, w.Body.String())
+	cursor := regexp.MustCompile(`"nextCursor":"([^"]+)"`).FindStringSubmatch(w.Body.String())[1]
+	w = send("GET", "/user/notifications?limit=1&cursor="+cursor, recipient.ID, "")
+	asserts.Regexp(`"message":"2 people followed you".*"notificationsCount":2`, w.Body.String())
+	w = send("POST", "/user/notifications/all/read", recipient.ID, "")
+	asserts.Equal(`{"readCount":1,"unreadCount":0}`, w.Body.String())
+
+	w = send("PUT", "/user/notifications/preferences", recipient.ID, `{"preferences":{"likes":false}}`)
+	asserts.Equal(http.StatusUnprocessableEntity, w.Code)
+	asserts.Equal(`{"errors":{"preferences":"Unknown notification type"}}`, w.Body.String())
+	w = send("PUT", "/user/notifications/preferences", recipient.ID, `{"preferences":{"follow":false}}`)
+	asserts.Equal(`{"preferences":{"comment":true,"favorite":true,"follow":false,"mention":true}}`, w.Body.String())
+	send("DELETE", "/profiles/"+recipient.Username+"/follow", mockUsers[2].ID, "")
+	send("POST", "/profiles/"+recipient.Username+"/follow", mockUsers[2].ID, "")
+	w = send("GET", "/user/notifications?unread=true", recipient.ID, "")
+	asserts.Regexp(`"notificationsCount":0`, w.Body.String(), "turned off types should not be notified")
+}
+
 //This is a hack way to add test database for each case, as whole test will just share one database.
 //You can read TestWithoutAuth's comment to know how to not share database each case.
+func TestLoginMetrics(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	r := gin.New()
+	UsersRegister(r.Group("/users"))
+	send := func(url string, body string) int {
+		req, _ := http.NewRequest("POST", url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	registrations := testutil.ToFloat64(registrationsCounter)
+	logins := testutil.ToFloat64(loginsCounter)
+	unknown := testutil.ToFloat64(failedLoginsCounter.WithLabelValues("unknown_email"))
+	wrong := testutil.ToFloat64(failedLoginsCounter.WithLabelValues("wrong_password"))
+
+	asserts.Equal(http.StatusCreated, send("/users/", `{"user":{"username":"counted","email":"counted@linkedin.com","password":"password123"}}`))
+	asserts.Equal(http.StatusUnprocessableEntity, send("/users/", `{"user":{"username":"counted","email":"counted@linkedin.com","password":"password123"}}`))
+	asserts.Equal(http.StatusOK, send("/users/login", `{"user":{"email":"counted@linkedin.com","password":"password123"}}`))
+	asserts.Equal(http.StatusForbidden, send("/users/login", `{"user":{"email":"counted@linkedin.com","password":"password456"}}`))
+	asserts.Equal(http.StatusForbidden, send("/users/login", `{"user":{"email":"nobody@linkedin.com","password":"password123"}}`))
+	asserts.Equal(http.StatusForbidden, send("/users/login", `{"user":{"email":"nobody@linkedin.com","password":"password123"}}`))
+
+	asserts.Equal(registrations+1, testutil.ToFloat64(registrationsCounter))
+	asserts.Equal(logins+1, testutil.ToFloat64(loginsCounter))
+	asserts.Equal(wrong+1, testutil.ToFloat64(failedLoginsCounter.WithLabelValues("wrong_password")))
+	asserts.Equal(unknown+2, testutil.ToFloat64(failedLoginsCounter.WithLabelValues("unknown_email")))
+}
+
 func TestMain(m *testing.M) {
 	test_db = common.TestDBInit()
 	AutoMigrate()
+	jobs.AutoMigrate()
 	exitVal := m.Run()
 	common.TestDBFree(test_db)
 	os.Exit(exitVal)
@@ -3,8 +3,12 @@ package users
 import (
 	"github.com/gin-gonic/gin"
 	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"gopkg.in/go-playground/validator.v8"
 )
 
+// Names taken by the routes next to the profiles, GET /profiles/suggestions could never show such a user.
+var reservedUsernames = map[string]bool{"suggestions": true}
+
 // *ModelValidator containing two parts:
 // - Validator: write the form/json checking rule according to the doc https://github.com/go-playground/validator
 // - DataModel: fill with data from Validator after invoking common.Bind(c, self)
@@ -28,6 +32,11 @@ func (self *UserModelValidator) Bind(c *gin.Context) error {
 	if err != nil {
 		return err
 	}
+	if reservedUsernames[self.User.Username] {
+		return validator.ValidationErrors{
+			"Username": &validator.FieldError{Field: "Username", Name: "Username", Tag: "reserved", ActualTag: "reserved"},
+		}
+	}
 	self.userModel.Username = self.User.Username
 	self.userModel.Email = self.User.Email
 	self.userModel.Bio = self.User.Bio
@@ -84,3 +93,13 @@ func NewLoginValidator() LoginValidator {
 	loginValidator := LoginValidator{}
 	return loginValidator
 }
+
+// Only the types given are changed.
+// 	{"preferences":{"favorite":false,"comment":true}}
+type NotificationPreferencesValidator struct {
+	Preferences map[string]bool `json:"preferences" binding:"required"`
+}
+
+func (self *NotificationPreferencesValidator) Bind(c *gin.Context) error {
+	return common.Bind(c, self)
+}
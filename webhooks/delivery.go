@@ -0,0 +1,285 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/jobs"
+	"github.com/jinzhu/gorm"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// How deliveries are retried: an endpoint failing MaxAttempts times in a row fails the delivery, the wait
+// before the next attempt starts at RetryBase and doubles after every failure up to RetryMax.
+var (
+	MaxAttempts     = uint(common.GetEnvInt("WEBHOOK_MAX_ATTEMPTS", 8))
+	RetryBase       = time.Duration(common.GetEnvInt("WEBHOOK_RETRY_BASE_SECONDS", 30)) * time.Second
+	RetryMax        = time.Duration(common.GetEnvInt("WEBHOOK_RETRY_MAX_SECONDS", 6*60*60)) * time.Second
+	DeliveryTimeout = time.Duration(common.GetEnvInt("WEBHOOK_TIMEOUT_SECONDS", 10)) * time.Second
+	PollInterval    = time.Duration(common.GetEnvInt("WEBHOOK_POLL_SECONDS", 5)) * time.Second
+)
+
+// How many deliveries one round of the dispatcher sends at most.
+const deliveryBatch = 50
+
+// The most of an error kept in the log.
+const errorLogLimit = 1024
+
+// Whether endpoints may be on loopback, private, link-local or unspecified addresses. Off unless
+// WEBHOOK_ALLOW_PRIVATE is true, so that webhooks can't be used to call into the network of the app.
+var AllowPrivateAddresses = common.GetEnv("WEBHOOK_ALLOW_PRIVATE", "") == "true"
+
+// The ranges of private addresses next to those net.IP tells apart on its own.
+var privateNetworks []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		privateNetworks = append(privateNetworks, network)
+	}
+}
+
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Refuse the connections to addresses that are not public, checked on the address actually dialed so
+// that a host resolving to another address since it was registered is caught too.
+func dialPublicOnly(network, address string, conn syscall.RawConn) error {
+	if AllowPrivateAddresses {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return ErrPrivateURL
+	}
+	return nil
+}
+
+// Redirects are not followed, endpoints answer for themselves and a redirect counts as a failed attempt.
+// No proxy is used either, dialPublicOnly would check the address of the proxy instead of the endpoint.
+var client = &http.Client{
+	Timeout: DeliveryTimeout,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: DeliveryTimeout, Control: dialPublicOnly}).DialContext,
+		TLSHandshakeTimeout: DeliveryTimeout,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// The jobs of the webhooks: turning domain events into deliveries and sending the due deliveries.
+const (
+	EnqueueJob = "webhooks.enqueue"
+	DeliverJob = "webhooks.deliver"
+)
+
+// The poller of every runner sending the deliveries due for a retry.
+const RetryPoller = "webhooks.retry"
+
+// Register the jobs of the webhooks, before the runner starts. Deliveries are sent as soon as they are queued,
+// those waiting for a retry are looked for every PollInterval by a poller, without a job for every look.
+// Any number of deliver jobs and pollers may run at once, every delivery is claimed by one of them.
+func RegisterJobs() {
+	jobs.Subscribe(EnqueueJob, jobs.Options{Queue: "webhooks"}, HandleEvent)
+	jobs.Register(DeliverJob, jobs.Options{Queue: "webhooks", MaxAttempts: 1}, func(ctx context.Context, job jobs.Job) error {
+		DeliverDue(ctx, time.Now())
+		return nil
+	})
+	jobs.Poll(RetryPoller, PollInterval, func(ctx context.Context) {
+		DeliverDue(ctx, time.Now())
+	})
+}
+
+// Send the deliveries due at now, returning how many were attempted. Every request sent is traced as
+// a child of the span of ctx.
+func DeliverDue(ctx context.Context, now time.Time) int {
+	db := common.GetDB()
+	var due []WebhookDeliveryModel
+	err := db.Where("status = ? AND next_attempt_at <= ?", DeliveryPending, now).
+		Order("next_attempt_at asc, id asc").Limit(deliveryBatch).Find(&due).Error
+	if err != nil {
+		common.LoggerFrom(ctx).Error().Err(err).Str("func", "webhooks.DeliverDue").Msg("db err")
+		return 0
+	}
+	attempted := 0
+	for _, delivery := range due {
+		if !claim(&delivery, now) {
+			continue
+		}
+		attempted++
+		if err := attempt(ctx, delivery, now); err != nil {
+			common.LoggerFrom(ctx).Error().Err(err).Str("func", "webhooks.DeliverDue").Msg("db err")
+		}
+	}
+	return attempted
+}
+
+// Take a delivery for this instance by counting the attempt, which only one instance can do. Until the attempt
+// is over the delivery is pushed back, so that it is tried again if this instance goes away in the middle.
+func claim(delivery *WebhookDeliveryModel, now time.Time) bool {
+	db := common.GetDB()
+	result := db.Model(&WebhookDeliveryModel{}).
+		Where("id = ? AND status = ? AND attempts = ?", delivery.ID, DeliveryPending, delivery.Attempts).
+		UpdateColumns(map[string]interface{}{"attempts": delivery.Attempts + 1, "next_attempt_at": now.Add(DeliveryTimeout + RetryBase)})
+	if result.Error != nil || result.RowsAffected != 1 {
+		return false
+	}
+	delivery.Attempts++
+	return true
+}
+
+// POST a claimed delivery to its webhook, log the attempt and settle when to try again.
+func attempt(ctx context.Context, delivery WebhookDeliveryModel, now time.Time) error {
+	db := common.GetDB()
+	webhook, err := FindOneWebhook(&WebhookModel{Model: gorm.Model{ID: delivery.WebhookID}})
+	log := WebhookAttemptModel{DeliveryID: delivery.ID}
+	if err != nil || (!webhook.Active && delivery.Event != EventPing) {
+		log.Error = "The webhook was deleted or disabled"
+		if err := db.Create(&log).Error; err != nil {
+			return err
+		}
+		return db.Model(&delivery).UpdateColumn("status", DeliveryFailed).Error
+	}
+
+	started := time.Now()
+	log.ResponseStatus, err = send(ctx, webhook, delivery)
+	log.DurationMs = int64(time.Since(started) / time.Millisecond)
+	if err != nil {
+		log.Error = truncate(err.Error(), errorLogLimit)
+	}
+	if err := db.Create(&log).Error; err != nil {
+		return err
+	}
+
+	changes := map[string]interface{}{"response_status": log.ResponseStatus}
+	switch {
+	case err == nil && log.ResponseStatus >= 200 && log.ResponseStatus < 300:
+		changes["status"] = DeliverySucceeded
+	case delivery.Attempts >= MaxAttempts:
+		changes["status"] = DeliveryFailed
+	default:
+		changes["next_attempt_at"] = now.Add(Backoff(delivery.Attempts))
+	}
+	return db.Model(&delivery).UpdateColumns(changes).Error
+}
+
+// The request carries the trace context of its span, receivers tracing theirs join the trace. Only the
+// status of the response is kept, its body could be anything the endpoint chose to answer.
+func send(ctx context.Context, webhook WebhookModel, delivery WebhookDeliveryModel) (status int, err error) {
+	ctx, span := common.StartSpan(ctx, "webhooks.deliver", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.HTTPMethod("POST"), attribute.Int64("webhook.id", int64(webhook.ID)),
+			attribute.Int64("webhook.delivery_id", int64(delivery.ID)), attribute.String("webhook.event", delivery.Event),
+			attribute.Int64("webhook.attempt", int64(delivery.Attempts))))
+	defer func() {
+		span.SetAttributes(semconv.HTTPStatusCode(status))
+		if err == nil && status >= 400 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		common.RecordSpanError(span, err)
+		span.End()
+	}()
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	span.SetAttributes(semconv.ServerAddress(req.URL.Hostname()))
+	common.InjectTraceContext(ctx, req.Header)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Conduit-Webhooks/1.0")
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatUint(uint64(delivery.ID), 10))
+	req.Header.Set("X-Webhook-Signature", Sign(webhook.Secret, time.Now(), body))
+	resp, err := client.Do(req)
+	if err != nil {
+		if errors.Is(err, ErrPrivateURL) {
+			return 0, ErrPrivateURL
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Read a little of the body so that the connection can be used again.
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	return resp.StatusCode, nil
+}
+
+// The signature of a payload sent at, as found in the X-Webhook-Signature header: t=<unix time>,v1=<hex HMAC>.
+// The HMAC is the SHA-256 one keyed with the secret of the webhook over "<unix time>.<body>". Receivers
+// compute it again to make sure the payload comes from here, and reject old times to stop replays.
+// 	signature := webhooks.Sign(secret, time.Now(), body)
+func Sign(secret string, at time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// How long to wait after the given number of failed attempts: RetryBase, then twice as long every time, up to RetryMax.
+func Backoff(attempts uint) time.Duration {
+	wait := RetryBase
+	for i := uint(1); i < attempts && wait < RetryMax; i++ {
+		wait *= 2
+	}
+	if wait > RetryMax {
+		wait = RetryMax
+	}
+	return wait
+}
+
+// Send a ping to webhook right away and return the delivery with its attempt, whether or not the webhook
+// is active. A failed ping is retried like any other delivery.
+func ping(ctx context.Context, webhook WebhookModel) (WebhookDeliveryModel, error) {
+	payload, err := newPayload(0, EventPing, time.Now(), map[string]interface{}{"webhookId": webhook.ID, "events": webhook.EventList()})
+	if err != nil {
+		return WebhookDeliveryModel{}, err
+	}
+	now := time.Now()
+	delivery := WebhookDeliveryModel{WebhookID: webhook.ID, Event: EventPing, Payload: payload, Status: DeliveryPending, NextAttemptAt: now}
+	if err := SaveOne(&delivery); err != nil {
+		return delivery, err
+	}
+	if claim(&delivery, now) {
+		if err := attempt(ctx, delivery, now); err != nil {
+			return delivery, err
+		}
+	}
+	return findDelivery(webhook, delivery.ID)
+}
+
+func truncate(text string, limit int) string {
+	if len(text) > limit {
+		return text[:limit]
+	}
+	return text
+}
@@ -0,0 +1,14 @@
+/*
+The webhooks module containing the endpoints users register to hear about articles, comments, favorites and follows, and the queue delivering the events to them.
+
+model.go: definition of orm based data model
+
+delivery.go: signing, sending and retrying the deliveries
+
+routers.go: router binding and core logic
+
+serializers.go: definition the schema of return data
+
+validators.go: definition the validator of form data
+*/
+package webhooks
@@ -0,0 +1,301 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/jobs"
+	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+	"github.com/jinzhu/gorm"
+)
+
+// Sent on demand to check an endpoint, webhooks do not subscribe to it.
+const EventPing = "ping"
+
+// Subscribing to AllEvents gets every domain event, including the ones added later.
+const AllEvents = "*"
+
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+var ErrUnknownEvent = errors.New("Unknown event")
+var ErrNoEvents = errors.New("Subscribe to at least one event")
+var ErrInvalidURL = errors.New("Only absolute http and https URLs can be called")
+var ErrPrivateURL = errors.New("Only public addresses can be called")
+var ErrUnknownHost = errors.New("The host of the URL can't be found")
+var ErrModeratorsOnly = errors.New("Only moderators can receive the events of every user")
+
+// An endpoint the events concerning its owner are POSTed to: the articles they write and their comments,
+// favorites and follows, whoever does them. Global webhooks, which only moderators can register, get the
+// events of every user. Events is a comma separated list of common.DomainEvents or AllEvents.
+type WebhookModel struct {
+	gorm.Model
+	Owner   users.UserModel
+	OwnerID uint   `gorm:"index"`
+	URL     string `gorm:"size:2048"`
+	Secret  string
+	Events  string
+	Global  bool `gorm:"not null"`
+	Active  bool `gorm:"not null"`
+}
+
+// One event on its way to one webhook. It stays pending until the endpoint answers with a 2xx,
+// NextAttemptAt backing off after every failure, and fails for good after MaxAttempts.
+type WebhookDeliveryModel struct {
+	gorm.Model
+	WebhookID      uint   `gorm:"index"`
+	EventID        uint   `gorm:"index"`
+	Event          string `gorm:"size:64"`
+	Payload        string `gorm:"type:text"`
+	Status         string `gorm:"size:16;index:idx_webhook_delivery_due"`
+	Attempts       uint
+	NextAttemptAt  time.Time `gorm:"index:idx_webhook_delivery_due"`
+	ResponseStatus int
+	Attempted      []WebhookAttemptModel `gorm:"foreignkey:DeliveryID"`
+}
+
+// The log of one try at a delivery: what the endpoint answered, or why it could not be reached.
+type WebhookAttemptModel struct {
+	gorm.Model
+	DeliveryID     uint `gorm:"index"`
+	ResponseStatus int
+	Error          string `gorm:"size:1024"`
+	DurationMs     int64
+}
+
+// What the endpoints get, the same for every webhook the event goes to. ID is the id of the event,
+// receivers use it to notice the rare event delivered twice. Pings have none.
+type Payload struct {
+	ID        uint        `json:"id,omitempty"`
+	Event     string      `json:"event"`
+	CreatedAt string      `json:"createdAt"`
+	Data      interface{} `json:"data"`
+}
+
+// Migrate the schema of database if needed
+func AutoMigrate() {
+	db := common.GetDB()
+
+	db.AutoMigrate(&WebhookModel{})
+	db.AutoMigrate(&WebhookDeliveryModel{})
+	db.AutoMigrate(&WebhookAttemptModel{})
+}
+
+func (model WebhookModel) EventList() []string {
+	if model.Events == "" {
+		return []string{}
+	}
+	return strings.Split(model.Events, ",")
+}
+
+func (model WebhookModel) subscribes(kind string) bool {
+	for _, event := range model.EventList() {
+		if event == kind || event == AllEvents {
+			return true
+		}
+	}
+	return false
+}
+
+// Check a webhook about to be saved by owner.
+func (model WebhookModel) check(owner users.UserModel) error {
+	endpoint, err := url.Parse(model.URL)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return ErrInvalidURL
+	}
+	events := model.EventList()
+	if len(events) == 0 {
+		return ErrNoEvents
+	}
+	for _, event := range events {
+		if !isEvent(event) {
+			return ErrUnknownEvent
+		}
+	}
+	if model.Global && !owner.Moderator {
+		return ErrModeratorsOnly
+	}
+	return checkHost(model.URL)
+}
+
+// Every address the host of the URL resolves to has to be public, see AllowPrivateAddresses. It is
+// checked again on every delivery, the addresses may have changed by then.
+func checkHost(rawURL string) error {
+	if AllowPrivateAddresses {
+		return nil
+	}
+	endpoint, _ := url.Parse(rawURL)
+	ips, err := net.LookupIP(endpoint.Hostname())
+	if err != nil || len(ips) == 0 {
+		return ErrUnknownHost
+	}
+	for _, ip := range ips {
+		if !isPublicIP(ip) {
+			return ErrPrivateURL
+		}
+	}
+	return nil
+}
+
+func isEvent(kind string) bool {
+	if kind == AllEvents {
+		return true
+	}
+	for _, known := range common.DomainEvents {
+		if kind == known {
+			return true
+		}
+	}
+	return false
+}
+
+// A random secret for the signatures, given to the owner once when the webhook is registered.
+func newSecret() string {
+	buf := make([]byte, 24)
+	rand.Read(buf)
+	return "whsec_" + hex.EncodeToString(buf)
+}
+
+func FindOneWebhook(condition interface{}) (WebhookModel, error) {
+	db := common.GetDB()
+	var model WebhookModel
+	err := db.Where(condition).First(&model).Error
+	return model, err
+}
+
+func findWebhooksOf(owner users.UserModel) ([]WebhookModel, error) {
+	db := common.GetDB()
+	var models []WebhookModel
+	err := db.Where("owner_id = ?", owner.ID).Order("id asc").Find(&models).Error
+	return models, err
+}
+
+func SaveOne(data interface{}) error {
+	db := common.GetDB()
+	err := db.Save(data).Error
+	return err
+}
+
+// Delete a webhook, its pending deliveries fail when they come up.
+func DeleteWebhookModel(condition interface{}) error {
+	db := common.GetDB()
+	err := db.Where(condition).Delete(WebhookModel{}).Error
+	return err
+}
+
+// Queue a domain event of the outbox for every active webhook that subscribes to it, together with a job
+// sending them right away. The event may come again if the job is retried, webhooks that already have
+// a delivery of it are skipped.
+// 	jobs.Subscribe(webhooks.EnqueueJob, jobs.Options{Queue: "webhooks"}, webhooks.HandleEvent)
+func HandleEvent(ctx context.Context, event jobs.Event) error {
+	db := common.GetDB()
+	var webhooks []WebhookModel
+	query := db.Where("active = ?", true)
+	if len(event.UserIDs) > 0 {
+		query = query.Where("global = ? OR owner_id IN (?)", true, event.UserIDs)
+	} else {
+		query = query.Where("global = ?", true)
+	}
+	if err := query.Order("id asc").Find(&webhooks).Error; err != nil {
+		return err
+	}
+	var delivered []uint
+	err := db.Model(&WebhookDeliveryModel{}).Where("event_id = ?", event.ID).Pluck("webhook_id", &delivered).Error
+	if err != nil {
+		return err
+	}
+	skip := map[uint]bool{}
+	for _, id := range delivered {
+		skip[id] = true
+	}
+	var targets []WebhookModel
+	for _, webhook := range webhooks {
+		if webhook.subscribes(event.Kind) && !skip[webhook.ID] {
+			targets = append(targets, webhook)
+		}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+	payload, err := newPayload(event.ID, event.Kind, event.CreatedAt, event.Data)
+	if err != nil {
+		return jobs.Permanent(err)
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, webhook := range targets {
+			delivery := WebhookDeliveryModel{
+				WebhookID:     webhook.ID,
+				EventID:       event.ID,
+				Event:         event.Kind,
+				Payload:       payload,
+				Status:        DeliveryPending,
+				NextAttemptAt: time.Now(),
+			}
+			if err := tx.Create(&delivery).Error; err != nil {
+				return err
+			}
+		}
+		return jobs.EnqueueTx(tx, DeliverJob, nil)
+	})
+}
+
+func newPayload(eventID uint, kind string, at time.Time, data interface{}) (string, error) {
+	payload, err := json.Marshal(Payload{
+		ID:        eventID,
+		Event:     kind,
+		CreatedAt: at.UTC().Format("2006-01-02T15:04:05.999Z"),
+		Data:      data,
+	})
+	return string(payload), err
+}
+
+// Load one page of the deliveries of a webhook, newest first.
+func findDeliveryPage(webhook WebhookModel, status string, page common.Pagination) ([]WebhookDeliveryModel, int, common.PageInfo, error) {
+	db := common.GetDB()
+	var models []WebhookDeliveryModel
+	var count int
+	query := db.Model(&WebhookDeliveryModel{}).Where("webhook_id = ?", webhook.ID)
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if err := query.Count(&count).Error; err != nil {
+		return models, count, common.PageInfo{}, err
+	}
+	if err := page.Scope(query, "webhook_delivery_models", true).Find(&models).Error; err != nil {
+		return models, count, common.PageInfo{}, err
+	}
+	ids := make([]uint, len(models))
+	for i, model := range models {
+		ids[i] = model.ID
+	}
+	keep, info := page.Info(ids, count)
+	models = models[:keep]
+	if page.Reverse() {
+		for i, j := 0, len(models)-1; i < j; i, j = i+1, j-1 {
+			models[i], models[j] = models[j], models[i]
+		}
+	}
+	return models, count, info, nil
+}
+
+// A delivery of webhook with the log of its attempts, oldest first.
+func findDelivery(webhook WebhookModel, id uint) (WebhookDeliveryModel, error) {
+	db := common.GetDB()
+	var model WebhookDeliveryModel
+	err := db.Preload("Attempted", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id asc")
+	}).Where("id = ? AND webhook_id = ?", id, webhook.ID).First(&model).Error
+	return model, err
+}
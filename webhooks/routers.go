@@ -0,0 +1,186 @@
+package webhooks
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+	"github.com/jinzhu/gorm"
+)
+
+// Every user manages their own webhooks, the group is the authenticated /webhooks one.
+func WebhooksRegister(router *gin.RouterGroup) {
+	router.GET("", WebhookList)
+	router.POST("", WebhookCreate)
+	router.GET("/:id", WebhookRetrieve)
+	router.PUT("/:id", WebhookUpdate)
+	router.DELETE("/:id", WebhookDelete)
+	router.POST("/:id/ping", WebhookPing)
+	router.GET("/:id/deliveries", WebhookDeliveryList)
+	router.GET("/:id/deliveries/:delivery", WebhookDeliveryRetrieve)
+}
+
+func WebhookList(c *gin.Context) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	webhookModels, err := findWebhooksOf(myUserModel)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("webhooks", errors.New("Invalid param")))
+		return
+	}
+	serializer := WebhooksSerializer{c, webhookModels}
+	c.JSON(http.StatusOK, gin.H{"webhooks": serializer.Response(), "webhooksCount": len(webhookModels)})
+}
+
+// Register a webhook, a secret is made up unless one is given. The response is the only one showing the secret.
+// 	POST /api/webhooks {"webhook":{"url":"https://example.com/hooks","events":["article.created"]}}
+func WebhookCreate(c *gin.Context) {
+	webhookModelValidator := NewWebhookModelValidator()
+	if err := webhookModelValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	if webhookModelValidator.webhookModel.Secret == "" {
+		webhookModelValidator.webhookModel.Secret = newSecret()
+	}
+	saveWebhook(c, webhookModelValidator.webhookModel, http.StatusCreated, true)
+}
+
+func WebhookRetrieve(c *gin.Context) {
+	webhookModel, ok := findOwnWebhook(c)
+	if !ok {
+		return
+	}
+	serializer := WebhookSerializer{c, webhookModel}
+	c.JSON(http.StatusOK, gin.H{"webhook": serializer.Response()})
+}
+
+func WebhookUpdate(c *gin.Context) {
+	webhookModel, ok := findOwnWebhook(c)
+	if !ok {
+		return
+	}
+	webhookModelValidator := NewWebhookModelValidatorFillWith(webhookModel)
+	if err := webhookModelValidator.Bind(c); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewValidatorError(err))
+		return
+	}
+	saveWebhook(c, webhookModelValidator.webhookModel, http.StatusOK, webhookModelValidator.Webhook.Secret != "")
+}
+
+// Check and save a webhook, showing its secret in the response only when it was just set.
+func saveWebhook(c *gin.Context, webhookModel WebhookModel, status int, showSecret bool) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	switch err := webhookModel.check(myUserModel); err {
+	case nil:
+	case ErrInvalidURL, ErrPrivateURL, ErrUnknownHost:
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("url", err))
+		return
+	case ErrModeratorsOnly:
+		c.JSON(http.StatusForbidden, common.NewError("global", err))
+		return
+	default:
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("events", err))
+		return
+	}
+	if err := SaveOne(&webhookModel); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := WebhookSerializer{c, webhookModel}
+	if showSecret {
+		c.JSON(status, gin.H{"webhook": serializer.WithSecret()})
+	} else {
+		c.JSON(status, gin.H{"webhook": serializer.Response()})
+	}
+}
+
+func WebhookDelete(c *gin.Context) {
+	webhookModel, ok := findOwnWebhook(c)
+	if !ok {
+		return
+	}
+	if err := DeleteWebhookModel(&WebhookModel{Model: gorm.Model{ID: webhookModel.ID}}); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"webhook": "Delete success"})
+}
+
+// Send a ping to the webhook right away and answer with the delivery and its log, to try an endpoint out.
+func WebhookPing(c *gin.Context) {
+	webhookModel, ok := findOwnWebhook(c)
+	if !ok {
+		return
+	}
+	deliveryModel, err := ping(c.Request.Context(), webhookModel)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, common.NewError("database", err))
+		return
+	}
+	serializer := DeliverySerializer{c, deliveryModel}
+	c.JSON(http.StatusCreated, gin.H{"delivery": serializer.Response()})
+}
+
+// The deliveries of a webhook newest first, status=pending, succeeded or failed narrows them down.
+func WebhookDeliveryList(c *gin.Context) {
+	webhookModel, ok := findOwnWebhook(c)
+	if !ok {
+		return
+	}
+	page, err := common.NewPagination(common.NewListing("deliveries", strconv.Itoa(int(webhookModel.ID)), c.Query("status")), c.Query("limit"), c.Query("offset"), c.Query("cursor"), common.DefaultPageLimit)
+	if err != nil {
+		c.JSON(common.CursorErrorStatus(err), common.NewError("cursor", err))
+		return
+	}
+	deliveryModels, count, pageInfo, err := findDeliveryPage(webhookModel, c.Query("status"), page)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("deliveries", errors.New("Invalid param")))
+		return
+	}
+	serializer := DeliveriesSerializer{c, deliveryModels}
+	c.JSON(http.StatusOK, gin.H{
+		"deliveries":      serializer.Response(),
+		"deliveriesCount": count,
+		"nextCursor":      pageInfo.NextCursor,
+		"prevCursor":      pageInfo.PrevCursor,
+	})
+}
+
+// A delivery with the log of every attempt at it.
+func WebhookDeliveryRetrieve(c *gin.Context) {
+	webhookModel, ok := findOwnWebhook(c)
+	if !ok {
+		return
+	}
+	id64, err := strconv.ParseUint(c.Param("delivery"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("delivery", errors.New("Invalid id")))
+		return
+	}
+	deliveryModel, err := findDelivery(webhookModel, uint(id64))
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("delivery", errors.New("Invalid id")))
+		return
+	}
+	serializer := DeliverySerializer{c, deliveryModel}
+	c.JSON(http.StatusOK, gin.H{"delivery": serializer.Response()})
+}
+
+// Load the webhook of the id param if it belongs to the user, answering 404 otherwise.
+func findOwnWebhook(c *gin.Context) (WebhookModel, bool) {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+	id64, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("webhook", errors.New("Invalid id")))
+		return WebhookModel{}, false
+	}
+	webhookModel, err := FindOneWebhook(&WebhookModel{Model: gorm.Model{ID: uint(id64)}, OwnerID: myUserModel.ID})
+	if err != nil {
+		c.JSON(http.StatusNotFound, common.NewError("webhook", errors.New("Invalid id")))
+		return WebhookModel{}, false
+	}
+	return webhookModel, true
+}
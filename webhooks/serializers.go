@@ -0,0 +1,121 @@
+package webhooks
+
+import (
+	"encoding/json"
+
+	"github.com/gin-gonic/gin"
+)
+
+type WebhookSerializer struct {
+	C *gin.Context
+	WebhookModel
+}
+
+type WebhooksSerializer struct {
+	C        *gin.Context
+	Webhooks []WebhookModel
+}
+
+// The secret is only shown once, when the webhook is registered or the secret changed.
+type WebhookResponse struct {
+	ID        uint     `json:"id"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	Global    bool     `json:"global"`
+	Active    bool     `json:"active"`
+	Secret    string   `json:"secret,omitempty"`
+	CreatedAt string   `json:"createdAt"`
+	UpdatedAt string   `json:"updatedAt"`
+}
+
+func (s *WebhookSerializer) Response() WebhookResponse {
+	return WebhookResponse{
+		ID:        s.ID,
+		URL:       s.URL,
+		Events:    s.EventList(),
+		Global:    s.Global,
+		Active:    s.Active,
+		CreatedAt: s.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		UpdatedAt: s.UpdatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+	}
+}
+
+// The response with the secret, for the owner who just set it.
+func (s *WebhookSerializer) WithSecret() WebhookResponse {
+	response := s.Response()
+	response.Secret = s.Secret
+	return response
+}
+
+func (s *WebhooksSerializer) Response() []WebhookResponse {
+	response := []WebhookResponse{}
+	for _, webhook := range s.Webhooks {
+		serializer := WebhookSerializer{s.C, webhook}
+		response = append(response, serializer.Response())
+	}
+	return response
+}
+
+type DeliverySerializer struct {
+	C *gin.Context
+	WebhookDeliveryModel
+}
+
+type DeliveriesSerializer struct {
+	C          *gin.Context
+	Deliveries []WebhookDeliveryModel
+}
+
+// NextAttemptAt is only set while the delivery is pending, Log only when a single delivery is asked for.
+type DeliveryResponse struct {
+	ID             uint              `json:"id"`
+	Event          string            `json:"event"`
+	Status         string            `json:"status"`
+	Attempts       uint              `json:"attempts"`
+	ResponseStatus int               `json:"responseStatus"`
+	NextAttemptAt  *string           `json:"nextAttemptAt"`
+	CreatedAt      string            `json:"createdAt"`
+	Payload        json.RawMessage   `json:"payload"`
+	Log            []AttemptResponse `json:"log,omitempty"`
+}
+
+type AttemptResponse struct {
+	ResponseStatus int    `json:"responseStatus"`
+	Error          string `json:"error"`
+	DurationMs     int64  `json:"durationMs"`
+	CreatedAt      string `json:"createdAt"`
+}
+
+func (s *DeliverySerializer) Response() DeliveryResponse {
+	response := DeliveryResponse{
+		ID:             s.ID,
+		Event:          s.Event,
+		Status:         s.Status,
+		Attempts:       s.Attempts,
+		ResponseStatus: s.ResponseStatus,
+		CreatedAt:      s.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		Payload:        json.RawMessage(s.Payload),
+	}
+	if s.Status == DeliveryPending {
+		nextAttemptAt := s.NextAttemptAt.UTC().Format("2006-01-02T15:04:05.999Z")
+		response.NextAttemptAt = &nextAttemptAt
+	}
+	for _, attempt := range s.Attempted {
+		response.Log = append(response.Log, AttemptResponse{
+			ResponseStatus: attempt.ResponseStatus,
+			Error:          attempt.Error,
+			DurationMs:     attempt.DurationMs,
+			CreatedAt:      attempt.CreatedAt.UTC().Format("2006-01-02T15:04:05.999Z"),
+		})
+	}
+	return response
+}
+
+func (s *DeliveriesSerializer) Response() []DeliveryResponse {
+	response := []DeliveryResponse{}
+	for _, delivery := range s.Deliveries {
+		serializer := DeliverySerializer{s.C, delivery}
+		response = append(response, serializer.Response())
+	}
+	return response
+}
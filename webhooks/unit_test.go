@@ -0,0 +1,244 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/gothinkster/golang-gin-realworld-example-app/articles"
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/filters"
+	"github.com/gothinkster/golang-gin-realworld-example-app/jobs"
+	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+)
+
+var test_db *gorm.DB
+
+//Reset test DB and create new one with mock data
+func resetDBWithMock() {
+	common.TestDBFree(test_db)
+	test_db = common.TestDBInit()
+	users.AutoMigrate()
+	jobs.AutoMigrate()
+	test_db.AutoMigrate(&articles.ArticleModel{}, &articles.TagModel{}, &articles.TagAliasModel{}, &articles.TagFollowModel{},
+		&articles.FavoriteModel{}, &articles.ArticleUserModel{}, &articles.CommentModel{}, &articles.ReactionModel{},
+		&articles.ReactionCountModel{}, &articles.ArticleTermModel{}, &articles.TermModel{}, &articles.MentionModel{})
+	filters.AutoMigrate()
+	AutoMigrate()
+}
+
+func userModelMocker(names ...string) []users.UserModel {
+	var ret []users.UserModel
+	for _, name := range names {
+		userModel := users.UserModel{Username: name, Email: name + "@linkedin.com"}
+		test_db.Create(&userModel)
+		ret = append(ret, userModel)
+	}
+	return ret
+}
+
+func newRouter() *gin.Engine {
+	r := gin.New()
+	r.Use(users.AuthMiddleware(true))
+	articles.ArticlesRegister(r.Group("/articles"))
+	users.ProfileRegister(r.Group("/profiles"))
+	WebhooksRegister(r.Group("/webhooks"))
+	return r
+}
+
+// A request received by the test endpoint.
+type received struct {
+	path    string
+	headers http.Header
+	body    string
+}
+
+func TestWebhooks(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+	RegisterJobs()
+
+	var mu sync.Mutex
+	var requests []received
+	status := http.StatusOK
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, received{r.URL.Path, r.Header, string(body)})
+		w.WriteHeader(status)
+		fmt.Fprint(w, "thanks")
+	}))
+	defer endpoint.Close()
+	reset := func(code int) []received {
+		mu.Lock()
+		defer mu.Unlock()
+		got := requests
+		requests = nil
+		status = code
+		return got
+	}
+
+	mockUsers := userModelMocker("author", "reader", "moderator")
+	author, reader, moderator := mockUsers[0], mockUsers[1], mockUsers[2]
+	test_db.Model(&moderator).UpdateColumn("moderator", true)
+	r := newRouter()
+	send := func(method string, url string, userID uint, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", fmt.Sprintf("Token %v", common.GenToken(userID)))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("POST", "/webhooks", author.ID, `{"webhook":{"url":"ftp://example.com","events":["article.created"]}}`)
+	asserts.Equal(`{"errors":{"url":"Only absolute http and https URLs can be called"}}`, w.Body.String())
+	w = send("POST", "/webhooks", author.ID, `{"webhook":{"url":"https://example.com","events":["article.read"]}}`)
+	asserts.Equal(`{"errors":{"events":"Unknown event"}}`, w.Body.String())
+	w = send("POST", "/webhooks", author.ID, `{"webhook":{"url":"https://example.com","events":["*"],"global":true}}`)
+	asserts.Equal(http.StatusForbidden, w.Code, "only moderators should get the events of every user")
+
+	w = send("POST", "/webhooks", author.ID, `{"webhook":{"url":"`+endpoint.URL+`/author",`+
+		`"events":["article.created","comment.created","favorite.added"]}}`)
+	asserts.Equal(http.StatusCreated, w.Code)
+	asserts.Regexp(`^{"webhook":{"id":1,"url":"`+endpoint.URL+`/author","events":\["article.created","comment.created",`+
+		`"favorite.added"\],"global":false,"active":true,"secret":"whsec_[0-9a-f]{48}",`, w.Body.String())
+	hook, _ := FindOneWebhook(&WebhookModel{OwnerID: author.ID})
+	w = send("POST", "/webhooks", moderator.ID, `{"webhook":{"url":"`+endpoint.URL+`/global","events":["*"],"global":true,`+
+		`"secret":"a very secret secret"}}`)
+	asserts.Equal(http.StatusCreated, w.Code)
+	asserts.Regexp(`"secret":"a very secret secret"`, w.Body.String())
+	w = send("GET", "/webhooks/1", author.ID, "")
+	asserts.NotContains(w.Body.String(), "secret", "the secret should only be shown once")
+	asserts.Equal(http.StatusNotFound, send("GET", "/webhooks/1", reader.ID, "").Code, "webhooks should be private")
+
+	w = send("POST", "/articles/", author.ID, `{"article":{"title":"Hooked","body":"on webhooks"}}`)
+	asserts.Equal(http.StatusCreated, w.Code)
+	jobs.RunDue(time.Now())
+	got := reset(http.StatusOK)
+	asserts.Len(got, 2)
+	asserts.Equal("/author", got[0].path)
+	asserts.Equal("/global", got[1].path, "global webhooks should get the events of everyone")
+	asserts.Equal("article.created", got[0].headers.Get("X-Webhook-Event"))
+	asserts.Regexp(`^{"id":1,"event":"article.created","createdAt":"[^"]+","data":{"slug":"hooked","title":"Hooked",`+
+		`.*"author":"author"`, got[0].body)
+	signature := got[0].headers.Get("X-Webhook-Signature")
+	unix, _ := strconv.ParseInt(strings.TrimPrefix(strings.Split(signature, ",")[0], "t="), 10, 64)
+	asserts.Equal(Sign(hook.Secret, time.Unix(unix, 0), []byte(got[0].body)), signature, "payloads should be signed")
+	asserts.Equal(0, DeliverDue(context.Background(), time.Now()), "delivered events should not be sent again")
+	asserts.NoError(HandleEvent(context.Background(), jobs.Event{ID: 1, Kind: common.ArticleCreated, UserIDs: []uint{author.ID}}))
+	asserts.Equal(0, DeliverDue(context.Background(), time.Now()), "events relayed twice should only be delivered once")
+
+	send("POST", "/articles/hooked/favorite", reader.ID, "")
+	send("POST", "/articles/hooked/favorite", reader.ID, "")
+	send("POST", "/profiles/reader/follow", moderator.ID, "")
+	jobs.RunDue(time.Now())
+	got = reset(http.StatusOK)
+	asserts.Len(got, 3, "favoriting twice should add one favorite")
+	asserts.Regexp(`{"article":"hooked","title":"Hooked","user":"reader"}`, got[0].body)
+	asserts.Equal("/global", got[2].path, "webhooks should only get the events they subscribe to")
+	asserts.Regexp(`"event":"user.followed".*{"user":"reader","follower":"moderator"}`, got[2].body)
+
+	reset(http.StatusInternalServerError)
+	defer func(maxAttempts uint) { MaxAttempts = maxAttempts }(MaxAttempts)
+	MaxAttempts = 2
+	send("PUT", "/webhooks/2", moderator.ID, `{"webhook":{"active":false}}`)
+	send("POST", "/articles/hooked/comments", reader.ID, `{"comment":{"body":"so hooked"}}`)
+	now := time.Now()
+	jobs.RunDue(now)
+	asserts.Len(reset(http.StatusInternalServerError), 1, "inactive webhooks should not get events")
+	w = send("GET", "/webhooks/1/deliveries?status=pending", author.ID, "")
+	asserts.Regexp(`^{"deliveries":\[{"id":6,"event":"comment.created","status":"pending","attempts":1,"responseStatus":500,`+
+		`"nextAttemptAt":"[^"]+",.*"deliveriesCount":1,`, w.Body.String())
+	asserts.Equal(0, DeliverDue(context.Background(), now.Add(RetryBase-time.Second)), "failed deliveries should wait before the next attempt")
+	asserts.Equal(1, DeliverDue(context.Background(), now.Add(RetryBase+time.Second)))
+	w = send("GET", "/webhooks/1/deliveries/6", author.ID, "")
+	asserts.NotContains(w.Body.String(), "thanks", "the answers of the endpoints should not be shown")
+	asserts.Regexp(`"status":"failed","attempts":2,.*"log":\[{"responseStatus":500,"error":"",`+
+		`.*{"responseStatus":500,`, w.Body.String())
+	asserts.Equal(0, DeliverDue(context.Background(), now.Add(time.Hour)), "deliveries should fail for good after the last attempt")
+
+	reset(http.StatusOK)
+	otel.SetTracerProvider(sdktrace.NewTracerProvider())
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	w = send("POST", "/webhooks/2/ping", moderator.ID, "")
+	asserts.Equal(http.StatusCreated, w.Code)
+	asserts.Regexp(`^{"delivery":{"id":7,"event":"ping","status":"succeeded","attempts":1,"responseStatus":200,"nextAttemptAt":null,`+
+		`.*"payload":{"event":"ping","createdAt":"[^"]+","data":{"events":\["\*"\],"webhookId":2}},"log":\[`, w.Body.String())
+	pinged := reset(http.StatusOK)[0]
+	asserts.Equal("7", pinged.headers.Get("X-Webhook-Delivery"))
+	asserts.Regexp(`^00-[0-9a-f]{32}-[0-9a-f]{16}-01$`, pinged.headers.Get("traceparent"), "deliveries should carry the trace context")
+
+	asserts.Equal(http.StatusOK, send("DELETE", "/webhooks/1", author.ID, "").Code)
+	w = send("GET", "/webhooks", author.ID, "")
+	asserts.Equal(`{"webhooks":[],"webhooksCount":0}`, w.Body.String())
+}
+
+func TestPrivateAddresses(t *testing.T) {
+	asserts := assert.New(t)
+	resetDBWithMock()
+
+	redirected := false
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { redirected = true }))
+	defer target.Close()
+	endpoint := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusFound))
+	defer endpoint.Close()
+	owner := userModelMocker("owner")[0]
+	webhook := WebhookModel{OwnerID: owner.ID, URL: endpoint.URL, Events: "*", Active: true, Secret: newSecret()}
+	asserts.NoError(webhook.check(owner))
+	test_db.Create(&webhook)
+	delivery := WebhookDeliveryModel{WebhookID: webhook.ID, Event: EventPing, Payload: "{}"}
+	status, err := send(context.Background(), webhook, delivery)
+	asserts.NoError(err)
+	asserts.Equal(http.StatusFound, status, "redirects should not be followed")
+	asserts.False(redirected)
+
+	AllowPrivateAddresses = false
+	defer func() { AllowPrivateAddresses = true }()
+	for _, url := range []string{"http://127.0.0.1/", "http://10.0.0.8/", "http://192.168.1.1:8080/", "http://[::1]/",
+		"http://169.254.169.254/latest/meta-data", "http://0.0.0.0/", "http://localhost/"} {
+		webhook := WebhookModel{URL: url, Events: "*"}
+		asserts.Equal(ErrPrivateURL, webhook.check(owner), url)
+	}
+	asserts.True(isPublicIP(net.ParseIP("93.184.216.34")))
+	client.CloseIdleConnections()
+	_, err = send(context.Background(), webhook, delivery)
+	asserts.Equal(ErrPrivateURL, err, "addresses should be checked again when they are dialed")
+}
+
+func TestBackoff(t *testing.T) {
+	asserts := assert.New(t)
+	asserts.Equal(RetryBase, Backoff(1))
+	asserts.Equal(4*RetryBase, Backoff(3), "the wait should double after every failure")
+	asserts.Equal(RetryMax, Backoff(100))
+}
+
+//This is a hack way to add test database for each case, as whole test will just share one database.
+func TestMain(m *testing.M) {
+	test_db = common.TestDBInit()
+	// The test endpoints listen on the loopback address.
+	AllowPrivateAddresses = true
+	exitVal := m.Run()
+	common.TestDBFree(test_db)
+	os.Exit(exitVal)
+}
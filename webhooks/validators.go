@@ -0,0 +1,62 @@
+package webhooks
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gothinkster/golang-gin-realworld-example-app/common"
+	"github.com/gothinkster/golang-gin-realworld-example-app/users"
+)
+
+type WebhookModelValidator struct {
+	Webhook struct {
+		URL    string   `form:"url" json:"url" binding:"exists,max=2048"`
+		Events []string `form:"events" json:"events" binding:"required"`
+		Secret string   `form:"secret" json:"secret" binding:"omitempty,min=16,max=128"`
+		Global bool     `form:"global" json:"global"`
+		Active *bool    `form:"active" json:"active"`
+	} `json:"webhook"`
+	webhookModel WebhookModel `json:"-"`
+}
+
+func NewWebhookModelValidator() WebhookModelValidator {
+	return WebhookModelValidator{}
+}
+
+// Updates leave out what does not change, the secret included.
+func NewWebhookModelValidatorFillWith(webhookModel WebhookModel) WebhookModelValidator {
+	webhookModelValidator := NewWebhookModelValidator()
+	webhookModelValidator.webhookModel = webhookModel
+	webhookModelValidator.Webhook.URL = webhookModel.URL
+	webhookModelValidator.Webhook.Events = webhookModel.EventList()
+	webhookModelValidator.Webhook.Global = webhookModel.Global
+	webhookModelValidator.Webhook.Active = &webhookModel.Active
+	return webhookModelValidator
+}
+
+func (s *WebhookModelValidator) Bind(c *gin.Context) error {
+	myUserModel := c.MustGet("my_user_model").(users.UserModel)
+
+	err := common.Bind(c, s)
+	if err != nil {
+		return err
+	}
+	var events []string
+	seen := map[string]bool{}
+	for _, event := range s.Webhook.Events {
+		if event = strings.TrimSpace(event); !seen[event] {
+			seen[event] = true
+			events = append(events, event)
+		}
+	}
+	s.webhookModel.Owner = myUserModel
+	s.webhookModel.OwnerID = myUserModel.ID
+	s.webhookModel.URL = strings.TrimSpace(s.Webhook.URL)
+	s.webhookModel.Events = strings.Join(events, ",")
+	s.webhookModel.Global = s.Webhook.Global
+	s.webhookModel.Active = s.Webhook.Active == nil || *s.Webhook.Active
+	if s.Webhook.Secret != "" {
+		s.webhookModel.Secret = s.Webhook.Secret
+	}
+	return nil
+}